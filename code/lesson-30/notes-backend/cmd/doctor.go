@@ -0,0 +1,138 @@
+/*
+Copyright © 2020 Andrew Meredith <andrew@learn-clojurescript.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"learn-cljs.com/notes/internal/note"
+)
+
+// doctorQueueTimeout is how long doctor waits for the index queue to drain
+// before it compares the index with the repository.
+const doctorQueueTimeout = time.Minute
+
+var doctorFix bool
+
+// doctorCmd checks the repository and the search index for inconsistencies
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the repository and search index for inconsistencies",
+	Long: `Check the repository for associations between notes and tags that are
+broken, and compare each tenant's notes with the Bleve search index by ID and
+update time.
+
+Every problem found is reported, and with --fix, repaired. The command fails if
+any problem is left unrepaired. The server must not be running.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var cfg Config
+		if err := viper.Unmarshal(&cfg); err != nil {
+			log.Fatalf("error unmarshaling config: %v", err)
+		}
+
+		if err := doctor(cfg, doctorFix); err != nil {
+			log.Fatalf("error checking: %v", err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+
+	doctorCmd.Flags().BoolVar(&doctorFix, "fix", false, "Repair the problems that are found")
+}
+
+// doctor checks the repository and, if it is a Bleve index, the search index.
+func doctor(cfg Config, fix bool) error {
+	idx, err := note.NewSearchIndex(cfg.Search)
+	if errors.Is(err, note.ErrStaleIndex) {
+		return fmt.Errorf("%w (run `notes reindex`)", err)
+	}
+	if err != nil {
+		return fmt.Errorf("error opening search index: %w", err)
+	}
+	if c, ok := idx.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	repo, err := note.NewRepository(cfg.Repository, idx)
+	if err != nil {
+		return fmt.Errorf("error opening repository: %w", err)
+	}
+	defer repo.Close()
+
+	problems, err := repo.CheckIntegrity(fix)
+	if err != nil {
+		return fmt.Errorf("error checking repository: %w", err)
+	}
+
+	if cfg.Search.Type != "bleve" {
+		log.Printf("Skipping the %s search index, which cannot be checked", cfg.Search.Type)
+	} else {
+		if err := waitForIndexQueue(repo, doctorQueueTimeout); err != nil {
+			return err
+		}
+		indexProblems, err := note.CheckSearchIndex(repo, idx, fix)
+		problems = append(problems, indexProblems...)
+		if err != nil {
+			report(problems)
+			return fmt.Errorf("error checking search index: %w", err)
+		}
+	}
+
+	if unfixed := report(problems); unfixed > 0 {
+		return fmt.Errorf("%d problems found (run with --fix to repair them)", unfixed)
+	}
+	return nil
+}
+
+// waitForIndexQueue waits for the repository to apply the changes in its
+// index queue, which would otherwise show up as differences from the index.
+func waitForIndexQueue(repo note.Repository, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		depth, err := repo.IndexQueueDepth()
+		if err != nil {
+			return fmt.Errorf("error reading index queue: %w", err)
+		}
+		if depth == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d search index updates still pending after %v", depth, timeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// report prints the problems and returns how many were not fixed.
+func report(problems []*note.Problem) (unfixed int) {
+	for _, p := range problems {
+		fmt.Println(p)
+		if !p.Fixed {
+			unfixed++
+		}
+	}
+	log.Printf("Found %d problems, fixed %d", len(problems), len(problems)-unfixed)
+	return unfixed
+}
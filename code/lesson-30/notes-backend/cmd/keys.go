@@ -0,0 +1,123 @@
+/*
+Copyright © 2020 Andrew Meredith <andrew@learn-clojurescript.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"learn-cljs.com/notes/internal/keyring"
+)
+
+var keysPruneAfter time.Duration
+
+// keysCmd groups the commands that manage the keyring
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage the keys that sign tenant tokens",
+	Long: `Manage the keyring of secrets that sign tenant tokens.
+
+Tokens name the key that signed them. New tokens are signed with the current
+key, and tokens signed with retired keys stay valid until their key is pruned.
+Tokens that name no key were signed with signing-secret, which verifies them
+for as long as it is set. The server reads the keyring when it starts.`,
+}
+
+// keysRotateCmd adds a new signing key to the keyring
+var keysRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Add a new key that signs tenant tokens from now on",
+	Long: `Add a new key to the keyring, which signs tenant tokens from now on, and
+retire the current key, which still verifies the tokens it signed.
+
+With --prune-after, keys that were retired longer ago than that are removed,
+which invalidates their tokens. Restart the server to use the new key.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var cfg Config
+		if err := viper.Unmarshal(&cfg); err != nil {
+			log.Fatalf("error unmarshaling config: %v", err)
+		}
+
+		if err := rotateKeys(cfg.Keyring, keysPruneAfter); err != nil {
+			log.Fatalf("error rotating keys: %v", err)
+		}
+	},
+}
+
+// keysListCmd lists the keys in the keyring
+var keysListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the keys in the keyring",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var cfg Config
+		if err := viper.Unmarshal(&cfg); err != nil {
+			log.Fatalf("error unmarshaling config: %v", err)
+		}
+
+		keys, err := keyring.Load(cfg.Keyring)
+		if err != nil {
+			log.Fatalf("error loading keyring: %v", err)
+		}
+		for _, key := range keys.Keys {
+			status := "current"
+			if key.RetiredAt != nil {
+				status = "retired " + key.RetiredAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%s\tcreated %s\t%s\n", key.ID, key.CreatedAt.Format(time.RFC3339), status)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+	keysCmd.AddCommand(keysRotateCmd)
+	keysCmd.AddCommand(keysListCmd)
+
+	keysRotateCmd.Flags().DurationVar(&keysPruneAfter, "prune-after", 0, "Remove keys retired longer ago than this (0 keeps them all)")
+}
+
+// rotateKeys adds a new key to the keyring at path and prunes the keys that
+// were retired more than pruneAfter ago, unless it is zero.
+func rotateKeys(path string, pruneAfter time.Duration) error {
+	keys, err := keyring.Load(path)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	key, err := keys.Rotate(now)
+	if err != nil {
+		return err
+	}
+	var pruned []*keyring.Key
+	if pruneAfter > 0 {
+		pruned = keys.Prune(now.Add(-pruneAfter))
+	}
+	if err := keys.Save(path); err != nil {
+		return err
+	}
+
+	log.Printf("Added key %s to %s", key.ID, path)
+	for _, key := range pruned {
+		log.Printf("Pruned key %s, retired %s", key.ID, key.RetiredAt.Format(time.RFC3339))
+	}
+	return nil
+}
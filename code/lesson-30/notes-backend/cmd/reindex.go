@@ -0,0 +1,78 @@
+/*
+Copyright © 2020 Andrew Meredith <andrew@learn-clojurescript.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"learn-cljs.com/notes/internal/note"
+)
+
+var reindexTenant string
+
+// reindexCmd rebuilds the Bleve search index from the repository
+var reindexCmd = &cobra.Command{
+	Use:   "reindex",
+	Short: "Rebuild the search index from the repository",
+	Long: `Rebuild the Bleve search index from the notes in the repository.
+
+The index is rebuilt at a new path and swapped in once it is complete. With
+--tenant, only that tenant's documents are replaced, in place; this requires an
+index built with the current mapping. The server must not be running.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var cfg Config
+		if err := viper.Unmarshal(&cfg); err != nil {
+			log.Fatalf("error unmarshaling config: %v", err)
+		}
+
+		if err := reindex(cfg, reindexTenant); err != nil {
+			log.Fatalf("error reindexing: %v", err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(reindexCmd)
+
+	reindexCmd.Flags().StringVar(&reindexTenant, "tenant", "", "Only reindex the notes of this tenant")
+}
+
+// reindex rebuilds the search index, or one tenant's part of it.
+func reindex(cfg Config, tenantID string) error {
+	if cfg.Search.Type != "bleve" {
+		return fmt.Errorf("only the bleve search index can be rebuilt, not %q", cfg.Search.Type)
+	}
+
+	start := time.Now()
+	var n int
+	var err error
+	if tenantID == "" {
+		n, err = note.RebuildBleveIndex(cfg.Search, cfg.Repository)
+	} else {
+		n, err = note.ReindexBleveTenant(cfg.Search, cfg.Repository, tenantID)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Indexed %d notes in %v", n, time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -17,6 +17,7 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -27,6 +28,7 @@ import (
 	"time"
 
 	"github.com/spf13/cobra"
+	"learn-cljs.com/notes/internal/keyring"
 	"learn-cljs.com/notes/internal/note"
 	"learn-cljs.com/notes/internal/transport"
 
@@ -46,19 +48,39 @@ var rootCmd = &cobra.Command{
 			log.Fatalf("error unmarshaling config: %v", err)
 		}
 
-		if cfg.SigningSecret == "" {
-			log.Fatalf("signing secret must be set")
+		keys, err := keyring.Load(cfg.Keyring)
+		if err != nil {
+			log.Fatalf("error loading keyring: %v", err)
+		}
+		if cfg.SigningSecret == "" && keys.Current() == nil {
+			log.Fatalf("signing secret must be set, or a keyring created with `notes keys rotate`")
 		}
 
-		idx, err := note.NewBleveSearchindex(cfg.Search)
+		idx, err := note.NewSearchIndex(cfg.Search)
+		if errors.Is(err, note.ErrStaleIndex) && cfg.Search.BleveAutoRebuild {
+			log.Printf("Rebuilding search index: %v", err)
+			if err = reindex(cfg, ""); err == nil {
+				idx, err = note.NewSearchIndex(cfg.Search)
+			}
+		}
+		if errors.Is(err, note.ErrStaleIndex) {
+			log.Fatalf("error opening search index: %v (run `notes reindex` or set search.bleve-auto-rebuild)", err)
+		}
 		if err != nil {
-			log.Fatalf("error creating repository: %v", err)
+			log.Fatalf("error creating search index: %v", err)
 		}
 
 		repository, err := note.NewRepository(cfg.Repository, idx)
 		if err != nil {
 			log.Fatalf("error creating repository: %v", err)
 		}
+		if cfg.Search.Type == "memory" && cfg.Repository.Type != "memory" {
+			n, err := note.IndexAll(repository, idx)
+			if err != nil {
+				log.Fatalf("error filling search index: %v", err)
+			}
+			log.Printf("Indexed %d notes in memory", n)
+		}
 
 		ctx, cancel := context.WithCancel(context.Background())
 
@@ -70,6 +92,9 @@ var rootCmd = &cobra.Command{
 				Context:       ctx,
 				NoteService:   service,
 				SigningSecret: []byte(cfg.SigningSecret),
+				Keyring:       keys,
+				AdminToken:    []byte(cfg.AdminToken),
+				Auth:          cfg.Auth,
 			},
 		)
 
@@ -79,12 +104,19 @@ var rootCmd = &cobra.Command{
 			}
 		}()
 
+		purgerDone := make(chan struct{})
+		go func() {
+			service.RunTrashPurger(ctx, cfg.Trash)
+			close(purgerDone)
+		}()
+
 		signalChan := make(chan os.Signal, 1)
 		signal.Notify(
 			signalChan,
 			syscall.SIGHUP,
 			syscall.SIGINT,
 			syscall.SIGQUIT,
+			syscall.SIGTERM,
 		)
 
 		<-signalChan
@@ -102,10 +134,14 @@ var rootCmd = &cobra.Command{
 			log.Printf("shutdown error: %v\n", err)
 			defer os.Exit(1)
 		}
-		service.Close()
 
 		// manually cancel context if not using httpServer.RegisterOnShutdown(cancel)
 		cancel()
+		<-purgerDone
+		if depth, err := service.IndexQueueDepth(); err == nil && depth > 0 {
+			log.Printf("Waiting for %d pending search index updates", depth)
+		}
+		service.Close()
 
 		defer os.Exit(0)
 	},
@@ -115,8 +151,12 @@ type Config struct {
 	BindAddress   string `mapstructure:"addr"`
 	StaticFileDir string `mapstructure:"dir"`
 	SigningSecret string `mapstructure:"signing-secret"`
+	Keyring       string `mapstructure:"keyring"`
+	AdminToken    string `mapstructure:"admin-token"`
 	Repository    note.RepositoryConfig
 	Search        note.SearchIndexConfig
+	Trash         note.TrashConfig
+	Auth          transport.AuthConfig
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -135,11 +175,25 @@ func init() {
 	rootCmd.PersistentFlags().String("addr", "0.0.0.0:8080", "address to which to bind server")
 	rootCmd.PersistentFlags().String("dir", "./static", "Directory from which to serve static files")
 	rootCmd.PersistentFlags().String("signing-secret", "", "Secret used to sign tenantIDs")
+	rootCmd.PersistentFlags().String("keyring", "./db-data/keyring.json", "Keyring of rotated secrets used to sign tenantIDs (managed with notes keys)")
+	rootCmd.PersistentFlags().String("admin-token", "", "Bearer token of the admin endpoints, which are disabled if it is empty")
 
 	rootCmd.PersistentFlags().String("repository.type", "memory", "repo type")
 	rootCmd.PersistentFlags().String("repository.badger-dir", "./db-data/kv", "Badger repository directory")
+	rootCmd.PersistentFlags().String("repository.sqlite-path", "./db-data/notes.db", "SQLite repository file")
+	rootCmd.PersistentFlags().Int("repository.revision-limit", 50, "Revisions to keep per note (0 keeps all)")
+
+	rootCmd.PersistentFlags().Duration("trash.retention", 30*24*time.Hour, "How long deleted notes are kept (0 keeps them forever)")
+	rootCmd.PersistentFlags().Duration("trash.purge-interval", time.Hour, "How often expired notes are purged from the trash and expired sessions are deleted")
+
+	rootCmd.PersistentFlags().Duration("auth.access-token-ttl", 15*time.Minute, "How long an access token issued at login is accepted")
+	rootCmd.PersistentFlags().Duration("auth.refresh-token-ttl", 30*24*time.Hour, "How long a user stays signed in without refreshing their session")
 
+	rootCmd.PersistentFlags().String("search.type", "bleve", "search index type (bleve, sqlite or memory)")
 	rootCmd.PersistentFlags().String("search.bleve-path", "./db-data/search/index.bleve", "Search index file")
+	rootCmd.PersistentFlags().Bool("search.bleve-auto-rebuild", false, "Rebuild the search index at startup if its mapping is out of date")
+	rootCmd.PersistentFlags().String("search.sqlite-path", "./db-data/notes.db", "SQLite search index file")
+	rootCmd.PersistentFlags().StringToString("search.languages", nil, "Languages of tenants' notes, as tenant=language pairs (others are detected)")
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -26,7 +26,8 @@ require (
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/spf13/viper v1.7.1
 	github.com/stretchr/testify v1.4.0
-	golang.org/x/sys v0.0.0-20200828194041-157a740278f4 // indirect
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
 	gopkg.in/ini.v1 v1.60.2 // indirect
 	gopkg.in/urfave/cli.v1 v1.20.0 // indirect
+	modernc.org/sqlite v1.14.6
 )
@@ -0,0 +1,133 @@
+// Package keyring keeps the secrets that sign tenant tokens. Each token names
+// the key that signed it, so that a new key can take over signing while
+// tokens signed with the keys it retired stay valid.
+package keyring
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// secretSize is the number of random bytes in a generated secret.
+const secretSize = 32
+
+// Key is a signing secret. A key is retired when another replaces it for
+// signing, and is only used to verify tokens from then on.
+type Key struct {
+	ID        string     `json:"id"`
+	Secret    []byte     `json:"secret"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RetiredAt *time.Time `json:"retiredAt,omitempty"`
+}
+
+// Keyring holds the current signing key and the retired keys that still
+// verify tokens, oldest first.
+type Keyring struct {
+	Keys []*Key `json:"keys"`
+}
+
+// Load reads the keyring at path. A missing file is an empty keyring.
+func Load(path string) (*Keyring, error) {
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Keyring{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	k := new(Keyring)
+	if err := json.Unmarshal(bs, k); err != nil {
+		return nil, fmt.Errorf("error reading keyring %q: %w", path, err)
+	}
+	return k, nil
+}
+
+// Save writes the keyring to path, readable only by its owner. It is written
+// to a temporary file first, so that a keyring is never left half written.
+func (k *Keyring) Save(path string) error {
+	bs, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("error creating directory for keyring: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Current returns the key that signs new tokens, or nil if the keyring is
+// empty.
+func (k *Keyring) Current() *Key {
+	for i := len(k.Keys) - 1; i >= 0; i-- {
+		if k.Keys[i].RetiredAt == nil {
+			return k.Keys[i]
+		}
+	}
+	return nil
+}
+
+// Find returns the key with the given ID, or nil if there is none.
+func (k *Keyring) Find(id string) *Key {
+	for _, key := range k.Keys {
+		if key.ID == id {
+			return key
+		}
+	}
+	return nil
+}
+
+// Rotate adds a new key with a random secret, which takes over signing from
+// the current key, and returns it. Keys are numbered in the order they are
+// added.
+func (k *Keyring) Rotate(now time.Time) (*Key, error) {
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	var last int
+	for _, key := range k.Keys {
+		if n, err := strconv.Atoi(key.ID); err == nil && n > last {
+			last = n
+		}
+	}
+	for _, key := range k.Keys {
+		if key.RetiredAt == nil {
+			key.RetiredAt = &now
+		}
+	}
+
+	key := &Key{
+		ID:        strconv.Itoa(last + 1),
+		Secret:    secret,
+		CreatedAt: now,
+	}
+	k.Keys = append(k.Keys, key)
+	return key, nil
+}
+
+// Prune removes the keys that were retired before the given time, which
+// invalidates the tokens they signed, and returns them.
+func (k *Keyring) Prune(retiredBefore time.Time) []*Key {
+	var kept, pruned []*Key
+	for _, key := range k.Keys {
+		if key.RetiredAt != nil && key.RetiredAt.Before(retiredBefore) {
+			pruned = append(pruned, key)
+		} else {
+			kept = append(kept, key)
+		}
+	}
+	k.Keys = kept
+	return pruned
+}
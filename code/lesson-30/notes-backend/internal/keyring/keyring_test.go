@@ -0,0 +1,65 @@
+package keyring
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotate(t *testing.T) {
+	k := &Keyring{}
+	assert.Nil(t, k.Current(), "should have no current key when empty")
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	first, err := k.Rotate(start)
+	require.NoError(t, err)
+	assert.Equal(t, "1", first.ID)
+	assert.Len(t, first.Secret, secretSize)
+	assert.Equal(t, first, k.Current())
+
+	second, err := k.Rotate(start.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, "2", second.ID)
+	assert.NotEqual(t, first.Secret, second.Secret)
+	assert.Equal(t, second, k.Current(), "should sign with the newest key")
+	require.NotNil(t, first.RetiredAt)
+	assert.Equal(t, start.Add(time.Hour), *first.RetiredAt)
+	assert.Equal(t, first, k.Find("1"), "should keep retired keys")
+	assert.Nil(t, k.Find("3"))
+
+	_, err = k.Rotate(start.Add(3 * time.Hour))
+	require.NoError(t, err)
+	pruned := k.Prune(start.Add(2 * time.Hour))
+	assert.Equal(t, []*Key{first}, pruned, "should prune keys retired before the cutoff")
+	assert.Nil(t, k.Find("1"))
+	assert.NotNil(t, k.Find("2"))
+
+	fourth, err := k.Rotate(start.Add(4 * time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, "4", fourth.ID, "should not reuse the IDs of pruned keys")
+}
+
+func TestLoadSave(t *testing.T) {
+	file := path.Join(t.TempDir(), "keys", "keyring.json")
+	k, err := Load(file)
+	require.NoError(t, err, "should treat a missing keyring as empty")
+	assert.Empty(t, k.Keys)
+
+	key, err := k.Rotate(time.Now())
+	require.NoError(t, err)
+	require.NoError(t, k.Save(file))
+
+	info, err := os.Stat(file)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "should only be readable by its owner")
+
+	loaded, err := Load(file)
+	require.NoError(t, err)
+	require.NotNil(t, loaded.Current())
+	assert.Equal(t, key.ID, loaded.Current().ID)
+	assert.Equal(t, key.Secret, loaded.Current().Secret)
+}
@@ -0,0 +1,83 @@
+package note
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// APIKey lets an integration act for a tenant within the scopes it was
+// issued with, until it expires or is revoked. Scopes are interpreted by the
+// transport's policy.
+type APIKey struct {
+	ID       string   `json:"id"`
+	TenantID string   `json:"tenantId"`
+	Name     string   `json:"name"`
+	Scopes   []string `json:"scopes"`
+	// Hash is the hash of the key's token, which is only shown when the key
+	// is issued. It is stored but never sent to clients.
+	Hash       string     `json:"-"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// storedAPIKey is the stored form of an API key, which includes its hash.
+type storedAPIKey struct {
+	*apiKeyFields
+	Hash string `json:"hash"`
+}
+
+type apiKeyFields APIKey
+
+func (k *APIKey) MustMarshal() []byte {
+	bs, err := json.Marshal(storedAPIKey{(*apiKeyFields)(k), k.Hash})
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+func (k *APIKey) Unmarshal(bs []byte) error {
+	if k == nil {
+		return nil
+	}
+	stored := storedAPIKey{apiKeyFields: (*apiKeyFields)(k)}
+	if err := json.Unmarshal(bs, &stored); err != nil {
+		return err
+	}
+	k.Hash = stored.Hash
+	return nil
+}
+
+// expired reports whether the key can no longer be used at the given time.
+func (k *APIKey) expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// ErrInvalidAPIKey is matched by the errors returned when an API key is
+// issued without a name or scopes, or with an expiry in the past.
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+// apiKeyPrefix starts every API key token, which tells them apart from other
+// tokens.
+const apiKeyPrefix = "key_"
+
+// apiKeyUsePrecision is how stale the last-used time of an API key may get,
+// so that reads made with a key do not all turn into writes.
+const apiKeyUsePrecision = time.Minute
+
+func invalidAPIKey(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidAPIKey, fmt.Sprintf(format, args...))
+}
+
+func apiKeyNotFound(id string) error {
+	return fmt.Errorf("API key %q %w", id, ErrNotFound)
+}
+
+// IsAPIKey reports whether token looks like an API key rather than another
+// kind of token.
+func IsAPIKey(token string) bool {
+	return len(token) > len(apiKeyPrefix) && token[:len(apiKeyPrefix)] == apiKeyPrefix
+}
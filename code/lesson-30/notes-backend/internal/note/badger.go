@@ -3,8 +3,9 @@ package note
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
-	"sync"
+	"sort"
 	"time"
 
 	badger "github.com/dgraph-io/badger/v2"
@@ -13,8 +14,9 @@ import (
 // Add data is stored in a single db file.
 
 const (
-	noteIDSeq = "noteIDs"
-	tagIDSeq  = "tagIDs"
+	noteIDSeq   = "noteIDs"
+	tagIDSeq    = "tagIDs"
+	indexJobSeq = "indexJobs"
 )
 
 func NewBadgerRepo(c RepositoryConfig, idx SearchIndex) (*badgerRepo, error) {
@@ -25,8 +27,8 @@ func NewBadgerRepo(c RepositoryConfig, idx SearchIndex) (*badgerRepo, error) {
 	}
 
 	repo := &badgerRepo{
-		db:  db,
-		idx: idx,
+		db:            db,
+		revisionLimit: c.RevisionLimit,
 	}
 
 	if repo.noteIDs, err = db.GetSequence([]byte(noteIDSeq), 100); err != nil {
@@ -44,25 +46,968 @@ func NewBadgerRepo(c RepositoryConfig, idx SearchIndex) (*badgerRepo, error) {
 		return nil, fmt.Errorf("error advancing tag ID seq: %w", err)
 	}
 
+	if repo.indexJobIDs, err = db.GetSequence([]byte(indexJobSeq), 100); err != nil {
+		return nil, fmt.Errorf("error acquiring index job seq: %w", err)
+	}
+	if _, err = repo.indexJobIDs.Next(); err != nil {
+		return nil, fmt.Errorf("error advancing index job seq: %w", err)
+	}
+
+	if err := repo.migrate(); err != nil {
+		return nil, fmt.Errorf("error migrating BadgerDB: %w", err)
+	}
+
+	repo.indexer = startIndexWorker(repo, idx)
 	return repo, nil
 }
 
-type badgerRepo struct {
-	db      *badger.DB
-	idx     SearchIndex
-	noteIDs *badger.Sequence
-	tagIDs  *badger.Sequence
+// badgerMigrations bring data written by earlier versions up to date. They
+// are applied in order and must only ever be appended to.
+var badgerMigrations = []func(r *badgerRepo) error{
+	(*badgerRepo).addSortKeys,
+	(*badgerRepo).addTagNameKeys,
+}
+
+// migrate applies the migrations that have not been applied yet. The number
+// applied so far is stored under a key outside of every tenant.
+func (r *badgerRepo) migrate() error {
+	key := badgerKey{entityType: "schema"}.Bytes()
+	var version uint64
+	err := r.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		switch err {
+		case nil:
+		case badger.ErrKeyNotFound:
+			return nil
+		default:
+			return err
+		}
+		return item.Value(func(bs []byte) error {
+			version = binary.BigEndian.Uint64(bs)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for ; version < uint64(len(badgerMigrations)); version++ {
+		if err := badgerMigrations[version](r); err != nil {
+			return fmt.Errorf("error applying migration %d: %w", version+1, err)
+		}
+		err := r.db.Update(func(txn *badger.Txn) error {
+			bs := make([]byte, 8)
+			binary.BigEndian.PutUint64(bs, version+1)
+			return txn.Set(key, bs)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addSortKeys indexes notes that were written before notes could be listed
+// page by page.
+func (r *badgerRepo) addSortKeys() error {
+	wb := r.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	err := r.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			parts := bytes.SplitN(it.Item().Key(), []byte{KEY_SEP}, 3)
+			if len(parts) != 3 || string(parts[1]) != "n" {
+				continue
+			}
+
+			var note *Note
+			err := it.Item().Value(func(bs []byte) (err error) {
+				note, err = decodeNote(bs)
+				return
+			})
+			if err != nil {
+				return err
+			}
+			tx := &badgerTransaction{badgerRepo: r, tenantID: string(parts[0])}
+			for sort := range badgerSortKeyTypes {
+				if err := wb.Set(tx.sortKey(sort, note).Bytes(), nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return wb.Flush()
+}
+
+// addTagNameKeys indexes tags by name, which was not unique before the index
+// was added. Where two of a tenant's tags share a name, the newer one is
+// renamed by appending its ID.
+func (r *badgerRepo) addTagNameKeys() error {
+	wb := r.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	err := r.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		// Keys are ordered by tenant, so only the current tenant's names need
+		// to be remembered.
+		var tenantID string
+		names := make(map[string]bool)
+		for it.Rewind(); it.Valid(); it.Next() {
+			parts := bytes.SplitN(it.Item().Key(), []byte{KEY_SEP}, 3)
+			if len(parts) != 3 || string(parts[1]) != "t" {
+				continue
+			}
+			if string(parts[0]) != tenantID {
+				tenantID = string(parts[0])
+				names = make(map[string]bool)
+			}
+
+			tag := new(Tag)
+			if err := it.Item().Value(tag.Unmarshal); err != nil {
+				return err
+			}
+			tx := &badgerTransaction{badgerRepo: r, tenantID: tenantID}
+			if names[tag.Name] {
+				for names[tag.Name] {
+					tag.Name = fmt.Sprintf("%s (%d)", tag.Name, tag.ID)
+				}
+				if err := wb.Set(tx.tagKey(tag.ID).Bytes(), tag.MustMarshal()); err != nil {
+					return err
+				}
+			}
+			names[tag.Name] = true
+			if err := wb.Set(tx.tagNameKey(tag.Name).Bytes(), tx.tagKey(tag.ID).entityKey); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return wb.Flush()
+}
+
+type badgerRepo struct {
+	db            *badger.DB
+	noteIDs       *badger.Sequence
+	tagIDs        *badger.Sequence
+	indexJobIDs   *badger.Sequence
+	revisionLimit int
+	indexer       *indexWorker
+}
+
+func (r *badgerRepo) Close() error {
+	r.indexer.close()
+	fmt.Println("Closing BadgerDB database")
+	for _, seq := range []*badger.Sequence{r.noteIDs, r.tagIDs, r.indexJobIDs} {
+		if err := seq.Release(); err != nil {
+			return err
+		}
+	}
+	return r.db.Close()
+}
+
+// TenantIDs reads the tenant from the first key of each tenant and then skips
+// past the rest of its keys, so it does not visit every key in the database.
+func (r *badgerRepo) TenantIDs() ([]string, error) {
+	ids := []string{}
+	err := r.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); {
+			key := it.Item().Key()
+			i := bytes.IndexByte(key, KEY_SEP)
+			if i < 0 {
+				// A sequence, which is stored outside of every tenant.
+				it.Next()
+				continue
+			}
+			if i > 0 {
+				ids = append(ids, string(key[:i]))
+			}
+			it.Seek(append(key[:i:i], KEY_SEP+1))
+		}
+		return nil
+	})
+	return ids, err
+}
+
+func (r *badgerRepo) IndexQueueDepth() (int, error) {
+	var n int
+	err := r.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := indexJobKey(0).Bytes()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// CheckIntegrity scans the association, revision and tag name keys of every
+// tenant. Repairs are collected while scanning and written in a batch at the
+// end, as a single transaction could grow too big.
+func (r *badgerRepo) CheckIntegrity(fix bool) ([]*Problem, error) {
+	type link struct {
+		tenantID      string
+		noteID, tagID uint64
+	}
+	// links records whether the note-to-tag and tag-to-note keys of each
+	// association exist.
+	links := make(map[link]*[2]bool)
+	var linkOrder []link
+	type tagName struct {
+		tenantID, name string
+		tagID          uint64
+	}
+	var names []tagName
+	type revisions struct {
+		tenantID string
+		noteID   uint64
+	}
+	revisionKeys := make(map[revisions][][]byte)
+	var revisionOrder []revisions
+
+	wb := r.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	var problems []*Problem
+	err := r.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			parts := bytes.SplitN(item.Key(), []byte{KEY_SEP}, 3)
+			if len(parts) != 3 || len(parts[0]) == 0 {
+				continue
+			}
+			tenantID, id := string(parts[0]), parts[2]
+			switch entityType := string(parts[1]); entityType {
+			case "nt", "tn":
+				if len(id) != 16 {
+					continue
+				}
+				idA, idB := binary.BigEndian.Uint64(id[:8]), binary.BigEndian.Uint64(id[8:])
+				l, side := link{tenantID, idA, idB}, 0
+				if entityType == "tn" {
+					l, side = link{tenantID, idB, idA}, 1
+				}
+				if links[l] == nil {
+					links[l] = new([2]bool)
+					linkOrder = append(linkOrder, l)
+				}
+				links[l][side] = true
+			case "r":
+				if len(id) != 16 {
+					continue
+				}
+				rv := revisions{tenantID, binary.BigEndian.Uint64(id[:8])}
+				if revisionKeys[rv] == nil {
+					revisionOrder = append(revisionOrder, rv)
+				}
+				revisionKeys[rv] = append(revisionKeys[rv], item.KeyCopy(nil))
+			case "tname":
+				bs, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				if len(bs) == 8 {
+					names = append(names, tagName{tenantID, string(id), binary.BigEndian.Uint64(bs)})
+				}
+			}
+		}
+
+		sort.Slice(linkOrder, func(i, j int) bool {
+			a, b := linkOrder[i], linkOrder[j]
+			if a.tenantID != b.tenantID {
+				return a.tenantID < b.tenantID
+			}
+			if a.noteID != b.noteID {
+				return a.noteID < b.noteID
+			}
+			return a.tagID < b.tagID
+		})
+		for _, l := range linkOrder {
+			tx := &badgerTransaction{badgerRepo: r, tenantID: l.tenantID}
+			hasNote, err := tx.hasNote(txn, l.noteID)
+			if err != nil {
+				return err
+			}
+			hasTag, err := tx.exists(txn, tx.tagKey(l.tagID))
+			if err != nil {
+				return err
+			}
+			keys := links[l]
+			desc := linkProblem(l.noteID, l.tagID, hasNote, hasTag, keys[0], keys[1])
+			if desc == "" {
+				continue
+			}
+			problems = append(problems, &Problem{TenantID: l.tenantID, Description: desc, Fixed: fix})
+			if !fix {
+				continue
+			}
+			if hasNote && hasTag && keys[0] {
+				err = wb.Set(tx.tagNoteKey(l.tagID, l.noteID).Bytes(), tx.noteKey(l.noteID).entityKey)
+			} else if err = wb.Delete(tx.noteTagKey(l.noteID, l.tagID).Bytes()); err == nil {
+				err = wb.Delete(tx.tagNoteKey(l.tagID, l.noteID).Bytes())
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, n := range names {
+			tx := &badgerTransaction{badgerRepo: r, tenantID: n.tenantID}
+			tag, err := tx.findTag(txn, n.tagID)
+			if err != nil {
+				return err
+			}
+			var desc string
+			switch {
+			case tag == nil:
+				desc = fmt.Sprintf("tag name %q refers to missing tag %d", n.name, n.tagID)
+			case tag.Name != n.name:
+				desc = fmt.Sprintf("tag name %q refers to tag %d, which is named %q", n.name, n.tagID, tag.Name)
+			default:
+				continue
+			}
+			problems = append(problems, &Problem{TenantID: n.tenantID, Description: desc, Fixed: fix})
+			if fix {
+				if err := wb.Delete(tx.tagNameKey(n.name).Bytes()); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, rv := range revisionOrder {
+			tx := &badgerTransaction{badgerRepo: r, tenantID: rv.tenantID}
+			hasNote, err := tx.hasNote(txn, rv.noteID)
+			if err != nil {
+				return err
+			}
+			if hasNote {
+				continue
+			}
+			p := orphanedRevisionsProblem(rv.tenantID, rv.noteID)
+			p.Fixed = fix
+			problems = append(problems, p)
+			if !fix {
+				continue
+			}
+			for _, key := range revisionKeys[rv] {
+				if err := wb.Delete(key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if fix {
+		if err := wb.Flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].TenantID < problems[j].TenantID
+	})
+	return problems, nil
+}
+
+func (r *badgerRepo) CreateTenant(tenant *Tenant) error {
+	if err := newTenant(tenant); err != nil {
+		return err
+	}
+	return r.db.Update(func(txn *badger.Txn) error {
+		key := tenantKey(tenant.ID).Bytes()
+		_, err := txn.Get(key)
+		switch err {
+		case nil:
+			return tenantExists(tenant.ID)
+		case badger.ErrKeyNotFound:
+		default:
+			return err
+		}
+		return txn.Set(key, tenant.MustMarshal())
+	})
+}
+
+func (r *badgerRepo) FindTenant(id string) (tenant *Tenant, err error) {
+	err = r.db.View(func(txn *badger.Txn) error {
+		tenant, err = findTenant(txn, id)
+		return err
+	})
+	return
+}
+
+func (r *badgerRepo) FindTenants(q TenantQuery) (*TenantPage, error) {
+	after, err := q.after()
+	if err != nil {
+		return nil, err
+	}
+
+	tenants := make([]*Tenant, 0)
+	err = r.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := tenantKey("").Bytes()
+		start := prefix
+		if after != "" {
+			// The smallest key after that of the last tenant.
+			start = append(tenantKey(after).Bytes(), 0)
+		}
+		for it.Seek(start); it.ValidForPrefix(prefix); it.Next() {
+			tenant := new(Tenant)
+			if err := it.Item().Value(tenant.Unmarshal); err != nil {
+				return err
+			}
+			if !q.matches(tenant) {
+				continue
+			}
+			tenants = append(tenants, tenant)
+			if q.Limit > 0 && len(tenants) > q.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return q.page(tenants), nil
+}
+
+func (r *badgerRepo) UpdateTenant(id string, tenant *Tenant) error {
+	if !tenant.Status.valid() {
+		return fmt.Errorf("invalid tenant status %q", tenant.Status)
+	}
+	return r.db.Update(func(txn *badger.Txn) error {
+		existing, err := findTenant(txn, id)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return tenantNotFound(id)
+		}
+		existing.Name = tenant.Name
+		existing.Status = tenant.Status
+		if err := txn.Set(tenantKey(id).Bytes(), existing.MustMarshal()); err != nil {
+			return err
+		}
+		*tenant = *existing
+		return nil
+	})
+}
+
+func findTenant(txn *badger.Txn, id string) (*Tenant, error) {
+	item, err := txn.Get(tenantKey(id).Bytes())
+	switch err {
+	case nil:
+	case badger.ErrKeyNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	tenant := new(Tenant)
+	if err := item.Value(tenant.Unmarshal); err != nil {
+		return nil, err
+	}
+	return tenant, nil
+}
+
+func (r *badgerRepo) CreateUser(user *User) error {
+	if err := newUser(user); err != nil {
+		return err
+	}
+	return r.db.Update(func(txn *badger.Txn) error {
+		emailKey := userEmailKey(user.Email).Bytes()
+		_, err := txn.Get(emailKey)
+		switch err {
+		case nil:
+			return emailExists(user.Email)
+		case badger.ErrKeyNotFound:
+		default:
+			return err
+		}
+
+		if err := txn.Set(userKey(user.ID).Bytes(), user.MustMarshal()); err != nil {
+			return err
+		}
+		if err := txn.Set(emailKey, []byte(user.ID)); err != nil {
+			return err
+		}
+		return txn.Set(tenantUserKey(user.TenantID, user.ID).Bytes(), nil)
+	})
+}
+
+func (r *badgerRepo) FindUser(id string) (user *User, err error) {
+	err = r.db.View(func(txn *badger.Txn) error {
+		user, err = findUser(txn, id)
+		return err
+	})
+	return
+}
+
+func (r *badgerRepo) FindUserByEmail(email string) (user *User, err error) {
+	err = r.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(userEmailKey(email).Bytes())
+		switch err {
+		case nil:
+		case badger.ErrKeyNotFound:
+			return nil
+		default:
+			return err
+		}
+		id, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		user, err = findUser(txn, string(id))
+		return err
+	})
+	return
+}
+
+func (r *badgerRepo) FindUsers(tenantID string) ([]*User, error) {
+	users := make([]*User, 0)
+	err := r.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := tenantUserKey(tenantID, "").Bytes()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			user, err := findUser(txn, string(it.Item().Key()[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			if user != nil {
+				users = append(users, user)
+			}
+		}
+		return nil
+	})
+	return users, err
+}
+
+func (r *badgerRepo) UpdateUser(id string, user *User) error {
+	if !user.Role.valid() {
+		return invalidUser("unknown role %q", user.Role)
+	}
+	return r.db.Update(func(txn *badger.Txn) error {
+		existing, err := findUser(txn, id)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return userNotFound(id)
+		}
+		existing.Role = user.Role
+		if err := txn.Set(userKey(id).Bytes(), existing.MustMarshal()); err != nil {
+			return err
+		}
+		*user = *existing
+		return nil
+	})
+}
+
+// DeleteUser also deletes the user's sessions, which are listed under the
+// user.
+func (r *badgerRepo) DeleteUser(id string) error {
+	return r.db.Update(func(txn *badger.Txn) error {
+		user, err := findUser(txn, id)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return userNotFound(id)
+		}
+		for _, key := range []badgerKey{
+			userKey(id),
+			userEmailKey(user.Email),
+			tenantUserKey(user.TenantID, id),
+		} {
+			if err := txn.Delete(key.Bytes()); err != nil {
+				return err
+			}
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		var sessionIDs []string
+		prefix := userSessionKey(id, "").Bytes()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			sessionIDs = append(sessionIDs, string(it.Item().Key()[len(prefix):]))
+		}
+		for _, sessionID := range sessionIDs {
+			if err := txn.Delete(sessionKey(sessionID).Bytes()); err != nil {
+				return err
+			}
+			if err := txn.Delete(userSessionKey(id, sessionID).Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func findUser(txn *badger.Txn, id string) (*User, error) {
+	item, err := txn.Get(userKey(id).Bytes())
+	switch err {
+	case nil:
+	case badger.ErrKeyNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	user := new(User)
+	if err := item.Value(user.Unmarshal); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (r *badgerRepo) CreateSession(session *Session) error {
+	return r.db.Update(func(txn *badger.Txn) error {
+		key := sessionKey(session.ID).Bytes()
+		_, err := txn.Get(key)
+		switch err {
+		case nil:
+			return &AlreadyExistsError{Entity: "session", Name: session.ID}
+		case badger.ErrKeyNotFound:
+		default:
+			return err
+		}
+		if err := txn.Set(key, session.MustMarshal()); err != nil {
+			return err
+		}
+		return txn.Set(userSessionKey(session.UserID, session.ID).Bytes(), nil)
+	})
+}
+
+func (r *badgerRepo) FindSession(id string) (session *Session, err error) {
+	err = r.db.View(func(txn *badger.Txn) error {
+		session, err = findSession(txn, id)
+		return err
+	})
+	return
+}
+
+func (r *badgerRepo) DeleteSession(id string) error {
+	return r.db.Update(func(txn *badger.Txn) error {
+		session, err := findSession(txn, id)
+		if err != nil {
+			return err
+		}
+		if session == nil {
+			return sessionNotFound()
+		}
+		return deleteSession(txn, session)
+	})
+}
+
+func (r *badgerRepo) DeleteExpiredSessions(expiredBy time.Time) (int, error) {
+	var due []string
+	err := r.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := sessionKey("").Bytes()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			session := new(Session)
+			if err := it.Item().Value(session.Unmarshal); err != nil {
+				return err
+			}
+			if !expiredBy.Before(session.ExpiresAt) {
+				due = append(due, session.ID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int
+	for _, id := range due {
+		err := r.db.Update(func(txn *badger.Txn) error {
+			session, err := findSession(txn, id)
+			if session == nil || err != nil {
+				// Deleted since the sessions were read.
+				return err
+			}
+			deleted++
+			return deleteSession(txn, session)
+		})
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+func findSession(txn *badger.Txn, id string) (*Session, error) {
+	item, err := txn.Get(sessionKey(id).Bytes())
+	switch err {
+	case nil:
+	case badger.ErrKeyNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	session := new(Session)
+	if err := item.Value(session.Unmarshal); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func deleteSession(txn *badger.Txn, session *Session) error {
+	if err := txn.Delete(sessionKey(session.ID).Bytes()); err != nil {
+		return err
+	}
+	return txn.Delete(userSessionKey(session.UserID, session.ID).Bytes())
+}
+
+func (r *badgerRepo) CreateAPIKey(key *APIKey) error {
+	return r.db.Update(func(txn *badger.Txn) error {
+		for _, k := range []badgerKey{apiKeyKey(key.ID), apiKeyHashKey(key.Hash)} {
+			_, err := txn.Get(k.Bytes())
+			switch err {
+			case nil:
+				return &AlreadyExistsError{Entity: "API key", Name: key.ID}
+			case badger.ErrKeyNotFound:
+			default:
+				return err
+			}
+		}
+
+		if err := txn.Set(apiKeyKey(key.ID).Bytes(), key.MustMarshal()); err != nil {
+			return err
+		}
+		if err := txn.Set(apiKeyHashKey(key.Hash).Bytes(), []byte(key.ID)); err != nil {
+			return err
+		}
+		return txn.Set(tenantAPIKeyKey(key.TenantID, key.ID).Bytes(), nil)
+	})
+}
+
+func (r *badgerRepo) FindAPIKey(id string) (key *APIKey, err error) {
+	err = r.db.View(func(txn *badger.Txn) error {
+		key, err = findAPIKey(txn, id)
+		return err
+	})
+	return
+}
+
+func (r *badgerRepo) FindAPIKeyByHash(hash string) (key *APIKey, err error) {
+	err = r.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(apiKeyHashKey(hash).Bytes())
+		switch err {
+		case nil:
+		case badger.ErrKeyNotFound:
+			return nil
+		default:
+			return err
+		}
+		id, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		key, err = findAPIKey(txn, string(id))
+		return err
+	})
+	return
+}
+
+func (r *badgerRepo) FindAPIKeys(tenantID string) ([]*APIKey, error) {
+	keys := make([]*APIKey, 0)
+	err := r.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := tenantAPIKeyKey(tenantID, "").Bytes()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key, err := findAPIKey(txn, string(it.Item().Key()[len(prefix):]))
+			if err != nil {
+				return err
+			}
+			if key != nil {
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (r *badgerRepo) TouchAPIKey(id string, usedAt time.Time) error {
+	return r.db.Update(func(txn *badger.Txn) error {
+		key, err := findAPIKey(txn, id)
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			return apiKeyNotFound(id)
+		}
+		key.LastUsedAt = &usedAt
+		return txn.Set(apiKeyKey(id).Bytes(), key.MustMarshal())
+	})
+}
+
+func (r *badgerRepo) DeleteAPIKey(id string) error {
+	return r.db.Update(func(txn *badger.Txn) error {
+		key, err := findAPIKey(txn, id)
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			return apiKeyNotFound(id)
+		}
+		for _, k := range []badgerKey{
+			apiKeyKey(id),
+			apiKeyHashKey(key.Hash),
+			tenantAPIKeyKey(key.TenantID, id),
+		} {
+			if err := txn.Delete(k.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func findAPIKey(txn *badger.Txn, id string) (*APIKey, error) {
+	item, err := txn.Get(apiKeyKey(id).Bytes())
+	switch err {
+	case nil:
+	case badger.ErrKeyNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	key := new(APIKey)
+	if err := item.Value(key.Unmarshal); err != nil {
+		return nil, err
+	}
+	return key, nil
 }
 
-func (r *badgerRepo) Close() error {
-	fmt.Println("Closing BadgerDB database")
-	if err := r.noteIDs.Release(); err != nil {
-		return err
+func (r *badgerRepo) peekIndexJobs(n int) ([]indexJob, error) {
+	var jobs []indexJob
+	err := r.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := indexJobKey(0).Bytes()
+		for it.Seek(prefix); it.ValidForPrefix(prefix) && len(jobs) < n; it.Next() {
+			var job indexJob
+			if err := it.Item().Value(func(bs []byte) error {
+				return json.Unmarshal(bs, &job)
+			}); err != nil {
+				return err
+			}
+			key := it.Item().Key()
+			job.Seq = binary.BigEndian.Uint64(key[len(key)-8:])
+			jobs = append(jobs, job)
+		}
+		return nil
+	})
+	return jobs, err
+}
+
+func (r *badgerRepo) ackIndexJob(seq uint64) error {
+	return r.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(indexJobKey(seq).Bytes())
+	})
+}
+
+// PurgeTrash walks the purge queue, which is ordered by deletion time across
+// all tenants, and purges each due note in its own transaction.
+func (r *badgerRepo) PurgeTrash(deletedBefore time.Time) (int, error) {
+	type entry struct {
+		tenantID string
+		noteID   uint64
 	}
-	if err := r.tagIDs.Release(); err != nil {
-		return err
+	var due []entry
+	err := r.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := badgerKey{entityType: "dt"}.Bytes()
+		cutoff := deletedBefore.UnixNano()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			entityKey := it.Item().Key()[len(prefix):]
+			if int64(binary.BigEndian.Uint64(entityKey[:8])) >= cutoff {
+				break
+			}
+			due = append(due, entry{
+				tenantID: string(entityKey[16:]),
+				noteID:   binary.BigEndian.Uint64(entityKey[8:16]),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
-	return r.db.Close()
+
+	var purged int
+	for _, e := range due {
+		tx := &badgerTransaction{badgerRepo: r, tenantID: e.tenantID}
+		err := r.db.Update(func(txn *badger.Txn) error {
+			note, err := tx.getTrashedNote(txn, e.noteID)
+			if note == nil || err != nil {
+				// Restored or purged since the queue was read.
+				return err
+			}
+			purged++
+			return tx.purgeNote(txn, note)
+		})
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
 }
 
 func (r *badgerRepo) Transaction(tenantID string) Transaction {
@@ -72,56 +1017,115 @@ func (r *badgerRepo) Transaction(tenantID string) Transaction {
 	}
 }
 
+func (r *badgerRepo) Update(tenantID string, fn func(tx Transaction) error) error {
+	tx := &badgerTransaction{
+		badgerRepo: r,
+		tenantID:   tenantID,
+	}
+	err := r.db.Update(func(txn *badger.Txn) error {
+		tx.txn = txn
+		return fn(tx)
+	})
+	tx.txn = nil
+	if err != nil {
+		return err
+	}
+
+	r.indexer.notify()
+	return nil
+}
+
+// badgerTransaction either runs every operation in its own Badger transaction
+// or, when created by Update, runs all operations in a single shared txn.
 type badgerTransaction struct {
 	*badgerRepo
 	tenantID string
+
+	txn *badger.Txn
 }
 
-func (tx *badgerTransaction) FindNoteByID(id uint64) (note *Note, err error) {
-	key := tx.noteKey(id)
-	err = tx.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(key.Bytes())
-		switch err {
-		case nil:
-			return item.Value(func(bs []byte) error {
-				note = new(Note)
-				return note.Unmarshal(bs)
-			})
-		case badger.ErrKeyNotFound:
-			return nil
-		default:
+func (tx *badgerTransaction) view(fn func(txn *badger.Txn) error) error {
+	if tx.txn != nil {
+		return fn(tx.txn)
+	}
+	return tx.db.View(fn)
+}
+
+func (tx *badgerTransaction) update(fn func(txn *badger.Txn) error) error {
+	if tx.txn != nil {
+		return fn(tx.txn)
+	}
+	if err := tx.db.Update(fn); err != nil {
+		return err
+	}
+	tx.indexer.notify()
+	return nil
+}
+
+// reindex queues notes to have their search documents brought up to date.
+// The queue entries are part of txn, so they are committed with the change.
+func (tx *badgerTransaction) reindex(txn *badger.Txn, noteIDs ...uint64) error {
+	for _, noteID := range noteIDs {
+		seq, err := tx.indexJobIDs.Next()
+		if err != nil {
+			return err
+		}
+		job, err := json.Marshal(indexJob{TenantID: tx.tenantID, NoteID: noteID})
+		if err != nil {
+			return err
+		}
+		if err := txn.Set(indexJobKey(seq).Bytes(), job); err != nil {
 			return err
 		}
-	})
-	if note != nil {
-		err = tx.withTags(note)
 	}
+	return nil
+}
+
+func (tx *badgerTransaction) FindNoteByID(id uint64) (note *Note, err error) {
+	err = tx.view(func(txn *badger.Txn) error {
+		note, err = tx.findNote(txn, id)
+		return err
+	})
 	return
 }
 
 func (tx *badgerTransaction) FindAllNotes() ([]*Note, error) {
+	return tx.listNotes(tx.noteKey(0))
+}
+
+func (tx *badgerTransaction) FindTrashedNotes() ([]*Note, error) {
+	return tx.listNotes(tx.trashKey(0))
+}
+
+// listNotes loads every note stored under prefix, along with its tags.
+func (tx *badgerTransaction) listNotes(prefixKey badgerKey) ([]*Note, error) {
 	notes := make([]*Note, 0)
-	err := tx.db.View(func(txn *badger.Txn) error {
+	err := tx.view(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchSize = 10
 		it := txn.NewIterator(opts)
-		defer it.Close()
 
-		prefix := tx.noteKey(0).Bytes()
+		prefix := prefixKey.Bytes()
 		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
 			item := it.Item()
 			err := item.Value(func(bs []byte) error {
-				note := new(Note)
-				if err := note.Unmarshal(bs); err != nil {
+				note, err := decodeNote(bs)
+				if err != nil {
 					return fmt.Errorf("error decoding as note: %w", err)
 				}
-				if err := tx.withTags(note); err != nil {
-					return err
-				}
 				notes = append(notes, note)
 				return nil
 			})
 			if err != nil {
+				it.Close()
+				return err
+			}
+		}
+		// Badger only allows a single open iterator in a read-write txn.
+		it.Close()
+
+		for _, note := range notes {
+			if err := tx.withTags(txn, note); err != nil {
 				return err
 			}
 		}
@@ -131,28 +1135,156 @@ func (tx *badgerTransaction) FindAllNotes() ([]*Note, error) {
 	return notes, err
 }
 
-func (tx *badgerTransaction) FindTagByID(id uint64) (tag *Tag, err error) {
-	key := tx.tagKey(id)
-	err = tx.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(key.Bytes())
-		switch err {
-		case nil:
-			return item.Value(func(bs []byte) error {
-				tag = new(Tag)
-				return tag.Unmarshal(bs)
-			})
-		case badger.ErrKeyNotFound:
-			return nil
-		default:
+// FindNotes walks the sort key index for the requested order, seeking past the
+// cursor and any range that the time filters exclude.
+func (tx *badgerTransaction) FindNotes(q NoteQuery) (*NotePage, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	after, err := q.after()
+	if err != nil {
+		return nil, err
+	}
+
+	var page *NotePage
+	err = tx.view(func(txn *badger.Txn) error {
+		if q.TagID > 0 {
+			page, err = tx.findTaggedNotes(txn, &q, after)
 			return err
 		}
+
+		prefix := badgerKey{tenantID: tx.tenantID, entityType: badgerSortKeyTypes[q.Sort]}.Bytes()
+		start, stop := tx.sortKeyRange(&q, after, prefix)
+		var afterKey []byte
+		if after != nil {
+			afterKey = tx.sortKey(q.Sort, after).Bytes()
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Reverse = q.Descending
+		it := txn.NewIterator(opts)
+
+		notes := make([]*Note, 0)
+		for it.Seek(start); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().Key()
+			if stop != nil && (bytes.Compare(key, stop) >= 0) != q.Descending {
+				break
+			}
+			if bytes.Equal(key, afterKey) {
+				continue
+			}
+			id := binary.BigEndian.Uint64(key[len(key)-8:])
+			note, err := tx.getNote(txn, id)
+			if err != nil {
+				it.Close()
+				return err
+			}
+			if note == nil || !q.matches(note) {
+				continue
+			}
+			notes = append(notes, note)
+			if q.Limit > 0 && len(notes) > q.Limit {
+				break
+			}
+		}
+		// Badger only allows a single open iterator in a read-write txn.
+		it.Close()
+
+		page = q.page(notes)
+		for _, note := range page.Notes {
+			if err := tx.withTags(txn, note); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return page, err
+}
+
+// sortKeyRange returns where to start iterating over the sort keys under
+// prefix and, if a time filter bounds the sort field, the key at which to stop.
+func (tx *badgerTransaction) sortKeyRange(q *NoteQuery, after *Note, prefix []byte) (start, stop []byte) {
+	var lower, upper []byte
+	switch {
+	case q.Sort == SortByUpdatedAt && !q.UpdatedSince.IsZero():
+		lower = tx.sortKey(q.Sort, &Note{UpdatedAt: q.UpdatedSince}).Bytes()
+	case q.Sort == SortByCreatedAt && !q.CreatedBefore.IsZero():
+		upper = tx.sortKey(q.Sort, &Note{CreatedAt: q.CreatedBefore}).Bytes()
+	}
+
+	if q.Descending {
+		// A reverse iterator seeks to the greatest key not after start.
+		start = append(append([]byte(nil), prefix...), 0xFF)
+		if upper != nil {
+			start = upper
+		}
+		if after != nil {
+			if key := tx.sortKey(q.Sort, after).Bytes(); bytes.Compare(key, start) < 0 {
+				start = key
+			}
+		}
+		return start, lower
+	}
+
+	start = prefix
+	if lower != nil {
+		start = lower
+	}
+	if after != nil {
+		if key := tx.sortKey(q.Sort, after).Bytes(); bytes.Compare(key, start) > 0 {
+			start = key
+		}
+	}
+	return start, upper
+}
+
+// findTaggedNotes lists the notes with a tag by way of the tag's associations
+// rather than the sort index, which is cheaper whenever the tag is on only a
+// fraction of the tenant's notes.
+func (tx *badgerTransaction) findTaggedNotes(txn *badger.Txn, q *NoteQuery, after *Note) (*NotePage, error) {
+	ids, err := tx.assocIDs(txn, tx.tagNoteKey(q.TagID, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	notes := make([]*Note, 0, len(ids))
+	for _, id := range ids {
+		note, err := tx.getNote(txn, id)
+		if err != nil {
+			return nil, err
+		}
+		// Trashed notes keep their tags but are not listed.
+		if note != nil && q.matches(note) {
+			notes = append(notes, note)
+		}
+	}
+
+	notes = q.sort(notes, after)
+	if q.Limit > 0 && len(notes) > q.Limit+1 {
+		notes = notes[:q.Limit+1]
+	}
+	page := q.page(notes)
+	for _, note := range page.Notes {
+		if err := tx.withTags(txn, note); err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+func (tx *badgerTransaction) FindTagByID(id uint64) (tag *Tag, err error) {
+	err = tx.view(func(txn *badger.Txn) error {
+		tag, err = tx.findTag(txn, id)
+		return err
 	})
 	return
 }
 
 func (tx *badgerTransaction) FindAllTags() ([]*Tag, error) {
 	tags := make([]*Tag, 0)
-	err := tx.db.View(func(txn *badger.Txn) error {
+	err := tx.view(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchSize = 10
 		it := txn.NewIterator(opts)
@@ -179,49 +1311,228 @@ func (tx *badgerTransaction) FindAllTags() ([]*Tag, error) {
 	return tags, err
 }
 
+func (tx *badgerTransaction) FindTags(q TagQuery) (*TagPage, error) {
+	after, err := q.after()
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make([]*Tag, 0)
+	err = tx.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchSize = 10
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := tx.tagKey(0).Bytes()
+		start := prefix
+		if after > 0 {
+			start = tx.tagKey(after + 1).Bytes()
+		}
+		for it.Seek(start); it.ValidForPrefix(prefix); it.Next() {
+			tag := new(Tag)
+			if err := it.Item().Value(tag.Unmarshal); err != nil {
+				return err
+			}
+			tags = append(tags, tag)
+			if q.Limit > 0 && len(tags) > q.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return q.page(tags), nil
+}
+
+func (tx *badgerTransaction) FindRevisions(noteID uint64) ([]*Revision, error) {
+	revisions := make([]*Revision, 0)
+	err := tx.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchSize = 10
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := tx.revisionKey(noteID, 0).Bytes()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			rev := new(Revision)
+			if err := it.Item().Value(rev.Unmarshal); err != nil {
+				return err
+			}
+			revisions = append(revisions, rev)
+		}
+		return nil
+	})
+
+	return revisions, err
+}
+
+func (tx *badgerTransaction) FindRevision(noteID, rev uint64) (revision *Revision, err error) {
+	if rev == 0 {
+		return nil, nil
+	}
+	err = tx.view(func(txn *badger.Txn) error {
+		item, err := txn.Get(tx.revisionKey(noteID, rev).Bytes())
+		switch err {
+		case nil:
+			revision = new(Revision)
+			return item.Value(revision.Unmarshal)
+		case badger.ErrKeyNotFound:
+			return nil
+		default:
+			return err
+		}
+	})
+	return
+}
+
 func (tx *badgerTransaction) CreateNote(note *Note) error {
 	id, err := tx.noteIDs.Next()
 	if err != nil {
 		return err
 	}
 
-	key := tx.noteKey(id)
 	now := time.Now()
 	note.ID = id
+	note.Version = 1
 	note.CreatedAt = now
 	note.UpdatedAt = now
-	err = tx.db.Update(func(txn *badger.Txn) error {
-		return txn.Set(key.Bytes(), note.MustMarshal())
+	note.DeletedAt = nil
+	return tx.update(func(txn *badger.Txn) error {
+		if err := tx.putNote(txn, note); err != nil {
+			return err
+		}
+		if err := tx.addRevision(txn, note); err != nil {
+			return err
+		}
+		return tx.reindex(txn, id)
 	})
-	if err == nil {
-		go tx.updateSearchIndex(id)
-	}
-	return err
 }
 
 func (tx *badgerTransaction) UpdateNote(id uint64, note *Note) error {
-	key := tx.noteKey(id)
-	note.UpdatedAt = time.Now()
-	err := tx.db.Update(func(txn *badger.Txn) error {
-		return txn.Set(key.Bytes(), note.MustMarshal())
+	return tx.update(func(txn *badger.Txn) error {
+		existing, err := tx.getNote(txn, id)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return noteNotFound(id)
+		}
+
+		// Notes written before revisions were introduced have no history, so
+		// their current state becomes the first revision.
+		latest, err := tx.latestRevision(txn, id)
+		if err != nil {
+			return err
+		}
+		if latest == 0 {
+			if err := tx.addRevision(txn, existing); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.deleteSortKeys(txn, existing); err != nil {
+			return err
+		}
+		existing.Version++
+		existing.Title = note.Title
+		existing.Content = note.Content
+		existing.UpdatedAt = time.Now()
+		existing.UpdatedBy = note.UpdatedBy
+		if err := tx.putNote(txn, existing); err != nil {
+			return err
+		}
+		if err := tx.addRevision(txn, existing); err != nil {
+			return err
+		}
+
+		note.ID = existing.ID
+		note.Version = existing.Version
+		note.CreatedAt = existing.CreatedAt
+		note.UpdatedAt = existing.UpdatedAt
+		return tx.reindex(txn, id)
+	})
+}
+
+func (tx *badgerTransaction) CheckNoteVersion(id, version uint64) error {
+	return tx.view(func(txn *badger.Txn) error {
+		note, err := tx.getNote(txn, id)
+		if err != nil {
+			return err
+		}
+		if note == nil {
+			return noteNotFound(id)
+		}
+		return checkVersion(note, version)
+	})
+}
+
+func (tx *badgerTransaction) DeleteNote(id uint64) error {
+	return tx.update(func(txn *badger.Txn) error {
+		note, err := tx.getNote(txn, id)
+		if err != nil {
+			return err
+		}
+		if note == nil {
+			return noteNotFound(id)
+		}
+
+		now := time.Now()
+		note.DeletedAt = &now
+		if err := tx.deleteSortKeys(txn, note); err != nil {
+			return err
+		}
+		if err := txn.Delete(tx.noteKey(id).Bytes()); err != nil {
+			return err
+		}
+		if err := txn.Set(tx.trashKey(id).Bytes(), note.MustMarshal()); err != nil {
+			return err
+		}
+		if err := txn.Set(purgeQueueKey(tx.tenantID, id, now).Bytes(), nil); err != nil {
+			return err
+		}
+		return tx.reindex(txn, id)
+	})
+}
+
+func (tx *badgerTransaction) RestoreNote(id uint64) error {
+	return tx.update(func(txn *badger.Txn) error {
+		note, err := tx.getTrashedNote(txn, id)
+		if err != nil {
+			return err
+		}
+		if note == nil {
+			return noteNotFound(id)
+		}
+
+		if err := txn.Delete(purgeQueueKey(tx.tenantID, id, *note.DeletedAt).Bytes()); err != nil {
+			return err
+		}
+		if err := txn.Delete(tx.trashKey(id).Bytes()); err != nil {
+			return err
+		}
+		note.DeletedAt = nil
+		if err := tx.putNote(txn, note); err != nil {
+			return err
+		}
+		return tx.reindex(txn, id)
 	})
-	if err == nil {
-		go tx.updateSearchIndex(id)
-	}
-
-	return err
 }
 
-func (tx *badgerTransaction) DeleteNote(id uint64) error {
-	key := tx.noteKey(id)
-	// TODO: Schedule deletion of note/tag associations for this note
-	err := tx.db.Update(func(txn *badger.Txn) error {
-		return txn.Delete(key.Bytes())
+func (tx *badgerTransaction) PurgeNote(id uint64) error {
+	return tx.update(func(txn *badger.Txn) error {
+		note, err := tx.getTrashedNote(txn, id)
+		if err != nil {
+			return err
+		}
+		if note == nil {
+			return noteNotFound(id)
+		}
+		return tx.purgeNote(txn, note)
 	})
-	if err == nil {
-		go tx.idx.RemoveNote(tx.tenantID, id)
-	}
-	return err
 }
 
 func (tx *badgerTransaction) CreateTag(tag *Tag) error {
@@ -233,46 +1544,125 @@ func (tx *badgerTransaction) CreateTag(tag *Tag) error {
 	key := tx.tagKey(id)
 	tag.ID = id
 	tag.CreatedAt = time.Now()
-	return tx.db.Update(func(txn *badger.Txn) error {
+	return tx.update(func(txn *badger.Txn) error {
+		if err := tx.claimTagName(txn, tag); err != nil {
+			return err
+		}
 		return txn.Set(key.Bytes(), tag.MustMarshal())
 	})
 }
 
+func (tx *badgerTransaction) UpdateTag(id uint64, tag *Tag) error {
+	return tx.update(func(txn *badger.Txn) error {
+		existing, err := tx.findTag(txn, id)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return tagNotFound(id)
+		}
+
+		tag.ID = id
+		tag.CreatedAt = existing.CreatedAt
+		if tag.Name != existing.Name {
+			if err := tx.claimTagName(txn, tag); err != nil {
+				return err
+			}
+			if err := txn.Delete(tx.tagNameKey(existing.Name).Bytes()); err != nil {
+				return err
+			}
+		}
+		if err := txn.Set(tx.tagKey(id).Bytes(), tag.MustMarshal()); err != nil {
+			return err
+		}
+		noteIDs, err := tx.assocIDs(txn, tx.tagNoteKey(id, 0))
+		if err != nil {
+			return err
+		}
+		return tx.reindex(txn, noteIDs...)
+	})
+}
+
 func (tx *badgerTransaction) DeleteTag(id uint64) error {
-	key := tx.tagKey(id)
-	// TODO: Schedule deletion of tag/note associations for this tag
-	return tx.db.Update(func(txn *badger.Txn) error {
-		return txn.Delete(key.Bytes())
+	return tx.update(func(txn *badger.Txn) error {
+		tag, err := tx.findTag(txn, id)
+		if err != nil {
+			return err
+		}
+		if tag == nil {
+			return tagNotFound(id)
+		}
+		noteIDs, err := tx.unlinkTag(txn, id)
+		if err != nil {
+			return err
+		}
+		if err := tx.deleteTag(txn, tag); err != nil {
+			return err
+		}
+		return tx.reindex(txn, noteIDs...)
 	})
 }
 
-func (tx *badgerTransaction) TagNote(noteID, tagID uint64) error {
-	// TODO: Validate existence of note and tag
-	noteIDBytes := tx.noteKey(noteID).entityKey
-	tagIDBytes := tx.tagKey(tagID).entityKey
-	err := tx.db.Update(func(txn *badger.Txn) error {
-		noteToTagKey := tx.noteTagKey(noteID, tagID)
-		if err := txn.Set(noteToTagKey.Bytes(), tagIDBytes); err != nil {
-			// If there is an error here, we will end up in an inconsistent state
-			// because we could not delete the reverse reference.
+func (tx *badgerTransaction) MergeTag(id, intoID uint64) error {
+	return tx.update(func(txn *badger.Txn) error {
+		tag, err := tx.findTag(txn, id)
+		if err != nil {
 			return err
 		}
+		if tag == nil {
+			return tagNotFound(id)
+		}
+		ok, err := tx.exists(txn, tx.tagKey(intoID))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return tagNotFound(intoID)
+		}
+		if id == intoID {
+			return fmt.Errorf("cannot merge tag %d into itself", id)
+		}
 
-		tagToNoteKey := tx.tagNoteKey(tagID, noteID)
-		if err := txn.Set(tagToNoteKey.Bytes(), noteIDBytes); err != nil {
+		noteIDs, err := tx.unlinkTag(txn, id)
+		if err != nil {
+			return err
+		}
+		for _, noteID := range noteIDs {
+			if err := tx.link(txn, noteID, intoID); err != nil {
+				return err
+			}
+		}
+		if err := tx.deleteTag(txn, tag); err != nil {
 			return err
 		}
+		return tx.reindex(txn, noteIDs...)
+	})
+}
 
-		return nil
+func (tx *badgerTransaction) TagNote(noteID, tagID uint64) error {
+	return tx.update(func(txn *badger.Txn) error {
+		ok, err := tx.exists(txn, tx.noteKey(noteID))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return noteNotFound(noteID)
+		}
+		if ok, err = tx.exists(txn, tx.tagKey(tagID)); err != nil {
+			return err
+		}
+		if !ok {
+			return tagNotFound(tagID)
+		}
+		if err := tx.link(txn, noteID, tagID); err != nil {
+			return err
+		}
+		return tx.reindex(txn, noteID)
 	})
-	if err == nil {
-		go tx.updateSearchIndex(noteID)
-	}
-	return err
 }
 
 func (tx *badgerTransaction) UntagNote(noteID, tagID uint64) error {
-	err := tx.db.Update(func(txn *badger.Txn) error {
+	return tx.update(func(txn *badger.Txn) error {
 		noteToTagKey := tx.noteTagKey(noteID, tagID)
 		if err := txn.Delete(noteToTagKey.Bytes()); err != nil {
 			return err
@@ -283,77 +1673,310 @@ func (tx *badgerTransaction) UntagNote(noteID, tagID uint64) error {
 			return err
 		}
 
-		return nil
+		return tx.reindex(txn, noteID)
 	})
-	if err == nil {
-		go tx.updateSearchIndex(noteID)
+}
+
+func (tx *badgerTransaction) findNote(txn *badger.Txn, id uint64) (*Note, error) {
+	note, err := tx.getNote(txn, id)
+	if note == nil || err != nil {
+		return nil, err
+	}
+	if err := tx.withTags(txn, note); err != nil {
+		return nil, err
 	}
-	return err
+	return note, nil
 }
 
-func (tx *badgerTransaction) updateSearchIndex(noteID uint64) {
-	note, err := tx.FindNoteByID(noteID)
-	if err != nil {
-		fmt.Printf("error loading note for index %d: %v", note.ID, err)
+// getNote loads a note without its tags.
+func (tx *badgerTransaction) getNote(txn *badger.Txn, id uint64) (*Note, error) {
+	return tx.loadNote(txn, tx.noteKey(id))
+}
+
+// getTrashedNote loads a note from the trash without its tags.
+func (tx *badgerTransaction) getTrashedNote(txn *badger.Txn, id uint64) (*Note, error) {
+	return tx.loadNote(txn, tx.trashKey(id))
+}
+
+func (tx *badgerTransaction) loadNote(txn *badger.Txn, key badgerKey) (*Note, error) {
+	item, err := txn.Get(key.Bytes())
+	switch err {
+	case nil:
+	case badger.ErrKeyNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	var note *Note
+	err = item.Value(func(bs []byte) (err error) {
+		note, err = decodeNote(bs)
 		return
+	})
+	return note, err
+}
+
+func decodeNote(bs []byte) (*Note, error) {
+	note := new(Note)
+	if err := note.Unmarshal(bs); err != nil {
+		return nil, err
 	}
+	// Notes stored before versioning was introduced are at their first version.
+	if note.Version == 0 {
+		note.Version = 1
+	}
+	return note, nil
+}
 
-	if err = tx.idx.IndexNote(tx.tenantID, note); err != nil {
-		fmt.Printf("Error indexing note %d: %v", note.ID, err)
+// putNote stores a note and its sort keys. Tags are stored as associations
+// rather than as part of the note itself.
+func (tx *badgerTransaction) putNote(txn *badger.Txn, note *Note) error {
+	stored := *note
+	stored.Tags = nil
+	if err := txn.Set(tx.noteKey(note.ID).Bytes(), stored.MustMarshal()); err != nil {
+		return err
+	}
+	for sort := range badgerSortKeyTypes {
+		if err := txn.Set(tx.sortKey(sort, note).Bytes(), nil); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func (tx *badgerTransaction) withTags(note *Note) error {
-	var tagIDs []uint64
-	err := tx.db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchSize = 10
-		it := txn.NewIterator(opts)
-		defer it.Close()
+// deleteSortKeys removes a note from the listing indexes, which must be done
+// before any field that notes are sorted by changes.
+func (tx *badgerTransaction) deleteSortKeys(txn *badger.Txn, note *Note) error {
+	for sort := range badgerSortKeyTypes {
+		if err := txn.Delete(tx.sortKey(sort, note).Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		prefix := tx.noteTagKey(note.ID, 0).Bytes()
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			item := it.Item()
-			err := item.Value(func(bs []byte) error {
-				tagID := binary.BigEndian.Uint64(bs)
-				tagIDs = append(tagIDs, tagID)
-				return nil
-			})
-			if err != nil {
-				return err
-			}
+// purgeNote permanently deletes a trashed note along with its revisions and
+// tag associations.
+func (tx *badgerTransaction) purgeNote(txn *badger.Txn, note *Note) error {
+	if err := tx.deleteRevisions(txn, note.ID, 0); err != nil {
+		return err
+	}
+
+	if err := tx.unlinkNote(txn, note.ID); err != nil {
+		return err
+	}
+	if err := txn.Delete(purgeQueueKey(tx.tenantID, note.ID, *note.DeletedAt).Bytes()); err != nil {
+		return err
+	}
+	return txn.Delete(tx.trashKey(note.ID).Bytes())
+}
+
+// link associates a note with a tag in both directions.
+func (tx *badgerTransaction) link(txn *badger.Txn, noteID, tagID uint64) error {
+	if err := txn.Set(tx.noteTagKey(noteID, tagID).Bytes(), tx.tagKey(tagID).entityKey); err != nil {
+		return err
+	}
+	return txn.Set(tx.tagNoteKey(tagID, noteID).Bytes(), tx.noteKey(noteID).entityKey)
+}
+
+// unlinkNote deletes every association between a note and its tags, in both
+// directions.
+func (tx *badgerTransaction) unlinkNote(txn *badger.Txn, noteID uint64) error {
+	tagIDs, err := tx.assocIDs(txn, tx.noteTagKey(noteID, 0))
+	if err != nil {
+		return err
+	}
+	for _, tagID := range tagIDs {
+		if err := txn.Delete(tx.noteTagKey(noteID, tagID).Bytes()); err != nil {
+			return err
 		}
-		return nil
-	})
+		if err := txn.Delete(tx.tagNoteKey(tagID, noteID).Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unlinkTag deletes every association between a tag and its notes, in both
+// directions, and returns the IDs of the notes that had the tag.
+func (tx *badgerTransaction) unlinkTag(txn *badger.Txn, tagID uint64) ([]uint64, error) {
+	noteIDs, err := tx.assocIDs(txn, tx.tagNoteKey(tagID, 0))
+	if err != nil {
+		return nil, err
+	}
+	for _, noteID := range noteIDs {
+		if err := txn.Delete(tx.tagNoteKey(tagID, noteID).Bytes()); err != nil {
+			return nil, err
+		}
+		if err := txn.Delete(tx.noteTagKey(noteID, tagID).Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	return noteIDs, nil
+}
+
+// assocIDs returns the IDs at the end of every association key under prefix.
+func (tx *badgerTransaction) assocIDs(txn *badger.Txn, prefix badgerKey) ([]uint64, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var ids []uint64
+	p := prefix.Bytes()
+	for it.Seek(p); it.ValidForPrefix(p); it.Next() {
+		key := it.Item().Key()
+		ids = append(ids, binary.BigEndian.Uint64(key[len(key)-8:]))
+	}
+	return ids, nil
+}
+
+func (tx *badgerTransaction) exists(txn *badger.Txn, key badgerKey) (bool, error) {
+	_, err := txn.Get(key.Bytes())
+	switch err {
+	case nil:
+		return true, nil
+	case badger.ErrKeyNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// hasNote reports whether a note exists, in or out of the trash.
+func (tx *badgerTransaction) hasNote(txn *badger.Txn, id uint64) (bool, error) {
+	ok, err := tx.exists(txn, tx.noteKey(id))
+	if err != nil || ok {
+		return ok, err
+	}
+	return tx.exists(txn, tx.trashKey(id))
+}
+
+func (tx *badgerTransaction) findTag(txn *badger.Txn, id uint64) (*Tag, error) {
+	item, err := txn.Get(tx.tagKey(id).Bytes())
+	switch err {
+	case nil:
+	case badger.ErrKeyNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	tag := new(Tag)
+	if err := item.Value(tag.Unmarshal); err != nil {
+		return nil, err
+	}
+	return tag, nil
+}
+
+// claimTagName reserves the tag's name for it, failing if another tag of the
+// tenant has it.
+func (tx *badgerTransaction) claimTagName(txn *badger.Txn, tag *Tag) error {
+	key := tx.tagNameKey(tag.Name)
+	ok, err := tx.exists(txn, key)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return tagExists(tag.Name)
+	}
+	return txn.Set(key.Bytes(), tx.tagKey(tag.ID).entityKey)
+}
+
+// deleteTag deletes a tag that no longer has any associations, along with its
+// name.
+func (tx *badgerTransaction) deleteTag(txn *badger.Txn, tag *Tag) error {
+	if err := txn.Delete(tx.tagNameKey(tag.Name).Bytes()); err != nil {
+		return err
+	}
+	return txn.Delete(tx.tagKey(tag.ID).Bytes())
+}
+
+// addRevision records the current state of note as its next revision and
+// discards any revisions beyond the retention limit.
+func (tx *badgerTransaction) addRevision(txn *badger.Txn, note *Note) error {
+	latest, err := tx.latestRevision(txn, note.ID)
 	if err != nil {
 		return err
 	}
 
-	tagCount := len(tagIDs)
-	if tagCount == 0 {
-		return nil
+	rev := newRevision(note, latest+1)
+	if err := txn.Set(tx.revisionKey(note.ID, rev.Rev).Bytes(), rev.MustMarshal()); err != nil {
+		return err
 	}
 
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-	wg.Add(tagCount)
-	note.Tags = make([]*Tag, tagCount)
-	for i, tagID := range tagIDs {
-		i := i
-		tagID := tagID
-		go func() {
-			var findTagErr error
-			if note.Tags[i], findTagErr = tx.FindTagByID(tagID); findTagErr != nil {
-				mu.Lock()
-				err = findTagErr
-				mu.Unlock()
-			}
-			wg.Done()
-		}()
+	if tx.revisionLimit > 0 && rev.Rev > uint64(tx.revisionLimit) {
+		return tx.deleteRevisions(txn, note.ID, rev.Rev-uint64(tx.revisionLimit))
+	}
+	return nil
+}
+
+// latestRevision returns the number of the newest revision of a note, or 0 if
+// it has none.
+func (tx *badgerTransaction) latestRevision(txn *badger.Txn, noteID uint64) (uint64, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Reverse = true
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	prefix := tx.revisionKey(noteID, 0).Bytes()
+	// Seek past the last possible revision so that the reverse iterator lands
+	// on the newest one.
+	seek := append(append([]byte(nil), prefix...), 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+	it.Seek(seek)
+	if !it.ValidForPrefix(prefix) {
+		return 0, nil
+	}
+	key := it.Item().Key()
+	return binary.BigEndian.Uint64(key[len(key)-8:]), nil
+}
+
+// deleteRevisions deletes every revision of a note up to and including
+// upTo. If upTo is 0, all revisions are deleted.
+func (tx *badgerTransaction) deleteRevisions(txn *badger.Txn, noteID, upTo uint64) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+
+	var keys [][]byte
+	prefix := tx.revisionKey(noteID, 0).Bytes()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		key := it.Item().KeyCopy(nil)
+		if upTo > 0 && binary.BigEndian.Uint64(key[len(key)-8:]) > upTo {
+			break
+		}
+		keys = append(keys, key)
+	}
+	it.Close()
+
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *badgerTransaction) withTags(txn *badger.Txn, note *Note) error {
+	tagIDs, err := tx.assocIDs(txn, tx.noteTagKey(note.ID, 0))
+	if err != nil {
+		return err
+	}
+
+	for _, tagID := range tagIDs {
+		tag, err := tx.findTag(txn, tagID)
+		if err != nil {
+			return err
+		}
+		// Associations left behind by tags deleted before deletes cascaded
+		// are skipped rather than returned as nil tags.
+		if tag != nil {
+			note.Tags = append(note.Tags, tag)
+		}
 	}
-	wg.Wait()
 
-	return err
+	return nil
 }
 
 func (tx *badgerTransaction) noteKey(id uint64) badgerKey {
@@ -384,6 +2007,177 @@ func (tx *badgerTransaction) tagKey(id uint64) badgerKey {
 	return key
 }
 
+// tagNameKey maps a tag's name to its ID, which keeps names unique within a
+// tenant.
+func (tx *badgerTransaction) tagNameKey(name string) badgerKey {
+	return badgerKey{
+		tenantID:   tx.tenantID,
+		entityType: "tname",
+		entityKey:  []byte(name),
+	}
+}
+
+// trashKey is where a note is stored while it is in the trash.
+func (tx *badgerTransaction) trashKey(id uint64) badgerKey {
+	key := badgerKey{
+		tenantID:   tx.tenantID,
+		entityType: "d",
+	}
+	if id > 0 {
+		entityID := make([]byte, 8)
+		binary.BigEndian.PutUint64(entityID, id)
+		key.entityKey = entityID
+	}
+
+	return key
+}
+
+// purgeQueueKey indexes trashed notes of every tenant by the time they were
+// deleted, so that expired notes can be found without scanning each tenant.
+func purgeQueueKey(tenantID string, noteID uint64, deletedAt time.Time) badgerKey {
+	var buf bytes.Buffer
+	buf.Grow(16 + len(tenantID))
+
+	entityID := make([]byte, 8)
+	binary.BigEndian.PutUint64(entityID, uint64(deletedAt.UnixNano()))
+	_, _ = buf.Write(entityID)
+	binary.BigEndian.PutUint64(entityID, noteID)
+	_, _ = buf.Write(entityID)
+	_, _ = buf.WriteString(tenantID)
+
+	return badgerKey{
+		entityType: "dt",
+		entityKey:  buf.Bytes(),
+	}
+}
+
+// indexJobKey orders the index queue of every tenant by job sequence number.
+func indexJobKey(seq uint64) badgerKey {
+	key := badgerKey{entityType: "iq"}
+	if seq > 0 {
+		key.entityKey = make([]byte, 8)
+		binary.BigEndian.PutUint64(key.entityKey, seq)
+	}
+	return key
+}
+
+// tenantKey is where the registry keeps a tenant, outside of every tenant's
+// own keys.
+func tenantKey(id string) badgerKey {
+	return badgerKey{
+		entityType: "tenant",
+		entityKey:  []byte(id),
+	}
+}
+
+// userKey is where a user is kept. Users are global, like tenants, so that
+// they can sign in without naming their tenant.
+func userKey(id string) badgerKey {
+	return badgerKey{
+		entityType: "user",
+		entityKey:  []byte(id),
+	}
+}
+
+// userEmailKey maps an email to the ID of its user, which keeps emails
+// unique.
+func userEmailKey(email string) badgerKey {
+	return badgerKey{
+		entityType: "uemail",
+		entityKey:  []byte(email),
+	}
+}
+
+// tenantUserKey lists the users of a tenant by ID. An empty userID gives the
+// prefix of every such key of the tenant.
+func tenantUserKey(tenantID, userID string) badgerKey {
+	return badgerKey{
+		entityType: "tuser",
+		entityKey:  append([]byte(tenantID+string(KEY_SEP)), userID...),
+	}
+}
+
+// sessionKey is where a session is kept, under the hash of its refresh
+// token.
+func sessionKey(id string) badgerKey {
+	return badgerKey{
+		entityType: "session",
+		entityKey:  []byte(id),
+	}
+}
+
+// userSessionKey lists the sessions of a user by ID, so that they can be
+// deleted with the user. An empty sessionID gives the prefix of every such
+// key of the user.
+func userSessionKey(userID, sessionID string) badgerKey {
+	return badgerKey{
+		entityType: "usession",
+		entityKey:  append([]byte(userID+string(KEY_SEP)), sessionID...),
+	}
+}
+
+// apiKeyKey is where an API key is kept. Keys are global, like users, so
+// that a request can be matched to its key before its tenant is known.
+func apiKeyKey(id string) badgerKey {
+	return badgerKey{
+		entityType: "apikey",
+		entityKey:  []byte(id),
+	}
+}
+
+// apiKeyHashKey maps the hash of an API key's token to the key's ID.
+func apiKeyHashKey(hash string) badgerKey {
+	return badgerKey{
+		entityType: "apikeyhash",
+		entityKey:  []byte(hash),
+	}
+}
+
+// tenantAPIKeyKey lists the API keys of a tenant by ID. An empty keyID gives
+// the prefix of every such key of the tenant.
+func tenantAPIKeyKey(tenantID, keyID string) badgerKey {
+	return badgerKey{
+		entityType: "tapikey",
+		entityKey:  append([]byte(tenantID+string(KEY_SEP)), keyID...),
+	}
+}
+
+// badgerSortKeyTypes holds the entity type of the index for each order that
+// notes can be listed in. Only notes that are not in the trash are indexed.
+var badgerSortKeyTypes = map[NoteSort]string{
+	SortByCreatedAt: "nc",
+	SortByUpdatedAt: "nu",
+	SortByTitle:     "ns",
+}
+
+// sortKey is a note's key in the index for the given order. Keys sort by the
+// field and then by note ID.
+func (tx *badgerTransaction) sortKey(sort NoteSort, note *Note) badgerKey {
+	var buf bytes.Buffer
+	buf.Grow(16)
+
+	field := make([]byte, 8)
+	switch sort {
+	case SortByCreatedAt:
+		binary.BigEndian.PutUint64(field, uint64(note.CreatedAt.UnixNano()))
+		_, _ = buf.Write(field)
+	case SortByUpdatedAt:
+		binary.BigEndian.PutUint64(field, uint64(note.UpdatedAt.UnixNano()))
+		_, _ = buf.Write(field)
+	case SortByTitle:
+		_, _ = buf.WriteString(titleSortKey(note.Title))
+		_ = buf.WriteByte(KEY_SEP)
+	}
+	binary.BigEndian.PutUint64(field, note.ID)
+	_, _ = buf.Write(field)
+
+	return badgerKey{
+		tenantID:   tx.tenantID,
+		entityType: badgerSortKeyTypes[sort],
+		entityKey:  buf.Bytes(),
+	}
+}
+
 func (tx *badgerTransaction) noteTagKey(noteID, tagID uint64) badgerKey {
 	return tx.assocKey("nt", noteID, tagID)
 }
@@ -392,6 +2186,10 @@ func (tx *badgerTransaction) tagNoteKey(tagID, noteID uint64) badgerKey {
 	return tx.assocKey("tn", tagID, noteID)
 }
 
+func (tx *badgerTransaction) revisionKey(noteID, rev uint64) badgerKey {
+	return tx.assocKey("r", noteID, rev)
+}
+
 func (tx *badgerTransaction) assocKey(joinType string, idA, idB uint64) badgerKey {
 	var idBuf bytes.Buffer
 	idBuf.Grow(16)
@@ -3,42 +3,128 @@ package note
 import (
 	"errors"
 	"fmt"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/custom"
 	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
-	"github.com/blevesearch/bleve/analysis/lang/en"
+	"github.com/blevesearch/bleve/analysis/token/edgengram"
+	"github.com/blevesearch/bleve/analysis/token/lowercase"
+	"github.com/blevesearch/bleve/analysis/tokenizer/unicode"
+	"github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/highlight/highlighter/html"
 	"github.com/blevesearch/bleve/search/query"
 )
 
+// bleveMappingVersion identifies the mapping that initIndex builds. Bump it
+// whenever the mapping changes, so that indexes built with the old mapping
+// are detected when they are opened.
+const bleveMappingVersion = 6
+
+var bleveMappingVersionKey = []byte("mappingVersion")
+
+// ErrStaleIndex is matched by the error returned when a search index was built
+// with a different mapping than the current one. Such an index has to be
+// rebuilt with RebuildBleveIndex.
+var ErrStaleIndex = errors.New("search index was built with a different mapping")
+
+// NewBleveSearchindex opens the index at c.BleveIndexPath, creating an empty
+// one if there is none. It returns an error matching ErrStaleIndex if the
+// index was built with a different mapping.
 func NewBleveSearchindex(c SearchIndexConfig) (*BleveSearchIndex, error) {
-	idx, err := bleve.Open(c.BleveIndexPath)
+	if err := checkLanguages(c.Languages); err != nil {
+		return nil, err
+	}
+	path := c.BleveIndexPath
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		// Finish backing out of a swap that was interrupted.
+		if err := os.Rename(path+".old", path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	idx, err := bleve.Open(path)
 	if err == bleve.ErrorIndexPathDoesNotExist {
-		idx, err = initIndex(c)
+		idx, err = initIndex(path)
 	}
 	if err != nil {
 		return nil, err
 	}
 
+	version, err := mappingVersion(idx)
+	if err == nil && version != bleveMappingVersion {
+		err = fmt.Errorf("%w: %q has mapping version %d, want %d",
+			ErrStaleIndex, path, version, bleveMappingVersion)
+	}
+	if err != nil {
+		idx.Close()
+		return nil, err
+	}
+
 	return &BleveSearchIndex{
-		idx: idx,
+		idx:       idx,
+		languages: c.Languages,
 	}, nil
 }
 
+func checkLanguages(languages map[string]string) error {
+	for tenantID, lang := range languages {
+		if languageAnalyzers[lang] == "" {
+			return fmt.Errorf("unsupported search language %q for tenant %q", lang, tenantID)
+		}
+	}
+	return nil
+}
+
+// mappingVersion reads the mapping version that an index was built with.
+// Indexes built before the version was recorded used version 1.
+func mappingVersion(idx bleve.Index) (int, error) {
+	bs, err := idx.GetInternal(bleveMappingVersionKey)
+	if err != nil || bs == nil {
+		return 1, err
+	}
+	return strconv.Atoi(string(bs))
+}
+
 type BleveSearchIndex struct {
 	idx bleve.Index
+	// languages maps tenant IDs to the language of their notes.
+	languages map[string]string
+}
+
+func (i *BleveSearchIndex) Close() error {
+	return i.idx.Close()
 }
 
+// searchDocument is indexed with the mapping for its language, which
+// analyzes its title and content in that language.
 type searchDocument struct {
 	TenantID string `json:"tenantId"`
+	Language string `json:"language"`
 	Note     *Note  `json:"note"`
 }
 
-func (i *BleveSearchIndex) IndexNote(tenantID string, note *Note) error {
-	return i.idx.Index(stringID(note.ID), searchDocument{
+func (d searchDocument) BleveType() string {
+	return documentType(d.Language)
+}
+
+func documentType(lang string) string {
+	return "doc_" + lang
+}
+
+func (i *BleveSearchIndex) document(tenantID string, note *Note) searchDocument {
+	return searchDocument{
 		TenantID: tenantID,
+		Language: noteLanguage(i.languages, tenantID, note),
 		Note:     note,
-	})
+	}
+}
+
+func (i *BleveSearchIndex) IndexNote(tenantID string, note *Note) error {
+	return i.idx.Index(stringID(note.ID), i.document(tenantID, note))
 }
 
 func (i *BleveSearchIndex) RemoveNote(tenantID string, id uint64) error {
@@ -53,31 +139,194 @@ func (i *BleveSearchIndex) RemoveNote(tenantID string, id uint64) error {
 		return fmt.Errorf("error checking for document: %w", err)
 	}
 	if res.Total != 1 {
-		return errors.New("document not found in search index")
+		return errNotIndexed
 	}
 
 	return i.idx.Delete(stringID(id))
 }
 
-func (i *BleveSearchIndex) Search(tenantID string, query string) ([]uint64, error) {
+// Search suggests a corrected query if a query finds nothing.
+func (i *BleveSearchIndex) Search(tenantID string, r SearchRequest) (*SearchResult, error) {
+	expr, err := parseSearchQuery(r.Query)
+	if err != nil {
+		return nil, err
+	}
+	if expr == nil {
+		return &SearchResult{Hits: make([]*SearchHit, 0)}, nil
+	}
+
+	res, err := i.search(tenantID, expr, r)
+	if err == nil && res.Total == 0 {
+		res.DidYouMean, err = i.didYouMean(tenantID, r.Query)
+	}
+	return res, err
+}
+
+func (i *BleveSearchIndex) search(tenantID string, expr searchExpr, r SearchRequest) (*SearchResult, error) {
 	q := bleve.NewBooleanQuery()
-	q.AddMust(bleve.NewMatchQuery(query))
+	q.AddMust(languageQuery(expr))
 	q.AddMust(tenantTermQuery(tenantID))
-	req := bleve.NewSearchRequest(q)
+	req := bleve.NewSearchRequestOptions(q, r.size(), r.From, false)
+	req.Highlight = bleve.NewHighlightWithStyle(html.Name)
+	req.Highlight.AddField("note.title")
+	req.Highlight.AddField("note.content")
+	req.AddFacet("tags", bleve.NewFacetRequest("note.tags.name", searchTagFacetSize))
+	ranges := dateFacetRanges(time.Now())
+	for _, field := range []string{"createdAt", "updatedAt"} {
+		f := bleve.NewFacetRequest("note."+field, len(ranges))
+		for _, r := range ranges {
+			f.AddDateTimeRange(r.name, r.start, r.end)
+		}
+		req.AddFacet(field, f)
+	}
 	res, err := i.idx.Search(req)
 	if err != nil {
 		return nil, err
 	}
 
-	hits := res.Hits
-	ids := make([]uint64, len(hits))
-	for i, hit := range hits {
-		if ids[i], err = numID(hit.ID); err != nil {
+	result := &SearchResult{
+		Total:  res.Total,
+		Hits:   make([]*SearchHit, len(res.Hits)),
+		Facets: &SearchFacets{Tags: make([]*FacetCount, 0)},
+	}
+	if tags := res.Facets["tags"]; tags != nil {
+		for _, term := range tags.Terms {
+			result.Facets.Tags = append(result.Facets.Tags, &FacetCount{
+				Value:  term.Term,
+				Count:  term.Count,
+				Filter: tagFilter(term.Term),
+			})
+		}
+	}
+	result.Facets.Created = dateFacets(res.Facets["createdAt"], ranges, "created")
+	result.Facets.Updated = dateFacets(res.Facets["updatedAt"], ranges, "updated")
+
+	for j, hit := range res.Hits {
+		id, err := numID(hit.ID)
+		if err != nil {
 			return nil, err
 		}
+		result.Hits[j] = &SearchHit{
+			NoteID:     id,
+			Score:      hit.Score,
+			Highlights: highlights(hit.Fragments),
+		}
 	}
 
-	return ids, nil
+	return result, nil
+}
+
+// dateFacets orders the counts of date ranges as the ranges are ordered, and
+// leaves out empty ranges.
+func dateFacets(res *search.FacetResult, ranges []dateFacetRange, field string) []*FacetCount {
+	counts := make(map[string]int)
+	if res != nil {
+		for _, r := range res.DateRanges {
+			counts[r.Name] = r.Count
+		}
+	}
+	facets := make([]*FacetCount, 0, len(ranges))
+	for _, r := range ranges {
+		if counts[r.name] > 0 {
+			facets = append(facets, &FacetCount{
+				Value:  r.name,
+				Count:  counts[r.name],
+				Filter: r.filter(field),
+			})
+		}
+	}
+	return facets
+}
+
+// highlights renames the fragments of a hit from the fields of the search
+// document to those of a note. Bleve returns the start of a field that did not
+// match, which is left out.
+func highlights(fragments map[string][]string) map[string][]string {
+	var h map[string][]string
+	for field, frags := range fragments {
+		var marked []string
+		for _, frag := range frags {
+			if strings.Contains(frag, "<mark>") {
+				marked = append(marked, frag)
+			}
+		}
+		if len(marked) == 0 {
+			continue
+		}
+		if h == nil {
+			h = make(map[string][]string)
+		}
+		h[strings.TrimPrefix(field, "note.")] = marked
+	}
+	return h
+}
+
+// languageQuery compiles a parsed search query once for each language, so
+// that the documents in each language are searched for the query's words as
+// analyzed in that language.
+func languageQuery(expr searchExpr) query.Query {
+	q := bleve.NewDisjunctionQuery()
+	for _, lang := range searchLanguages() {
+		langTerm := bleve.NewTermQuery(lang)
+		langTerm.SetField("language")
+		q.AddQuery(bleve.NewConjunctionQuery(langTerm, bleveQuery(expr, languageAnalyzers[lang])))
+	}
+	return q
+}
+
+// bleveQuery compiles a parsed search query, analyzing its words with
+// analyzer. Bare words and phrases match the title, content or tags of a
+// note.
+func bleveQuery(expr searchExpr, analyzer string) query.Query {
+	switch e := expr.(type) {
+	case termExpr:
+		switch {
+		case e.field == "tag":
+			q := bleve.NewTermQuery(e.text)
+			q.SetField("note.tags.name")
+			return q
+		case e.phrase && e.field == "":
+			return bleve.NewDisjunctionQuery(
+				bleveQuery(termExpr{field: "title", text: e.text, phrase: true}, analyzer),
+				bleveQuery(termExpr{field: "content", text: e.text, phrase: true}, analyzer),
+				bleveQuery(termExpr{field: "tag", text: e.text}, analyzer),
+			)
+		case e.phrase:
+			q := bleve.NewMatchPhraseQuery(e.text)
+			q.SetField("note." + e.field)
+			q.Analyzer = analyzer
+			return q
+		}
+		q := bleve.NewMatchQuery(e.text)
+		q.SetOperator(query.MatchQueryOperatorAnd)
+		q.Analyzer = analyzer
+		if e.field != "" {
+			q.SetField("note." + e.field)
+		}
+		return q
+	case timeRangeExpr:
+		q := bleve.NewDateRangeInclusiveQuery(e.start, e.end, &e.startInclusive, &e.endInclusive)
+		q.SetField("note." + e.field)
+		return q
+	case notExpr:
+		q := bleve.NewBooleanQuery()
+		q.AddMust(bleve.NewMatchAllQuery())
+		q.AddMustNot(bleveQuery(e.expr, analyzer))
+		return q
+	case andExpr:
+		q := bleve.NewConjunctionQuery()
+		for _, expr := range e {
+			q.AddQuery(bleveQuery(expr, analyzer))
+		}
+		return q
+	case orExpr:
+		q := bleve.NewDisjunctionQuery()
+		for _, expr := range e {
+			q.AddQuery(bleveQuery(expr, analyzer))
+		}
+		return q
+	}
+	panic(fmt.Sprintf("unexpected search expression %T", expr))
 }
 
 func tenantTermQuery(tenantID string) *query.TermQuery {
@@ -95,33 +344,109 @@ func numID(id string) (uint64, error) {
 	return strconv.ParseUint(id, 10, 64)
 }
 
-func initIndex(c SearchIndexConfig) (bleve.Index, error) {
-	textFM := bleve.NewTextFieldMapping()
-	textFM.Analyzer = en.AnalyzerName
-	textFM.Store = false
+const (
+	// prefixesAnalyzer splits text into lower-case words and indexes every
+	// prefix of each word of up to maxPrefixLength letters.
+	prefixesAnalyzer = "prefixes"
+	maxPrefixLength  = 20
+	// wordsAnalyzer splits text into lower-case words.
+	wordsAnalyzer = "words"
+)
 
+func initIndex(path string) (bleve.Index, error) {
 	keywordFM := bleve.NewTextFieldMapping()
 	keywordFM.Analyzer = keyword.Name
 	keywordFM.Store = false
 
-	tagMapping := bleve.NewDocumentMapping()
-	tagMapping.AddFieldMappingsAt("name", keywordFM)
+	// Titles and tag names are also indexed by the prefixes of their words
+	// for suggestions, and titles and content by their unstemmed words for
+	// correcting misspelt queries.
+	prefixesFM := bleve.NewTextFieldMapping()
+	prefixesFM.Analyzer = prefixesAnalyzer
+	prefixesFM.Store = false
+	prefixesFM.IncludeInAll = false
+	titlePrefixesFM, tagPrefixesFM := *prefixesFM, *prefixesFM
+	titlePrefixesFM.Name = "titlePrefixes"
+	tagPrefixesFM.Name = "namePrefixes"
+
+	wordsFM := bleve.NewTextFieldMapping()
+	wordsFM.Name = "words"
+	wordsFM.Analyzer = wordsAnalyzer
+	wordsFM.Store = false
+	wordsFM.IncludeInAll = false
+	wordsFM.IncludeTermVectors = true
 
-	noteMapping := bleve.NewDocumentMapping()
-	noteMapping.AddFieldMappingsAt("title", textFM)
-	noteMapping.AddFieldMappingsAt("content", textFM)
-	noteMapping.AddSubDocumentMapping("tags", tagMapping)
+	dateFM := bleve.NewDateTimeFieldMapping()
+	dateFM.Store = false
+	dateFM.IncludeInAll = false
+	// UpdatedAt is stored so that documents can be checked against the
+	// repository.
+	storedDateFM := *dateFM
+	storedDateFM.Store = true
 
-	docMapping := bleve.NewDocumentMapping()
-	docMapping.AddFieldMappingsAt("tenantId", keywordFM)
-	docMapping.AddSubDocumentMapping("note", noteMapping)
+	tagMapping := bleve.NewDocumentMapping()
+	tagMapping.AddFieldMappingsAt("name", keywordFM, &tagPrefixesFM)
 
 	indexMapping := bleve.NewIndexMapping()
-	indexMapping.AddDocumentMapping("doc", docMapping)
-	indexMapping.DefaultType = "doc"
-	indexMapping.DefaultAnalyzer = "en"
+
+	// Each language has a document type whose mapping differs only in the
+	// analyzer of titles and content, which are stored with term vectors so
+	// that hits can be highlighted.
+	for _, lang := range searchLanguages() {
+		textFM := bleve.NewTextFieldMapping()
+		textFM.Analyzer = languageAnalyzers[lang]
+		textFM.Store = true
+		textFM.IncludeTermVectors = true
+
+		noteMapping := bleve.NewDocumentMapping()
+		noteMapping.AddFieldMappingsAt("title", textFM, &titlePrefixesFM, wordsFM)
+		noteMapping.AddFieldMappingsAt("content", textFM, wordsFM)
+		noteMapping.AddFieldMappingsAt("createdAt", dateFM)
+		noteMapping.AddFieldMappingsAt("updatedAt", &storedDateFM)
+		noteMapping.AddSubDocumentMapping("tags", tagMapping)
+
+		docMapping := bleve.NewDocumentMapping()
+		docMapping.AddFieldMappingsAt("tenantId", keywordFM)
+		docMapping.AddFieldMappingsAt("language", keywordFM)
+		docMapping.AddSubDocumentMapping("note", noteMapping)
+		indexMapping.AddDocumentMapping(documentType(lang), docMapping)
+	}
+
+	err := indexMapping.AddCustomTokenFilter("prefixes", map[string]interface{}{
+		"type": edgengram.Name,
+		"min":  1.0,
+		"max":  float64(maxPrefixLength),
+	})
+	if err == nil {
+		err = indexMapping.AddCustomAnalyzer(prefixesAnalyzer, map[string]interface{}{
+			"type":          custom.Name,
+			"tokenizer":     unicode.Name,
+			"token_filters": []string{lowercase.Name, "prefixes"},
+		})
+	}
+	if err == nil {
+		err = indexMapping.AddCustomAnalyzer(wordsAnalyzer, map[string]interface{}{
+			"type":          custom.Name,
+			"tokenizer":     unicode.Name,
+			"token_filters": []string{lowercase.Name},
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	indexMapping.DefaultType = documentType(defaultLanguage)
+	indexMapping.DefaultAnalyzer = languageAnalyzers[defaultLanguage]
 	indexMapping.IndexDynamic = false
 	indexMapping.StoreDynamic = false
 
-	return bleve.New(c.BleveIndexPath, indexMapping)
+	idx, err := bleve.New(path, indexMapping)
+	if err != nil {
+		return nil, err
+	}
+	version := []byte(strconv.Itoa(bleveMappingVersion))
+	if err := idx.SetInternal(bleveMappingVersionKey, version); err != nil {
+		idx.Close()
+		return nil, err
+	}
+	return idx, nil
 }
@@ -1,10 +1,14 @@
 package note
 
 import (
+	"errors"
+	"fmt"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBleveSearchIndex(t *testing.T) {
@@ -14,8 +18,15 @@ func TestBleveSearchIndex(t *testing.T) {
 		BleveIndexPath: file,
 	})
 	assert.NoError(t, err)
+	defer idx.Close()
 
-	err = idx.IndexNote("tenant1", &Note{
+	testSearchIndex(t, idx)
+}
+
+// testSearchIndex checks that notes are found by their words and tags, and
+// only by their own tenant.
+func testSearchIndex(t *testing.T, idx SearchIndex) {
+	err := idx.IndexNote("tenant1", &Note{
 		ID:      123,
 		Title:   "Taco Tuesday",
 		Content: "Every day is a great day to eat tacos!",
@@ -39,31 +50,550 @@ func TestBleveSearchIndex(t *testing.T) {
 	})
 	assert.NoError(t, err)
 
-	notes, err := idx.Search("tenant1", "tuesday")
+	notes, err := searchIDs(idx, "tenant1", "tuesday")
 	assert.NoError(t, err)
 	assert.Len(t, notes, 2)
 	assert.Contains(t, notes, uint64(123))
 	assert.Contains(t, notes, uint64(345))
 
-	notes, err = idx.Search("tenant1", "Tacos")
+	notes, err = searchIDs(idx, "tenant1", "Tacos")
 	assert.NoError(t, err)
 	assert.Len(t, notes, 2)
 	assert.Contains(t, notes, uint64(123))
 	assert.Contains(t, notes, uint64(234))
 
-	notes, err = idx.Search("other-tenant", "Tacos")
+	notes, err = searchIDs(idx, "other-tenant", "Tacos")
 	assert.NoError(t, err)
 	assert.Empty(t, notes, "should not get notes for another tenant")
 
 	err = idx.RemoveNote("tenant1", 123)
 	assert.NoError(t, err)
 
-	notes, err = idx.Search("tenant1", "tacos")
+	notes, err = searchIDs(idx, "tenant1", "tacos")
 	assert.NoError(t, err)
 	assert.Equal(t, []uint64{234}, notes, "should not return deleted notes")
 
-	notes, err = idx.Search("tenant1", "List")
+	notes, err = searchIDs(idx, "tenant1", "List")
 	assert.NoError(t, err)
 	assert.Len(t, notes, 1)
 	assert.Contains(t, notes, uint64(234), "should match tags")
 }
+
+func TestBleveSearchResults(t *testing.T) {
+	idx, err := NewBleveSearchindex(SearchIndexConfig{
+		BleveIndexPath: path.Join(t.TempDir(), "index.bleve"),
+	})
+	require.NoError(t, err)
+	defer idx.Close()
+
+	testSearchResults(t, idx)
+}
+
+// testSearchResults checks the scores, highlights and paging of search
+// results.
+func testSearchResults(t *testing.T, idx SearchIndex) {
+	require.NoError(t, idx.IndexNote("tenant1", &Note{
+		ID:      1,
+		Title:   "Tacos",
+		Content: "Tacos <b>tacos</b> tacos, all day long.",
+	}))
+	for id := uint64(2); id <= 5; id++ {
+		require.NoError(t, idx.IndexNote("tenant1", &Note{
+			ID:      id,
+			Title:   fmt.Sprintf("Groceries %d", id),
+			Content: "Buy eggs, milk and something for tacos.",
+		}))
+	}
+	require.NoError(t, idx.IndexNote("tenant2", &Note{ID: 6, Title: "Tacos"}))
+
+	res, err := idx.Search("tenant1", SearchRequest{Query: "tacos", Size: 2})
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, res.Total, "should count every hit")
+	require.Len(t, res.Hits, 2, "should return one page")
+	assert.Equal(t, uint64(1), res.Hits[0].NoteID, "should put the best match first")
+	assert.Greater(t, res.Hits[0].Score, res.Hits[1].Score)
+	assert.Equal(t, []string{"<mark>Tacos</mark>"}, res.Hits[0].Highlights["title"])
+	require.Len(t, res.Hits[0].Highlights["content"], 1)
+	assert.Contains(t, res.Hits[0].Highlights["content"][0], "&lt;b&gt;<mark>tacos</mark>&lt;/b&gt;",
+		"should escape the note's text")
+	assert.NotContains(t, res.Hits[1].Highlights, "title", "should only highlight fields that matched")
+
+	seen := map[uint64]bool{}
+	for from := 0; from < 5; from += 2 {
+		res, err := idx.Search("tenant1", SearchRequest{Query: "tacos", From: from, Size: 2})
+		require.NoError(t, err)
+		for _, id := range res.IDs() {
+			assert.False(t, seen[id], "should not repeat hit %d", id)
+			seen[id] = true
+		}
+	}
+	assert.Len(t, seen, 5, "should page through every hit")
+
+	res, err = idx.Search("tenant1", SearchRequest{Query: "tacos", From: 5})
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, res.Total)
+	assert.Empty(t, res.Hits)
+}
+
+func TestBleveSearchQueryLanguage(t *testing.T) {
+	idx, err := NewBleveSearchindex(SearchIndexConfig{
+		BleveIndexPath: path.Join(t.TempDir(), "index.bleve"),
+	})
+	require.NoError(t, err)
+	defer idx.Close()
+
+	testSearchQueryLanguage(t, idx)
+}
+
+// testSearchQueryLanguage checks every construct of the query language.
+func testSearchQueryLanguage(t *testing.T, idx SearchIndex) {
+	for _, n := range queryLanguageNotes() {
+		require.NoError(t, idx.IndexNote("tenant1", n))
+	}
+	require.NoError(t, idx.IndexNote("tenant2", &Note{
+		ID:    99,
+		Title: "Weekly meeting",
+		Tags:  []*Tag{{ID: 1, Name: "work"}},
+	}))
+
+	tests := []struct {
+		query string
+		want  []uint64
+	}{
+		{"tag:work title:meeting updated:>2024-01-01 -draft", []uint64{1}},
+		{"meeting", []uint64{1, 2, 3}},
+		{"weekly meeting", []uint64{1}},
+		{"title:meeting", []uint64{1, 2}},
+		{"title:weekly-meeting", []uint64{1}},
+		{"content:agenda", []uint64{1, 2}},
+		{`"weekly meeting"`, []uint64{1}},
+		{`"meeting weekly"`, []uint64{}},
+		{"tag:work", []uint64{1, 2}},
+		{`tag:"work stuff"`, []uint64{4}},
+		{"tag:Work", []uint64{}},
+		{"-draft", []uint64{1, 3, 4}},
+		{"NOT title:meeting", []uint64{3, 4}},
+		{"eggs OR tacos", []uint64{3, 4}},
+		{"(eggs OR tacos) -tacos", []uint64{3}},
+		{"updated:<2024-01-01", []uint64{3}},
+		{"updated:2024-02-01", []uint64{1, 2}},
+		{"updated:>=2024-02-01T12:00:00Z", []uint64{1, 4}},
+		{"created:>2024-02-01", []uint64{4}},
+	}
+	for _, tt := range tests {
+		res, err := idx.Search("tenant1", SearchRequest{Query: tt.query, Size: 10})
+		if assert.NoError(t, err, "query %q", tt.query) {
+			assert.ElementsMatch(t, tt.want, res.IDs(), "query %q", tt.query)
+		}
+	}
+
+	_, err := idx.Search("tenant1", SearchRequest{Query: "title:(meeting"})
+	assert.True(t, errors.Is(err, ErrInvalidQuery), "should reject invalid queries, got %v", err)
+}
+
+func TestBleveSearchFacets(t *testing.T) {
+	idx, err := NewBleveSearchindex(SearchIndexConfig{
+		BleveIndexPath: path.Join(t.TempDir(), "index.bleve"),
+	})
+	require.NoError(t, err)
+	defer idx.Close()
+
+	testSearchFacets(t, idx)
+}
+
+// testSearchFacets checks that facets count every hit of the tenant, and that
+// their filters select the hits they count.
+func testSearchFacets(t *testing.T, idx SearchIndex) {
+	now := time.Now()
+	work := &Tag{ID: 1, Name: "work"}
+	quoted := &Tag{ID: 2, Name: `say "hi"`}
+	notes := []*Note{
+		{ID: 1, Title: "Tacos", Tags: []*Tag{work, quoted}, CreatedAt: now.AddDate(-2, 0, 0), UpdatedAt: now},
+		{ID: 2, Title: "Tacos", Tags: []*Tag{work}, CreatedAt: now.AddDate(0, 0, -3), UpdatedAt: now.AddDate(0, 0, -3)},
+		{ID: 3, Title: "Tacos", CreatedAt: now.AddDate(0, -2, 0), UpdatedAt: now.AddDate(0, -2, 0)},
+		{ID: 4, Title: "Burritos", Tags: []*Tag{work}, CreatedAt: now, UpdatedAt: now},
+	}
+	for _, n := range notes {
+		require.NoError(t, idx.IndexNote("tenant1", n))
+	}
+	require.NoError(t, idx.IndexNote("tenant2", &Note{
+		ID: 5, Title: "Tacos", Tags: []*Tag{work}, CreatedAt: now, UpdatedAt: now,
+	}))
+
+	res, err := idx.Search("tenant1", SearchRequest{Query: "tacos", Size: 1})
+	require.NoError(t, err)
+	require.NotNil(t, res.Facets)
+	assert.Equal(t, []*FacetCount{
+		{Value: "work", Count: 2, Filter: `tag:"work"`},
+		{Value: `say "hi"`, Count: 1, Filter: `tag:"say \"hi\""`},
+	}, res.Facets.Tags, "should count every hit of the tenant by tag")
+
+	values := func(facets []*FacetCount) map[string]int {
+		counts := make(map[string]int)
+		for _, f := range facets {
+			counts[f.Value] = f.Count
+		}
+		return counts
+	}
+	assert.Equal(t, map[string]int{"week": 1, "month": 1, "year": 2, "older": 1}, values(res.Facets.Created))
+	assert.Equal(t, map[string]int{"today": 1, "week": 2, "month": 2, "year": 3}, values(res.Facets.Updated))
+	assert.Equal(t, "older", res.Facets.Created[len(res.Facets.Created)-1].Value, "should order dates from most recent")
+
+	for _, facets := range [][]*FacetCount{res.Facets.Tags, res.Facets.Created, res.Facets.Updated} {
+		for _, f := range facets {
+			filtered, err := idx.Search("tenant1", SearchRequest{Query: "tacos " + f.Filter})
+			require.NoError(t, err, "filter %q", f.Filter)
+			assert.EqualValues(t, f.Count, filtered.Total, "filter %q should select the hits it counts", f.Filter)
+		}
+	}
+}
+
+// queryLanguageNotes returns notes for testing the search query language.
+func queryLanguageNotes() []*Note {
+	at := func(s string) time.Time {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	work := &Tag{ID: 1, Name: "work"}
+	return []*Note{
+		{
+			ID:        1,
+			Title:     "Weekly meeting",
+			Content:   "Agenda for the team",
+			Tags:      []*Tag{work},
+			CreatedAt: at("2024-02-01T08:00:00Z"),
+			UpdatedAt: at("2024-02-01T12:00:00Z"),
+		},
+		{
+			ID:        2,
+			Title:     "Meeting notes",
+			Content:   "Draft agenda",
+			Tags:      []*Tag{work},
+			CreatedAt: at("2024-02-01T08:00:00Z"),
+			UpdatedAt: at("2024-02-01T09:00:00Z"),
+		},
+		{
+			ID:        3,
+			Title:     "Shopping",
+			Content:   "Eggs and milk for the meeting snacks",
+			Tags:      []*Tag{{ID: 2, Name: "home"}},
+			CreatedAt: at("2023-12-01T08:00:00Z"),
+			UpdatedAt: at("2023-12-01T08:00:00Z"),
+		},
+		{
+			ID:        4,
+			Title:     "Team lunch",
+			Content:   "Tacos",
+			Tags:      []*Tag{{ID: 3, Name: "work stuff"}},
+			CreatedAt: at("2024-03-01T08:00:00Z"),
+			UpdatedAt: at("2024-03-01T08:00:00Z"),
+		},
+	}
+}
+
+func TestBleveSuggest(t *testing.T) {
+	idx, err := NewBleveSearchindex(SearchIndexConfig{
+		BleveIndexPath: path.Join(t.TempDir(), "index.bleve"),
+	})
+	require.NoError(t, err)
+	defer idx.Close()
+
+	testSuggest(t, idx)
+}
+
+// testSuggest checks the ranking and tenant scoping of suggestions.
+func testSuggest(t *testing.T, idx SearchIndex) {
+	meetings := &Tag{ID: 1, Name: "Meetings"}
+	mexican := &Tag{ID: 2, Name: "mexican food"}
+	work := &Tag{ID: 3, Name: "work"}
+	notes := []*Note{
+		{ID: 1, Title: "Weekly meeting", Content: "Agenda", Tags: []*Tag{meetings, work}},
+		{ID: 2, Title: "Meeting notes", Tags: []*Tag{meetings}},
+		{ID: 3, Title: "Tacos", Content: "Meet at noon", Tags: []*Tag{mexican}},
+		{ID: 4, Title: "Weekend plans", Tags: []*Tag{work}},
+	}
+	for _, n := range notes {
+		require.NoError(t, idx.IndexNote("tenant1", n))
+	}
+	require.NoError(t, idx.IndexNote("tenant2", &Note{
+		ID: 5, Title: "Meeting with tenant2", Tags: []*Tag{{ID: 4, Name: "members"}},
+	}))
+
+	titleIDs := func(s *Suggestions) []uint64 {
+		ids := make([]uint64, len(s.Titles))
+		for j, title := range s.Titles {
+			ids[j] = title.NoteID
+		}
+		return ids
+	}
+
+	s, err := idx.Suggest("tenant1", "Me", 10)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []uint64{1, 2}, titleIDs(s), "should complete words of titles, not content")
+	assert.Equal(t, []*TagSuggestion{
+		{Name: "Meetings", Count: 2},
+		{Name: "mexican food", Count: 1},
+	}, s.Tags, "should rank tags by their number of notes")
+
+	s, err = idx.Suggest("tenant1", "wee mee", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1}, titleIDs(s), "should complete every word")
+	assert.Equal(t, "Weekly meeting", s.Titles[0].Title)
+	assert.Empty(t, s.Tags)
+
+	s, err = idx.Suggest("tenant1", "foo", 10)
+	require.NoError(t, err)
+	assert.Empty(t, s.Titles)
+	assert.Equal(t, []*TagSuggestion{{Name: "mexican food", Count: 1}}, s.Tags, "should complete any word of a tag")
+
+	s, err = idx.Suggest("tenant1", "me", 1)
+	require.NoError(t, err)
+	assert.Len(t, s.Titles, 1)
+	assert.Equal(t, []*TagSuggestion{{Name: "Meetings", Count: 2}}, s.Tags)
+
+	s, err = idx.Suggest("tenant2", "me", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{5}, titleIDs(s), "should only suggest the tenant's titles")
+	assert.Equal(t, []*TagSuggestion{{Name: "members", Count: 1}}, s.Tags, "should only suggest the tenant's tags")
+
+	s, err = idx.Suggest("tenant1", "  ", 10)
+	require.NoError(t, err)
+	assert.Empty(t, s.Titles)
+	assert.Empty(t, s.Tags)
+}
+
+func TestBleveDidYouMean(t *testing.T) {
+	idx, err := NewBleveSearchindex(SearchIndexConfig{
+		BleveIndexPath: path.Join(t.TempDir(), "index.bleve"),
+	})
+	require.NoError(t, err)
+	defer idx.Close()
+
+	testDidYouMean(t, idx)
+}
+
+// testDidYouMean checks that only words of the tenant's notes correct a query,
+// and only into one that finds something.
+func testDidYouMean(t *testing.T, idx SearchIndex) {
+	require.NoError(t, idx.IndexNote("tenant1", &Note{ID: 1, Title: "Weekly meeting", Content: "Discuss the budget"}))
+	require.NoError(t, idx.IndexNote("tenant1", &Note{ID: 2, Title: "Tacos", Content: "Carnitas and salsa"}))
+	require.NoError(t, idx.IndexNote("tenant2", &Note{ID: 3, Title: "Burritos", Content: "Barbacoa"}))
+
+	tests := []struct {
+		query, want string
+	}{
+		{"meetign", "meeting"},
+		{"Weekly budgte", "Weekly budget"},
+		{"title:tacoz", "title:tacos"},
+		{"(carnitsa OR pizza) -salsa", ""},
+		{"weekly carnitas", ""},
+		{"pizza", ""},
+		{"burritso", ""},
+		{"tag:tacoz", ""},
+	}
+	for _, tt := range tests {
+		res, err := idx.Search("tenant1", SearchRequest{Query: tt.query})
+		require.NoError(t, err, "query %q", tt.query)
+		assert.Zero(t, res.Total, "query %q", tt.query)
+		assert.Equal(t, tt.want, res.DidYouMean, "query %q", tt.query)
+	}
+
+	res, err := idx.Search("tenant1", SearchRequest{Query: "meeting"})
+	require.NoError(t, err)
+	assert.Empty(t, res.DidYouMean, "should not correct a query that finds something")
+}
+
+func TestBleveRelated(t *testing.T) {
+	idx, err := NewBleveSearchindex(SearchIndexConfig{
+		BleveIndexPath: path.Join(t.TempDir(), "index.bleve"),
+	})
+	require.NoError(t, err)
+	defer idx.Close()
+
+	testRelated(t, idx)
+}
+
+// testRelated checks that related notes share tags or words with a note.
+func testRelated(t *testing.T, idx SearchIndex) {
+	baking := &Tag{ID: 1, Name: "baking"}
+	starter := &Note{
+		ID:      1,
+		Title:   "Sourdough starter",
+		Content: "Feed the sourdough starter with flour and water every morning.",
+		Tags:    []*Tag{baking},
+	}
+	notes := []*Note{
+		starter,
+		{ID: 2, Title: "Sourdough loaf", Content: "Mix the starter with flour, water and salt.", Tags: []*Tag{baking}},
+		{ID: 3, Title: "Focaccia", Content: "Olive oil, flour, water and rosemary.", Tags: []*Tag{baking}},
+		{ID: 4, Title: "Weekly meeting", Content: "Discuss the budget every morning."},
+		{ID: 5, Title: "Tax return", Content: "File before April."},
+	}
+	for _, n := range notes {
+		require.NoError(t, idx.IndexNote("tenant1", n))
+	}
+	require.NoError(t, idx.IndexNote("tenant2", &Note{ID: 6, Title: starter.Title, Content: starter.Content}))
+
+	res, err := idx.Related("tenant1", starter, 10)
+	require.NoError(t, err)
+	ids := res.IDs()
+	require.NotEmpty(t, ids)
+	assert.Equal(t, uint64(2), ids[0], "should put the most similar note first")
+	assert.Contains(t, ids, uint64(3), "should find notes that share tags and words")
+	assert.NotContains(t, ids, uint64(1), "should leave out the note itself")
+	assert.NotContains(t, ids, uint64(5), "should leave out notes with nothing in common")
+	assert.NotContains(t, ids, uint64(6), "should only find the tenant's notes")
+
+	res, err = idx.Related("tenant1", starter, 1)
+	require.NoError(t, err)
+	assert.Len(t, res.Hits, 1)
+	assert.GreaterOrEqual(t, res.Total, uint64(2), "should count every related note")
+
+	res, err = idx.Related("tenant1", &Note{ID: 7}, 10)
+	require.NoError(t, err)
+	assert.Empty(t, res.Hits, "should not relate an empty note to anything")
+}
+
+func TestBleveSearchLanguages(t *testing.T) {
+	idx, err := NewBleveSearchindex(SearchIndexConfig{
+		BleveIndexPath: path.Join(t.TempDir(), "index.bleve"),
+		Languages:      map[string]string{"tenant-de": "de", "tenant-en": "en"},
+	})
+	require.NoError(t, err)
+	defer idx.Close()
+
+	gardens := func(id uint64) *Note {
+		return &Note{ID: id, Title: "Häuser", Content: "Gärten und Häuser"}
+	}
+	require.NoError(t, idx.IndexNote("tenant-de", gardens(1)))
+	require.NoError(t, idx.IndexNote("tenant-en", gardens(2)))
+	require.NoError(t, idx.IndexNote("tenant1", &Note{ID: 3, Title: "会議", Content: "東京で会議があります"}))
+	require.NoError(t, idx.IndexNote("tenant1", &Note{
+		ID:      4,
+		Title:   "Treffen",
+		Content: "Wir treffen uns mit der Gruppe und reden über die Pläne",
+	}))
+
+	tests := []struct {
+		tenantID, query string
+		want            []uint64
+	}{
+		{"tenant-de", "haus", []uint64{1}},
+		{"tenant-de", `"garten und haus"`, []uint64{1}},
+		{"tenant-en", "haus", []uint64{}},
+		{"tenant-en", "häuser", []uint64{2}},
+		{"tenant1", "会議", []uint64{3}},
+		{"tenant1", "東京", []uint64{3}},
+		{"tenant1", "plan", []uint64{4}},
+		{"tenant1", "title:treffen gruppen", []uint64{4}},
+	}
+	for _, tt := range tests {
+		ids, err := searchIDs(idx, tt.tenantID, tt.query)
+		if assert.NoError(t, err, "query %q", tt.query) {
+			assert.ElementsMatch(t, tt.want, ids, "query %q of %s", tt.query, tt.tenantID)
+		}
+	}
+
+	_, err = NewBleveSearchindex(SearchIndexConfig{
+		BleveIndexPath: path.Join(t.TempDir(), "index.bleve"),
+		Languages:      map[string]string{"tenant1": "xx"},
+	})
+	assert.EqualError(t, err, `unsupported search language "xx" for tenant "tenant1"`)
+}
+
+func TestBleveMappingVersion(t *testing.T) {
+	file := path.Join(t.TempDir(), "index.bleve")
+	c := SearchIndexConfig{BleveIndexPath: file}
+	idx, err := NewBleveSearchindex(c)
+	require.NoError(t, err)
+	require.NoError(t, idx.Close())
+
+	idx, err = NewBleveSearchindex(c)
+	require.NoError(t, err, "should open an index with the current mapping")
+	require.NoError(t, idx.idx.SetInternal(bleveMappingVersionKey, []byte("0")))
+	require.NoError(t, idx.Close())
+
+	_, err = NewBleveSearchindex(c)
+	assert.True(t, errors.Is(err, ErrStaleIndex), "should reject an index with another mapping, got %v", err)
+}
+
+func TestRebuildBleveIndex(t *testing.T) {
+	dir := t.TempDir()
+	sc := SearchIndexConfig{BleveIndexPath: path.Join(dir, "index.bleve")}
+	rc := RepositoryConfig{Type: "badgerdb", BadgerDir: path.Join(dir, "kv")}
+
+	repo, err := NewBadgerRepo(rc, nopSearchIndex{})
+	require.NoError(t, err)
+	tacos := &Note{Title: "Tacos", Content: "Al pastor"}
+	trashed := &Note{Title: "Old tacos"}
+	other := &Note{Title: "Other tacos"}
+	require.NoError(t, repo.Transaction("tenant1").CreateNote(tacos))
+	require.NoError(t, repo.Transaction("tenant1").CreateNote(trashed))
+	require.NoError(t, repo.Transaction("tenant1").DeleteNote(trashed.ID))
+	require.NoError(t, repo.Transaction("tenant2").CreateNote(other))
+	require.NoError(t, repo.Close())
+
+	// An index with an outdated mapping that still holds a trashed note.
+	idx, err := NewBleveSearchindex(sc)
+	require.NoError(t, err)
+	require.NoError(t, idx.IndexNote("tenant1", trashed))
+	require.NoError(t, idx.idx.SetInternal(bleveMappingVersionKey, []byte("0")))
+	require.NoError(t, idx.Close())
+
+	n, err := RebuildBleveIndex(sc, rc)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	idx, err = NewBleveSearchindex(sc)
+	require.NoError(t, err, "should replace the index with one built with the current mapping")
+	notes, err := searchIDs(idx, "tenant1", "tacos")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{tacos.ID}, notes)
+	notes, err = searchIDs(idx, "tenant2", "tacos")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{other.ID}, notes)
+
+	// A document the repository knows nothing about.
+	require.NoError(t, idx.IndexNote("tenant1", &Note{ID: 999, Title: "Stray tacos"}))
+	require.NoError(t, idx.Close())
+
+	n, err = ReindexBleveTenant(sc, rc, "tenant1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	idx, err = NewBleveSearchindex(sc)
+	require.NoError(t, err)
+	defer idx.Close()
+	notes, err = searchIDs(idx, "tenant1", "tacos")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{tacos.ID}, notes, "should remove documents of notes that no longer exist")
+	notes, err = searchIDs(idx, "tenant2", "tacos")
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{other.ID}, notes, "should leave other tenants alone")
+}
+
+type nopSearchIndex struct{}
+
+func (nopSearchIndex) IndexNote(string, *Note) error   { return nil }
+func (nopSearchIndex) RemoveNote(string, uint64) error { return nil }
+func (nopSearchIndex) Search(string, SearchRequest) (*SearchResult, error) {
+	return &SearchResult{}, nil
+}
+func (nopSearchIndex) Suggest(string, string, int) (*Suggestions, error) {
+	return &Suggestions{}, nil
+}
+func (nopSearchIndex) Related(string, *Note, int) (*SearchResult, error) {
+	return &SearchResult{}, nil
+}
+
+// searchIDs returns the IDs of the notes on the first page of a search.
+func searchIDs(idx SearchIndex, tenantID, query string) ([]uint64, error) {
+	res, err := idx.Search(tenantID, SearchRequest{Query: query})
+	if err != nil {
+		return nil, err
+	}
+	return res.IDs(), nil
+}
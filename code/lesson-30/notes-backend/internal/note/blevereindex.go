@@ -0,0 +1,226 @@
+package note
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/document"
+)
+
+// reindexPageSize is the number of notes read from the repository at a time
+// while rebuilding an index.
+const reindexPageSize = 500
+
+// RebuildBleveIndex builds a new index at the path in sc from every tenant's
+// notes in the repository configured by rc, and returns how many notes it
+// indexed. The new index is built alongside the old one, which keeps serving
+// until the new index is complete and is swapped in for it. Neither the index
+// nor the repository may be open elsewhere while it runs.
+func RebuildBleveIndex(sc SearchIndexConfig, rc RepositoryConfig) (int, error) {
+	if err := checkLanguages(sc.Languages); err != nil {
+		return 0, err
+	}
+	path := sc.BleveIndexPath
+	fresh := path + ".rebuild"
+	if err := os.RemoveAll(fresh); err != nil {
+		return 0, err
+	}
+	idx, err := initIndex(fresh)
+	if err != nil {
+		return 0, fmt.Errorf("error creating index at %q: %w", fresh, err)
+	}
+	i := &BleveSearchIndex{idx: idx, languages: sc.Languages}
+
+	n, err := i.reindex(rc, "")
+	if closeErr := i.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.RemoveAll(fresh)
+		return 0, err
+	}
+	return n, swapIndex(fresh, path)
+}
+
+// ReindexBleveTenant replaces one tenant's documents in the index at the path
+// in sc with its notes in the repository configured by rc, and returns how
+// many notes it indexed. Searches see either all of the old documents or all
+// of the new ones. The index must be up to date with the current mapping;
+// use RebuildBleveIndex otherwise.
+func ReindexBleveTenant(sc SearchIndexConfig, rc RepositoryConfig, tenantID string) (int, error) {
+	i, err := NewBleveSearchindex(sc)
+	if err != nil {
+		return 0, err
+	}
+	n, err := i.reindex(rc, tenantID)
+	if closeErr := i.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// reindex indexes the notes of the given tenant, or of every tenant if it is
+// empty. Each tenant is written in a single batch that first removes the
+// tenant's existing documents. The repository keeps this index up to date
+// while it is open, so any changes left in its index queue are applied too.
+func (i *BleveSearchIndex) reindex(rc RepositoryConfig, tenantID string) (total int, err error) {
+	repo, err := NewRepository(rc, i)
+	if err != nil {
+		return 0, fmt.Errorf("error opening repository: %w", err)
+	}
+	defer func() {
+		if closeErr := repo.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	tenantIDs := []string{tenantID}
+	if tenantID == "" {
+		if tenantIDs, err = repo.TenantIDs(); err != nil {
+			return 0, fmt.Errorf("error listing tenants: %w", err)
+		}
+	}
+
+	for _, tenantID := range tenantIDs {
+		n, err := i.reindexTenant(repo.Transaction(tenantID), tenantID)
+		if err != nil {
+			return total, fmt.Errorf("error reindexing tenant %q: %w", tenantID, err)
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func (i *BleveSearchIndex) reindexTenant(tx Transaction, tenantID string) (int, error) {
+	b := i.idx.NewBatch()
+
+	ids, err := i.documentIDs(tenantID)
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		b.Delete(id)
+	}
+
+	var n int
+	q := NoteQuery{Limit: reindexPageSize}
+	for {
+		page, err := tx.FindNotes(q)
+		if err != nil {
+			return 0, err
+		}
+		for _, note := range page.Notes {
+			if err := b.Index(stringID(note.ID), i.document(tenantID, note)); err != nil {
+				return 0, err
+			}
+			n++
+		}
+		if page.Next == "" {
+			break
+		}
+		q.Cursor = page.Next
+	}
+
+	return n, i.idx.Batch(b)
+}
+
+// documentIDs returns the IDs of every document that belongs to the tenant.
+func (i *BleveSearchIndex) documentIDs(tenantID string) ([]string, error) {
+	req := bleve.NewSearchRequestOptions(tenantTermQuery(tenantID), 0, 0, false)
+	res, err := i.idx.Search(req)
+	if err != nil || res.Total == 0 {
+		return nil, err
+	}
+
+	req.Size = int(res.Total)
+	if res, err = i.idx.Search(req); err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(res.Hits))
+	for j, hit := range res.Hits {
+		ids[j] = hit.ID
+	}
+	return ids, nil
+}
+
+// indexedNotes reads the stored UpdatedAt stamp of every tenant's documents.
+// Tenants are listed from the terms of the tenantId field.
+func (i *BleveSearchIndex) indexedNotes() (map[string]map[uint64]time.Time, error) {
+	dict, err := i.idx.FieldDict("tenantId")
+	if err != nil {
+		return nil, err
+	}
+	var tenantIDs []string
+	for {
+		entry, err := dict.Next()
+		if err != nil {
+			dict.Close()
+			return nil, err
+		}
+		if entry == nil {
+			break
+		}
+		tenantIDs = append(tenantIDs, entry.Term)
+	}
+	if err := dict.Close(); err != nil {
+		return nil, err
+	}
+
+	notes := make(map[string]map[uint64]time.Time, len(tenantIDs))
+	for _, tenantID := range tenantIDs {
+		ids, err := i.documentIDs(tenantID)
+		if err != nil {
+			return nil, err
+		}
+		stamps := make(map[uint64]time.Time, len(ids))
+		for _, id := range ids {
+			n, err := numID(id)
+			if err != nil {
+				return nil, err
+			}
+			if stamps[n], err = i.updatedAt(id); err != nil {
+				return nil, err
+			}
+		}
+		notes[tenantID] = stamps
+	}
+	return notes, nil
+}
+
+// updatedAt reads the UpdatedAt stamp stored with a document, which is zero
+// if it has none. The stored field is read rather than loaded with a search,
+// which would format it to the second.
+func (i *BleveSearchIndex) updatedAt(id string) (time.Time, error) {
+	doc, err := i.idx.Document(id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if doc != nil {
+		for _, f := range doc.Fields {
+			if f, ok := f.(*document.DateTimeField); ok && f.Name() == "note.updatedAt" {
+				return f.DateTime()
+			}
+		}
+	}
+	return time.Time{}, nil
+}
+
+// swapIndex moves the index at fresh to path. A directory cannot be renamed
+// over another, so the old index is first moved aside to path.old, from
+// which NewBleveSearchindex restores it if the swap is interrupted.
+func swapIndex(fresh, path string) error {
+	old := path + ".old"
+	if err := os.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := os.Rename(path, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(fresh, path); err != nil {
+		os.Rename(old, path)
+		return fmt.Errorf("error moving rebuilt index into place: %w", err)
+	}
+	return os.RemoveAll(old)
+}
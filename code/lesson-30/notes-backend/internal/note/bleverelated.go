@@ -0,0 +1,145 @@
+package note
+
+import (
+	"math"
+	"sort"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+const (
+	// maxRelatedTerms is the number of a note's most significant words that
+	// related notes are found by.
+	maxRelatedTerms = 25
+	// relatedTagBoost weighs a shared tag against the most significant word.
+	relatedTagBoost = 2.0
+)
+
+// Related finds the notes that share the note's tags and the words that are
+// frequent in it but rare in the index. Words that no other note contains
+// cannot find anything and are skipped. How rare a word is counts the notes of
+// every tenant, which only affects the ranking of the tenant's own notes.
+func (i *BleveSearchIndex) Related(tenantID string, note *Note, limit int) (*SearchResult, error) {
+	res := &SearchResult{Hits: make([]*SearchHit, 0)}
+	terms, err := i.significantTerms(tenantID, note)
+	if err != nil {
+		return nil, err
+	}
+
+	similar := bleve.NewDisjunctionQuery()
+	for _, t := range terms {
+		for _, field := range []string{"note.title", "note.content"} {
+			q := bleve.NewTermQuery(t.term)
+			q.SetField(field)
+			q.SetBoost(t.weight)
+			similar.AddQuery(q)
+		}
+	}
+	for _, tag := range note.Tags {
+		if tag == nil {
+			continue
+		}
+		q := bleve.NewTermQuery(tag.Name)
+		q.SetField("note.tags.name")
+		q.SetBoost(relatedTagBoost)
+		similar.AddQuery(q)
+	}
+	if len(similar.Disjuncts) == 0 || limit <= 0 {
+		return res, nil
+	}
+
+	q := bleve.NewBooleanQuery()
+	q.AddMust(similar, tenantTermQuery(tenantID))
+	q.AddMustNot(query.NewDocIDQuery([]string{stringID(note.ID)}))
+	sr, err := i.idx.Search(bleve.NewSearchRequestOptions(q, limit, 0, false))
+	if err != nil {
+		return nil, err
+	}
+
+	res.Total = sr.Total
+	for _, hit := range sr.Hits {
+		id, err := numID(hit.ID)
+		if err != nil {
+			return nil, err
+		}
+		res.Hits = append(res.Hits, &SearchHit{NoteID: id, Score: hit.Score})
+	}
+	return res, nil
+}
+
+type weightedTerm struct {
+	term   string
+	weight float64
+}
+
+// significantTerms weighs the words of a note's title and content, analyzed
+// in its language, by how often they occur in it and how rare they are in the
+// index, and returns the heaviest, heaviest first, with weights between 0 and
+// 1.
+func (i *BleveSearchIndex) significantTerms(tenantID string, note *Note) ([]weightedTerm, error) {
+	lang := noteLanguage(i.languages, tenantID, note)
+	analyzer := i.idx.Mapping().AnalyzerNamed(languageAnalyzers[lang])
+	counts := make(map[string]int)
+	for _, text := range []string{note.Title, note.Content} {
+		for _, token := range analyzer.Analyze([]byte(text)) {
+			counts[string(token.Term)]++
+		}
+	}
+	if len(counts) == 0 {
+		return nil, nil
+	}
+
+	adv, _, err := i.idx.Advanced()
+	if err != nil {
+		return nil, err
+	}
+	r, err := adv.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	docs, err := r.DocCount()
+	if err != nil {
+		return nil, err
+	}
+
+	terms := make([]weightedTerm, 0, len(counts))
+	for term, count := range counts {
+		tfr, err := r.TermFieldReader([]byte(term), "_all", false, false, false)
+		if err != nil {
+			return nil, err
+		}
+		df := tfr.Count()
+		tfr.Close()
+		// The note itself is one of the documents with the term.
+		if df < 2 {
+			continue
+		}
+		idf := 1 + math.Log(float64(docs)/float64(df))
+		terms = append(terms, weightedTerm{term, math.Sqrt(float64(count)) * idf})
+	}
+
+	return topTerms(terms), nil
+}
+
+// topTerms returns the heaviest terms, heaviest first, with their weights
+// scaled to between 0 and 1.
+func topTerms(terms []weightedTerm) []weightedTerm {
+	sort.Slice(terms, func(a, b int) bool {
+		if terms[a].weight != terms[b].weight {
+			return terms[a].weight > terms[b].weight
+		}
+		return terms[a].term < terms[b].term
+	})
+	if len(terms) > maxRelatedTerms {
+		terms = terms[:maxRelatedTerms]
+	}
+	if len(terms) > 0 {
+		max := terms[0].weight
+		for j := range terms {
+			terms[j].weight /= max
+		}
+	}
+	return terms
+}
@@ -0,0 +1,157 @@
+package note
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+const (
+	// suggestTagFacetSize is the number of tags counted on the notes whose
+	// tags match a prefix. It exceeds the limit on suggestions because those
+	// notes can have other tags, which are left out.
+	suggestTagFacetSize = 200
+	// correctionSampleSize is the number of notes from which the words that
+	// could correct a misspelt word are counted.
+	correctionSampleSize = 100
+)
+
+// Suggest ranks titles by how well they match the prefix, and tags by the
+// number of the tenant's notes they are on.
+func (i *BleveSearchIndex) Suggest(tenantID, prefix string, limit int) (*Suggestions, error) {
+	s := &Suggestions{
+		Titles: make([]*TitleSuggestion, 0),
+		Tags:   make([]*TagSuggestion, 0),
+	}
+	words := suggestWords(prefix)
+	if len(words) == 0 || limit <= 0 {
+		return s, nil
+	}
+
+	req := bleve.NewSearchRequestOptions(prefixQuery(tenantID, "note.titlePrefixes", words), limit, 0, false)
+	req.Fields = []string{"note.title"}
+	res, err := i.idx.Search(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, hit := range res.Hits {
+		id, err := numID(hit.ID)
+		if err != nil {
+			return nil, err
+		}
+		title, _ := hit.Fields["note.title"].(string)
+		s.Titles = append(s.Titles, &TitleSuggestion{NoteID: id, Title: title, Score: hit.Score})
+	}
+
+	req = bleve.NewSearchRequestOptions(prefixQuery(tenantID, "note.tags.namePrefixes", words), 0, 0, false)
+	req.AddFacet("tags", bleve.NewFacetRequest("note.tags.name", suggestTagFacetSize))
+	if res, err = i.idx.Search(req); err != nil {
+		return nil, err
+	}
+	if tags := res.Facets["tags"]; tags != nil {
+		for _, term := range tags.Terms {
+			if len(s.Tags) == limit {
+				break
+			}
+			if hasWordPrefixes(term.Term, words) {
+				s.Tags = append(s.Tags, &TagSuggestion{Name: term.Term, Count: term.Count})
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// prefixQuery matches the tenant's notes in which field has every prefix.
+func prefixQuery(tenantID, field string, prefixes []string) query.Query {
+	q := bleve.NewConjunctionQuery(tenantTermQuery(tenantID))
+	for _, prefix := range prefixes {
+		if utf8.RuneCountInString(prefix) > maxPrefixLength {
+			prefix = string([]rune(prefix)[:maxPrefixLength])
+		}
+		term := bleve.NewTermQuery(prefix)
+		term.SetField(field)
+		q.AddQuery(term)
+	}
+	return q
+}
+
+// suggestWords splits text into lower-case words.
+func suggestWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// hasWordPrefixes reports whether each prefix begins a word of text.
+func hasWordPrefixes(text string, prefixes []string) bool {
+	words := suggestWords(text)
+	for _, prefix := range prefixes {
+		found := false
+		for _, word := range words {
+			if strings.HasPrefix(word, prefix) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// didYouMean corrects the words of a query that found nothing with words that
+// occur in the tenant's notes. It returns "" if the corrected query would find
+// nothing either.
+func (i *BleveSearchIndex) didYouMean(tenantID, query string) (string, error) {
+	corrected, err := correctQuery(query, func(word string) (string, error) {
+		return i.correct(tenantID, word)
+	})
+	if err != nil || corrected == "" {
+		return "", err
+	}
+
+	expr, err := parseSearchQuery(corrected)
+	if err != nil || expr == nil {
+		return "", nil
+	}
+	res, err := i.search(tenantID, expr, SearchRequest{Size: 1})
+	if err != nil || res.Total == 0 {
+		return "", err
+	}
+	return corrected, nil
+}
+
+// correct returns the word in the tenant's notes that is closest to a word, or
+// "" if the word occurs in them or nothing is close.
+func (i *BleveSearchIndex) correct(tenantID, word string) (string, error) {
+	edits := maxEdits(word)
+	if edits == 0 {
+		return "", nil
+	}
+	fuzzy := bleve.NewFuzzyQuery(word)
+	fuzzy.SetField("note.words")
+	fuzzy.SetFuzziness(edits)
+
+	req := bleve.NewSearchRequestOptions(
+		bleve.NewConjunctionQuery(fuzzy, tenantTermQuery(tenantID)),
+		correctionSampleSize, 0, false,
+	)
+	req.IncludeLocations = true
+	res, err := i.idx.Search(req)
+	if err != nil {
+		return "", err
+	}
+
+	counts := make(map[string]int)
+	for _, hit := range res.Hits {
+		for term := range hit.Locations["note.words"] {
+			counts[term]++
+		}
+	}
+	return closestWord(word, counts), nil
+}
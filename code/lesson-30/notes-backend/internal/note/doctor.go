@@ -0,0 +1,170 @@
+package note
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Problem is an inconsistency within the repository, found by
+// CheckIntegrity, or between the repository and the search index, found by
+// CheckSearchIndex.
+type Problem struct {
+	TenantID    string
+	Description string
+	// Fixed is set if the problem was repaired.
+	Fixed bool
+}
+
+func (p *Problem) String() string {
+	s := fmt.Sprintf("tenant %q: %s", p.TenantID, p.Description)
+	if p.Fixed {
+		s += " (fixed)"
+	}
+	return s
+}
+
+// linkProblem describes what is wrong with an association between a note
+// and a tag, given which of them exist and in which directions the
+// association is recorded, or returns "" if nothing is. An association with
+// a note or tag that does not exist is repaired by removing it. Otherwise the
+// note's side is what gives a note its tags, so the tag's side is made to
+// match it.
+func linkProblem(noteID, tagID uint64, hasNote, hasTag, noteToTag, tagToNote bool) string {
+	switch {
+	case !hasTag:
+		return fmt.Sprintf("note %d refers to missing tag %d", noteID, tagID)
+	case !hasNote:
+		return fmt.Sprintf("tag %d refers to missing note %d", tagID, noteID)
+	case !noteToTag:
+		return fmt.Sprintf("tag %d lists note %d, which does not have the tag", tagID, noteID)
+	case !tagToNote:
+		return fmt.Sprintf("note %d has tag %d, which does not list the note", noteID, tagID)
+	default:
+		return ""
+	}
+}
+
+func orphanedRevisionsProblem(tenantID string, noteID uint64) *Problem {
+	return &Problem{
+		TenantID:    tenantID,
+		Description: fmt.Sprintf("revisions of missing note %d", noteID),
+	}
+}
+
+// noteLister is implemented by search indexes that can list the notes they
+// hold, which is what CheckSearchIndex compares with the repository.
+type noteLister interface {
+	// indexedNotes returns the UpdatedAt stamp of every indexed note, by
+	// tenant and note ID.
+	indexedNotes() (map[string]map[uint64]time.Time, error)
+}
+
+// CheckSearchIndex compares each tenant's notes in the repository with those
+// in the search index, by ID and UpdatedAt stamp. Notes that are missing from
+// the index or out of date in it are reindexed if fix is set, and documents
+// of notes that are no longer in the repository, or are in the trash, are
+// removed. The repository's index queue should be empty, or it will be
+// reported as drift.
+func CheckSearchIndex(repo Repository, idx SearchIndex, fix bool) ([]*Problem, error) {
+	lister, ok := idx.(noteLister)
+	if !ok {
+		return nil, fmt.Errorf("a %T cannot be checked", idx)
+	}
+	indexed, err := lister.indexedNotes()
+	if err != nil {
+		return nil, fmt.Errorf("error listing indexed notes: %w", err)
+	}
+
+	tenantIDs, err := repo.TenantIDs()
+	if err != nil {
+		return nil, fmt.Errorf("error listing tenants: %w", err)
+	}
+	// The index may have documents of tenants that no longer have anything
+	// in the repository.
+	known := make(map[string]bool, len(tenantIDs))
+	for _, tenantID := range tenantIDs {
+		known[tenantID] = true
+	}
+	for tenantID := range indexed {
+		if !known[tenantID] {
+			tenantIDs = append(tenantIDs, tenantID)
+		}
+	}
+	sort.Strings(tenantIDs)
+
+	var problems []*Problem
+	for _, tenantID := range tenantIDs {
+		p, err := checkTenantIndex(repo.Transaction(tenantID), idx, tenantID, indexed[tenantID], fix)
+		problems = append(problems, p...)
+		if err != nil {
+			return problems, fmt.Errorf("error checking tenant %q: %w", tenantID, err)
+		}
+	}
+	return problems, nil
+}
+
+func checkTenantIndex(tx Transaction, idx SearchIndex, tenantID string, indexed map[uint64]time.Time, fix bool) ([]*Problem, error) {
+	var problems []*Problem
+	seen := make(idSet)
+	q := NoteQuery{Limit: reindexPageSize}
+	for {
+		page, err := tx.FindNotes(q)
+		if err != nil {
+			return problems, err
+		}
+		for _, note := range page.Notes {
+			seen[note.ID] = struct{}{}
+			updatedAt, ok := indexed[note.ID]
+			var p *Problem
+			switch {
+			case !ok:
+				p = &Problem{
+					TenantID:    tenantID,
+					Description: fmt.Sprintf("note %d is missing from the search index", note.ID),
+				}
+			case !updatedAt.Equal(note.UpdatedAt):
+				p = &Problem{
+					TenantID: tenantID,
+					Description: fmt.Sprintf("note %d was updated at %s, but the search index has it as of %s",
+						note.ID, note.UpdatedAt.Format(time.RFC3339Nano), updatedAt.Format(time.RFC3339Nano)),
+				}
+			default:
+				continue
+			}
+			problems = append(problems, p)
+			if fix {
+				if err := idx.IndexNote(tenantID, note); err != nil {
+					return problems, fmt.Errorf("error indexing note %d: %w", note.ID, err)
+				}
+				p.Fixed = true
+			}
+		}
+		if page.Next == "" {
+			break
+		}
+		q.Cursor = page.Next
+	}
+
+	var orphans []uint64
+	for id := range indexed {
+		if _, ok := seen[id]; !ok {
+			orphans = append(orphans, id)
+		}
+	}
+	sortIDs(orphans)
+	for _, id := range orphans {
+		p := &Problem{
+			TenantID:    tenantID,
+			Description: fmt.Sprintf("note %d is in the search index but not in the repository", id),
+		}
+		problems = append(problems, p)
+		if fix {
+			if err := idx.RemoveNote(tenantID, id); err != nil {
+				return problems, fmt.Errorf("error removing note %d: %w", id, err)
+			}
+			p.Fixed = true
+		}
+	}
+	return problems, nil
+}
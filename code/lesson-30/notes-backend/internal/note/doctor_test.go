@@ -0,0 +1,198 @@
+package note
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBleveCheckSearchIndex(t *testing.T) {
+	idx, err := NewBleveSearchindex(SearchIndexConfig{
+		BleveIndexPath: path.Join(t.TempDir(), "index.bleve"),
+	})
+	require.NoError(t, err)
+	defer idx.Close()
+	testCheckSearchIndex(t, idx)
+}
+
+func TestMemoryCheckSearchIndex(t *testing.T) {
+	testCheckSearchIndex(t, NewMemorySearchIndex())
+}
+
+func testCheckSearchIndex(t *testing.T, idx SearchIndex) {
+	repo := NewInMemoryRepo(RepositoryConfig{}, nopSearchIndex{})
+	defer repo.Close()
+	current := &Note{Title: "Tacos"}
+	stale := &Note{Title: "Burritos"}
+	missing := &Note{Title: "Nachos"}
+	require.NoError(t, repo.Transaction("tenant1").CreateNote(current))
+	require.NoError(t, repo.Transaction("tenant1").CreateNote(stale))
+	require.NoError(t, repo.Transaction("tenant2").CreateNote(missing))
+
+	require.NoError(t, idx.IndexNote("tenant1", current))
+	old := *stale
+	old.UpdatedAt = old.UpdatedAt.Add(-time.Hour)
+	require.NoError(t, idx.IndexNote("tenant1", &old))
+	require.NoError(t, idx.IndexNote("tenant3", &Note{ID: 99, Title: "Gone"}))
+
+	problems, err := CheckSearchIndex(repo, idx, false)
+	require.NoError(t, err)
+	require.Len(t, problems, 3)
+	assert.Equal(t, "tenant1", problems[0].TenantID)
+	assert.Contains(t, problems[0].Description, fmt.Sprintf("note %d was updated at", stale.ID))
+	assert.Equal(t, &Problem{TenantID: "tenant2", Description: fmt.Sprintf("note %d is missing from the search index", missing.ID)}, problems[1])
+	assert.Equal(t, &Problem{TenantID: "tenant3", Description: "note 99 is in the search index but not in the repository"}, problems[2])
+
+	problems, err = CheckSearchIndex(repo, idx, true)
+	require.NoError(t, err)
+	require.Len(t, problems, 3)
+	for _, p := range problems {
+		assert.True(t, p.Fixed, "should fix %s", p)
+	}
+	ids, err := searchIDs(idx, "tenant2", "nachos")
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{missing.ID}, ids, "should index the missing note")
+
+	problems, err = CheckSearchIndex(repo, idx, false)
+	require.NoError(t, err)
+	assert.Empty(t, problems, "should leave nothing to fix")
+}
+
+func TestInMemoryCheckIntegrity(t *testing.T) {
+	repo := NewInMemoryRepo(RepositoryConfig{}, nopSearchIndex{})
+	defer repo.Close()
+	testCheckIntegrity(t, repo, func(tenantID string, id uint64) {
+		delete(repo.tenants[tenantID].tags, id)
+	})
+}
+
+func TestBadgerCheckIntegrity(t *testing.T) {
+	repo, err := NewBadgerRepo(RepositoryConfig{BadgerDir: t.TempDir()}, nopSearchIndex{})
+	require.NoError(t, err)
+	defer repo.Close()
+	testCheckIntegrity(t, repo, func(tenantID string, id uint64) {
+		tx := &badgerTransaction{badgerRepo: repo, tenantID: tenantID}
+		require.NoError(t, repo.db.Update(func(txn *badger.Txn) error {
+			tag, err := tx.findTag(txn, id)
+			if err != nil {
+				return err
+			}
+			return tx.deleteTag(txn, tag)
+		}))
+	})
+}
+
+func TestSQLiteCheckIntegrity(t *testing.T) {
+	repo, err := NewSQLiteRepo(RepositoryConfig{SQLitePath: path.Join(t.TempDir(), "notes.db")}, nopSearchIndex{})
+	require.NoError(t, err)
+	defer repo.Close()
+	testCheckIntegrity(t, repo, func(tenantID string, id uint64) {
+		// Foreign keys would cascade the delete to the tag's associations.
+		conn, err := repo.db.Conn(context.Background())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.ExecContext(context.Background(), `PRAGMA foreign_keys = OFF`)
+		require.NoError(t, err)
+		_, err = conn.ExecContext(context.Background(), `DELETE FROM tags WHERE id = ?`, id)
+		require.NoError(t, err)
+		_, err = conn.ExecContext(context.Background(), `PRAGMA foreign_keys = ON`)
+		require.NoError(t, err)
+	})
+}
+
+// testCheckIntegrity deletes a tag with removeTag, which leaves its
+// associations behind, and checks that they are found and removed.
+func testCheckIntegrity(t *testing.T, repo Repository, removeTag func(tenantID string, id uint64)) {
+	tx := repo.Transaction("tenant1")
+	tacos, trashed := &Note{Title: "Tacos"}, &Note{Title: "Old tacos"}
+	lunch, dinner := &Tag{Name: "lunch"}, &Tag{Name: "dinner"}
+	require.NoError(t, tx.CreateNote(tacos))
+	require.NoError(t, tx.CreateNote(trashed))
+	require.NoError(t, tx.CreateTag(lunch))
+	require.NoError(t, tx.CreateTag(dinner))
+	require.NoError(t, tx.TagNote(tacos.ID, lunch.ID))
+	require.NoError(t, tx.TagNote(tacos.ID, dinner.ID))
+	require.NoError(t, tx.TagNote(trashed.ID, lunch.ID))
+	require.NoError(t, tx.DeleteNote(trashed.ID))
+
+	problems, err := repo.CheckIntegrity(false)
+	require.NoError(t, err)
+	assert.Empty(t, problems, "should accept the associations of trashed notes")
+
+	removeTag("tenant1", lunch.ID)
+	problems, err = repo.CheckIntegrity(false)
+	require.NoError(t, err)
+	want := []*Problem{
+		{TenantID: "tenant1", Description: fmt.Sprintf("note %d refers to missing tag %d", tacos.ID, lunch.ID)},
+		{TenantID: "tenant1", Description: fmt.Sprintf("note %d refers to missing tag %d", trashed.ID, lunch.ID)},
+	}
+	assert.Equal(t, want, problems)
+
+	problems, err = repo.CheckIntegrity(true)
+	require.NoError(t, err)
+	for _, p := range want {
+		p.Fixed = true
+	}
+	assert.Equal(t, want, problems)
+
+	problems, err = repo.CheckIntegrity(false)
+	require.NoError(t, err)
+	assert.Empty(t, problems, "should leave nothing to fix")
+	note, err := tx.FindNoteByID(tacos.ID)
+	require.NoError(t, err)
+	require.Len(t, note.Tags, 1)
+	assert.Equal(t, dinner.ID, note.Tags[0].ID)
+}
+
+func TestBadgerCheckIntegrityKeys(t *testing.T) {
+	repo, err := NewBadgerRepo(RepositoryConfig{BadgerDir: t.TempDir()}, nopSearchIndex{})
+	require.NoError(t, err)
+	defer repo.Close()
+	tx := &badgerTransaction{badgerRepo: repo, tenantID: "tenant1"}
+	tacos, lunch := &Note{Title: "Tacos"}, &Tag{Name: "lunch"}
+	require.NoError(t, tx.CreateNote(tacos))
+	require.NoError(t, tx.CreateTag(lunch))
+	require.NoError(t, tx.TagNote(tacos.ID, lunch.ID))
+
+	// A one-sided association, a name left behind by a deleted tag and the
+	// revisions of a note that no longer exists.
+	require.NoError(t, repo.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Delete(tx.tagNoteKey(lunch.ID, tacos.ID).Bytes()); err != nil {
+			return err
+		}
+		if err := txn.Set(tx.tagNameKey("dinner").Bytes(), tx.tagKey(99).entityKey); err != nil {
+			return err
+		}
+		return txn.Set(tx.revisionKey(98, 1).Bytes(), (&Revision{Rev: 1}).MustMarshal())
+	}))
+
+	problems, err := repo.CheckIntegrity(true)
+	require.NoError(t, err)
+	assert.Equal(t, []*Problem{
+		{TenantID: "tenant1", Description: fmt.Sprintf("note %d has tag %d, which does not list the note", tacos.ID, lunch.ID), Fixed: true},
+		{TenantID: "tenant1", Description: `tag name "dinner" refers to missing tag 99`, Fixed: true},
+		{TenantID: "tenant1", Description: "revisions of missing note 98", Fixed: true},
+	}, problems)
+
+	page, err := tx.FindNotes(NoteQuery{TagID: lunch.ID})
+	require.NoError(t, err)
+	assert.Len(t, page.Notes, 1, "should list the note under its tag again")
+	require.NoError(t, tx.CreateTag(&Tag{Name: "dinner"}), "should free the name")
+	problems, err = repo.CheckIntegrity(false)
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+}
+
+func TestSyncRemovesUnindexedNote(t *testing.T) {
+	repo := NewInMemoryRepo(RepositoryConfig{}, nopSearchIndex{})
+	defer repo.Close()
+	w := &indexWorker{queue: repo, idx: NewMemorySearchIndex()}
+	assert.NoError(t, w.sync(indexJob{TenantID: "tenant1", NoteID: 42}),
+		"should not retry removing a note that was never indexed")
+}
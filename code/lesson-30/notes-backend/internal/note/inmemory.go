@@ -2,169 +2,1100 @@ package note
 
 import (
 	"fmt"
+	"sort"
+	"sync"
 	"time"
 )
 
+// inMemoryRepo keeps each tenant's data in its own partition. It is safe for
+// concurrent use and is intended as a faithful stand-in for the persistent
+// repositories in demos and tests.
 type inMemoryRepo struct {
-	notes  []Note
-	tags   []Tag
-	links  []link
-	lastID uint64
+	mu            sync.RWMutex
+	tenants       map[string]*inMemoryTenant
+	registry      map[string]Tenant
+	users         map[string]User
+	sessions      map[string]Session
+	apiKeys       map[string]APIKey
+	lastID        uint64
+	revisionLimit int
+
+	// The index queue is shared by all tenants and lives as long as the
+	// repository does.
+	queue   []indexJob
+	lastSeq uint64
+	indexer *indexWorker
 }
 
-type link struct {
-	noteID, tagID uint64
+// inMemoryTenant holds a single tenant's notes, tags and the associations
+// between them, indexed in both directions. Trashed notes keep their
+// associations and revisions until they are purged.
+type inMemoryTenant struct {
+	notes     map[uint64]Note
+	trash     map[uint64]Note
+	tags      map[uint64]Tag
+	noteTags  map[uint64]idSet
+	tagNotes  map[uint64]idSet
+	revisions map[uint64][]Revision // note ID -> revisions, oldest first
 }
 
-func NewInMemoryRepo() *inMemoryRepo {
-	return &inMemoryRepo{}
+type idSet map[uint64]struct{}
+
+func newInMemoryTenant() *inMemoryTenant {
+	return &inMemoryTenant{
+		notes:     make(map[uint64]Note),
+		trash:     make(map[uint64]Note),
+		tags:      make(map[uint64]Tag),
+		noteTags:  make(map[uint64]idSet),
+		tagNotes:  make(map[uint64]idSet),
+		revisions: make(map[uint64][]Revision),
+	}
 }
 
-func (r *inMemoryRepo) Transaction(tenantID string) Transaction {
-	// Ignore tenantID - inMemoryRepo itself implements transaction
+// purge permanently removes a trashed note and everything attached to it.
+func (t *inMemoryTenant) purge(noteID uint64) {
+	for tagID := range t.noteTags[noteID] {
+		t.unlink(noteID, tagID)
+	}
+	delete(t.trash, noteID)
+	delete(t.revisions, noteID)
+}
+
+func (t *inMemoryTenant) link(noteID, tagID uint64) {
+	if t.noteTags[noteID] == nil {
+		t.noteTags[noteID] = make(idSet)
+	}
+	if t.tagNotes[tagID] == nil {
+		t.tagNotes[tagID] = make(idSet)
+	}
+	t.noteTags[noteID][tagID] = struct{}{}
+	t.tagNotes[tagID][noteID] = struct{}{}
+}
+
+func (t *inMemoryTenant) unlink(noteID, tagID uint64) {
+	delete(t.noteTags[noteID], tagID)
+	if len(t.noteTags[noteID]) == 0 {
+		delete(t.noteTags, noteID)
+	}
+	delete(t.tagNotes[tagID], noteID)
+	if len(t.tagNotes[tagID]) == 0 {
+		delete(t.tagNotes, tagID)
+	}
+}
+
+func (s idSet) clone() idSet {
+	c := make(idSet, len(s))
+	for id := range s {
+		c[id] = struct{}{}
+	}
+	return c
+}
+
+// sorted returns the IDs in ascending order.
+func (s idSet) sorted() []uint64 {
+	ids := make([]uint64, 0, len(s))
+	for id := range s {
+		ids = append(ids, id)
+	}
+	sortIDs(ids)
+	return ids
+}
+
+func sortIDs(ids []uint64) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+}
+
+func NewInMemoryRepo(c RepositoryConfig, idx SearchIndex) *inMemoryRepo {
+	r := &inMemoryRepo{
+		tenants:       make(map[string]*inMemoryTenant),
+		registry:      make(map[string]Tenant),
+		users:         make(map[string]User),
+		sessions:      make(map[string]Session),
+		apiKeys:       make(map[string]APIKey),
+		revisionLimit: c.RevisionLimit,
+	}
+	r.indexer = startIndexWorker(r, idx)
 	return r
 }
 
-func (r *inMemoryRepo) FindNoteByID(id uint64) (*Note, error) {
-	for _, note := range r.notes {
-		if note.ID == id {
-			return r.withTags(note), nil
+func (r *inMemoryRepo) Transaction(tenantID string) Transaction {
+	return &inMemoryTransaction{
+		inMemoryRepo: r,
+		tenantID:     tenantID,
+	}
+}
+
+func (r *inMemoryRepo) Update(tenantID string, fn func(tx Transaction) error) error {
+	tx := &inMemoryTransaction{
+		inMemoryRepo: r,
+		tenantID:     tenantID,
+	}
+	err := func() error {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		tx.locked = true
+		defer func() { tx.locked = false }()
+
+		if err := fn(tx); err != nil {
+			// Undo the changes in reverse, so that each entry ends up as it
+			// was before its first change.
+			for i := len(tx.undo) - 1; i >= 0; i-- {
+				tx.undo[i]()
+			}
+			return err
 		}
+		r.enqueue(tx.pending...)
+		return nil
+	}()
+	if err != nil {
+		return err
 	}
 
-	return nil, nil
+	r.indexer.notify()
+	return nil
 }
 
-func (r *inMemoryRepo) FindAllNotes() ([]*Note, error) {
-	notes := make([]*Note, len(r.notes))
-	for i, note := range r.notes {
-		n := note
-		notes[i] = r.withTags(n)
-	}
+func (r *inMemoryRepo) PurgeTrash(deletedBefore time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	return notes, nil
+	var purged int
+	for _, t := range r.tenants {
+		for id, note := range t.trash {
+			if note.DeletedAt.Before(deletedBefore) {
+				t.purge(id)
+				purged++
+			}
+		}
+	}
+	return purged, nil
 }
 
-func (r *inMemoryRepo) FindTagByID(id uint64) (*Tag, error) {
-	for _, tag := range r.tags {
-		if tag.ID == id {
-			return &tag, nil
+func (r *inMemoryRepo) TenantIDs() ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := []string{}
+	for id, t := range r.tenants {
+		if len(t.notes) > 0 || len(t.trash) > 0 || len(t.tags) > 0 {
+			ids = append(ids, id)
 		}
 	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (r *inMemoryRepo) CreateTenant(tenant *Tenant) error {
+	if err := newTenant(tenant); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.registry[tenant.ID]; ok {
+		return tenantExists(tenant.ID)
+	}
+	r.registry[tenant.ID] = *tenant
+	return nil
+}
 
+func (r *inMemoryRepo) FindTenant(id string) (*Tenant, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if tenant, ok := r.registry[id]; ok {
+		return &tenant, nil
+	}
 	return nil, nil
 }
 
-func (r *inMemoryRepo) FindAllTags() ([]*Tag, error) {
-	tags := make([]*Tag, len(r.tags))
-	for i, tag := range r.tags {
-		t := tag
-		tags[i] = &t
+func (r *inMemoryRepo) FindTenants(q TenantQuery) (*TenantPage, error) {
+	after, err := q.after()
+	if err != nil {
+		return nil, err
 	}
 
-	return tags, nil
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := make([]string, 0, len(r.registry))
+	for id := range r.registry {
+		if id > after {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	tenants := make([]*Tenant, 0)
+	for _, id := range ids {
+		tenant := r.registry[id]
+		if !q.matches(&tenant) {
+			continue
+		}
+		tenants = append(tenants, &tenant)
+		if q.Limit > 0 && len(tenants) > q.Limit {
+			break
+		}
+	}
+	return q.page(tenants), nil
 }
 
-func (r *inMemoryRepo) CreateNote(note *Note) error {
-	r.lastID++
-	note.ID = r.lastID
-	now := time.Now()
-	note.CreatedAt = now
-	note.UpdatedAt = now
-	r.notes = append(r.notes, *note)
+func (r *inMemoryRepo) UpdateTenant(id string, tenant *Tenant) error {
+	if !tenant.Status.valid() {
+		return fmt.Errorf("invalid tenant status %q", tenant.Status)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	existing, ok := r.registry[id]
+	if !ok {
+		return tenantNotFound(id)
+	}
+	existing.Name = tenant.Name
+	existing.Status = tenant.Status
+	r.registry[id] = existing
+	*tenant = existing
 	return nil
 }
 
-func (r *inMemoryRepo) UpdateNote(id uint64, update *Note) error {
-	for i, note := range r.notes {
-		if note.ID == id {
-			newNote := note
-			if update.Title != "" {
-				newNote.Title = update.Title
-			}
-			if update.Content != "" {
-				newNote.Content = update.Content
-			}
+func (r *inMemoryRepo) CreateUser(user *User) error {
+	if err := newUser(user); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.users {
+		if existing.Email == user.Email {
+			return emailExists(user.Email)
+		}
+	}
+	r.users[user.ID] = *user
+	return nil
+}
 
-			newNote.UpdatedAt = time.Now()
-			r.notes[i] = newNote
-			break
+func (r *inMemoryRepo) FindUser(id string) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if user, ok := r.users[id]; ok {
+		return &user, nil
+	}
+	return nil, nil
+}
+
+func (r *inMemoryRepo) FindUserByEmail(email string) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, user := range r.users {
+		if user.Email == email {
+			return &user, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *inMemoryRepo) FindUsers(tenantID string) ([]*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	users := make([]*User, 0)
+	for _, user := range r.users {
+		if user.TenantID == tenantID {
+			user := user
+			users = append(users, &user)
 		}
 	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
 
+func (r *inMemoryRepo) UpdateUser(id string, user *User) error {
+	if !user.Role.valid() {
+		return invalidUser("unknown role %q", user.Role)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	existing, ok := r.users[id]
+	if !ok {
+		return userNotFound(id)
+	}
+	existing.Role = user.Role
+	r.users[id] = existing
+	*user = existing
 	return nil
 }
 
-func (r *inMemoryRepo) DeleteNote(id uint64) error {
-	notes := make([]Note, len(r.notes)-1)
-	for _, note := range r.notes {
-		if note.ID != id {
-			notes = append(notes, note)
+func (r *inMemoryRepo) DeleteUser(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.users[id]; !ok {
+		return userNotFound(id)
+	}
+	delete(r.users, id)
+	for sid, session := range r.sessions {
+		if session.UserID == id {
+			delete(r.sessions, sid)
 		}
 	}
+	return nil
+}
 
+func (r *inMemoryRepo) CreateSession(session *Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.sessions[session.ID]; ok {
+		return &AlreadyExistsError{Entity: "session", Name: session.ID}
+	}
+	r.sessions[session.ID] = *session
 	return nil
 }
 
-func (r *inMemoryRepo) CreateTag(tag *Tag) error {
-	r.lastID++
-	tag.ID = r.lastID
-	now := time.Now()
-	tag.CreatedAt = now
-	r.tags = append(r.tags, *tag)
+func (r *inMemoryRepo) FindSession(id string) (*Session, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if session, ok := r.sessions[id]; ok {
+		return &session, nil
+	}
+	return nil, nil
+}
+
+func (r *inMemoryRepo) DeleteSession(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.sessions[id]; !ok {
+		return sessionNotFound()
+	}
+	delete(r.sessions, id)
 	return nil
 }
 
-func (r *inMemoryRepo) DeleteTag(id uint64) error {
-	tags := make([]Tag, len(r.tags)-1)
-	for _, tag := range r.tags {
-		if tag.ID != id {
-			tags = append(tags, tag)
+func (r *inMemoryRepo) DeleteExpiredSessions(expiredBy time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var deleted int
+	for id, session := range r.sessions {
+		if !expiredBy.Before(session.ExpiresAt) {
+			delete(r.sessions, id)
+			deleted++
 		}
 	}
+	return deleted, nil
+}
 
+func (r *inMemoryRepo) CreateAPIKey(key *APIKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.apiKeys {
+		if existing.ID == key.ID || existing.Hash == key.Hash {
+			return &AlreadyExistsError{Entity: "API key", Name: key.ID}
+		}
+	}
+	key.Scopes = append([]string{}, key.Scopes...)
+	r.apiKeys[key.ID] = *key
 	return nil
 }
 
-func (r *inMemoryRepo) TagNote(noteID, tagID uint64) error {
-	for _, link := range r.links {
-		if link.noteID == noteID && link.tagID == tagID {
-			return nil
+func (r *inMemoryRepo) FindAPIKey(id string) (*APIKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if key, ok := r.apiKeys[id]; ok {
+		return &key, nil
+	}
+	return nil, nil
+}
+
+func (r *inMemoryRepo) FindAPIKeyByHash(hash string) (*APIKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, key := range r.apiKeys {
+		if key.Hash == hash {
+			return &key, nil
 		}
 	}
-	r.links = append(r.links, link{
-		noteID: noteID,
-		tagID:  tagID,
-	})
+	return nil, nil
+}
 
+func (r *inMemoryRepo) FindAPIKeys(tenantID string) ([]*APIKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	keys := make([]*APIKey, 0)
+	for _, key := range r.apiKeys {
+		if key.TenantID == tenantID {
+			key := key
+			keys = append(keys, &key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys, nil
+}
+
+func (r *inMemoryRepo) TouchAPIKey(id string, usedAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key, ok := r.apiKeys[id]
+	if !ok {
+		return apiKeyNotFound(id)
+	}
+	key.LastUsedAt = &usedAt
+	r.apiKeys[id] = key
 	return nil
 }
 
-func (r *inMemoryRepo) UntagNote(noteID, tagID uint64) error {
-	var newLinks []link
-	for _, link := range r.links {
-		if link.noteID == noteID && link.tagID == tagID {
+func (r *inMemoryRepo) DeleteAPIKey(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.apiKeys[id]; !ok {
+		return apiKeyNotFound(id)
+	}
+	delete(r.apiKeys, id)
+	return nil
+}
+
+func (r *inMemoryRepo) IndexQueueDepth() (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.queue), nil
+}
+
+func (r *inMemoryRepo) CheckIntegrity(fix bool) ([]*Problem, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tenantIDs := make([]string, 0, len(r.tenants))
+	for tenantID := range r.tenants {
+		tenantIDs = append(tenantIDs, tenantID)
+	}
+	sort.Strings(tenantIDs)
+
+	var problems []*Problem
+	for _, tenantID := range tenantIDs {
+		problems = append(problems, r.tenants[tenantID].check(tenantID, fix)...)
+	}
+	return problems, nil
+}
+
+// check looks for broken associations and orphaned revisions in a tenant's
+// partition, as described by Repository.CheckIntegrity.
+func (t *inMemoryTenant) check(tenantID string, fix bool) []*Problem {
+	type link struct{ noteID, tagID uint64 }
+	links := make(map[link]bool)
+	for noteID, tagIDs := range t.noteTags {
+		for tagID := range tagIDs {
+			links[link{noteID, tagID}] = true
+		}
+	}
+	for tagID, noteIDs := range t.tagNotes {
+		for noteID := range noteIDs {
+			links[link{noteID, tagID}] = true
+		}
+	}
+	sorted := make([]link, 0, len(links))
+	for l := range links {
+		sorted = append(sorted, l)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].noteID != sorted[j].noteID {
+			return sorted[i].noteID < sorted[j].noteID
+		}
+		return sorted[i].tagID < sorted[j].tagID
+	})
+
+	var problems []*Problem
+	for _, l := range sorted {
+		_, inNotes := t.notes[l.noteID]
+		_, inTrash := t.trash[l.noteID]
+		_, hasTag := t.tags[l.tagID]
+		_, noteToTag := t.noteTags[l.noteID][l.tagID]
+		_, tagToNote := t.tagNotes[l.tagID][l.noteID]
+		desc := linkProblem(l.noteID, l.tagID, inNotes || inTrash, hasTag, noteToTag, tagToNote)
+		if desc == "" {
 			continue
 		}
-		newLinks = append(newLinks, link)
+		problems = append(problems, &Problem{TenantID: tenantID, Description: desc, Fixed: fix})
+		if !fix {
+			continue
+		}
+		if (inNotes || inTrash) && hasTag && noteToTag {
+			t.link(l.noteID, l.tagID)
+		} else {
+			t.unlink(l.noteID, l.tagID)
+		}
+	}
+
+	var orphans []uint64
+	for noteID := range t.revisions {
+		_, inNotes := t.notes[noteID]
+		_, inTrash := t.trash[noteID]
+		if !inNotes && !inTrash {
+			orphans = append(orphans, noteID)
+		}
+	}
+	sortIDs(orphans)
+	for _, noteID := range orphans {
+		p := orphanedRevisionsProblem(tenantID, noteID)
+		problems = append(problems, p)
+		if fix {
+			delete(t.revisions, noteID)
+			p.Fixed = true
+		}
+	}
+	return problems
+}
+
+// enqueue adds jobs to the index queue. The caller must hold the write lock.
+func (r *inMemoryRepo) enqueue(jobs ...indexJob) {
+	for _, job := range jobs {
+		r.lastSeq++
+		job.Seq = r.lastSeq
+		r.queue = append(r.queue, job)
 	}
-	r.links = newLinks
+}
+
+func (r *inMemoryRepo) peekIndexJobs(n int) ([]indexJob, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.queue) < n {
+		n = len(r.queue)
+	}
+	return append([]indexJob(nil), r.queue[:n]...), nil
+}
 
+func (r *inMemoryRepo) ackIndexJob(seq uint64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, job := range r.queue {
+		if job.Seq == seq {
+			r.queue = append(r.queue[:i:i], r.queue[i+1:]...)
+			break
+		}
+	}
 	return nil
 }
 
 func (r *inMemoryRepo) Close() error {
+	r.indexer.close()
 	fmt.Println("Closing in-memory repo (TODO: Remove this noop log)")
 	return nil
 }
 
-func (r *inMemoryRepo) withTags(n Note) *Note {
-	for _, link := range r.links {
-		if link.noteID == n.ID {
-			tag, _ := r.FindTagByID(link.tagID)
-			n.Tags = append(n.Tags, tag)
+type inMemoryTransaction struct {
+	*inMemoryRepo
+	tenantID string
+	// locked is set while Update holds the repository's write lock.
+	locked bool
+	// pending holds the index jobs of an Update until it succeeds.
+	pending []indexJob
+	// undo holds what puts back the entries that an Update changed, so that
+	// it can be rolled back without copying the whole partition.
+	undo []func()
+}
+
+func (tx *inMemoryTransaction) lock() func() {
+	if tx.locked {
+		return func() {}
+	}
+	tx.mu.Lock()
+	return tx.mu.Unlock
+}
+
+func (tx *inMemoryTransaction) rlock() func() {
+	if tx.locked {
+		return func() {}
+	}
+	tx.mu.RLock()
+	return tx.mu.RUnlock
+}
+
+// partition returns the tenant's data, creating it if necessary. The caller
+// must hold the write lock.
+func (tx *inMemoryTransaction) partition() *inMemoryTenant {
+	t, ok := tx.tenants[tx.tenantID]
+	if !ok {
+		t = newInMemoryTenant()
+		tx.tenants[tx.tenantID] = t
+	}
+	return t
+}
+
+// readPartition returns the tenant's data without creating it, so that reads
+// under a read lock never mutate the repository.
+func (tx *inMemoryTransaction) readPartition() *inMemoryTenant {
+	if t, ok := tx.tenants[tx.tenantID]; ok {
+		return t
+	}
+	return newInMemoryTenant()
+}
+
+func (tx *inMemoryTransaction) nextID() uint64 {
+	tx.lastID++
+	return tx.lastID
+}
+
+// saveNote lets an Update roll back the changes it is about to make to a
+// note, its revisions and its tag links. Each of its tags must be saved too
+// if the links change.
+func (tx *inMemoryTransaction) saveNote(t *inMemoryTenant, id uint64) {
+	if !tx.locked {
+		return
+	}
+	note, live := t.notes[id]
+	trashed, inTrash := t.trash[id]
+	tagIDs, tagged := t.noteTags[id]
+	if tagged {
+		tagIDs = tagIDs.clone()
+	}
+	revisions, revised := t.revisions[id]
+	tx.undo = append(tx.undo, func() {
+		if live {
+			t.notes[id] = note
+		} else {
+			delete(t.notes, id)
+		}
+		if inTrash {
+			t.trash[id] = trashed
+		} else {
+			delete(t.trash, id)
+		}
+		if tagged {
+			t.noteTags[id] = tagIDs
+		} else {
+			delete(t.noteTags, id)
+		}
+		// Revisions are only ever appended, so the old slice still holds
+		// them.
+		if revised {
+			t.revisions[id] = revisions
+		} else {
+			delete(t.revisions, id)
+		}
+	})
+}
+
+// saveTag lets an Update roll back the changes it is about to make to a tag
+// and its note links.
+func (tx *inMemoryTransaction) saveTag(t *inMemoryTenant, id uint64) {
+	if !tx.locked {
+		return
+	}
+	tag, exists := t.tags[id]
+	noteIDs, tagged := t.tagNotes[id]
+	if tagged {
+		noteIDs = noteIDs.clone()
+	}
+	tx.undo = append(tx.undo, func() {
+		if exists {
+			t.tags[id] = tag
+		} else {
+			delete(t.tags, id)
+		}
+		if tagged {
+			t.tagNotes[id] = noteIDs
+		} else {
+			delete(t.tagNotes, id)
+		}
+	})
+}
+
+// reindex queues a note to have its search document brought up to date. The
+// caller must hold the write lock.
+func (tx *inMemoryTransaction) reindex(noteID uint64) {
+	job := indexJob{TenantID: tx.tenantID, NoteID: noteID}
+	if tx.locked {
+		tx.pending = append(tx.pending, job)
+		return
+	}
+	tx.enqueue(job)
+	tx.indexer.notify()
+}
+
+func (tx *inMemoryTransaction) FindNoteByID(id uint64) (*Note, error) {
+	defer tx.rlock()()
+	t := tx.readPartition()
+	if note, ok := t.notes[id]; ok {
+		return t.withTags(note), nil
+	}
+
+	return nil, nil
+}
+
+func (tx *inMemoryTransaction) FindAllNotes() ([]*Note, error) {
+	defer tx.rlock()()
+	t := tx.readPartition()
+	ids := make([]uint64, 0, len(t.notes))
+	for id := range t.notes {
+		ids = append(ids, id)
+	}
+	sortIDs(ids)
+
+	notes := make([]*Note, len(ids))
+	for i, id := range ids {
+		notes[i] = t.withTags(t.notes[id])
+	}
+
+	return notes, nil
+}
+
+func (tx *inMemoryTransaction) FindTrashedNotes() ([]*Note, error) {
+	defer tx.rlock()()
+	t := tx.readPartition()
+	ids := make([]uint64, 0, len(t.trash))
+	for id := range t.trash {
+		ids = append(ids, id)
+	}
+	sortIDs(ids)
+
+	notes := make([]*Note, len(ids))
+	for i, id := range ids {
+		notes[i] = t.withTags(t.trash[id])
+	}
+
+	return notes, nil
+}
+
+func (tx *inMemoryTransaction) FindNotes(q NoteQuery) (*NotePage, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	after, err := q.after()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.rlock()()
+	t := tx.readPartition()
+	notes := make([]*Note, 0)
+	for id, note := range t.notes {
+		if q.TagID > 0 {
+			if _, ok := t.noteTags[id][q.TagID]; !ok {
+				continue
+			}
+		}
+		note := note
+		if q.matches(&note) {
+			notes = append(notes, &note)
+		}
+	}
+
+	notes = q.sort(notes, after)
+	if q.Limit > 0 && len(notes) > q.Limit+1 {
+		notes = notes[:q.Limit+1]
+	}
+	for i, note := range notes {
+		notes[i] = t.withTags(*note)
+	}
+	return q.page(notes), nil
+}
+
+func (tx *inMemoryTransaction) FindTagByID(id uint64) (*Tag, error) {
+	defer tx.rlock()()
+	if tag, ok := tx.readPartition().tags[id]; ok {
+		return &tag, nil
+	}
+
+	return nil, nil
+}
+
+func (tx *inMemoryTransaction) FindAllTags() ([]*Tag, error) {
+	defer tx.rlock()()
+	t := tx.readPartition()
+	ids := make([]uint64, 0, len(t.tags))
+	for id := range t.tags {
+		ids = append(ids, id)
+	}
+	sortIDs(ids)
+
+	tags := make([]*Tag, len(ids))
+	for i, id := range ids {
+		tag := t.tags[id]
+		tags[i] = &tag
+	}
+
+	return tags, nil
+}
+
+func (tx *inMemoryTransaction) FindTags(q TagQuery) (*TagPage, error) {
+	after, err := q.after()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.rlock()()
+	t := tx.readPartition()
+	ids := make([]uint64, 0, len(t.tags))
+	for id := range t.tags {
+		if id > after {
+			ids = append(ids, id)
+		}
+	}
+	sortIDs(ids)
+	if q.Limit > 0 && len(ids) > q.Limit+1 {
+		ids = ids[:q.Limit+1]
+	}
+
+	tags := make([]*Tag, len(ids))
+	for i, id := range ids {
+		tag := t.tags[id]
+		tags[i] = &tag
+	}
+	return q.page(tags), nil
+}
+
+func (tx *inMemoryTransaction) FindRevisions(noteID uint64) ([]*Revision, error) {
+	defer tx.rlock()()
+	stored := tx.readPartition().revisions[noteID]
+	revisions := make([]*Revision, len(stored))
+	for i, rev := range stored {
+		rev := rev
+		revisions[i] = &rev
+	}
+
+	return revisions, nil
+}
+
+func (tx *inMemoryTransaction) FindRevision(noteID, rev uint64) (*Revision, error) {
+	defer tx.rlock()()
+	for _, revision := range tx.readPartition().revisions[noteID] {
+		if revision.Rev == rev {
+			return &revision, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (tx *inMemoryTransaction) CreateNote(note *Note) error {
+	defer tx.lock()()
+	note.ID = tx.nextID()
+	note.Version = 1
+	now := time.Now()
+	note.CreatedAt = now
+	note.UpdatedAt = now
+	note.DeletedAt = nil
+
+	stored := *note
+	stored.Tags = nil
+	t := tx.partition()
+	tx.saveNote(t, note.ID)
+	t.notes[note.ID] = stored
+	tx.addRevision(t, &stored)
+	tx.reindex(note.ID)
+	return nil
+}
+
+func (tx *inMemoryTransaction) UpdateNote(id uint64, update *Note) error {
+	defer tx.lock()()
+	t := tx.partition()
+	note, ok := t.notes[id]
+	if !ok {
+		return noteNotFound(id)
+	}
+
+	tx.saveNote(t, id)
+	note.Version++
+	note.Title = update.Title
+	note.Content = update.Content
+	note.UpdatedAt = time.Now()
+	note.UpdatedBy = update.UpdatedBy
+	t.notes[id] = note
+	tx.addRevision(t, &note)
+
+	update.ID = note.ID
+	update.Version = note.Version
+	update.CreatedAt = note.CreatedAt
+	update.UpdatedAt = note.UpdatedAt
+	tx.reindex(id)
+	return nil
+}
+
+func (tx *inMemoryTransaction) CheckNoteVersion(id, version uint64) error {
+	defer tx.rlock()()
+	note, ok := tx.readPartition().notes[id]
+	if !ok {
+		return noteNotFound(id)
+	}
+	return checkVersion(&note, version)
+}
+
+func (tx *inMemoryTransaction) DeleteNote(id uint64) error {
+	defer tx.lock()()
+	t := tx.partition()
+	note, ok := t.notes[id]
+	if !ok {
+		return noteNotFound(id)
+	}
+
+	tx.saveNote(t, id)
+	now := time.Now()
+	note.DeletedAt = &now
+	t.trash[id] = note
+	delete(t.notes, id)
+	tx.reindex(id)
+	return nil
+}
+
+func (tx *inMemoryTransaction) RestoreNote(id uint64) error {
+	defer tx.lock()()
+	t := tx.partition()
+	note, ok := t.trash[id]
+	if !ok {
+		return noteNotFound(id)
+	}
+
+	tx.saveNote(t, id)
+	note.DeletedAt = nil
+	t.notes[id] = note
+	delete(t.trash, id)
+	tx.reindex(id)
+	return nil
+}
+
+func (tx *inMemoryTransaction) PurgeNote(id uint64) error {
+	defer tx.lock()()
+	t := tx.partition()
+	if _, ok := t.trash[id]; !ok {
+		return noteNotFound(id)
+	}
+
+	tx.saveNote(t, id)
+	for tagID := range t.noteTags[id] {
+		tx.saveTag(t, tagID)
+	}
+	t.purge(id)
+	return nil
+}
+
+func (tx *inMemoryTransaction) CreateTag(tag *Tag) error {
+	defer tx.lock()()
+	t := tx.partition()
+	if _, ok := t.tagNamed(tag.Name); ok {
+		return tagExists(tag.Name)
+	}
+
+	tag.ID = tx.nextID()
+	tag.CreatedAt = time.Now()
+	tx.saveTag(t, tag.ID)
+	t.tags[tag.ID] = *tag
+	return nil
+}
+
+func (tx *inMemoryTransaction) UpdateTag(id uint64, update *Tag) error {
+	defer tx.lock()()
+	t := tx.partition()
+	tag, ok := t.tags[id]
+	if !ok {
+		return tagNotFound(id)
+	}
+	if other, ok := t.tagNamed(update.Name); ok && other != id {
+		return tagExists(update.Name)
+	}
+
+	tx.saveTag(t, id)
+	tag.Name = update.Name
+	tag.Color = update.Color
+	tag.Description = update.Description
+	t.tags[id] = tag
+	*update = tag
+
+	for noteID := range t.tagNotes[id] {
+		tx.reindex(noteID)
+	}
+	return nil
+}
+
+func (tx *inMemoryTransaction) DeleteTag(id uint64) error {
+	defer tx.lock()()
+	t := tx.partition()
+	if _, ok := t.tags[id]; !ok {
+		return tagNotFound(id)
+	}
+
+	tx.saveTag(t, id)
+	for noteID := range t.tagNotes[id] {
+		tx.saveNote(t, noteID)
+		t.unlink(noteID, id)
+		tx.reindex(noteID)
+	}
+	delete(t.tags, id)
+	return nil
+}
+
+func (tx *inMemoryTransaction) MergeTag(id, intoID uint64) error {
+	defer tx.lock()()
+	t := tx.partition()
+	if _, ok := t.tags[id]; !ok {
+		return tagNotFound(id)
+	}
+	if _, ok := t.tags[intoID]; !ok {
+		return tagNotFound(intoID)
+	}
+	if id == intoID {
+		return fmt.Errorf("cannot merge tag %d into itself", id)
+	}
+
+	tx.saveTag(t, id)
+	tx.saveTag(t, intoID)
+	for noteID := range t.tagNotes[id] {
+		tx.saveNote(t, noteID)
+		t.unlink(noteID, id)
+		t.link(noteID, intoID)
+		tx.reindex(noteID)
+	}
+	delete(t.tags, id)
+	return nil
+}
+
+func (tx *inMemoryTransaction) TagNote(noteID, tagID uint64) error {
+	defer tx.lock()()
+	t := tx.partition()
+	if _, ok := t.notes[noteID]; !ok {
+		return noteNotFound(noteID)
+	}
+	if _, ok := t.tags[tagID]; !ok {
+		return tagNotFound(tagID)
+	}
+
+	tx.saveNote(t, noteID)
+	tx.saveTag(t, tagID)
+	t.link(noteID, tagID)
+	tx.reindex(noteID)
+	return nil
+}
+
+func (tx *inMemoryTransaction) UntagNote(noteID, tagID uint64) error {
+	defer tx.lock()()
+	t := tx.partition()
+	tx.saveNote(t, noteID)
+	tx.saveTag(t, tagID)
+	t.unlink(noteID, tagID)
+	tx.reindex(noteID)
+	return nil
+}
+
+// addRevision records the current state of note as its next revision and
+// discards any revisions beyond the retention limit.
+func (tx *inMemoryTransaction) addRevision(t *inMemoryTenant, note *Note) {
+	revisions := t.revisions[note.ID]
+	var latest uint64
+	if len(revisions) > 0 {
+		latest = revisions[len(revisions)-1].Rev
+	}
+
+	revisions = append(revisions, *newRevision(note, latest+1))
+	if tx.revisionLimit > 0 && len(revisions) > tx.revisionLimit {
+		revisions = append([]Revision(nil), revisions[len(revisions)-tx.revisionLimit:]...)
+	}
+	t.revisions[note.ID] = revisions
+}
+
+// tagNamed returns the ID of the tag with the given name.
+func (t *inMemoryTenant) tagNamed(name string) (uint64, bool) {
+	for id, tag := range t.tags {
+		if tag.Name == name {
+			return id, true
 		}
 	}
+	return 0, false
+}
+
+func (t *inMemoryTenant) withTags(n Note) *Note {
+	for _, tagID := range t.noteTags[n.ID].sorted() {
+		tag := t.tags[tagID]
+		n.Tags = append(n.Tags, &tag)
+	}
 
 	return &n
 }
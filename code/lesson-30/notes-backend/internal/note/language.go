@@ -0,0 +1,146 @@
+package note
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/blevesearch/bleve/analysis/lang/cjk"
+	"github.com/blevesearch/bleve/analysis/lang/da"
+	"github.com/blevesearch/bleve/analysis/lang/de"
+	"github.com/blevesearch/bleve/analysis/lang/en"
+	"github.com/blevesearch/bleve/analysis/lang/es"
+	"github.com/blevesearch/bleve/analysis/lang/fi"
+	"github.com/blevesearch/bleve/analysis/lang/fr"
+	"github.com/blevesearch/bleve/analysis/lang/it"
+	"github.com/blevesearch/bleve/analysis/lang/nl"
+	"github.com/blevesearch/bleve/analysis/lang/no"
+	"github.com/blevesearch/bleve/analysis/lang/pt"
+	"github.com/blevesearch/bleve/analysis/lang/ru"
+	"github.com/blevesearch/bleve/analysis/lang/sv"
+)
+
+// defaultLanguage is the language of notes whose language is neither
+// configured for their tenant nor detected.
+const defaultLanguage = "en"
+
+// languageAnalyzers maps the languages that the Bleve index can analyze, by
+// ISO 639-1 code, to their analyzers. Chinese, Japanese and Korean text is
+// split into overlapping pairs of characters, as it has no spaces between
+// words.
+var languageAnalyzers = map[string]string{
+	"da": da.AnalyzerName,
+	"de": de.AnalyzerName,
+	"en": en.AnalyzerName,
+	"es": es.AnalyzerName,
+	"fi": fi.AnalyzerName,
+	"fr": fr.AnalyzerName,
+	"it": it.AnalyzerName,
+	"ja": cjk.AnalyzerName,
+	"ko": cjk.AnalyzerName,
+	"nl": nl.AnalyzerName,
+	"no": no.AnalyzerName,
+	"pt": pt.AnalyzerName,
+	"ru": ru.AnalyzerName,
+	"sv": sv.AnalyzerName,
+	"zh": cjk.AnalyzerName,
+}
+
+// searchLanguages returns the codes of the languages that the Bleve index
+// can analyze, in order.
+func searchLanguages() []string {
+	langs := make([]string, 0, len(languageAnalyzers))
+	for lang := range languageAnalyzers {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// languageStopWords are some of the most common words of the languages that
+// use the Latin alphabet which detectLanguage tells apart.
+var languageStopWords = map[string][]string{
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ein", "eine", "mit", "ich", "zu", "den", "von", "auf", "sie", "es", "für", "sich", "auch", "wir"},
+	"en": {"the", "and", "is", "of", "to", "in", "that", "it", "for", "with", "you", "was", "this", "are", "on", "be", "have", "not", "we", "at"},
+	"es": {"el", "la", "los", "las", "y", "es", "un", "una", "de", "que", "en", "por", "con", "para", "no", "del", "se", "lo", "está", "al"},
+	"fr": {"le", "la", "les", "et", "est", "un", "une", "des", "du", "pas", "pour", "que", "qui", "dans", "avec", "sur", "je", "ce", "il", "nous"},
+	"it": {"il", "la", "di", "che", "e", "è", "un", "una", "per", "non", "con", "del", "della", "sono", "gli", "le", "mi", "ho", "lo", "nel"},
+	"nl": {"de", "het", "een", "en", "is", "van", "niet", "dat", "ik", "je", "op", "met", "voor", "zijn", "er", "maar", "ook", "wij", "te", "naar"},
+	"pt": {"o", "a", "os", "as", "e", "é", "um", "uma", "de", "que", "não", "do", "da", "em", "para", "com", "por", "se", "mais", "na"},
+	"sv": {"och", "att", "det", "som", "en", "är", "på", "för", "med", "jag", "inte", "den", "har", "till", "av", "om", "ett", "vi", "var", "men"},
+}
+
+// minLanguageStopWords is the number of stop words that text must contain
+// for its language to be detected from them.
+const minLanguageStopWords = 2
+
+// detectLanguage guesses the language of text, and returns "" if it cannot.
+// Chinese, Japanese, Korean and Russian are told by their scripts, and the
+// languages of languageStopWords by which of their stop words the text has
+// most of. It knows too little to be right about short or mixed text, which
+// is why a tenant's language can be configured instead.
+func detectLanguage(text string) string {
+	var letters, han, kana, hangul, cyrillic int
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			kana++
+		case unicode.Is(unicode.Han, r):
+			han++
+		case unicode.Is(unicode.Hangul, r):
+			hangul++
+		case unicode.Is(unicode.Cyrillic, r):
+			cyrillic++
+		case !unicode.IsLetter(r):
+			continue
+		}
+		letters++
+	}
+	if letters == 0 {
+		return ""
+	}
+	switch {
+	case kana > 0 && (kana+han)*2 >= letters:
+		return "ja"
+	case hangul*2 >= letters:
+		return "ko"
+	case han*2 >= letters:
+		return "zh"
+	case cyrillic*2 >= letters:
+		return "ru"
+	}
+
+	counts := make(map[string]int)
+	for _, word := range suggestWords(text) {
+		counts[word]++
+	}
+	best, bestCount, tied := "", 0, false
+	for _, lang := range searchLanguages() {
+		n := 0
+		for _, word := range languageStopWords[lang] {
+			n += counts[word]
+		}
+		switch {
+		case n > bestCount:
+			best, bestCount, tied = lang, n, false
+		case n == bestCount:
+			tied = true
+		}
+	}
+	if bestCount < minLanguageStopWords || tied {
+		return ""
+	}
+	return best
+}
+
+// noteLanguage returns the language in which a note is analyzed: the
+// tenant's, if one is configured, or else the one detected from the note.
+func noteLanguage(languages map[string]string, tenantID string, note *Note) string {
+	if lang := languages[tenantID]; lang != "" {
+		return lang
+	}
+	if lang := detectLanguage(strings.Join([]string{note.Title, note.Content}, "\n")); lang != "" {
+		return lang
+	}
+	return defaultLanguage
+}
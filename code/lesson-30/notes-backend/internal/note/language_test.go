@@ -0,0 +1,37 @@
+package note
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"The agenda for the weekly meeting is on the wiki", "en"},
+		{"Wir treffen uns mit der Gruppe und reden über die Pläne", "de"},
+		{"Nous avons une réunion dans la salle avec le directeur", "fr"},
+		{"La reunión es en la oficina con los clientes", "es"},
+		{"東京で会議があります", "ja"},
+		{"我们明天在北京开会", "zh"},
+		{"내일 서울에서 회의가 있습니다", "ko"},
+		{"Встреча завтра в офисе", "ru"},
+		{"Tacos", ""},
+		{"", ""},
+		{"12:30", ""},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, detectLanguage(tt.text), "text %q", tt.text)
+	}
+}
+
+func TestNoteLanguage(t *testing.T) {
+	languages := map[string]string{"tenant-de": "de"}
+	english := &Note{Title: "Meeting", Content: "The agenda is on the wiki"}
+	assert.Equal(t, "de", noteLanguage(languages, "tenant-de", english), "should prefer the tenant's language")
+	assert.Equal(t, "en", noteLanguage(languages, "tenant1", english))
+	assert.Equal(t, "ja", noteLanguage(languages, "tenant1", &Note{Title: "会議があります"}))
+	assert.Equal(t, defaultLanguage, noteLanguage(languages, "tenant1", &Note{Title: "Tacos"}))
+}
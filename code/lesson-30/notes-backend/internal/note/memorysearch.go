@@ -0,0 +1,805 @@
+package note
+
+import (
+	"html"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// NewMemorySearchIndex creates a SearchIndex that keeps an inverted index of
+// each tenant's notes in memory. It starts out empty and is lost when the
+// process exits, so it suits the memory repository in demos and tests, which
+// then leave nothing behind on disk.
+func NewMemorySearchIndex() *MemorySearchIndex {
+	return &MemorySearchIndex{
+		tenants: make(map[string]*memorySearchTenant),
+	}
+}
+
+// MemorySearchIndex is safe for concurrent use. It supports the whole query
+// language, facets, suggestions, corrections and related notes, with a
+// simpler analyzer and scoring than Bleve's.
+type MemorySearchIndex struct {
+	mu      sync.RWMutex
+	tenants map[string]*memorySearchTenant
+}
+
+// memorySearchTenant holds a tenant's documents, and for each field the
+// documents that contain each term. The fields are "title", "content" and
+// "tags", which hold analyzed terms, and "tagNames", which holds whole tag
+// names for matching tags exactly.
+type memorySearchTenant struct {
+	docs     map[uint64]*memoryDocument
+	postings map[string]map[string]idSet
+}
+
+func newMemorySearchTenant() *memorySearchTenant {
+	return &memorySearchTenant{
+		docs:     make(map[uint64]*memoryDocument),
+		postings: make(map[string]map[string]idSet),
+	}
+}
+
+// memoryDocument is what the index keeps of a note.
+type memoryDocument struct {
+	id                   uint64
+	title, content       string
+	tags                 []string
+	createdAt, updatedAt time.Time
+	// fields maps each field to the positions of its terms.
+	fields map[string]map[string][]int
+	// words is the set of lower-case words of the title and content, from
+	// which misspelt words are corrected.
+	words map[string]bool
+}
+
+func newMemoryDocument(note *Note) *memoryDocument {
+	d := &memoryDocument{
+		id:        note.ID,
+		title:     note.Title,
+		content:   note.Content,
+		createdAt: note.CreatedAt,
+		updatedAt: note.UpdatedAt,
+		fields:    make(map[string]map[string][]int),
+		words:     make(map[string]bool),
+	}
+	d.addTerms("title", note.Title)
+	d.addTerms("content", note.Content)
+	for _, tag := range note.Tags {
+		if tag == nil {
+			continue
+		}
+		d.tags = append(d.tags, tag.Name)
+		d.addTerms("tags", tag.Name)
+		d.addTerm("tagNames", tag.Name, 0)
+	}
+	for _, word := range suggestWords(note.Title + " " + note.Content) {
+		d.words[word] = true
+	}
+	return d
+}
+
+func (d *memoryDocument) addTerms(field, text string) {
+	for _, token := range analyze(text) {
+		d.addTerm(field, token.term, token.pos)
+	}
+}
+
+func (d *memoryDocument) addTerm(field, term string, pos int) {
+	if d.fields[field] == nil {
+		d.fields[field] = make(map[string][]int)
+	}
+	d.fields[field][term] = append(d.fields[field][term], pos)
+}
+
+// length returns the number of terms in a field.
+func (d *memoryDocument) length(field string) int {
+	n := 0
+	for _, positions := range d.fields[field] {
+		n += len(positions)
+	}
+	return n
+}
+
+func (t *memorySearchTenant) add(d *memoryDocument) {
+	t.docs[d.id] = d
+	for field, terms := range d.fields {
+		if t.postings[field] == nil {
+			t.postings[field] = make(map[string]idSet)
+		}
+		for term := range terms {
+			if t.postings[field][term] == nil {
+				t.postings[field][term] = make(idSet)
+			}
+			t.postings[field][term][d.id] = struct{}{}
+		}
+	}
+}
+
+func (t *memorySearchTenant) remove(id uint64) bool {
+	d, ok := t.docs[id]
+	if !ok {
+		return false
+	}
+	delete(t.docs, id)
+	for field, terms := range d.fields {
+		for term := range terms {
+			delete(t.postings[field][term], id)
+			if len(t.postings[field][term]) == 0 {
+				delete(t.postings[field], term)
+			}
+		}
+	}
+	return true
+}
+
+func (i *MemorySearchIndex) IndexNote(tenantID string, note *Note) error {
+	d := newMemoryDocument(note)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	t := i.tenants[tenantID]
+	if t == nil {
+		t = newMemorySearchTenant()
+		i.tenants[tenantID] = t
+	}
+	t.remove(note.ID)
+	t.add(d)
+	return nil
+}
+
+func (i *MemorySearchIndex) RemoveNote(tenantID string, id uint64) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	t := i.tenants[tenantID]
+	if t == nil || !t.remove(id) {
+		return errNotIndexed
+	}
+	if len(t.docs) == 0 {
+		delete(i.tenants, tenantID)
+	}
+	return nil
+}
+
+func (i *MemorySearchIndex) indexedNotes() (map[string]map[uint64]time.Time, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	notes := make(map[string]map[uint64]time.Time, len(i.tenants))
+	for tenantID, t := range i.tenants {
+		stamps := make(map[uint64]time.Time, len(t.docs))
+		for id, d := range t.docs {
+			stamps[id] = d.updatedAt
+		}
+		notes[tenantID] = stamps
+	}
+	return notes, nil
+}
+
+// tenant returns a tenant's part of the index, which is empty if the tenant
+// has no documents. The caller must hold the read lock.
+func (i *MemorySearchIndex) tenant(tenantID string) *memorySearchTenant {
+	if t := i.tenants[tenantID]; t != nil {
+		return t
+	}
+	return newMemorySearchTenant()
+}
+
+func (i *MemorySearchIndex) Search(tenantID string, r SearchRequest) (*SearchResult, error) {
+	expr, err := parseSearchQuery(r.Query)
+	if err != nil {
+		return nil, err
+	}
+	if expr == nil {
+		return &SearchResult{Hits: make([]*SearchHit, 0)}, nil
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	t := i.tenant(tenantID)
+	res := t.search(expr, r)
+	if res.Total == 0 {
+		res.DidYouMean = t.didYouMean(r.Query)
+	}
+	return res, nil
+}
+
+func (t *memorySearchTenant) search(expr searchExpr, r SearchRequest) *SearchResult {
+	scores := t.match(expr)
+	ids := rankScores(scores)
+	res := &SearchResult{
+		Total:  uint64(len(ids)),
+		Hits:   make([]*SearchHit, 0),
+		Facets: t.facets(ids, time.Now()),
+	}
+
+	terms := highlightTerms(expr)
+	for j := r.From; j < len(ids) && j < r.From+r.size(); j++ {
+		d := t.docs[ids[j]]
+		res.Hits = append(res.Hits, &SearchHit{
+			NoteID:     d.id,
+			Score:      scores[d.id],
+			Highlights: d.highlights(terms),
+		})
+	}
+	return res
+}
+
+// rankScores orders the IDs of scored documents from the highest score.
+func rankScores(scores map[uint64]float64) []uint64 {
+	ids := make([]uint64, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool {
+		if scores[ids[a]] != scores[ids[b]] {
+			return scores[ids[a]] > scores[ids[b]]
+		}
+		return ids[a] < ids[b]
+	})
+	return ids
+}
+
+// match scores the documents that match a parsed query, as Bleve would: bare
+// words and phrases match the title, content or tags, and every word of a
+// term must match.
+func (t *memorySearchTenant) match(expr searchExpr) map[uint64]float64 {
+	switch e := expr.(type) {
+	case termExpr:
+		if e.field == "tag" {
+			return t.matchTagName(e.text)
+		}
+		fields := []string{e.field}
+		if e.field == "" {
+			fields = []string{"title", "content"}
+		}
+		if e.phrase {
+			scores := t.matchPhrase(fields, analyze(e.text))
+			if e.field == "" {
+				addScores(scores, t.matchTagName(e.text))
+			}
+			return scores
+		}
+		if e.field == "" {
+			fields = append(fields, "tags")
+		}
+		return t.matchWords(fields, analyze(e.text))
+	case timeRangeExpr:
+		scores := make(map[uint64]float64)
+		for id, d := range t.docs {
+			if e.matches(d) {
+				scores[id] = 0
+			}
+		}
+		return scores
+	case notExpr:
+		excluded := t.match(e.expr)
+		scores := make(map[uint64]float64)
+		for id := range t.docs {
+			if _, ok := excluded[id]; !ok {
+				scores[id] = 0
+			}
+		}
+		return scores
+	case andExpr:
+		var scores map[uint64]float64
+		for j, expr := range e {
+			matched := t.match(expr)
+			if j == 0 {
+				scores = matched
+				continue
+			}
+			for id, score := range scores {
+				if s, ok := matched[id]; ok {
+					scores[id] = score + s
+				} else {
+					delete(scores, id)
+				}
+			}
+		}
+		return scores
+	case orExpr:
+		scores := make(map[uint64]float64)
+		for _, expr := range e {
+			addScores(scores, t.match(expr))
+		}
+		return scores
+	}
+	return nil
+}
+
+func addScores(scores, more map[uint64]float64) {
+	for id, score := range more {
+		scores[id] += score
+	}
+}
+
+func (e timeRangeExpr) matches(d *memoryDocument) bool {
+	ts := d.createdAt
+	if e.field == "updatedAt" {
+		ts = d.updatedAt
+	}
+	if !e.start.IsZero() && (ts.Before(e.start) || !e.startInclusive && ts.Equal(e.start)) {
+		return false
+	}
+	if !e.end.IsZero() && (ts.After(e.end) || !e.endInclusive && ts.Equal(e.end)) {
+		return false
+	}
+	return true
+}
+
+func (t *memorySearchTenant) matchTagName(name string) map[uint64]float64 {
+	scores := make(map[uint64]float64)
+	for id := range t.postings["tagNames"][name] {
+		scores[id] = t.termScore("tagNames", name, id)
+	}
+	return scores
+}
+
+// matchWords matches the documents in which each term is in one of fields.
+// Text without any terms, such as stop words alone, matches nothing.
+func (t *memorySearchTenant) matchWords(fields []string, tokens []memoryToken) map[uint64]float64 {
+	var scores map[uint64]float64
+	for _, token := range tokens {
+		matched := make(map[uint64]float64)
+		for _, field := range fields {
+			for id := range t.postings[field][token.term] {
+				matched[id] += t.termScore(field, token.term, id)
+			}
+		}
+		if scores == nil {
+			scores = matched
+			continue
+		}
+		for id, score := range scores {
+			if s, ok := matched[id]; ok {
+				scores[id] = score + s
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+	return scores
+}
+
+// matchPhrase matches the documents in which the terms are in one of fields
+// in the same order and at the same distances from each other.
+func (t *memorySearchTenant) matchPhrase(fields []string, tokens []memoryToken) map[uint64]float64 {
+	scores := make(map[uint64]float64)
+	if len(tokens) == 0 {
+		return scores
+	}
+	for _, field := range fields {
+		for id := range t.postings[field][tokens[0].term] {
+			positions := t.docs[id].fields[field]
+			if !containsPhrase(positions, tokens) {
+				continue
+			}
+			for _, token := range tokens {
+				scores[id] += t.termScore(field, token.term, id)
+			}
+		}
+	}
+	return scores
+}
+
+func containsPhrase(positions map[string][]int, tokens []memoryToken) bool {
+	for _, start := range positions[tokens[0].term] {
+		found := true
+		for _, token := range tokens[1:] {
+			if !containsInt(positions[token.term], start+token.pos-tokens[0].pos) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(ns []int, n int) bool {
+	for _, m := range ns {
+		if m == n {
+			return true
+		}
+	}
+	return false
+}
+
+// termScore weighs a term in a document's field by TF-IDF, normalized by the
+// length of the field, as Lucene's classic similarity does.
+func (t *memorySearchTenant) termScore(field, term string, id uint64) float64 {
+	d := t.docs[id]
+	tf := float64(len(d.fields[field][term]))
+	idf := 1 + math.Log(float64(len(t.docs))/float64(len(t.postings[field][term])+1))
+	return math.Sqrt(tf) * idf * idf / math.Sqrt(float64(d.length(field)))
+}
+
+// facets counts the hits by tag and by date as the Bleve index does.
+func (t *memorySearchTenant) facets(ids []uint64, now time.Time) *SearchFacets {
+	counts := make(map[string]int)
+	for _, id := range ids {
+		for _, name := range t.docs[id].tags {
+			counts[name]++
+		}
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(a, b int) bool {
+		if counts[names[a]] != counts[names[b]] {
+			return counts[names[a]] > counts[names[b]]
+		}
+		return names[a] < names[b]
+	})
+	if len(names) > searchTagFacetSize {
+		names = names[:searchTagFacetSize]
+	}
+
+	facets := &SearchFacets{Tags: make([]*FacetCount, len(names))}
+	for j, name := range names {
+		facets.Tags[j] = &FacetCount{Value: name, Count: counts[name], Filter: tagFilter(name)}
+	}
+
+	ranges := dateFacetRanges(now)
+	facets.Created = t.dateFacets(ids, ranges, "created", func(d *memoryDocument) time.Time { return d.createdAt })
+	facets.Updated = t.dateFacets(ids, ranges, "updated", func(d *memoryDocument) time.Time { return d.updatedAt })
+	return facets
+}
+
+func (t *memorySearchTenant) dateFacets(ids []uint64, ranges []dateFacetRange, field string, date func(*memoryDocument) time.Time) []*FacetCount {
+	facets := make([]*FacetCount, 0, len(ranges))
+	for _, r := range ranges {
+		n := 0
+		for _, id := range ids {
+			ts := date(t.docs[id])
+			if (r.start.IsZero() || !ts.Before(r.start)) && (r.end.IsZero() || ts.Before(r.end)) {
+				n++
+			}
+		}
+		if n > 0 {
+			facets = append(facets, &FacetCount{Value: r.name, Count: n, Filter: r.filter(field)})
+		}
+	}
+	return facets
+}
+
+// highlightTerms collects the terms that a query looks for in titles and
+// content, by field. Negated terms are not highlighted.
+func highlightTerms(expr searchExpr) map[string]map[string]bool {
+	terms := map[string]map[string]bool{
+		"title":   make(map[string]bool),
+		"content": make(map[string]bool),
+	}
+	var collect func(expr searchExpr)
+	collect = func(expr searchExpr) {
+		switch e := expr.(type) {
+		case termExpr:
+			if e.field == "tag" {
+				return
+			}
+			for _, token := range analyze(e.text) {
+				for field := range terms {
+					if e.field == "" || e.field == field {
+						terms[field][token.term] = true
+					}
+				}
+			}
+		case andExpr:
+			for _, expr := range e {
+				collect(expr)
+			}
+		case orExpr:
+			for _, expr := range e {
+				collect(expr)
+			}
+		}
+	}
+	collect(expr)
+	return terms
+}
+
+// highlightFragmentSize is the length in bytes of the fragment of a field
+// that a highlight is cut down to.
+const highlightFragmentSize = 200
+
+// highlights marks the terms in the title and content, leaving out fields
+// without any.
+func (d *memoryDocument) highlights(terms map[string]map[string]bool) map[string][]string {
+	var h map[string][]string
+	for field, text := range map[string]string{"title": d.title, "content": d.content} {
+		frag := highlight(text, terms[field])
+		if frag == "" {
+			continue
+		}
+		if h == nil {
+			h = make(map[string][]string)
+		}
+		h[field] = []string{frag}
+	}
+	return h
+}
+
+// highlight escapes text as HTML and wraps the words whose terms are in terms
+// in <mark> tags. Text longer than highlightFragmentSize is cut down to a
+// fragment around the first match. It returns "" if nothing matches.
+func highlight(text string, terms map[string]bool) string {
+	var marked []memoryToken
+	for _, token := range analyze(text) {
+		if terms[token.term] {
+			marked = append(marked, token)
+		}
+	}
+	if len(marked) == 0 {
+		return ""
+	}
+
+	start, end := 0, len(text)
+	if end > highlightFragmentSize {
+		if start = marked[0].start - highlightFragmentSize/4; start < 0 {
+			start = 0
+		}
+		for start > 0 && !utf8.RuneStart(text[start]) {
+			start--
+		}
+		if end = start + highlightFragmentSize; end > len(text) {
+			end = len(text)
+		}
+		for end < len(text) && !utf8.RuneStart(text[end]) {
+			end--
+		}
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, token := range marked {
+		if token.start < start || token.end > end {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[pos:token.start]))
+		b.WriteString("<mark>" + html.EscapeString(text[token.start:token.end]) + "</mark>")
+		pos = token.end
+	}
+	b.WriteString(html.EscapeString(text[pos:end]))
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// didYouMean corrects the words of a query that found nothing with words of
+// the tenant's notes, as the Bleve index does.
+func (t *memorySearchTenant) didYouMean(query string) string {
+	corrected, _ := correctQuery(query, func(word string) (string, error) {
+		return t.correct(word), nil
+	})
+	if corrected == "" {
+		return ""
+	}
+	expr, err := parseSearchQuery(corrected)
+	if err != nil || expr == nil || len(t.match(expr)) == 0 {
+		return ""
+	}
+	return corrected
+}
+
+func (t *memorySearchTenant) correct(word string) string {
+	if maxEdits(word) == 0 {
+		return ""
+	}
+	counts := make(map[string]int)
+	for _, d := range t.docs {
+		for w := range d.words {
+			counts[w]++
+		}
+	}
+	return closestWord(word, counts)
+}
+
+// Suggest ranks titles by how much of them the prefix covers, and tags by the
+// number of the tenant's notes they are on.
+func (i *MemorySearchIndex) Suggest(tenantID, prefix string, limit int) (*Suggestions, error) {
+	s := &Suggestions{
+		Titles: make([]*TitleSuggestion, 0),
+		Tags:   make([]*TagSuggestion, 0),
+	}
+	words := suggestWords(prefix)
+	if len(words) == 0 || limit <= 0 {
+		return s, nil
+	}
+	typed := 0
+	for _, word := range words {
+		typed += utf8.RuneCountInString(word)
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	t := i.tenant(tenantID)
+
+	scores := make(map[uint64]float64)
+	counts := make(map[string]int)
+	for id, d := range t.docs {
+		if hasWordPrefixes(d.title, words) {
+			scores[id] = float64(typed) / float64(utf8.RuneCountInString(strings.Join(suggestWords(d.title), "")))
+		}
+		for _, name := range d.tags {
+			if hasWordPrefixes(name, words) {
+				counts[name]++
+			}
+		}
+	}
+
+	for _, id := range rankScores(scores) {
+		if len(s.Titles) == limit {
+			break
+		}
+		s.Titles = append(s.Titles, &TitleSuggestion{NoteID: id, Title: t.docs[id].title, Score: scores[id]})
+	}
+	for name, count := range counts {
+		s.Tags = append(s.Tags, &TagSuggestion{Name: name, Count: count})
+	}
+	sort.Slice(s.Tags, func(a, b int) bool {
+		if s.Tags[a].Count != s.Tags[b].Count {
+			return s.Tags[a].Count > s.Tags[b].Count
+		}
+		return s.Tags[a].Name < s.Tags[b].Name
+	})
+	if len(s.Tags) > limit {
+		s.Tags = s.Tags[:limit]
+	}
+	return s, nil
+}
+
+// Related finds the notes that share the note's tags and the words that are
+// frequent in it but rare among the tenant's other notes.
+func (i *MemorySearchIndex) Related(tenantID string, note *Note, limit int) (*SearchResult, error) {
+	res := &SearchResult{Hits: make([]*SearchHit, 0)}
+	if limit <= 0 {
+		return res, nil
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	t := i.tenant(tenantID)
+
+	counts := make(map[string]int)
+	for _, text := range []string{note.Title, note.Content} {
+		for _, token := range analyze(text) {
+			counts[token.term]++
+		}
+	}
+	var terms []weightedTerm
+	for term, count := range counts {
+		others := make(idSet)
+		for _, field := range []string{"title", "content"} {
+			for id := range t.postings[field][term] {
+				if id != note.ID {
+					others[id] = struct{}{}
+				}
+			}
+		}
+		if len(others) == 0 {
+			continue
+		}
+		idf := 1 + math.Log(float64(len(t.docs))/float64(len(others)))
+		terms = append(terms, weightedTerm{term, math.Sqrt(float64(count)) * idf})
+	}
+
+	scores := make(map[uint64]float64)
+	for _, term := range topTerms(terms) {
+		for _, field := range []string{"title", "content"} {
+			for id := range t.postings[field][term.term] {
+				scores[id] += term.weight * t.termScore(field, term.term, id)
+			}
+		}
+	}
+	for _, tag := range note.Tags {
+		if tag == nil {
+			continue
+		}
+		for id := range t.postings["tagNames"][tag.Name] {
+			scores[id] += relatedTagBoost * t.termScore("tagNames", tag.Name, id)
+		}
+	}
+	delete(scores, note.ID)
+
+	ids := rankScores(scores)
+	res.Total = uint64(len(ids))
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	for _, id := range ids {
+		res.Hits = append(res.Hits, &SearchHit{NoteID: id, Score: scores[id]})
+	}
+	return res, nil
+}
+
+// memoryToken is a term of analyzed text.
+type memoryToken struct {
+	term string
+	// pos is the position of the word in the text, counting stop words, and
+	// start and end its byte offsets.
+	pos, start, end int
+}
+
+// analyze splits text into lower-case words, drops stop words and stems the
+// rest.
+func analyze(text string) []memoryToken {
+	isWordRune := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsNumber(r)
+	}
+	var tokens []memoryToken
+	pos := 0
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if !isWordRune(r) {
+			i += size
+			continue
+		}
+		start := i
+		for i < len(text) {
+			r, size := utf8.DecodeRuneInString(text[i:])
+			if !isWordRune(r) {
+				break
+			}
+			i += size
+		}
+		word := strings.ToLower(text[start:i])
+		if !stopWords[word] {
+			tokens = append(tokens, memoryToken{term: stem(word), pos: pos, start: start, end: i})
+		}
+		pos++
+	}
+	return tokens
+}
+
+// stopWords are too common in English to be worth indexing.
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "but": true, "by": true, "for": true, "if": true, "in": true,
+	"into": true, "is": true, "it": true, "no": true, "not": true, "of": true,
+	"on": true, "or": true, "such": true, "that": true, "the": true,
+	"their": true, "then": true, "there": true, "these": true, "they": true,
+	"this": true, "to": true, "was": true, "will": true, "with": true,
+}
+
+// minStemLength is the length of the shortest stem that a suffix is stripped
+// down to.
+const minStemLength = 3
+
+// stemSuffixes are the plural suffixes and then the verb endings that stem
+// strips. At most one suffix of each group is stripped: the first that the
+// word ends with.
+var stemSuffixes = [][]struct{ suffix, replacement string }{
+	{{"sses", "ss"}, {"ies", "y"}, {"ss", "ss"}, {"s", ""}},
+	{{"ing", ""}, {"ed", ""}},
+}
+
+// stem strips the most common English inflections from a lower-case word, so
+// that "tacos" matches "taco" and "meetings" matches "meeting". It is much
+// cruder than a real stemmer, but words are stemmed alike when they are
+// indexed and searched for.
+func stem(word string) string {
+	for _, group := range stemSuffixes {
+		for _, s := range group {
+			if !strings.HasSuffix(word, s.suffix) {
+				continue
+			}
+			if stem := strings.TrimSuffix(word, s.suffix); utf8.RuneCountInString(stem) >= minStemLength {
+				word = stem + s.replacement
+			}
+			break
+		}
+	}
+	return word
+}
@@ -0,0 +1,67 @@
+package note
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemorySearchIndex(t *testing.T) {
+	testSearchIndex(t, NewMemorySearchIndex())
+}
+
+func TestMemorySearchResults(t *testing.T) {
+	testSearchResults(t, NewMemorySearchIndex())
+}
+
+func TestMemorySearchQueryLanguage(t *testing.T) {
+	testSearchQueryLanguage(t, NewMemorySearchIndex())
+}
+
+func TestMemorySearchFacets(t *testing.T) {
+	testSearchFacets(t, NewMemorySearchIndex())
+}
+
+func TestMemorySuggest(t *testing.T) {
+	testSuggest(t, NewMemorySearchIndex())
+}
+
+func TestMemoryDidYouMean(t *testing.T) {
+	testDidYouMean(t, NewMemorySearchIndex())
+}
+
+func TestMemoryRelated(t *testing.T) {
+	testRelated(t, NewMemorySearchIndex())
+}
+
+func TestAnalyze(t *testing.T) {
+	var terms []string
+	for _, token := range analyze("The tacos, meetings & classes: well-known!") {
+		terms = append(terms, token.term)
+	}
+	assert.Equal(t, []string{"taco", "meet", "class", "well", "known"}, terms)
+
+	tokens := analyze("Taco the Tuesday")
+	assert.Equal(t, 2, tokens[1].pos, "should count stop words in positions")
+	assert.Equal(t, "Tuesday", "Taco the Tuesday"[tokens[1].start:tokens[1].end])
+}
+
+func TestIndexAll(t *testing.T) {
+	repo := NewInMemoryRepo(RepositoryConfig{}, nopSearchIndex{})
+	defer repo.Close()
+	require.NoError(t, repo.Transaction("tenant1").CreateNote(&Note{Title: "Tacos"}))
+	require.NoError(t, repo.Transaction("tenant1").CreateNote(&Note{Title: "Burritos"}))
+	require.NoError(t, repo.Transaction("tenant2").CreateNote(&Note{Title: "Tacos"}))
+
+	idx := NewMemorySearchIndex()
+	n, err := IndexAll(repo, idx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	for _, tenantID := range []string{"tenant1", "tenant2"} {
+		ids, err := searchIDs(idx, tenantID, "tacos")
+		require.NoError(t, err)
+		assert.Len(t, ids, 1, "should index the notes of %s", tenantID)
+	}
+}
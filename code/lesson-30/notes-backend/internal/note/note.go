@@ -5,19 +5,29 @@ import (
 	"time"
 )
 
+// Note is a single note. Its Version starts at 1 and is incremented whenever
+// its title or content changes. UpdatedBy is the ID of the user who made the
+// latest change, and is empty if it was made with a tenant token.
 type Note struct {
-	ID        uint64    `json:"id"`
-	Title     string    `json:"title"`
-	Content   string    `json:"content"`
-	Tags      []*Tag    `json:"tags"`
-	CreatedAt time.Time `json:"createdAt"`
-	UpdatedAt time.Time `json:"updatedAt"`
+	ID        uint64     `json:"id"`
+	Version   uint64     `json:"version"`
+	Title     string     `json:"title"`
+	Content   string     `json:"content"`
+	Tags      []*Tag     `json:"tags"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	UpdatedBy string     `json:"updatedBy,omitempty"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
 }
 
+// Tag is a label that can be attached to any number of notes. Tag names are
+// unique within a tenant.
 type Tag struct {
-	ID        uint64    `json:"id"`
-	Name      string    `json:"name"`
-	CreatedAt time.Time `json:"createdAt"`
+	ID          uint64    `json:"id"`
+	Name        string    `json:"name"`
+	Color       string    `json:"color"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"createdAt"`
 }
 
 func (n *Note) MustMarshal() []byte {
@@ -0,0 +1,256 @@
+package notetest
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"learn-cljs.com/notes/internal/note"
+)
+
+// indexingTests check what repositories send to their search index, which
+// happens after a write has been committed.
+var indexingTests = []struct {
+	name string
+	test func(t *testing.T, repo note.Repository, idx *searchRecorder)
+}{
+	{"IndexesChanges", testIndexesChanges},
+	{"DeleteTagReindexes", testDeleteTagReindexes},
+	{"UpdateTagReindexes", testUpdateTagReindexes},
+	{"RetriesFailedIndexing", testRetriesFailedIndexing},
+	{"IndexQueueDepth", testIndexQueueDepth},
+	{"CloseDrainsIndexQueue", testCloseDrainsIndexQueue},
+}
+
+// searchRecorder is a SearchIndex that keeps the last version of each note it
+// was given. It can be made to fail or to hold up indexing.
+type searchRecorder struct {
+	mu       sync.Mutex
+	notes    map[string]map[uint64]note.Note
+	failures int
+	gate     chan struct{}
+}
+
+func newSearchRecorder() *searchRecorder {
+	return &searchRecorder{notes: make(map[string]map[uint64]note.Note)}
+}
+
+// failNext makes the next n calls to IndexNote fail.
+func (r *searchRecorder) failNext(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures = n
+}
+
+// hold makes IndexNote block until the returned function is called.
+func (r *searchRecorder) hold() (release func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	gate := make(chan struct{})
+	r.gate = gate
+	return func() { close(gate) }
+}
+
+func (r *searchRecorder) IndexNote(tenantID string, n *note.Note) error {
+	r.mu.Lock()
+	gate := r.gate
+	r.mu.Unlock()
+	if gate != nil {
+		<-gate
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failures > 0 {
+		r.failures--
+		return errors.New("index unavailable")
+	}
+	if r.notes[tenantID] == nil {
+		r.notes[tenantID] = make(map[uint64]note.Note)
+	}
+	r.notes[tenantID][n.ID] = *n
+	return nil
+}
+
+func (r *searchRecorder) RemoveNote(tenantID string, id uint64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.notes[tenantID], id)
+	return nil
+}
+
+func (r *searchRecorder) Search(tenantID string, req note.SearchRequest) (*note.SearchResult, error) {
+	return &note.SearchResult{}, nil
+}
+
+func (r *searchRecorder) Suggest(tenantID, prefix string, limit int) (*note.Suggestions, error) {
+	return &note.Suggestions{}, nil
+}
+
+func (r *searchRecorder) Related(tenantID string, n *note.Note, limit int) (*note.SearchResult, error) {
+	return &note.SearchResult{}, nil
+}
+
+// indexed returns the indexed version of a note, or nil if it is not indexed.
+func (r *searchRecorder) indexed(tenantID string, id uint64) *note.Note {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n, ok := r.notes[tenantID][id]; ok {
+		return &n
+	}
+	return nil
+}
+
+// eventually waits for the index to satisfy cond. It polls rather than use
+// assert.Eventually, which panics if cond takes longer than a tick.
+func (r *searchRecorder) eventually(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Errorf("condition not met: %s", msg)
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func testIndexesChanges(t *testing.T, repo note.Repository, idx *searchRecorder) {
+	tx := repo.Transaction(tenantA)
+	n := &note.Note{Title: "Draft"}
+	tag := &note.Tag{Name: "work"}
+	if !assert.NoError(t, tx.CreateNote(n)) || !assert.NoError(t, tx.CreateTag(tag)) {
+		return
+	}
+	idx.eventually(t, func() bool {
+		return idx.indexed(tenantA, n.ID) != nil
+	}, "should index created notes")
+
+	assert.NoError(t, tx.UpdateNote(n.ID, &note.Note{Title: "Final"}))
+	idx.eventually(t, func() bool {
+		indexed := idx.indexed(tenantA, n.ID)
+		return indexed != nil && indexed.Title == "Final"
+	}, "should reindex updated notes")
+
+	assert.NoError(t, tx.TagNote(n.ID, tag.ID))
+	idx.eventually(t, func() bool {
+		indexed := idx.indexed(tenantA, n.ID)
+		return indexed != nil && len(indexed.Tags) == 1
+	}, "should reindex tagged notes")
+
+	assert.NoError(t, tx.DeleteNote(n.ID))
+	idx.eventually(t, func() bool {
+		return idx.indexed(tenantA, n.ID) == nil
+	}, "should remove trashed notes")
+
+	assert.NoError(t, tx.RestoreNote(n.ID))
+	idx.eventually(t, func() bool {
+		return idx.indexed(tenantA, n.ID) != nil
+	}, "should index restored notes")
+}
+
+func testDeleteTagReindexes(t *testing.T, repo note.Repository, idx *searchRecorder) {
+	tx := repo.Transaction(tenantA)
+	tag := &note.Tag{Name: "work"}
+	assert.NoError(t, tx.CreateTag(tag))
+	var notes []*note.Note
+	for _, title := range []string{"One", "Two"} {
+		n := &note.Note{Title: title}
+		assert.NoError(t, tx.CreateNote(n))
+		assert.NoError(t, tx.TagNote(n.ID, tag.ID))
+		notes = append(notes, n)
+	}
+	idx.eventually(t, func() bool {
+		for _, n := range notes {
+			if indexed := idx.indexed(tenantA, n.ID); indexed == nil || len(indexed.Tags) != 1 {
+				return false
+			}
+		}
+		return true
+	}, "should index tagged notes")
+
+	assert.NoError(t, tx.DeleteTag(tag.ID))
+	idx.eventually(t, func() bool {
+		for _, n := range notes {
+			if indexed := idx.indexed(tenantA, n.ID); indexed == nil || len(indexed.Tags) != 0 {
+				return false
+			}
+		}
+		return true
+	}, "should reindex every note that had the deleted tag")
+}
+
+func testUpdateTagReindexes(t *testing.T, repo note.Repository, idx *searchRecorder) {
+	tx := repo.Transaction(tenantA)
+	tag := &note.Tag{Name: "work"}
+	n := &note.Note{Title: "One"}
+	assert.NoError(t, tx.CreateTag(tag))
+	assert.NoError(t, tx.CreateNote(n))
+	assert.NoError(t, tx.TagNote(n.ID, tag.ID))
+	idx.eventually(t, func() bool {
+		indexed := idx.indexed(tenantA, n.ID)
+		return indexed != nil && len(indexed.Tags) == 1
+	}, "should index the tagged note")
+
+	assert.NoError(t, tx.UpdateTag(tag.ID, &note.Tag{Name: "office"}))
+	idx.eventually(t, func() bool {
+		indexed := idx.indexed(tenantA, n.ID)
+		return indexed != nil && len(indexed.Tags) == 1 && indexed.Tags[0].Name == "office"
+	}, "should reindex notes with the renamed tag")
+}
+
+func testRetriesFailedIndexing(t *testing.T, repo note.Repository, idx *searchRecorder) {
+	idx.failNext(2)
+	n := &note.Note{Title: "Retried"}
+	assert.NoError(t, repo.Transaction(tenantA).CreateNote(n))
+	idx.eventually(t, func() bool {
+		return idx.indexed(tenantA, n.ID) != nil
+	}, "should retry indexing until it succeeds")
+}
+
+func testIndexQueueDepth(t *testing.T, repo note.Repository, idx *searchRecorder) {
+	release := idx.hold()
+	tx := repo.Transaction(tenantA)
+	var notes []*note.Note
+	for _, title := range []string{"One", "Two", "Three"} {
+		n := &note.Note{Title: title}
+		assert.NoError(t, tx.CreateNote(n))
+		notes = append(notes, n)
+	}
+
+	depth, err := repo.IndexQueueDepth()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, depth, "should count jobs until they are applied")
+
+	release()
+	idx.eventually(t, func() bool {
+		depth, err := repo.IndexQueueDepth()
+		return err == nil && depth == 0
+	}, "should empty the queue")
+	for _, n := range notes {
+		assert.NotNil(t, idx.indexed(tenantA, n.ID), "note %d", n.ID)
+	}
+}
+
+func testCloseDrainsIndexQueue(t *testing.T, repo note.Repository, idx *searchRecorder) {
+	release := idx.hold()
+	var notes []*note.Note
+	assert.NoError(t, repo.Update(tenantA, func(tx note.Transaction) error {
+		for _, title := range []string{"One", "Two", "Three"} {
+			n := &note.Note{Title: title}
+			if err := tx.CreateNote(n); err != nil {
+				return err
+			}
+			notes = append(notes, n)
+		}
+		return nil
+	}))
+
+	time.AfterFunc(20*time.Millisecond, release)
+	assert.NoError(t, repo.Close())
+	for _, n := range notes {
+		assert.NotNil(t, idx.indexed(tenantA, n.ID), "should index note %d before closing", n.ID)
+	}
+}
@@ -0,0 +1,1544 @@
+// Package notetest provides a conformance suite that every note.Repository
+// implementation is expected to pass, so that backends behave identically.
+package notetest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"learn-cljs.com/notes/internal/note"
+)
+
+// Factory returns a new, empty repository configured with c that keeps idx up
+// to date. It is called once per test case and should fill in any storage
+// locations that c leaves empty and register any cleanup with t.
+type Factory func(t *testing.T, c note.RepositoryConfig, idx note.SearchIndex) note.Repository
+
+var repositoryTests = []struct {
+	name   string
+	test   func(t *testing.T, repo note.Repository)
+	config note.RepositoryConfig
+}{
+	{"CreateAndFindNote", testCreateAndFindNote, note.RepositoryConfig{}},
+	{"CreateNoteIsLive", testCreateNoteIsLive, note.RepositoryConfig{}},
+	{"FindAllNotes", testFindAllNotes, note.RepositoryConfig{}},
+	{"UpdateNote", testUpdateNote, note.RepositoryConfig{}},
+	{"UpdateNoteKeepsMetadata", testUpdateNoteKeepsMetadata, note.RepositoryConfig{}},
+	{"DeleteNote", testDeleteNote, note.RepositoryConfig{}},
+	{"CreateAndFindTag", testCreateAndFindTag, note.RepositoryConfig{}},
+	{"DeleteTag", testDeleteTag, note.RepositoryConfig{}},
+	{"TagAndUntagNote", testTagAndUntagNote, note.RepositoryConfig{}},
+	{"TagNoteNotFound", testTagNoteNotFound, note.RepositoryConfig{}},
+	{"DeleteTagCascades", testDeleteTagCascades, note.RepositoryConfig{}},
+	{"UpdateTag", testUpdateTag, note.RepositoryConfig{}},
+	{"TagNamesUnique", testTagNamesUnique, note.RepositoryConfig{}},
+	{"MergeTag", testMergeTag, note.RepositoryConfig{}},
+	{"TenantIsolation", testTenantIsolation, note.RepositoryConfig{}},
+	{"NotFound", testNotFound, note.RepositoryConfig{}},
+	{"UpdateCommits", testUpdateCommits, note.RepositoryConfig{}},
+	{"UpdateRollsBack", testUpdateRollsBack, note.RepositoryConfig{}},
+	{"UpdateRollsBackRemovals", testUpdateRollsBackRemovals, note.RepositoryConfig{}},
+	{"ConcurrentWrites", testConcurrentWrites, note.RepositoryConfig{}},
+	{"Revisions", testRevisions, note.RepositoryConfig{}},
+	{"RevisionLimit", testRevisionLimit, note.RepositoryConfig{RevisionLimit: 2}},
+	{"FindNotes", testFindNotes, note.RepositoryConfig{}},
+	{"FindNotesFilters", testFindNotesFilters, note.RepositoryConfig{}},
+	{"FindTags", testFindTags, note.RepositoryConfig{}},
+	{"Versions", testVersions, note.RepositoryConfig{}},
+	{"Trash", testTrash, note.RepositoryConfig{}},
+	{"PurgeTrash", testPurgeTrash, note.RepositoryConfig{}},
+	{"TenantIDs", testTenantIDs, note.RepositoryConfig{}},
+	{"TenantRegistry", testTenantRegistry, note.RepositoryConfig{}},
+	{"FindTenants", testFindTenants, note.RepositoryConfig{}},
+	{"TenantStatus", testTenantStatus, note.RepositoryConfig{}},
+	{"Users", testUsers, note.RepositoryConfig{}},
+	{"Sessions", testSessions, note.RepositoryConfig{}},
+	{"SignIn", testSignIn, note.RepositoryConfig{}},
+	{"Members", testMembers, note.RepositoryConfig{}},
+	{"Authorship", testAuthorship, note.RepositoryConfig{}},
+	{"APIKeys", testAPIKeys, note.RepositoryConfig{}},
+	{"IssueAPIKey", testIssueAPIKey, note.RepositoryConfig{}},
+}
+
+// RunRepositoryTests runs the conformance suite against repositories created
+// by newRepo.
+func RunRepositoryTests(t *testing.T, newRepo Factory) {
+	for _, tt := range repositoryTests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newRepo(t, tt.config, newSearchRecorder()))
+		})
+	}
+	for _, tt := range indexingTests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			idx := newSearchRecorder()
+			tt.test(t, newRepo(t, note.RepositoryConfig{}, idx), idx)
+		})
+	}
+}
+
+const (
+	tenantA = "tenant-a"
+	tenantB = "tenant-b"
+)
+
+func testCreateAndFindNote(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	n := &note.Note{Title: "Shopping", Content: "Eggs, milk"}
+	require.NoError(t, tx.CreateNote(n))
+	assert.NotZero(t, n.ID)
+	assert.False(t, n.CreatedAt.IsZero(), "should set CreatedAt")
+	assert.True(t, n.UpdatedAt.Equal(n.CreatedAt), "should set UpdatedAt to CreatedAt")
+
+	found, err := tx.FindNoteByID(n.ID)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, n.ID, found.ID)
+	assert.Equal(t, "Shopping", found.Title)
+	assert.Equal(t, "Eggs, milk", found.Content)
+	assert.True(t, found.CreatedAt.Equal(n.CreatedAt))
+	assert.Empty(t, found.Tags)
+
+	other := &note.Note{Title: "Other"}
+	require.NoError(t, tx.CreateNote(other))
+	assert.NotEqual(t, n.ID, other.ID, "should assign distinct IDs")
+}
+
+func testCreateNoteIsLive(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	deletedAt := time.Now()
+	n := &note.Note{Title: "Shopping", Version: 7, DeletedAt: &deletedAt}
+	require.NoError(t, tx.CreateNote(n))
+	assert.Nil(t, n.DeletedAt, "should ignore a supplied DeletedAt")
+	assert.Equal(t, uint64(1), n.Version, "should ignore a supplied Version")
+
+	found, err := tx.FindNoteByID(n.ID)
+	require.NoError(t, err)
+	require.NotNil(t, found, "should not put the note in the trash")
+	assert.Nil(t, found.DeletedAt)
+	trashed, err := tx.FindTrashedNotes()
+	require.NoError(t, err)
+	assert.Empty(t, trashed)
+}
+
+func testFindAllNotes(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	notes, err := tx.FindAllNotes()
+	require.NoError(t, err)
+	assert.NotNil(t, notes, "should return an empty slice rather than nil")
+	assert.Empty(t, notes)
+
+	var ids []uint64
+	for i := 0; i < 3; i++ {
+		n := &note.Note{Title: fmt.Sprintf("Note %d", i)}
+		require.NoError(t, tx.CreateNote(n))
+		ids = append(ids, n.ID)
+	}
+
+	notes, err = tx.FindAllNotes()
+	require.NoError(t, err)
+	assert.Equal(t, ids, noteIDs(notes), "should list notes in ID order")
+}
+
+func testUpdateNote(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	n := &note.Note{Title: "Draft", Content: "Some content"}
+	require.NoError(t, tx.CreateNote(n))
+
+	update := &note.Note{Title: "Final"}
+	require.NoError(t, tx.UpdateNote(n.ID, update))
+	assert.Equal(t, n.ID, update.ID)
+	assert.True(t, update.CreatedAt.Equal(n.CreatedAt), "should report the original CreatedAt")
+	assert.False(t, update.UpdatedAt.Before(n.UpdatedAt), "should advance UpdatedAt")
+
+	found, err := tx.FindNoteByID(n.ID)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, "Final", found.Title)
+	assert.Equal(t, "", found.Content, "should replace rather than merge content")
+	assert.True(t, found.CreatedAt.Equal(n.CreatedAt), "should preserve CreatedAt")
+	assert.True(t, found.UpdatedAt.Equal(update.UpdatedAt))
+}
+
+func testUpdateNoteKeepsMetadata(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	n := &note.Note{Title: "Draft", UpdatedBy: "alice"}
+	require.NoError(t, tx.CreateNote(n))
+
+	deletedAt := time.Now()
+	update := &note.Note{
+		ID:        n.ID + 100,
+		Version:   7,
+		Title:     "Final",
+		CreatedAt: n.CreatedAt.Add(-time.Hour),
+		UpdatedBy: "bob",
+		DeletedAt: &deletedAt,
+	}
+	require.NoError(t, tx.UpdateNote(n.ID, update))
+	assert.Equal(t, n.ID, update.ID)
+	assert.Equal(t, uint64(2), update.Version)
+
+	found, err := tx.FindNoteByID(n.ID)
+	require.NoError(t, err)
+	require.NotNil(t, found, "should not put the note in the trash")
+	assert.Nil(t, found.DeletedAt, "should ignore a supplied DeletedAt")
+	assert.Equal(t, n.ID, found.ID)
+	assert.Equal(t, uint64(2), found.Version, "should ignore a supplied Version")
+	assert.True(t, found.CreatedAt.Equal(n.CreatedAt), "should ignore a supplied CreatedAt")
+	assert.Equal(t, "Final", found.Title)
+	assert.Equal(t, "bob", found.UpdatedBy)
+
+	trashed, err := tx.FindTrashedNotes()
+	require.NoError(t, err)
+	assert.Empty(t, trashed)
+	other, err := tx.FindNoteByID(n.ID + 100)
+	require.NoError(t, err)
+	assert.Nil(t, other, "should ignore a supplied ID")
+}
+
+func testDeleteNote(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	keep := &note.Note{Title: "Keep"}
+	remove := &note.Note{Title: "Remove"}
+	require.NoError(t, tx.CreateNote(keep))
+	require.NoError(t, tx.CreateNote(remove))
+
+	require.NoError(t, tx.DeleteNote(remove.ID))
+
+	found, err := tx.FindNoteByID(remove.ID)
+	require.NoError(t, err)
+	assert.Nil(t, found)
+
+	notes, err := tx.FindAllNotes()
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{keep.ID}, noteIDs(notes))
+
+	trashed, err := tx.FindTrashedNotes()
+	require.NoError(t, err)
+	require.Equal(t, []uint64{remove.ID}, noteIDs(trashed), "should move the note to the trash")
+	require.NotNil(t, trashed[0].DeletedAt)
+	assert.Equal(t, "Remove", trashed[0].Title)
+}
+
+func testCreateAndFindTag(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	tag := &note.Tag{Name: "work"}
+	require.NoError(t, tx.CreateTag(tag))
+	assert.NotZero(t, tag.ID)
+	assert.False(t, tag.CreatedAt.IsZero(), "should set CreatedAt")
+
+	found, err := tx.FindTagByID(tag.ID)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, "work", found.Name)
+
+	other := &note.Tag{Name: "home"}
+	require.NoError(t, tx.CreateTag(other))
+
+	tags, err := tx.FindAllTags()
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{tag.ID, other.ID}, tagIDs(tags))
+}
+
+func testDeleteTag(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	keep := &note.Tag{Name: "keep"}
+	remove := &note.Tag{Name: "remove"}
+	require.NoError(t, tx.CreateTag(keep))
+	require.NoError(t, tx.CreateTag(remove))
+
+	require.NoError(t, tx.DeleteTag(remove.ID))
+
+	found, err := tx.FindTagByID(remove.ID)
+	require.NoError(t, err)
+	assert.Nil(t, found)
+
+	tags, err := tx.FindAllTags()
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{keep.ID}, tagIDs(tags))
+}
+
+func testTagAndUntagNote(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	n := &note.Note{Title: "Tagged"}
+	work := &note.Tag{Name: "work"}
+	urgent := &note.Tag{Name: "urgent"}
+	require.NoError(t, tx.CreateNote(n))
+	require.NoError(t, tx.CreateTag(work))
+	require.NoError(t, tx.CreateTag(urgent))
+
+	require.NoError(t, tx.TagNote(n.ID, work.ID))
+	require.NoError(t, tx.TagNote(n.ID, urgent.ID))
+	require.NoError(t, tx.TagNote(n.ID, work.ID), "tagging twice should be a no-op")
+
+	found, err := tx.FindNoteByID(n.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{work.ID, urgent.ID}, tagIDs(found.Tags))
+	assert.Equal(t, "work", found.Tags[0].Name)
+
+	notes, err := tx.FindAllNotes()
+	require.NoError(t, err)
+	require.Len(t, notes, 1)
+	assert.Equal(t, []uint64{work.ID, urgent.ID}, tagIDs(notes[0].Tags))
+
+	require.NoError(t, tx.UntagNote(n.ID, work.ID))
+	found, err = tx.FindNoteByID(n.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{urgent.ID}, tagIDs(found.Tags))
+
+	require.NoError(t, tx.UntagNote(n.ID, work.ID), "untagging twice should be a no-op")
+}
+
+func testTagNoteNotFound(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	n := &note.Note{Title: "Tagged"}
+	tag := &note.Tag{Name: "work"}
+	trashed := &note.Note{Title: "Trashed"}
+	otherTag := &note.Tag{Name: "other"}
+	require.NoError(t, tx.CreateNote(n))
+	require.NoError(t, tx.CreateTag(tag))
+	require.NoError(t, tx.CreateNote(trashed))
+	require.NoError(t, tx.DeleteNote(trashed.ID))
+	require.NoError(t, repo.Transaction(tenantB).CreateTag(otherTag))
+
+	var notFound *note.NotFoundError
+	err := tx.TagNote(9999, tag.ID)
+	require.True(t, errors.As(err, &notFound), "should reject a missing note: %v", err)
+	assert.Equal(t, note.NotFoundError{Entity: "note", ID: 9999}, *notFound)
+
+	err = tx.TagNote(n.ID, 9999)
+	require.True(t, errors.As(err, &notFound), "should reject a missing tag: %v", err)
+	assert.Equal(t, note.NotFoundError{Entity: "tag", ID: 9999}, *notFound)
+
+	err = tx.TagNote(trashed.ID, tag.ID)
+	assert.True(t, errors.Is(err, note.ErrNotFound), "should reject a trashed note: %v", err)
+	err = tx.TagNote(n.ID, otherTag.ID)
+	assert.True(t, errors.Is(err, note.ErrNotFound), "should reject another tenant's tag: %v", err)
+
+	found, err := tx.FindNoteByID(n.ID)
+	require.NoError(t, err)
+	assert.Empty(t, found.Tags)
+	page, err := tx.FindNotes(note.NoteQuery{TagID: 9999})
+	require.NoError(t, err)
+	assert.Empty(t, page.Notes, "should not leave associations behind")
+}
+
+func testDeleteTagCascades(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	n := &note.Note{Title: "Tagged"}
+	trashed := &note.Note{Title: "Trashed"}
+	keep := &note.Tag{Name: "keep"}
+	remove := &note.Tag{Name: "remove"}
+	require.NoError(t, tx.CreateNote(n))
+	require.NoError(t, tx.CreateNote(trashed))
+	require.NoError(t, tx.CreateTag(keep))
+	require.NoError(t, tx.CreateTag(remove))
+	require.NoError(t, tx.TagNote(n.ID, keep.ID))
+	require.NoError(t, tx.TagNote(n.ID, remove.ID))
+	require.NoError(t, tx.TagNote(trashed.ID, remove.ID))
+	require.NoError(t, tx.DeleteNote(trashed.ID))
+
+	require.NoError(t, tx.DeleteTag(remove.ID))
+
+	found, err := tx.FindNoteByID(n.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{keep.ID}, tagIDs(found.Tags))
+	page, err := tx.FindNotes(note.NoteQuery{TagID: remove.ID})
+	require.NoError(t, err)
+	assert.Empty(t, page.Notes)
+
+	require.NoError(t, tx.RestoreNote(trashed.ID))
+	found, err = tx.FindNoteByID(trashed.ID)
+	require.NoError(t, err)
+	assert.Empty(t, found.Tags, "should remove the tag from notes in the trash")
+}
+
+func testUpdateTag(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	n := &note.Note{Title: "Tagged"}
+	tag := &note.Tag{Name: "work"}
+	require.NoError(t, tx.CreateNote(n))
+	require.NoError(t, tx.CreateTag(tag))
+	require.NoError(t, tx.TagNote(n.ID, tag.ID))
+
+	update := &note.Tag{Name: "office", Color: "#ff0000", Description: "Day job"}
+	require.NoError(t, tx.UpdateTag(tag.ID, update))
+	assert.Equal(t, tag.ID, update.ID)
+	assert.True(t, tag.CreatedAt.Equal(update.CreatedAt), "should keep CreatedAt")
+
+	found, err := tx.FindTagByID(tag.ID)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, "office", found.Name)
+	assert.Equal(t, "#ff0000", found.Color)
+	assert.Equal(t, "Day job", found.Description)
+
+	foundNote, err := tx.FindNoteByID(n.ID)
+	require.NoError(t, err)
+	require.Len(t, foundNote.Tags, 1)
+	assert.Equal(t, "office", foundNote.Tags[0].Name)
+
+	err = tx.UpdateTag(9999, &note.Tag{Name: "missing"})
+	assert.True(t, errors.Is(err, note.ErrNotFound), "should reject a missing tag: %v", err)
+	err = repo.Transaction(tenantB).UpdateTag(tag.ID, &note.Tag{Name: "stolen"})
+	assert.True(t, errors.Is(err, note.ErrNotFound), "should reject another tenant's tag: %v", err)
+}
+
+func testTagNamesUnique(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	work := &note.Tag{Name: "work"}
+	home := &note.Tag{Name: "home"}
+	require.NoError(t, tx.CreateTag(work))
+	require.NoError(t, tx.CreateTag(home))
+
+	var exists *note.AlreadyExistsError
+	err := tx.CreateTag(&note.Tag{Name: "work"})
+	require.True(t, errors.As(err, &exists), "should reject a duplicate name: %v", err)
+	assert.Equal(t, note.AlreadyExistsError{Entity: "tag", Name: "work"}, *exists)
+	err = tx.UpdateTag(home.ID, &note.Tag{Name: "work"})
+	assert.True(t, errors.Is(err, note.ErrAlreadyExists), "should reject renaming to a taken name: %v", err)
+
+	require.NoError(t, tx.UpdateTag(work.ID, &note.Tag{Name: "work", Color: "blue"}), "should allow keeping the same name")
+	require.NoError(t, tx.CreateTag(&note.Tag{Name: "Work"}), "names should be case-sensitive")
+	require.NoError(t, repo.Transaction(tenantB).CreateTag(&note.Tag{Name: "work"}), "names should be unique per tenant")
+
+	require.NoError(t, tx.UpdateTag(work.ID, &note.Tag{Name: "job"}))
+	require.NoError(t, tx.CreateTag(&note.Tag{Name: "work"}), "should free the old name on rename")
+	require.NoError(t, tx.DeleteTag(home.ID))
+	require.NoError(t, tx.CreateTag(&note.Tag{Name: "home"}), "should free the name on delete")
+
+	tags, err := tx.FindAllTags()
+	require.NoError(t, err)
+	assert.Len(t, tags, 4)
+}
+
+func testMergeTag(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	both := &note.Note{Title: "Both"}
+	fromOnly := &note.Note{Title: "From only"}
+	trashed := &note.Note{Title: "Trashed"}
+	from := &note.Tag{Name: "todo"}
+	into := &note.Tag{Name: "tasks"}
+	for _, n := range []*note.Note{both, fromOnly, trashed} {
+		require.NoError(t, tx.CreateNote(n))
+	}
+	require.NoError(t, tx.CreateTag(from))
+	require.NoError(t, tx.CreateTag(into))
+	require.NoError(t, tx.TagNote(both.ID, from.ID))
+	require.NoError(t, tx.TagNote(both.ID, into.ID))
+	require.NoError(t, tx.TagNote(fromOnly.ID, from.ID))
+	require.NoError(t, tx.TagNote(trashed.ID, from.ID))
+	require.NoError(t, tx.DeleteNote(trashed.ID))
+
+	err := tx.MergeTag(from.ID, 9999)
+	assert.True(t, errors.Is(err, note.ErrNotFound), "should reject a missing target: %v", err)
+	err = tx.MergeTag(9999, into.ID)
+	assert.True(t, errors.Is(err, note.ErrNotFound), "should reject a missing source: %v", err)
+	assert.Error(t, tx.MergeTag(from.ID, from.ID), "should reject merging a tag into itself")
+
+	require.NoError(t, tx.MergeTag(from.ID, into.ID))
+
+	found, err := tx.FindTagByID(from.ID)
+	require.NoError(t, err)
+	assert.Nil(t, found, "should delete the merged tag")
+	page, err := tx.FindNotes(note.NoteQuery{TagID: into.ID})
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{both.ID, fromOnly.ID}, noteIDs(page.Notes))
+	for _, n := range page.Notes {
+		assert.Equal(t, []uint64{into.ID}, tagIDs(n.Tags), "note %d", n.ID)
+	}
+	page, err = tx.FindNotes(note.NoteQuery{TagID: from.ID})
+	require.NoError(t, err)
+	assert.Empty(t, page.Notes)
+
+	require.NoError(t, tx.RestoreNote(trashed.ID))
+	restored, err := tx.FindNoteByID(trashed.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{into.ID}, tagIDs(restored.Tags), "should move notes in the trash too")
+
+	require.NoError(t, tx.CreateTag(&note.Tag{Name: "todo"}), "should free the merged tag's name")
+}
+
+func testTenantIsolation(t *testing.T, repo note.Repository) {
+	txA := repo.Transaction(tenantA)
+	txB := repo.Transaction(tenantB)
+
+	n := &note.Note{Title: "Private", Content: "Tenant A only"}
+	tag := &note.Tag{Name: "secret"}
+	require.NoError(t, txA.CreateNote(n))
+	require.NoError(t, txA.CreateTag(tag))
+
+	found, err := txB.FindNoteByID(n.ID)
+	require.NoError(t, err)
+	assert.Nil(t, found, "should not find another tenant's note")
+
+	foundTag, err := txB.FindTagByID(tag.ID)
+	require.NoError(t, err)
+	assert.Nil(t, foundTag, "should not find another tenant's tag")
+
+	notes, err := txB.FindAllNotes()
+	require.NoError(t, err)
+	assert.Empty(t, notes)
+
+	tags, err := txB.FindAllTags()
+	require.NoError(t, err)
+	assert.Empty(t, tags)
+
+	err = txB.UpdateNote(n.ID, &note.Note{Title: "Hijacked"})
+	assert.True(t, errors.Is(err, note.ErrNotFound), "should not update another tenant's note: %v", err)
+	assert.True(t, errors.Is(txB.DeleteNote(n.ID), note.ErrNotFound), "should not delete another tenant's note")
+	assert.True(t, errors.Is(txB.DeleteTag(tag.ID), note.ErrNotFound), "should not delete another tenant's tag")
+
+	found, err = txA.FindNoteByID(n.ID)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, "Private", found.Title)
+
+	foundTag, err = txA.FindTagByID(tag.ID)
+	require.NoError(t, err)
+	assert.NotNil(t, foundTag)
+}
+
+func testNotFound(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	const missing = 9999
+
+	n, err := tx.FindNoteByID(missing)
+	assert.NoError(t, err)
+	assert.Nil(t, n)
+
+	tag, err := tx.FindTagByID(missing)
+	assert.NoError(t, err)
+	assert.Nil(t, tag)
+
+	err = tx.UpdateNote(missing, &note.Note{Title: "Nope"})
+	assert.True(t, errors.Is(err, note.ErrNotFound), "UpdateNote: %v", err)
+
+	err = tx.DeleteNote(missing)
+	assert.True(t, errors.Is(err, note.ErrNotFound), "DeleteNote: %v", err)
+
+	err = tx.RestoreNote(missing)
+	assert.True(t, errors.Is(err, note.ErrNotFound), "RestoreNote: %v", err)
+
+	err = tx.PurgeNote(missing)
+	assert.True(t, errors.Is(err, note.ErrNotFound), "PurgeNote: %v", err)
+
+	err = tx.DeleteTag(missing)
+	assert.True(t, errors.Is(err, note.ErrNotFound), "DeleteTag: %v", err)
+
+	notes, err := tx.FindAllNotes()
+	require.NoError(t, err)
+	assert.Empty(t, notes, "failed operations should not create notes")
+}
+
+func testUpdateCommits(t *testing.T, repo note.Repository) {
+	n := &note.Note{Title: "Atomic"}
+	tags := []*note.Tag{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+	err := repo.Update(tenantA, func(tx note.Transaction) error {
+		if err := tx.CreateNote(n); err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			if err := tx.CreateTag(tag); err != nil {
+				return err
+			}
+			if err := tx.TagNote(n.ID, tag.ID); err != nil {
+				return err
+			}
+		}
+
+		found, err := tx.FindNoteByID(n.ID)
+		require.NoError(t, err)
+		require.NotNil(t, found, "should read writes made earlier in the same unit of work")
+		assert.Len(t, found.Tags, 3)
+		return nil
+	})
+	require.NoError(t, err)
+
+	found, err := repo.Transaction(tenantA).FindNoteByID(n.ID)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, tagIDs(tags), tagIDs(found.Tags))
+}
+
+func testUpdateRollsBack(t *testing.T, repo note.Repository) {
+	existing := &note.Note{Title: "Existing", Content: "Original"}
+	require.NoError(t, repo.Transaction(tenantA).CreateNote(existing))
+
+	errAbort := errors.New("abort")
+	err := repo.Update(tenantA, func(tx note.Transaction) error {
+		n := &note.Note{Title: "Doomed"}
+		if err := tx.CreateNote(n); err != nil {
+			return err
+		}
+		tag := &note.Tag{Name: "doomed"}
+		if err := tx.CreateTag(tag); err != nil {
+			return err
+		}
+		if err := tx.TagNote(existing.ID, tag.ID); err != nil {
+			return err
+		}
+		if err := tx.UpdateNote(existing.ID, &note.Note{Title: "Changed"}); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	assert.Equal(t, errAbort, err, "should return the error from fn")
+
+	tx := repo.Transaction(tenantA)
+	notes, err := tx.FindAllNotes()
+	require.NoError(t, err)
+	require.Equal(t, []uint64{existing.ID}, noteIDs(notes), "should discard created notes")
+	assert.Equal(t, "Existing", notes[0].Title, "should discard updates")
+	assert.Equal(t, "Original", notes[0].Content, "should discard updates")
+	assert.Empty(t, notes[0].Tags, "should discard tag links")
+
+	tags, err := tx.FindAllTags()
+	require.NoError(t, err)
+	assert.Empty(t, tags, "should discard created tags")
+}
+
+func testUpdateRollsBackRemovals(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	kept := &note.Note{Title: "Kept", Content: "Original"}
+	trashed := &note.Note{Title: "Trashed"}
+	home := &note.Tag{Name: "home"}
+	work := &note.Tag{Name: "work"}
+	for _, n := range []*note.Note{kept, trashed} {
+		require.NoError(t, tx.CreateNote(n))
+	}
+	for _, tag := range []*note.Tag{home, work} {
+		require.NoError(t, tx.CreateTag(tag))
+	}
+	require.NoError(t, tx.TagNote(kept.ID, home.ID))
+	require.NoError(t, tx.TagNote(kept.ID, work.ID))
+	require.NoError(t, tx.TagNote(trashed.ID, home.ID))
+	require.NoError(t, tx.DeleteNote(trashed.ID))
+
+	errAbort := errors.New("abort")
+	err := repo.Update(tenantA, func(tx note.Transaction) error {
+		for _, step := range []func() error{
+			func() error { return tx.UpdateNote(kept.ID, &note.Note{Title: "Changed"}) },
+			func() error { return tx.UntagNote(kept.ID, work.ID) },
+			func() error { return tx.MergeTag(home.ID, work.ID) },
+			func() error { return tx.DeleteTag(work.ID) },
+			func() error { return tx.PurgeNote(trashed.ID) },
+			func() error { return tx.DeleteNote(kept.ID) },
+			func() error { return tx.RestoreNote(kept.ID) },
+		} {
+			if err := step(); err != nil {
+				return err
+			}
+		}
+		return errAbort
+	})
+	assert.Equal(t, errAbort, err, "should return the error from fn")
+
+	found, err := tx.FindNoteByID(kept.ID)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, "Kept", found.Title, "should discard updates")
+	assert.Equal(t, []uint64{home.ID, work.ID}, tagIDs(found.Tags), "should restore tag links")
+	revisions, err := tx.FindRevisions(kept.ID)
+	require.NoError(t, err)
+	assert.Len(t, revisions, 1, "should discard revisions")
+
+	tags, err := tx.FindAllTags()
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{home.ID, work.ID}, tagIDs(tags), "should restore deleted and merged tags")
+	page, err := tx.FindNotes(note.NoteQuery{TagID: home.ID})
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{kept.ID}, noteIDs(page.Notes), "should restore the links of merged tags")
+
+	trash, err := tx.FindTrashedNotes()
+	require.NoError(t, err)
+	require.Equal(t, []uint64{trashed.ID}, noteIDs(trash), "should restore purged notes")
+	assert.Equal(t, []uint64{home.ID}, tagIDs(trash[0].Tags), "should restore the links of purged notes")
+	revisions, err = tx.FindRevisions(trashed.ID)
+	require.NoError(t, err)
+	assert.Len(t, revisions, 1, "should restore the revisions of purged notes")
+}
+
+func testConcurrentWrites(t *testing.T, repo note.Repository) {
+	const writers = 8
+	const notesPerWriter = 10
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*notesPerWriter)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			tenantID := tenantA
+			if w%2 == 1 {
+				tenantID = tenantB
+			}
+			for i := 0; i < notesPerWriter; i++ {
+				n := &note.Note{Title: fmt.Sprintf("Writer %d note %d", w, i)}
+				if err := repo.Transaction(tenantID).CreateNote(n); err != nil {
+					errs <- err
+					continue
+				}
+				if _, err := repo.Transaction(tenantID).FindAllNotes(); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	seen := make(map[uint64]bool)
+	for _, tenantID := range []string{tenantA, tenantB} {
+		notes, err := repo.Transaction(tenantID).FindAllNotes()
+		require.NoError(t, err)
+		assert.Len(t, notes, writers/2*notesPerWriter)
+		for _, n := range notes {
+			assert.False(t, seen[n.ID], "note ID %d assigned twice", n.ID)
+			seen[n.ID] = true
+		}
+	}
+}
+
+func testRevisions(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	n := &note.Note{Title: "v1", Content: "one"}
+	require.NoError(t, tx.CreateNote(n))
+	require.NoError(t, tx.UpdateNote(n.ID, &note.Note{Title: "v2", Content: "two"}))
+	require.NoError(t, tx.UpdateNote(n.ID, &note.Note{Title: "v3", Content: "three"}))
+
+	revisions, err := tx.FindRevisions(n.ID)
+	require.NoError(t, err)
+	require.Len(t, revisions, 3)
+	for i, rev := range revisions {
+		assert.Equal(t, n.ID, rev.NoteID)
+		assert.Equal(t, uint64(i+1), rev.Rev)
+		assert.Equal(t, fmt.Sprintf("v%d", i+1), rev.Title)
+	}
+	assert.Equal(t, "one", revisions[0].Content)
+	assert.True(t, revisions[0].CreatedAt.Equal(n.CreatedAt))
+
+	rev, err := tx.FindRevision(n.ID, 2)
+	require.NoError(t, err)
+	require.NotNil(t, rev)
+	assert.Equal(t, "two", rev.Content)
+
+	rev, err = tx.FindRevision(n.ID, 4)
+	require.NoError(t, err)
+	assert.Nil(t, rev)
+
+	other, err := repo.Transaction(tenantB).FindRevisions(n.ID)
+	require.NoError(t, err)
+	assert.Empty(t, other, "should not list another tenant's revisions")
+
+	rev, err = repo.Transaction(tenantB).FindRevision(n.ID, 1)
+	require.NoError(t, err)
+	assert.Nil(t, rev, "should not find another tenant's revisions")
+
+	err = repo.Update(tenantA, func(tx note.Transaction) error {
+		if err := tx.UpdateNote(n.ID, &note.Note{Title: "discarded"}); err != nil {
+			return err
+		}
+		return errors.New("abort")
+	})
+	require.Error(t, err)
+	revisions, err = tx.FindRevisions(n.ID)
+	require.NoError(t, err)
+	assert.Len(t, revisions, 3, "should discard revisions from a rolled back update")
+
+	require.NoError(t, tx.DeleteNote(n.ID))
+	revisions, err = tx.FindRevisions(n.ID)
+	require.NoError(t, err)
+	assert.Len(t, revisions, 3, "should keep revisions while the note is in the trash")
+
+	require.NoError(t, tx.PurgeNote(n.ID))
+	revisions, err = tx.FindRevisions(n.ID)
+	require.NoError(t, err)
+	assert.Empty(t, revisions, "should delete revisions with the note")
+}
+
+func testRevisionLimit(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	n := &note.Note{Title: "v1"}
+	require.NoError(t, tx.CreateNote(n))
+	for i := 2; i <= 4; i++ {
+		require.NoError(t, tx.UpdateNote(n.ID, &note.Note{Title: fmt.Sprintf("v%d", i)}))
+	}
+
+	revisions, err := tx.FindRevisions(n.ID)
+	require.NoError(t, err)
+	require.Len(t, revisions, 2, "should keep only the newest revisions")
+	assert.Equal(t, uint64(3), revisions[0].Rev)
+	assert.Equal(t, "v3", revisions[0].Title)
+	assert.Equal(t, uint64(4), revisions[1].Rev)
+	assert.Equal(t, "v4", revisions[1].Title)
+}
+
+// createListingNotes creates notes whose creation, update and title orders all
+// differ, plus a note in the trash that listings must skip.
+func createListingNotes(t *testing.T, tx note.Transaction) []*note.Note {
+	var notes []*note.Note
+	for _, title := range []string{"banana", "Apple", "cherry", "apple", "trashed"} {
+		n := &note.Note{Title: title}
+		require.NoError(t, tx.CreateNote(n))
+		notes = append(notes, n)
+		time.Sleep(2 * time.Millisecond)
+	}
+	require.NoError(t, tx.DeleteNote(notes[4].ID))
+
+	update := &note.Note{Title: "banana", Content: "ripe"}
+	require.NoError(t, tx.UpdateNote(notes[0].ID, update))
+	notes[0] = update
+	return notes[:4]
+}
+
+// findAllPages follows cursors until the last page, returning the IDs of every
+// note listed and the number of pages.
+func findAllPages(t *testing.T, tx note.Transaction, q note.NoteQuery) ([]uint64, int) {
+	var ids []uint64
+	var pages int
+	for {
+		page, err := tx.FindNotes(q)
+		require.NoError(t, err)
+		ids = append(ids, noteIDs(page.Notes)...)
+		pages++
+		if page.Next == "" {
+			return ids, pages
+		}
+		require.True(t, pages < 10, "should reach the last page")
+		q.Cursor = page.Next
+	}
+}
+
+func testFindNotes(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	n := createListingNotes(t, tx)
+	banana, upperApple, cherry, lowerApple := n[0].ID, n[1].ID, n[2].ID, n[3].ID
+
+	tests := []struct {
+		sort note.NoteSort
+		want []uint64
+	}{
+		{"", []uint64{banana, upperApple, cherry, lowerApple}},
+		{note.SortByCreatedAt, []uint64{banana, upperApple, cherry, lowerApple}},
+		{note.SortByUpdatedAt, []uint64{upperApple, cherry, lowerApple, banana}},
+		{note.SortByTitle, []uint64{upperApple, lowerApple, banana, cherry}},
+	}
+	for _, tt := range tests {
+		for _, limit := range []int{0, 1, 3, 4} {
+			q := note.NoteQuery{Sort: tt.sort, Limit: limit}
+			ids, pages := findAllPages(t, tx, q)
+			assert.Equal(t, tt.want, ids, "sort %q, limit %d", tt.sort, limit)
+			if limit > 0 {
+				assert.Equal(t, (len(tt.want)+limit-1)/limit, pages, "sort %q, limit %d", tt.sort, limit)
+			}
+
+			q.Descending = true
+			ids, _ = findAllPages(t, tx, q)
+			want := make([]uint64, len(tt.want))
+			for i, id := range tt.want {
+				want[len(want)-1-i] = id
+			}
+			assert.Equal(t, want, ids, "sort %q descending, limit %d", tt.sort, limit)
+		}
+	}
+
+	page, err := tx.FindNotes(note.NoteQuery{Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, page.Notes, 2)
+	assert.Equal(t, "banana", page.Notes[0].Title, "should load complete notes")
+	assert.Equal(t, "ripe", page.Notes[0].Content)
+
+	_, err = tx.FindNotes(note.NoteQuery{Sort: note.SortByTitle, Cursor: page.Next})
+	assert.True(t, errors.Is(err, note.ErrInvalidQuery), "should reject a cursor from another order: %v", err)
+	_, err = tx.FindNotes(note.NoteQuery{Cursor: "garbage"})
+	assert.True(t, errors.Is(err, note.ErrInvalidQuery), "should reject a malformed cursor: %v", err)
+	_, err = tx.FindNotes(note.NoteQuery{Sort: "color"})
+	assert.True(t, errors.Is(err, note.ErrInvalidQuery), "should reject an unknown sort: %v", err)
+
+	other, err := repo.Transaction(tenantB).FindNotes(note.NoteQuery{})
+	require.NoError(t, err)
+	assert.Empty(t, other.Notes, "should only list the tenant's notes")
+}
+
+func testFindNotesFilters(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	n := createListingNotes(t, tx)
+	banana, upperApple, lowerApple := n[0].ID, n[1].ID, n[3].ID
+
+	tag := &note.Tag{Name: "fruit"}
+	require.NoError(t, tx.CreateTag(tag))
+	require.NoError(t, tx.TagNote(upperApple, tag.ID))
+	require.NoError(t, tx.TagNote(lowerApple, tag.ID))
+
+	tests := []struct {
+		name  string
+		query note.NoteQuery
+		want  []uint64
+	}{
+		{"tag", note.NoteQuery{TagID: tag.ID}, []uint64{upperApple, lowerApple}},
+		{"tag by title descending", note.NoteQuery{TagID: tag.ID, Sort: note.SortByTitle, Descending: true}, []uint64{lowerApple, upperApple}},
+		{"updated since", note.NoteQuery{UpdatedSince: n[0].UpdatedAt}, []uint64{banana}},
+		{"updated since by update time", note.NoteQuery{UpdatedSince: n[3].UpdatedAt, Sort: note.SortByUpdatedAt}, []uint64{lowerApple, banana}},
+		{"updated since by update time descending", note.NoteQuery{UpdatedSince: n[3].UpdatedAt, Sort: note.SortByUpdatedAt, Descending: true}, []uint64{banana, lowerApple}},
+		{"created before", note.NoteQuery{CreatedBefore: n[2].CreatedAt}, []uint64{banana, upperApple}},
+		{"created before descending", note.NoteQuery{CreatedBefore: n[2].CreatedAt, Descending: true}, []uint64{upperApple, banana}},
+		{"created before by title", note.NoteQuery{CreatedBefore: n[2].CreatedAt, Sort: note.SortByTitle}, []uint64{upperApple, banana}},
+		{"combined", note.NoteQuery{TagID: tag.ID, CreatedBefore: n[3].CreatedAt}, []uint64{upperApple}},
+		{"no match", note.NoteQuery{TagID: tag.ID, UpdatedSince: n[0].UpdatedAt}, nil},
+	}
+	for _, tt := range tests {
+		for _, limit := range []int{0, 1} {
+			q := tt.query
+			q.Limit = limit
+			ids, _ := findAllPages(t, tx, q)
+			assert.Equal(t, tt.want, ids, "%s, limit %d", tt.name, limit)
+		}
+	}
+
+	page, err := tx.FindNotes(note.NoteQuery{TagID: tag.ID})
+	require.NoError(t, err)
+	require.Len(t, page.Notes, 2)
+	assert.Equal(t, []uint64{tag.ID}, tagIDs(page.Notes[0].Tags), "should load tags")
+}
+
+func testFindTags(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	var want []uint64
+	for i := 0; i < 5; i++ {
+		tag := &note.Tag{Name: fmt.Sprintf("tag-%d", i)}
+		require.NoError(t, tx.CreateTag(tag))
+		want = append(want, tag.ID)
+	}
+	require.NoError(t, repo.Transaction(tenantB).CreateTag(&note.Tag{Name: "other"}))
+
+	var ids []uint64
+	q := note.TagQuery{Limit: 2}
+	for pages := 1; ; pages++ {
+		page, err := tx.FindTags(q)
+		require.NoError(t, err)
+		ids = append(ids, tagIDs(page.Tags)...)
+		if page.Next == "" {
+			assert.Equal(t, 3, pages)
+			break
+		}
+		q.Cursor = page.Next
+	}
+	assert.Equal(t, want, ids)
+
+	page, err := tx.FindTags(note.TagQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, want, tagIDs(page.Tags))
+	assert.Empty(t, page.Next)
+
+	_, err = tx.FindTags(note.TagQuery{Cursor: "garbage"})
+	assert.True(t, errors.Is(err, note.ErrInvalidQuery), "should reject a malformed cursor: %v", err)
+}
+
+func testVersions(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	n := &note.Note{Title: "v1"}
+	require.NoError(t, tx.CreateNote(n))
+	assert.Equal(t, uint64(1), n.Version)
+
+	update := &note.Note{Title: "v2"}
+	require.NoError(t, tx.UpdateNote(n.ID, update))
+	assert.Equal(t, uint64(2), update.Version)
+	found, err := tx.FindNoteByID(n.ID)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), found.Version)
+
+	assert.NoError(t, tx.CheckNoteVersion(n.ID, 2))
+	err = tx.CheckNoteVersion(n.ID, 1)
+	require.True(t, errors.Is(err, note.ErrConflict), "should reject a stale version: %v", err)
+	var conflict *note.ConflictError
+	require.True(t, errors.As(err, &conflict))
+	assert.Equal(t, note.ConflictError{NoteID: n.ID, Expected: 1, Actual: 2}, *conflict)
+
+	err = repo.Update(tenantA, func(tx note.Transaction) error {
+		if err := tx.CheckNoteVersion(n.ID, 1); err != nil {
+			return err
+		}
+		return tx.UpdateNote(n.ID, &note.Note{Title: "lost update"})
+	})
+	assert.True(t, errors.Is(err, note.ErrConflict), "Update: %v", err)
+	found, err = tx.FindNoteByID(n.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "v2", found.Title)
+
+	err = tx.CheckNoteVersion(9999, 1)
+	assert.True(t, errors.Is(err, note.ErrNotFound), "CheckNoteVersion: %v", err)
+	err = repo.Transaction(tenantB).CheckNoteVersion(n.ID, 2)
+	assert.True(t, errors.Is(err, note.ErrNotFound), "should not check another tenant's note: %v", err)
+}
+
+func testTrash(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	n := &note.Note{Title: "Draft"}
+	tag := &note.Tag{Name: "work"}
+	require.NoError(t, tx.CreateNote(n))
+	require.NoError(t, tx.CreateTag(tag))
+	require.NoError(t, tx.TagNote(n.ID, tag.ID))
+	require.NoError(t, tx.DeleteNote(n.ID))
+
+	err := tx.UpdateNote(n.ID, &note.Note{Title: "Edited"})
+	assert.True(t, errors.Is(err, note.ErrNotFound), "should not update a trashed note: %v", err)
+	err = tx.DeleteNote(n.ID)
+	assert.True(t, errors.Is(err, note.ErrNotFound), "should not delete a trashed note twice: %v", err)
+	err = tx.PurgeNote(n.ID + 1000)
+	assert.True(t, errors.Is(err, note.ErrNotFound), "PurgeNote: %v", err)
+
+	trashed, err := repo.Transaction(tenantB).FindTrashedNotes()
+	require.NoError(t, err)
+	assert.Empty(t, trashed, "should not expose another tenant's trash")
+	err = repo.Transaction(tenantB).RestoreNote(n.ID)
+	assert.True(t, errors.Is(err, note.ErrNotFound), "should not restore another tenant's note: %v", err)
+
+	require.NoError(t, tx.RestoreNote(n.ID))
+	found, err := tx.FindNoteByID(n.ID)
+	require.NoError(t, err)
+	require.NotNil(t, found, "should restore the note")
+	assert.Equal(t, "Draft", found.Title)
+	assert.Nil(t, found.DeletedAt)
+	assert.Equal(t, []uint64{tag.ID}, tagIDs(found.Tags), "should keep tags through the trash")
+	trashed, err = tx.FindTrashedNotes()
+	require.NoError(t, err)
+	assert.Empty(t, trashed)
+
+	require.NoError(t, tx.DeleteNote(n.ID))
+	require.NoError(t, tx.PurgeNote(n.ID))
+	trashed, err = tx.FindTrashedNotes()
+	require.NoError(t, err)
+	assert.Empty(t, trashed, "should purge the note")
+	err = tx.RestoreNote(n.ID)
+	assert.True(t, errors.Is(err, note.ErrNotFound), "should not restore a purged note: %v", err)
+}
+
+func testPurgeTrash(t *testing.T, repo note.Repository) {
+	txA := repo.Transaction(tenantA)
+	txB := repo.Transaction(tenantB)
+	old := &note.Note{Title: "Old"}
+	other := &note.Note{Title: "Other tenant"}
+	recent := &note.Note{Title: "Recent"}
+	require.NoError(t, txA.CreateNote(old))
+	require.NoError(t, txB.CreateNote(other))
+	require.NoError(t, txA.CreateNote(recent))
+	require.NoError(t, txA.DeleteNote(old.ID))
+	require.NoError(t, txB.DeleteNote(other.ID))
+	time.Sleep(10 * time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, txA.DeleteNote(recent.ID))
+
+	purged, err := repo.PurgeTrash(cutoff)
+	require.NoError(t, err)
+	assert.Equal(t, 2, purged, "should purge expired notes of every tenant")
+
+	trashed, err := txA.FindTrashedNotes()
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{recent.ID}, noteIDs(trashed), "should keep recently deleted notes")
+	trashed, err = txB.FindTrashedNotes()
+	require.NoError(t, err)
+	assert.Empty(t, trashed)
+
+	purged, err = repo.PurgeTrash(cutoff)
+	require.NoError(t, err)
+	assert.Zero(t, purged)
+}
+
+func testTenantIDs(t *testing.T, repo note.Repository) {
+	ids, err := repo.TenantIDs()
+	require.NoError(t, err)
+	assert.NotNil(t, ids, "should return an empty slice rather than nil")
+	assert.Empty(t, ids)
+
+	trashed := &note.Note{Title: "Trashed"}
+	require.NoError(t, repo.Transaction(tenantB).CreateNote(trashed))
+	require.NoError(t, repo.Transaction(tenantB).DeleteNote(trashed.ID))
+	require.NoError(t, repo.Transaction(tenantA).CreateTag(&note.Tag{Name: "Tag only"}))
+	require.NoError(t, repo.Transaction("tenant-c").CreateNote(&note.Note{Title: "C"}))
+	_, err = repo.Transaction("tenant-d").FindAllNotes()
+	require.NoError(t, err)
+
+	ids, err = repo.TenantIDs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{tenantA, tenantB, "tenant-c"}, ids,
+		"should list tenants with notes, trashed notes or tags in order")
+}
+
+func testTenantRegistry(t *testing.T, repo note.Repository) {
+	found, err := repo.FindTenant(tenantA)
+	require.NoError(t, err)
+	assert.Nil(t, found, "should return nil for an unregistered tenant")
+
+	tenant := &note.Tenant{ID: tenantA, Name: "Acme"}
+	require.NoError(t, repo.CreateTenant(tenant))
+	assert.Equal(t, note.TenantActive, tenant.Status, "should default to active")
+	assert.False(t, tenant.CreatedAt.IsZero(), "should set the creation time")
+
+	err = repo.CreateTenant(&note.Tenant{ID: tenantA})
+	assert.True(t, errors.Is(err, note.ErrAlreadyExists), "should not register a tenant twice")
+
+	found, err = repo.FindTenant(tenantA)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, "Acme", found.Name)
+	assert.Equal(t, note.TenantActive, found.Status)
+	assert.True(t, tenant.CreatedAt.Equal(found.CreatedAt))
+
+	require.NoError(t, repo.UpdateTenant(tenantA, &note.Tenant{Name: "Acme Inc", Status: note.TenantSuspended}))
+	found, err = repo.FindTenant(tenantA)
+	require.NoError(t, err)
+	assert.Equal(t, "Acme Inc", found.Name)
+	assert.Equal(t, note.TenantSuspended, found.Status)
+	assert.True(t, tenant.CreatedAt.Equal(found.CreatedAt), "should keep the creation time")
+
+	err = repo.UpdateTenant(tenantB, &note.Tenant{Status: note.TenantSuspended})
+	assert.True(t, errors.Is(err, note.ErrNotFound), "should not update an unregistered tenant")
+
+	ids, err := repo.TenantIDs()
+	require.NoError(t, err)
+	assert.Empty(t, ids, "should not count registered tenants without data")
+}
+
+func testFindTenants(t *testing.T, repo note.Repository) {
+	for _, tenant := range []*note.Tenant{
+		{ID: "tenant-c", Status: note.TenantSuspended},
+		{ID: tenantA},
+		{ID: "tenant-d"},
+		{ID: tenantB, Status: note.TenantDeleted},
+	} {
+		require.NoError(t, repo.CreateTenant(tenant))
+	}
+
+	page, err := repo.FindTenants(note.TenantQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{tenantA, tenantB, "tenant-c", "tenant-d"}, tenantIDs(page.Tenants),
+		"should list tenants in ID order")
+	assert.Empty(t, page.Next)
+
+	page, err = repo.FindTenants(note.TenantQuery{Status: note.TenantActive})
+	require.NoError(t, err)
+	assert.Equal(t, []string{tenantA, "tenant-d"}, tenantIDs(page.Tenants))
+
+	var ids []string
+	q := note.TenantQuery{Limit: 3}
+	for {
+		page, err := repo.FindTenants(q)
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(page.Tenants), 3)
+		ids = append(ids, tenantIDs(page.Tenants)...)
+		if page.Next == "" {
+			break
+		}
+		q.Cursor = page.Next
+	}
+	assert.Equal(t, []string{tenantA, tenantB, "tenant-c", "tenant-d"}, ids, "should page through every tenant")
+
+	_, err = repo.FindTenants(note.TenantQuery{Status: "closed"})
+	assert.True(t, errors.Is(err, note.ErrInvalidQuery))
+	_, err = repo.FindTenants(note.TenantQuery{Cursor: "!"})
+	assert.True(t, errors.Is(err, note.ErrInvalidQuery))
+}
+
+func testTenantStatus(t *testing.T, repo note.Repository) {
+	s := note.NewService(repo, nil)
+
+	tenant, err := s.ActiveTenant(tenantA)
+	require.NoError(t, err)
+	assert.Equal(t, note.TenantActive, tenant.Status)
+	found, err := repo.FindTenant(tenantA)
+	require.NoError(t, err)
+	assert.NotNil(t, found, "should register tenants that are seen for the first time")
+
+	_, err = s.SetTenantStatus(tenantA, note.TenantSuspended)
+	require.NoError(t, err)
+	_, err = s.ActiveTenant(tenantA)
+	assert.True(t, errors.Is(err, note.ErrTenantInactive), "should reject suspended tenants")
+
+	_, err = s.SetTenantStatus(tenantA, note.TenantActive)
+	require.NoError(t, err)
+	_, err = s.ActiveTenant(tenantA)
+	assert.NoError(t, err, "should accept reinstated tenants")
+
+	_, err = s.SetTenantStatus(tenantA, note.TenantDeleted)
+	require.NoError(t, err)
+	_, err = s.ActiveTenant(tenantA)
+	assert.True(t, errors.Is(err, note.ErrTenantInactive), "should reject deleted tenants")
+	_, err = s.SetTenantStatus(tenantA, note.TenantActive)
+	assert.True(t, errors.Is(err, note.ErrTenantDeleted), "should not reinstate deleted tenants")
+
+	_, err = s.SetTenantStatus(tenantB, note.TenantSuspended)
+	assert.True(t, errors.Is(err, note.ErrNotFound))
+}
+
+func testUsers(t *testing.T, repo note.Repository) {
+	found, err := repo.FindUser("user-1")
+	require.NoError(t, err)
+	assert.Nil(t, found, "should return nil for an unknown user")
+	found, err = repo.FindUserByEmail("ann@example.com")
+	require.NoError(t, err)
+	assert.Nil(t, found, "should return nil for an unknown email")
+
+	ann := &note.User{ID: "user-2", TenantID: tenantA, Email: " Ann@Example.com", PasswordHash: []byte("hash-a")}
+	require.NoError(t, repo.CreateUser(ann))
+	assert.Equal(t, "ann@example.com", ann.Email, "should store emails in lower case")
+	assert.Equal(t, note.RoleViewer, ann.Role, "should default to viewer")
+	assert.False(t, ann.CreatedAt.IsZero(), "should set the creation time")
+	require.NoError(t, repo.CreateUser(&note.User{ID: "user-1", TenantID: tenantA, Email: "bob@example.com", PasswordHash: []byte("hash-b")}))
+	require.NoError(t, repo.CreateUser(&note.User{ID: "user-3", TenantID: tenantB, Email: "cat@example.com", PasswordHash: []byte("hash-c")}))
+
+	err = repo.CreateUser(&note.User{ID: "user-4", TenantID: tenantB, Email: "ANN@example.com", PasswordHash: []byte("hash-d")})
+	assert.True(t, errors.Is(err, note.ErrAlreadyExists), "should not give two users the same email")
+
+	found, err = repo.FindUser("user-2")
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, tenantA, found.TenantID)
+	assert.Equal(t, "ann@example.com", found.Email)
+	assert.Equal(t, []byte("hash-a"), found.PasswordHash, "should store the password hash")
+	assert.Equal(t, note.RoleViewer, found.Role)
+	assert.True(t, ann.CreatedAt.Equal(found.CreatedAt))
+
+	found, err = repo.FindUserByEmail("ann@example.com")
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, "user-2", found.ID)
+
+	users, err := repo.FindUsers(tenantA)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user-1", "user-2"}, userIDs(users), "should list a tenant's users in ID order")
+	users, err = repo.FindUsers("tenant-c")
+	require.NoError(t, err)
+	assert.NotNil(t, users, "should return an empty slice rather than nil")
+	assert.Empty(t, users)
+
+	ids, err := repo.TenantIDs()
+	require.NoError(t, err)
+	assert.Empty(t, ids, "should not count tenants with only users")
+}
+
+func testMembers(t *testing.T, repo note.Repository) {
+	s := note.NewService(repo, nil)
+	ann, err := s.RegisterUser(tenantA, "ann@example.com", "password1", note.RoleOwner)
+	require.NoError(t, err)
+	bob, err := s.RegisterUser(tenantA, "bob@example.com", "password2", note.RoleEditor)
+	require.NoError(t, err)
+	_, err = s.RegisterUser(tenantB, "cat@example.com", "password3", note.RoleOwner)
+	require.NoError(t, err)
+
+	_, err = s.SetUserRole(ann.ID, note.RoleEditor)
+	assert.True(t, errors.Is(err, note.ErrLastOwner), "should not demote the only owner")
+	assert.True(t, errors.Is(s.RemoveUser(ann.ID), note.ErrLastOwner), "should not remove the only owner")
+	_, err = s.SetUserRole(bob.ID, "admin")
+	assert.True(t, errors.Is(err, note.ErrInvalidUser))
+
+	updated, err := s.SetUserRole(bob.ID, note.RoleOwner)
+	require.NoError(t, err)
+	assert.Equal(t, note.RoleOwner, updated.Role)
+	assert.Equal(t, "bob@example.com", updated.Email, "should only change the role")
+	found, err := repo.FindUser(bob.ID)
+	require.NoError(t, err)
+	assert.Equal(t, note.RoleOwner, found.Role)
+
+	updated, err = s.SetUserRole(ann.ID, note.RoleViewer)
+	require.NoError(t, err, "should demote an owner once there is another")
+	assert.Equal(t, note.RoleViewer, updated.Role)
+
+	token, _, err := s.StartSession(updated, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, s.RemoveUser(ann.ID))
+	found, err = repo.FindUser(ann.ID)
+	require.NoError(t, err)
+	assert.Nil(t, found)
+	found, err = repo.FindUserByEmail("ann@example.com")
+	require.NoError(t, err)
+	assert.Nil(t, found, "should free the email of a removed user")
+	users, err := repo.FindUsers(tenantA)
+	require.NoError(t, err)
+	assert.Equal(t, []string{bob.ID}, userIDs(users))
+	_, _, err = s.RefreshSession(token, time.Hour)
+	assert.True(t, errors.Is(err, note.ErrInvalidCredentials), "should not refresh sessions of removed users")
+
+	assert.True(t, errors.Is(s.RemoveUser(ann.ID), note.ErrNotFound))
+	_, err = s.SetUserRole(ann.ID, note.RoleEditor)
+	assert.True(t, errors.Is(err, note.ErrNotFound))
+}
+
+func testSessions(t *testing.T, repo note.Repository) {
+	user := &note.User{ID: "user-1", TenantID: tenantA, Email: "ann@example.com", PasswordHash: []byte("hash")}
+	require.NoError(t, repo.CreateUser(user))
+
+	now := time.Now()
+	session := &note.Session{
+		ID:        "session-1",
+		UserID:    user.ID,
+		TenantID:  tenantA,
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+	}
+	require.NoError(t, repo.CreateSession(session))
+
+	found, err := repo.FindSession("session-1")
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, user.ID, found.UserID)
+	assert.Equal(t, tenantA, found.TenantID)
+	assert.True(t, session.ExpiresAt.Equal(found.ExpiresAt))
+
+	require.NoError(t, repo.DeleteSession("session-1"))
+	found, err = repo.FindSession("session-1")
+	require.NoError(t, err)
+	assert.Nil(t, found)
+	err = repo.DeleteSession("session-1")
+	assert.True(t, errors.Is(err, note.ErrNotFound), "should report deleting a missing session")
+
+	for _, session := range []*note.Session{
+		{ID: "expired", UserID: user.ID, TenantID: tenantA, CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)},
+		{ID: "current", UserID: user.ID, TenantID: tenantA, CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+	} {
+		require.NoError(t, repo.CreateSession(session))
+	}
+	n, err := repo.DeleteExpiredSessions(now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	found, err = repo.FindSession("expired")
+	require.NoError(t, err)
+	assert.Nil(t, found, "should delete an expired session")
+	found, err = repo.FindSession("current")
+	require.NoError(t, err)
+	assert.NotNil(t, found, "should keep a session that has not expired")
+
+	require.NoError(t, repo.DeleteUser(user.ID))
+	found, err = repo.FindSession("current")
+	require.NoError(t, err)
+	assert.Nil(t, found, "should delete the sessions of a deleted user")
+}
+
+func testSignIn(t *testing.T, repo note.Repository) {
+	s := note.NewService(repo, nil)
+
+	_, err := s.RegisterUser(tenantA, "not an email", "password1", note.RoleOwner)
+	assert.True(t, errors.Is(err, note.ErrInvalidUser))
+	_, err = s.RegisterUser(tenantA, "ann@example.com", "short", note.RoleOwner)
+	assert.True(t, errors.Is(err, note.ErrInvalidUser))
+	_, err = s.RegisterUser(tenantA, "ann@example.com", "password1", "admin")
+	assert.True(t, errors.Is(err, note.ErrInvalidUser))
+
+	user, err := s.RegisterUser(tenantA, "Ann@example.com", "password1", note.RoleOwner)
+	require.NoError(t, err)
+	assert.NotEqual(t, []byte("password1"), user.PasswordHash, "should not store the password itself")
+
+	_, err = s.Authenticate("ann@example.com", "password2")
+	assert.True(t, errors.Is(err, note.ErrInvalidCredentials), "should reject a wrong password")
+	_, err = s.Authenticate("bob@example.com", "password1")
+	assert.True(t, errors.Is(err, note.ErrInvalidCredentials), "should reject an unknown email")
+	found, err := s.Authenticate("ANN@example.com", "password1")
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+
+	token, session, err := s.StartSession(found, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, session.UserID)
+	assert.Equal(t, tenantA, session.TenantID)
+	stored, err := repo.FindSession(token)
+	require.NoError(t, err)
+	assert.Nil(t, stored, "should not store the refresh token itself")
+
+	refreshed, session, err := s.RefreshSession(token, time.Hour)
+	require.NoError(t, err)
+	assert.NotEqual(t, token, refreshed)
+	assert.Equal(t, user.ID, session.UserID)
+	_, _, err = s.RefreshSession(token, time.Hour)
+	assert.True(t, errors.Is(err, note.ErrInvalidCredentials), "should only accept a refresh token once")
+
+	require.NoError(t, s.EndSession(refreshed))
+	_, _, err = s.RefreshSession(refreshed, time.Hour)
+	assert.True(t, errors.Is(err, note.ErrInvalidCredentials), "should not refresh an ended session")
+	assert.NoError(t, s.EndSession(refreshed), "should allow ending a session twice")
+
+	expired, _, err := s.StartSession(found, -time.Second)
+	require.NoError(t, err)
+	_, _, err = s.RefreshSession(expired, time.Hour)
+	assert.True(t, errors.Is(err, note.ErrInvalidCredentials), "should not refresh an expired session")
+}
+
+func testAuthorship(t *testing.T, repo note.Repository) {
+	tx := repo.Transaction(tenantA)
+	n := &note.Note{Title: "Plan", UpdatedBy: "user-1"}
+	require.NoError(t, tx.CreateNote(n))
+	require.NoError(t, tx.UpdateNote(n.ID, &note.Note{Title: "Plan", Content: "Step 1", UpdatedBy: "user-2"}))
+	require.NoError(t, tx.UpdateNote(n.ID, &note.Note{Title: "Plan", Content: "Step 2"}))
+
+	found, err := tx.FindNoteByID(n.ID)
+	require.NoError(t, err)
+	assert.Empty(t, found.UpdatedBy, "should clear the author of changes made with a tenant token")
+
+	revisions, err := tx.FindRevisions(n.ID)
+	require.NoError(t, err)
+	require.Len(t, revisions, 3)
+	assert.Equal(t, "user-1", revisions[0].Author)
+	assert.Equal(t, "user-2", revisions[1].Author)
+	assert.Empty(t, revisions[2].Author)
+
+	restored, err := note.NewService(repo, nil).RestoreRevision(tenantA, "user-3", n.ID, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "user-3", restored.UpdatedBy, "should credit the user who restored the revision")
+	revision, err := tx.FindRevision(n.ID, 4)
+	require.NoError(t, err)
+	require.NotNil(t, revision)
+	assert.Equal(t, "user-3", revision.Author)
+
+	notes, err := tx.FindAllNotes()
+	require.NoError(t, err)
+	require.Len(t, notes, 1)
+	assert.Equal(t, "user-3", notes[0].UpdatedBy)
+}
+
+func testAPIKeys(t *testing.T, repo note.Repository) {
+	now := time.Now()
+	expiresAt := now.Add(time.Hour)
+	for _, key := range []*note.APIKey{
+		{ID: "key-2", TenantID: tenantA, Name: "sync", Scopes: []string{"notes:read"}, Hash: "hash-2", CreatedAt: now, ExpiresAt: &expiresAt},
+		{ID: "key-1", TenantID: tenantA, Name: "backup", Scopes: []string{"notes:read", "tags:write"}, Hash: "hash-1", CreatedAt: now},
+		{ID: "key-3", TenantID: tenantB, Name: "import", Scopes: []string{"notes:write"}, Hash: "hash-3", CreatedAt: now},
+	} {
+		require.NoError(t, repo.CreateAPIKey(key))
+	}
+	err := repo.CreateAPIKey(&note.APIKey{ID: "key-4", TenantID: tenantA, Name: "copy", Hash: "hash-1", CreatedAt: now})
+	assert.True(t, errors.Is(err, note.ErrAlreadyExists), "should reject a duplicate hash")
+
+	found, err := repo.FindAPIKeyByHash("hash-2")
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, "key-2", found.ID)
+	assert.Equal(t, "sync", found.Name)
+	assert.Equal(t, []string{"notes:read"}, found.Scopes)
+	assert.Equal(t, "hash-2", found.Hash)
+	require.NotNil(t, found.ExpiresAt)
+	assert.True(t, expiresAt.Equal(*found.ExpiresAt))
+	assert.Nil(t, found.LastUsedAt)
+
+	found, err = repo.FindAPIKey("key-1")
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Nil(t, found.ExpiresAt)
+	found, err = repo.FindAPIKeyByHash("hash-4")
+	require.NoError(t, err)
+	assert.Nil(t, found)
+
+	keys, err := repo.FindAPIKeys(tenantA)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"key-1", "key-2"}, apiKeyIDs(keys))
+
+	usedAt := now.Add(time.Minute)
+	require.NoError(t, repo.TouchAPIKey("key-1", usedAt))
+	found, err = repo.FindAPIKey("key-1")
+	require.NoError(t, err)
+	require.NotNil(t, found.LastUsedAt)
+	assert.True(t, usedAt.Equal(*found.LastUsedAt))
+	err = repo.TouchAPIKey("key-4", usedAt)
+	assert.True(t, errors.Is(err, note.ErrNotFound), "should report touching a missing key")
+
+	require.NoError(t, repo.DeleteAPIKey("key-1"))
+	found, err = repo.FindAPIKeyByHash("hash-1")
+	require.NoError(t, err)
+	assert.Nil(t, found, "should not find a deleted key by its hash")
+	keys, err = repo.FindAPIKeys(tenantA)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"key-2"}, apiKeyIDs(keys))
+	err = repo.DeleteAPIKey("key-1")
+	assert.True(t, errors.Is(err, note.ErrNotFound), "should report deleting a missing key")
+}
+
+func testIssueAPIKey(t *testing.T, repo note.Repository) {
+	s := note.NewService(repo, nil)
+	scopes := []string{"notes:read"}
+
+	_, _, err := s.IssueAPIKey(tenantA, " ", scopes, nil)
+	assert.True(t, errors.Is(err, note.ErrInvalidAPIKey), "should require a name")
+	_, _, err = s.IssueAPIKey(tenantA, "sync", nil, nil)
+	assert.True(t, errors.Is(err, note.ErrInvalidAPIKey), "should require a scope")
+	past := time.Now().Add(-time.Minute)
+	_, _, err = s.IssueAPIKey(tenantA, "sync", scopes, &past)
+	assert.True(t, errors.Is(err, note.ErrInvalidAPIKey), "should reject an expiry in the past")
+
+	token, key, err := s.IssueAPIKey(tenantA, "sync", scopes, nil)
+	require.NoError(t, err)
+	assert.True(t, note.IsAPIKey(token))
+	assert.NotContains(t, string(key.MustMarshal()), token, "should not store the token itself")
+
+	used, err := s.AuthenticateAPIKey(token)
+	require.NoError(t, err)
+	assert.Equal(t, key.ID, used.ID)
+	assert.Equal(t, tenantA, used.TenantID)
+	stored, err := repo.FindAPIKey(key.ID)
+	require.NoError(t, err)
+	require.NotNil(t, stored.LastUsedAt, "should record when the key was used")
+
+	_, err = s.AuthenticateAPIKey(token + "0")
+	assert.True(t, errors.Is(err, note.ErrInvalidCredentials), "should reject an unknown key")
+
+	require.NoError(t, repo.DeleteAPIKey(key.ID))
+	_, err = s.AuthenticateAPIKey(token)
+	assert.True(t, errors.Is(err, note.ErrInvalidCredentials), "should reject a revoked key")
+
+	// Keys cannot be issued already expired, so expire one by storing it
+	// again.
+	token, key, err = s.IssueAPIKey(tenantA, "old", scopes, nil)
+	require.NoError(t, err)
+	require.NoError(t, repo.DeleteAPIKey(key.ID))
+	key.ExpiresAt = &past
+	require.NoError(t, repo.CreateAPIKey(key))
+	_, err = s.AuthenticateAPIKey(token)
+	assert.True(t, errors.Is(err, note.ErrInvalidCredentials), "should reject an expired key")
+}
+
+func apiKeyIDs(keys []*note.APIKey) []string {
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = key.ID
+	}
+	return ids
+}
+
+func userIDs(users []*note.User) []string {
+	ids := make([]string, len(users))
+	for i, user := range users {
+		ids[i] = user.ID
+	}
+	return ids
+}
+
+func tenantIDs(tenants []*note.Tenant) []string {
+	ids := make([]string, len(tenants))
+	for i, tenant := range tenants {
+		ids[i] = tenant.ID
+	}
+	return ids
+}
+
+func noteIDs(notes []*note.Note) []uint64 {
+	ids := make([]uint64, len(notes))
+	for i, n := range notes {
+		ids[i] = n.ID
+	}
+	return ids
+}
+
+func tagIDs(tags []*note.Tag) []uint64 {
+	ids := make([]uint64, len(tags))
+	for i, tag := range tags {
+		ids[i] = tag.ID
+	}
+	return ids
+}
@@ -0,0 +1,259 @@
+package note
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ErrInvalidQuery is matched by the errors returned for a listing query that
+// cannot be run, such as one with an unknown sort field or a bad cursor.
+var ErrInvalidQuery = errors.New("invalid query")
+
+func invalidQuery(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidQuery, fmt.Sprintf(format, args...))
+}
+
+// NoteSort is a field by which notes can be listed. Notes with equal values
+// are ordered by ID.
+type NoteSort string
+
+const (
+	SortByCreatedAt NoteSort = "createdAt"
+	SortByUpdatedAt NoteSort = "updatedAt"
+	// SortByTitle orders titles case-insensitively for ASCII letters and
+	// byte-wise otherwise, which every backend can do efficiently.
+	SortByTitle NoteSort = "title"
+)
+
+// NoteQuery selects a page of notes that are not in the trash. Zero values
+// do not filter; the default sort is SortByCreatedAt and a Limit of 0
+// returns every remaining note.
+type NoteQuery struct {
+	Sort       NoteSort
+	Descending bool
+	Limit      int
+	// Cursor continues from the NotePage.Next of a query with the same sort
+	// and order.
+	Cursor string
+
+	TagID         uint64
+	UpdatedSince  time.Time
+	CreatedBefore time.Time
+}
+
+// NotePage is a page of notes. Next is empty on the last page.
+type NotePage struct {
+	Notes []*Note
+	Next  string
+}
+
+// noteCursor records the sort position of the last note on a page.
+type noteCursor struct {
+	Sort  NoteSort `json:"s"`
+	Desc  bool     `json:"d,omitempty"`
+	Time  int64    `json:"t,omitempty"`
+	Title string   `json:"k,omitempty"`
+	ID    uint64   `json:"id"`
+}
+
+// validate checks the query and fills in defaults.
+func (q *NoteQuery) validate() error {
+	switch q.Sort {
+	case "":
+		q.Sort = SortByCreatedAt
+	case SortByCreatedAt, SortByUpdatedAt, SortByTitle:
+	default:
+		return invalidQuery("cannot sort notes by %q", q.Sort)
+	}
+	if q.Limit < 0 {
+		return invalidQuery("limit must not be negative")
+	}
+	return nil
+}
+
+// after returns the note that the cursor points at, holding only the fields
+// that notes are ordered by, or nil if the query starts at the beginning.
+func (q *NoteQuery) after() (*Note, error) {
+	if q.Cursor == "" {
+		return nil, nil
+	}
+
+	var c noteCursor
+	bs, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err == nil {
+		err = json.Unmarshal(bs, &c)
+	}
+	if err != nil {
+		return nil, invalidQuery("malformed cursor")
+	}
+	if c.Sort != q.Sort || c.Desc != q.Descending {
+		return nil, invalidQuery("cursor belongs to a query with a different sort order")
+	}
+
+	n := &Note{ID: c.ID, Title: c.Title}
+	switch c.Sort {
+	case SortByCreatedAt:
+		n.CreatedAt = time.Unix(0, c.Time).UTC()
+	case SortByUpdatedAt:
+		n.UpdatedAt = time.Unix(0, c.Time).UTC()
+	}
+	return n, nil
+}
+
+func (q *NoteQuery) cursorFor(n *Note) string {
+	c := noteCursor{Sort: q.Sort, Desc: q.Descending, ID: n.ID}
+	switch q.Sort {
+	case SortByCreatedAt:
+		c.Time = n.CreatedAt.UnixNano()
+	case SortByUpdatedAt:
+		c.Time = n.UpdatedAt.UnixNano()
+	case SortByTitle:
+		c.Title = n.Title
+	}
+
+	bs, err := json.Marshal(c)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
+
+// matches applies the time filters. Filtering by tag is left to each backend,
+// which can do it without loading every note's tags.
+func (q *NoteQuery) matches(n *Note) bool {
+	if !q.UpdatedSince.IsZero() && n.UpdatedAt.Before(q.UpdatedSince) {
+		return false
+	}
+	if !q.CreatedBefore.IsZero() && !n.CreatedAt.Before(q.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// compare orders two notes as the query lists them.
+func (q *NoteQuery) compare(a, b *Note) int {
+	var c int
+	switch q.Sort {
+	case SortByCreatedAt:
+		c = compareTimes(a.CreatedAt, b.CreatedAt)
+	case SortByUpdatedAt:
+		c = compareTimes(a.UpdatedAt, b.UpdatedAt)
+	case SortByTitle:
+		c = compareStrings(titleSortKey(a.Title), titleSortKey(b.Title))
+	}
+	if c == 0 {
+		switch {
+		case a.ID < b.ID:
+			c = -1
+		case a.ID > b.ID:
+			c = 1
+		}
+	}
+	if q.Descending {
+		return -c
+	}
+	return c
+}
+
+// sort orders notes as the query lists them and drops any up to and
+// including the cursor position.
+func (q *NoteQuery) sort(notes []*Note, after *Note) []*Note {
+	sort.Slice(notes, func(i, j int) bool { return q.compare(notes[i], notes[j]) < 0 })
+	if after == nil {
+		return notes
+	}
+	i := sort.Search(len(notes), func(i int) bool { return q.compare(notes[i], after) > 0 })
+	return notes[i:]
+}
+
+// page builds a page from notes in query order. Backends fetch one note more
+// than the limit so that they can tell whether there is a next page.
+func (q *NoteQuery) page(notes []*Note) *NotePage {
+	page := &NotePage{Notes: notes}
+	if q.Limit > 0 && len(notes) > q.Limit {
+		page.Notes = notes[:q.Limit]
+		page.Next = q.cursorFor(page.Notes[q.Limit-1])
+	}
+	return page
+}
+
+// titleSortKey lower-cases ASCII letters only, so that it agrees with
+// SQLite's lower().
+func titleSortKey(title string) string {
+	bs := []byte(title)
+	for i, b := range bs {
+		if 'A' <= b && b <= 'Z' {
+			bs[i] = b + ('a' - 'A')
+		}
+	}
+	return string(bs)
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+func compareStrings(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// TagQuery selects a page of tags in ID order. A Limit of 0 returns every
+// remaining tag.
+type TagQuery struct {
+	Limit  int
+	Cursor string
+}
+
+// TagPage is a page of tags. Next is empty on the last page.
+type TagPage struct {
+	Tags []*Tag
+	Next string
+}
+
+// after returns the ID of the last tag of the previous page, or 0.
+func (q *TagQuery) after() (uint64, error) {
+	if q.Limit < 0 {
+		return 0, invalidQuery("limit must not be negative")
+	}
+	if q.Cursor == "" {
+		return 0, nil
+	}
+
+	var id uint64
+	bs, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err == nil {
+		err = json.Unmarshal(bs, &id)
+	}
+	if err != nil || id == 0 {
+		return 0, invalidQuery("malformed cursor")
+	}
+	return id, nil
+}
+
+// page builds a page from tags in ID order, of which there may be one more
+// than the limit.
+func (q *TagQuery) page(tags []*Tag) *TagPage {
+	page := &TagPage{Tags: tags}
+	if q.Limit > 0 && len(tags) > q.Limit {
+		page.Tags = tags[:q.Limit]
+		bs, _ := json.Marshal(page.Tags[q.Limit-1].ID)
+		page.Next = base64.RawURLEncoding.EncodeToString(bs)
+	}
+	return page
+}
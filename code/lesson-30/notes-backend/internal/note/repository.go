@@ -1,22 +1,140 @@
 package note
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
+// ErrNotFound is matched by the errors returned when an operation refers to a
+// note or tag that does not exist for the tenant.
+var ErrNotFound = errors.New("not found")
+
+// NotFoundError reports which entity an operation could not find.
+type NotFoundError struct {
+	Entity string
+	ID     uint64
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("%s %d not found", e.Entity, e.ID)
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// ErrConflict is matched by the errors returned when a write is based on a
+// version of a note that is no longer current.
+var ErrConflict = errors.New("conflict")
+
+// ConflictError reports the version a write expected and the version that is
+// actually stored.
+type ConflictError struct {
+	NoteID   uint64
+	Expected uint64
+	Actual   uint64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("note %d is at version %d, not %d", e.NoteID, e.Actual, e.Expected)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// ErrAlreadyExists is matched by the errors returned when a write would give a
+// tag the same name as another of the tenant's tags.
+var ErrAlreadyExists = errors.New("already exists")
+
+// AlreadyExistsError reports the name that is already taken.
+type AlreadyExistsError struct {
+	Entity string
+	Name   string
+}
+
+func (e *AlreadyExistsError) Error() string {
+	return fmt.Sprintf("%s %q already exists", e.Entity, e.Name)
+}
+
+func (e *AlreadyExistsError) Is(target error) bool {
+	return target == ErrAlreadyExists
+}
+
+func tagExists(name string) error {
+	return &AlreadyExistsError{Entity: "tag", Name: name}
+}
+
+// checkVersion returns a ConflictError unless note is at version.
+func checkVersion(note *Note, version uint64) error {
+	if note.Version != version {
+		return &ConflictError{NoteID: note.ID, Expected: version, Actual: note.Version}
+	}
+	return nil
+}
+
+func noteNotFound(id uint64) error {
+	return &NotFoundError{Entity: "note", ID: id}
+}
+
+func tagNotFound(id uint64) error {
+	return &NotFoundError{Entity: "tag", ID: id}
+}
+
+// Read operations return a nil entity and a nil error when the requested note
+// or tag does not exist. Notes in the trash are only returned by
+// FindTrashedNotes. Listings are ordered by ID.
 type Read interface {
 	FindNoteByID(id uint64) (*Note, error)
 	FindAllNotes() ([]*Note, error)
+	FindTrashedNotes() ([]*Note, error)
+	// FindNotes returns a page of notes. Invalid queries return an error
+	// matching ErrInvalidQuery.
+	FindNotes(q NoteQuery) (*NotePage, error)
 
 	FindTagByID(id uint64) (*Tag, error)
 	FindAllTags() ([]*Tag, error)
+	FindTags(q TagQuery) (*TagPage, error)
+
+	// FindRevisions returns the retained revisions of a note, oldest first.
+	FindRevisions(noteID uint64) ([]*Revision, error)
+	FindRevision(noteID, rev uint64) (*Revision, error)
 }
 
+// Mutate operations on a note or tag that does not exist return an error that
+// matches ErrNotFound. Creating or updating a note records a new revision.
+// A created note is never in the trash, whatever DeletedAt it is given.
 type Mutate interface {
 	CreateNote(*Note) error
+	// UpdateNote replaces the title and content of an existing note and
+	// increments its version. On success, note holds the stored state of the
+	// note.
 	UpdateNote(id uint64, note *Note) error
+	// CheckNoteVersion returns an error matching ErrConflict unless the note
+	// is at the given version. Calling it within Update makes the writes that
+	// follow conditional on the version.
+	CheckNoteVersion(id, version uint64) error
+	// DeleteNote moves a note to the trash, from which it can be restored
+	// until it is purged.
 	DeleteNote(id uint64) error
+	// RestoreNote moves a note out of the trash.
+	RestoreNote(id uint64) error
+	// PurgeNote permanently deletes a note that is in the trash, along with
+	// its revisions and tag associations.
+	PurgeNote(id uint64) error
 
+	// CreateTag and UpdateTag return an error matching ErrAlreadyExists if
+	// another of the tenant's tags has the same name.
 	CreateTag(*Tag) error
+	// UpdateTag replaces the name, color and description of a tag. On
+	// success, tag holds the stored state of the tag.
+	UpdateTag(id uint64, tag *Tag) error
+	// DeleteTag deletes a tag and removes it from every note.
 	DeleteTag(id uint64) error
+	// MergeTag moves every note with tag id over to tag intoID and then
+	// deletes tag id.
+	MergeTag(id, intoID uint64) error
 
 	TagNote(noteID, tagID uint64) error
 	UntagNote(noteID, tagID uint64) error
@@ -27,17 +145,108 @@ type Transaction interface {
 	Mutate
 }
 
+// TenantRegistry records every tenant that has been issued a token, apart
+// from the tenant's notes and tags.
+type TenantRegistry interface {
+	// CreateTenant registers a tenant, which is active unless it is given
+	// another status. It returns an error matching ErrAlreadyExists if the
+	// ID is taken.
+	CreateTenant(*Tenant) error
+	// FindTenant returns nil and a nil error if the tenant is not registered.
+	FindTenant(id string) (*Tenant, error)
+	FindTenants(q TenantQuery) (*TenantPage, error)
+	// UpdateTenant replaces the name and status of a registered tenant. On
+	// success, tenant holds the stored state of the tenant.
+	UpdateTenant(id string, tenant *Tenant) error
+}
+
+// UserRegistry keeps the users that sign in to tenants and their sessions.
+// Emails are stored in lower case.
+type UserRegistry interface {
+	// CreateUser returns an error matching ErrAlreadyExists if another user
+	// has the same email.
+	CreateUser(*User) error
+	// FindUser and FindUserByEmail return nil and a nil error if there is no
+	// such user.
+	FindUser(id string) (*User, error)
+	FindUserByEmail(email string) (*User, error)
+	// FindUsers returns the users of a tenant in ID order.
+	FindUsers(tenantID string) ([]*User, error)
+	// UpdateUser replaces the role of a user. On success, user holds the
+	// stored state of the user.
+	UpdateUser(id string, user *User) error
+	// DeleteUser removes a user and their sessions.
+	DeleteUser(id string) error
+
+	CreateSession(*Session) error
+	// FindSession returns nil and a nil error if there is no such session.
+	// Sessions are returned until they are deleted, even once they expire.
+	FindSession(id string) (*Session, error)
+	// DeleteSession returns an error matching ErrNotFound if there is no
+	// such session.
+	DeleteSession(id string) error
+	// DeleteExpiredSessions deletes every session that expired by the given
+	// time, and returns how many were deleted.
+	DeleteExpiredSessions(expiredBy time.Time) (int, error)
+}
+
+// KeyRegistry keeps the API keys that integrations use to act for tenants.
+type KeyRegistry interface {
+	// CreateAPIKey returns an error matching ErrAlreadyExists if another key
+	// has the same ID or hash.
+	CreateAPIKey(*APIKey) error
+	// FindAPIKey and FindAPIKeyByHash return nil and a nil error if there is
+	// no such key. Keys are returned until they are deleted, even once they
+	// expire.
+	FindAPIKey(id string) (*APIKey, error)
+	FindAPIKeyByHash(hash string) (*APIKey, error)
+	// FindAPIKeys returns the keys of a tenant in ID order.
+	FindAPIKeys(tenantID string) ([]*APIKey, error)
+	// TouchAPIKey records when a key was last used. It returns an error
+	// matching ErrNotFound if there is no such key.
+	TouchAPIKey(id string, usedAt time.Time) error
+	// DeleteAPIKey returns an error matching ErrNotFound if there is no such
+	// key.
+	DeleteAPIKey(id string) error
+}
+
 type Repository interface {
+	TenantRegistry
+	UserRegistry
+	KeyRegistry
+	// Transaction returns a Transaction in which every operation is applied on
+	// its own. Use Update when several operations must succeed or fail together.
 	Transaction(tenantID string) Transaction
+	// Update runs fn as a single unit of work. If fn returns an error, none of
+	// the operations it performed are persisted.
+	Update(tenantID string, fn func(tx Transaction) error) error
+	// PurgeTrash permanently deletes every tenant's notes that were moved to
+	// the trash before the given time, and returns how many were purged.
+	PurgeTrash(deletedBefore time.Time) (int, error)
+	// TenantIDs returns the IDs of every tenant that has notes or tags,
+	// including notes in the trash, in ascending order.
+	TenantIDs() ([]string, error)
+	// IndexQueueDepth returns the number of committed changes that have not
+	// yet been applied to the search index.
+	IndexQueueDepth() (int, error)
+	// CheckIntegrity looks for associations between notes and tags that are
+	// missing, one-sided or refer to a tag that does not exist, and for
+	// revisions of notes that do not exist. If fix is set, it repairs what it
+	// finds without changing the tags that any note has.
+	CheckIntegrity(fix bool) ([]*Problem, error)
+	// Close waits for the search index to catch up with every committed
+	// change before it releases the underlying storage.
 	Close() error
 }
 
 func NewRepository(c RepositoryConfig, idx SearchIndex) (Repository, error) {
 	switch c.Type {
 	case "memory":
-		return NewInMemoryRepo(), nil
+		return NewInMemoryRepo(c, idx), nil
 	case "badgerdb":
 		return NewBadgerRepo(c, idx)
+	case "sqlite":
+		return NewSQLiteRepo(c, idx)
 	default:
 		return nil, fmt.Errorf("Invalid repository type: %q", c.Type)
 	}
@@ -46,5 +255,10 @@ func NewRepository(c RepositoryConfig, idx SearchIndex) (Repository, error) {
 type RepositoryConfig struct {
 	Type string
 
-	BadgerDir string `mapstructure:"badger-dir"`
+	BadgerDir  string `mapstructure:"badger-dir"`
+	SQLitePath string `mapstructure:"sqlite-path"`
+
+	// RevisionLimit is the number of revisions retained per note. Older
+	// revisions are discarded as new ones are recorded. Zero keeps them all.
+	RevisionLimit int `mapstructure:"revision-limit"`
 }
@@ -0,0 +1,38 @@
+package note_test
+
+import (
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"learn-cljs.com/notes/internal/note"
+	"learn-cljs.com/notes/internal/note/notetest"
+)
+
+func TestInMemoryRepository(t *testing.T) {
+	notetest.RunRepositoryTests(t, func(t *testing.T, c note.RepositoryConfig, idx note.SearchIndex) note.Repository {
+		return note.NewInMemoryRepo(c, idx)
+	})
+}
+
+func TestBadgerRepository(t *testing.T) {
+	notetest.RunRepositoryTests(t, func(t *testing.T, c note.RepositoryConfig, idx note.SearchIndex) note.Repository {
+		c.BadgerDir = t.TempDir()
+		repo, err := note.NewBadgerRepo(c, idx)
+		require.NoError(t, err)
+		t.Cleanup(func() { repo.Close() })
+
+		return repo
+	})
+}
+
+func TestSQLiteRepository(t *testing.T) {
+	notetest.RunRepositoryTests(t, func(t *testing.T, c note.RepositoryConfig, idx note.SearchIndex) note.Repository {
+		c.SQLitePath = path.Join(t.TempDir(), "notes.db")
+		repo, err := note.NewSQLiteRepo(c, idx)
+		require.NoError(t, err)
+		t.Cleanup(func() { repo.Close() })
+
+		return repo
+	})
+}
@@ -0,0 +1,273 @@
+package note
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Revision is an immutable snapshot of a note's title and content. A revision
+// is recorded every time a note is created or updated.
+type Revision struct {
+	NoteID    uint64    `json:"noteId"`
+	Rev       uint64    `json:"rev"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Author is the ID of the user whose change the revision records.
+	Author string `json:"author,omitempty"`
+}
+
+func (r *Revision) MustMarshal() []byte {
+	bs, err := json.Marshal(r)
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+func (r *Revision) Unmarshal(bs []byte) error {
+	if r == nil {
+		return nil
+	}
+	return json.Unmarshal(bs, r)
+}
+
+func newRevision(note *Note, rev uint64) *Revision {
+	return &Revision{
+		NoteID:    note.ID,
+		Rev:       rev,
+		Title:     note.Title,
+		Content:   note.Content,
+		CreatedAt: note.UpdatedAt,
+		Author:    note.UpdatedBy,
+	}
+}
+
+func revisionNotFound(rev uint64) error {
+	return &NotFoundError{Entity: "revision", ID: rev}
+}
+
+// RevisionDiff is a line-level comparison of two revisions of a note.
+type RevisionDiff struct {
+	NoteID  uint64     `json:"noteId"`
+	From    uint64     `json:"from"`
+	To      uint64     `json:"to"`
+	Title   []DiffLine `json:"title"`
+	Content []DiffLine `json:"content"`
+}
+
+type DiffOp string
+
+const (
+	DiffEqual  DiffOp = "equal"
+	DiffInsert DiffOp = "insert"
+	DiffDelete DiffOp = "delete"
+)
+
+type DiffLine struct {
+	Op   DiffOp `json:"op"`
+	Text string `json:"text"`
+}
+
+// DiffLines computes a minimal line-level edit script that turns a into b,
+// using the linear space variant of Myers' O((N+M)D) algorithm, so that
+// comparing long notes that differ throughout does not need memory that
+// grows with the square of their length. Within each run of changes, deleted
+// lines come before inserted ones.
+func DiffLines(a, b string) []DiffLine {
+	x, y := splitLines(a), splitLines(b)
+
+	// Lines are compared as numbers, which is cheaper than comparing text.
+	ids := make(map[string]int)
+	intern := func(lines []string) []int {
+		out := make([]int, len(lines))
+		for i, line := range lines {
+			id, ok := ids[line]
+			if !ok {
+				id = len(ids)
+				ids[line] = id
+			}
+			out[i] = id
+		}
+		return out
+	}
+
+	size := 2*(len(x)+len(y)) + 2
+	d := &differ{
+		x: x, y: y,
+		a: intern(x), b: intern(y),
+		vf: make([]int, size),
+		vb: make([]int, size),
+	}
+	d.diff(0, len(x), 0, len(y))
+	return groupChanges(d.lines)
+}
+
+// differ holds the state shared by the recursive steps of DiffLines. The
+// buffers vf and vb are reused by every step, as each finishes with them
+// before the next starts.
+type differ struct {
+	x, y   []string
+	a, b   []int
+	vf, vb []int
+	lines  []DiffLine
+}
+
+// diff appends the edit script that turns x[aLo:aHi] into y[bLo:bHi].
+func (d *differ) diff(aLo, aHi, bLo, bHi int) {
+	for aLo < aHi && bLo < bHi && d.a[aLo] == d.b[bLo] {
+		d.lines = append(d.lines, DiffLine{Op: DiffEqual, Text: d.x[aLo]})
+		aLo++
+		bLo++
+	}
+	suffix := aHi
+	for aLo < aHi && bLo < bHi && d.a[aHi-1] == d.b[bHi-1] {
+		aHi--
+		bHi--
+	}
+
+	switch {
+	case aLo == aHi || bLo == bHi:
+		d.replace(aLo, aHi, bLo, bHi)
+	default:
+		if xMid, yMid, ok := d.middleSnake(aLo, aHi, bLo, bHi); ok {
+			d.diff(aLo, xMid, bLo, yMid)
+			d.diff(xMid, aHi, yMid, bHi)
+		} else {
+			d.replace(aLo, aHi, bLo, bHi)
+		}
+	}
+
+	for i := aHi; i < suffix; i++ {
+		d.lines = append(d.lines, DiffLine{Op: DiffEqual, Text: d.x[i]})
+	}
+}
+
+func (d *differ) replace(aLo, aHi, bLo, bHi int) {
+	for i := aLo; i < aHi; i++ {
+		d.lines = append(d.lines, DiffLine{Op: DiffDelete, Text: d.x[i]})
+	}
+	for j := bLo; j < bHi; j++ {
+		d.lines = append(d.lines, DiffLine{Op: DiffInsert, Text: d.y[j]})
+	}
+}
+
+// middleSnake finds a point on a shortest edit path between x[aLo:aHi] and
+// y[bLo:bHi] by searching forwards from the start and backwards from the end
+// until the two searches overlap. Both ranges must be non-empty and differ
+// in their first and last lines. It returns false if the ranges have no line
+// in common.
+func (d *differ) middleSnake(aLo, aHi, bLo, bHi int) (int, int, bool) {
+	n, m := aHi-aLo, bHi-bLo
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	length := 2*maxD + 2
+	// vf[offset+k] holds the furthest x reached forwards on diagonal k, and
+	// vb[offset+k] the furthest distance from the end reached backwards.
+	vf, vb := d.vf[:length], d.vb[:length]
+	for i := range vf {
+		vf[i], vb[i] = -1, -1
+	}
+	vf[offset+1], vb[offset+1] = 0, 0
+
+	delta := n - m
+	// If delta is odd, the searches can only meet while searching forwards.
+	front := delta%2 != 0
+	// Diagonals that run off the edge of the grid are skipped from then on.
+	var kfStart, kfEnd, kbStart, kbEnd int
+	for step := 0; step < maxD; step++ {
+		for k := -step + kfStart; k <= step-kfEnd; k += 2 {
+			i := offset + k
+			var xf int
+			if k == -step || (k != step && vf[i-1] < vf[i+1]) {
+				xf = vf[i+1]
+			} else {
+				xf = vf[i-1] + 1
+			}
+			yf := xf - k
+			for xf < n && yf < m && d.a[aLo+xf] == d.b[bLo+yf] {
+				xf++
+				yf++
+			}
+			vf[i] = xf
+			switch {
+			case xf > n:
+				kfEnd += 2
+			case yf > m:
+				kfStart += 2
+			case front:
+				j := offset + delta - k
+				if j >= 0 && j < length && vb[j] != -1 && xf >= n-vb[j] {
+					return aLo + xf, bLo + yf, true
+				}
+			}
+		}
+
+		for k := -step + kbStart; k <= step-kbEnd; k += 2 {
+			i := offset + k
+			var xb int
+			if k == -step || (k != step && vb[i-1] < vb[i+1]) {
+				xb = vb[i+1]
+			} else {
+				xb = vb[i-1] + 1
+			}
+			yb := xb - k
+			for xb < n && yb < m && d.a[aHi-xb-1] == d.b[bHi-yb-1] {
+				xb++
+				yb++
+			}
+			vb[i] = xb
+			switch {
+			case xb > n:
+				kbEnd += 2
+			case yb > m:
+				kbStart += 2
+			case !front:
+				j := offset + delta - k
+				if j >= 0 && j < length && vf[j] != -1 {
+					xf := vf[j]
+					yf := offset + xf - j
+					if xf >= n-xb {
+						return aLo + xf, bLo + yf, true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// groupChanges moves the deleted lines of each run of changes before its
+// inserted lines, which leaves the script as short as it was.
+func groupChanges(lines []DiffLine) []DiffLine {
+	for start := 0; start < len(lines); {
+		if lines[start].Op == DiffEqual {
+			start++
+			continue
+		}
+		end := start
+		for end < len(lines) && lines[end].Op != DiffEqual {
+			end++
+		}
+		run := append([]DiffLine(nil), lines[start:end]...)
+		i := start
+		for _, op := range []DiffOp{DiffDelete, DiffInsert} {
+			for _, line := range run {
+				if line.Op == op {
+					lines[i] = line
+					i++
+				}
+			}
+		}
+		start = end
+	}
+	return lines
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
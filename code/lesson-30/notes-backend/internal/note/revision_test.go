@@ -0,0 +1,135 @@
+package note
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []DiffLine
+	}{
+		{"both empty", "", "", nil},
+		{"identical", "a\nb", "a\nb", []DiffLine{
+			{DiffEqual, "a"}, {DiffEqual, "b"},
+		}},
+		{"insertion", "a\nc", "a\nb\nc", []DiffLine{
+			{DiffEqual, "a"}, {DiffInsert, "b"}, {DiffEqual, "c"},
+		}},
+		{"deletion", "a\nb\nc", "a\nc", []DiffLine{
+			{DiffEqual, "a"}, {DiffDelete, "b"}, {DiffEqual, "c"},
+		}},
+		{"from empty", "", "a\nb", []DiffLine{
+			{DiffInsert, "a"}, {DiffInsert, "b"},
+		}},
+		{"to empty", "a\nb\n", "", []DiffLine{
+			{DiffDelete, "a"}, {DiffDelete, "b"},
+		}},
+		{"replacement", "Buy eggs\nBuy milk\nCall mom", "Buy eggs\nBuy bread\nCall mom", []DiffLine{
+			{DiffEqual, "Buy eggs"}, {DiffDelete, "Buy milk"}, {DiffInsert, "Buy bread"}, {DiffEqual, "Call mom"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, DiffLines(tt.a, tt.b))
+		})
+	}
+}
+
+// applyDiff returns the texts that lines turns from and into.
+func applyDiff(lines []DiffLine) (a, b []string) {
+	for _, line := range lines {
+		if line.Op != DiffInsert {
+			a = append(a, line.Text)
+		}
+		if line.Op != DiffDelete {
+			b = append(b, line.Text)
+		}
+	}
+	return a, b
+}
+
+// editDistance counts the lines that must be deleted or inserted to turn a
+// into b.
+func editDistance(a, b []string) int {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] > lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	return len(a) + len(b) - 2*lcs[0][0]
+}
+
+func TestDiffLinesIsMinimal(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	randomText := func() []string {
+		lines := make([]string, rnd.Intn(12))
+		for i := range lines {
+			lines[i] = string(rune('a' + rnd.Intn(3)))
+		}
+		return lines
+	}
+
+	for i := 0; i < 1000; i++ {
+		x, y := randomText(), randomText()
+		a, b := strings.Join(x, "\n"), strings.Join(y, "\n")
+		lines := DiffLines(a, b)
+
+		gotA, gotB := applyDiff(lines)
+		if !assert.Equal(t, splitLines(a), gotA, "%q -> %q", a, b) ||
+			!assert.Equal(t, splitLines(b), gotB, "%q -> %q", a, b) {
+			return
+		}
+		var edits int
+		for _, line := range lines {
+			if line.Op != DiffEqual {
+				edits++
+			}
+		}
+		if !assert.Equal(t, editDistance(x, y), edits, "%q -> %q", a, b) {
+			return
+		}
+	}
+}
+
+func TestDiffLinesLargeInput(t *testing.T) {
+	const n = 5000
+	x, y := make([]string, n), make([]string, n)
+	for i := range x {
+		x[i] = fmt.Sprintf("old line %d", i)
+		y[i] = fmt.Sprintf("new line %d", i)
+	}
+	a, b := strings.Join(x, "\n"), strings.Join(y, "\n")
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	lines := DiffLines(a, b)
+	runtime.ReadMemStats(&after)
+
+	assert.Len(t, lines, 2*n)
+	gotA, gotB := applyDiff(lines)
+	assert.Equal(t, x, gotA)
+	assert.Equal(t, y, gotB)
+	// Keeping the state of every step of the search would take gigabytes here.
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(16<<20),
+		"should not allocate memory quadratic in the input")
+}
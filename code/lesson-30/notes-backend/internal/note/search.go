@@ -1,11 +1,384 @@
 package note
 
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// errNotIndexed is returned by RemoveNote when the index has no document
+// for the note.
+var errNotIndexed = errors.New("document not found in search index")
+
 type SearchIndex interface {
 	IndexNote(tenantID string, note *Note) error
+	// RemoveNote returns an error matching errNotIndexed if the tenant has no
+	// document for the note.
 	RemoveNote(tenantID string, id uint64) error
-	Search(tenantID, query string) ([]uint64, error)
+	// Search returns a page of the tenant's notes that match req.Query, best
+	// match first.
+	Search(tenantID string, req SearchRequest) (*SearchResult, error)
+	// Suggest completes a prefix that a user is typing with up to limit of
+	// the tenant's note titles and tag names each, best first.
+	Suggest(tenantID, prefix string, limit int) (*Suggestions, error)
+	// Related returns up to limit of the tenant's other notes that are most
+	// like note, by their tags and words, most similar first.
+	Related(tenantID string, note *Note, limit int) (*SearchResult, error)
+}
+
+// Suggestions complete a prefix. Every word of the prefix is a prefix of a
+// word of each suggestion.
+type Suggestions struct {
+	Titles []*TitleSuggestion `json:"titles"`
+	Tags   []*TagSuggestion   `json:"tags"`
+}
+
+type TitleSuggestion struct {
+	NoteID uint64  `json:"noteId"`
+	Title  string  `json:"title"`
+	Score  float64 `json:"score"`
+}
+
+// TagSuggestion is a tag name along with the number of notes it is on, by
+// which tags are ranked.
+type TagSuggestion struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// DefaultSearchSize is the number of hits returned when a SearchRequest does
+// not set Size.
+const DefaultSearchSize = 10
+
+// SearchRequest selects a page of search hits. From is the number of hits to
+// skip.
+type SearchRequest struct {
+	Query string
+	From  int
+	Size  int
+}
+
+func (r *SearchRequest) size() int {
+	if r.Size <= 0 {
+		return DefaultSearchSize
+	}
+	return r.Size
+}
+
+// SearchResult is a page of search hits. Total counts every hit, not just
+// those on the page, and so do the facets. Facets is nil if the index cannot
+// compute them.
+type SearchResult struct {
+	Total  uint64        `json:"total"`
+	Hits   []*SearchHit  `json:"hits"`
+	Facets *SearchFacets `json:"facets,omitempty"`
+	// DidYouMean is a corrected query that finds something, if the index
+	// has one for a query that found nothing.
+	DidYouMean string `json:"didYouMean,omitempty"`
+}
+
+// SearchFacets counts the hits of a search by tag, and by when the notes were
+// created and last updated. Tags are ordered by count, dates from the most
+// recent range to the oldest.
+type SearchFacets struct {
+	Tags    []*FacetCount `json:"tags"`
+	Created []*FacetCount `json:"created"`
+	Updated []*FacetCount `json:"updated"`
+}
+
+// FacetCount is the number of hits with a tag or in a date range. Adding its
+// Filter to the query narrows a search down to those hits.
+type FacetCount struct {
+	// Value is a tag name, or one of the date ranges "today", "week",
+	// "month", "year" and "older".
+	Value  string `json:"value"`
+	Count  int    `json:"count"`
+	Filter string `json:"filter"`
+}
+
+// searchTagFacetSize is the number of tags that facets count.
+const searchTagFacetSize = 20
+
+func tagFilter(name string) string {
+	return "tag:" + quotePhrase(name)
+}
+
+// dateFacetRange is a range of days, in UTC, by which hits are counted. A
+// zero start or end leaves that side open.
+type dateFacetRange struct {
+	name       string
+	start, end time.Time
+}
+
+// dateFacetRanges returns the ranges of days by which hits are counted. They
+// overlap, except for "older", so that each range holds everything that is
+// at least as recent.
+func dateFacetRanges(now time.Time) []dateFacetRange {
+	today := now.UTC().Truncate(24 * time.Hour)
+	yearAgo := today.AddDate(0, 0, -364)
+	return []dateFacetRange{
+		{name: "today", start: today},
+		{name: "week", start: today.AddDate(0, 0, -6)},
+		{name: "month", start: today.AddDate(0, 0, -29)},
+		{name: "year", start: yearAgo},
+		{name: "older", end: yearAgo},
+	}
+}
+
+// filter returns the query term that matches the range on a field of the
+// query language.
+func (r dateFacetRange) filter(field string) string {
+	if r.end.IsZero() {
+		return field + ":>=" + r.start.Format("2006-01-02")
+	}
+	return field + ":<" + r.end.Format("2006-01-02")
+}
+
+// IDs returns the note IDs of the hits in order.
+func (r *SearchResult) IDs() []uint64 {
+	ids := make([]uint64, len(r.Hits))
+	for i, hit := range r.Hits {
+		ids[i] = hit.NoteID
+	}
+	return ids
+}
+
+// SearchHit is a note that matched a search. Search indexes only fill in
+// NoteID; Service.SearchNotes loads the note itself.
+type SearchHit struct {
+	*Note
+	NoteID uint64  `json:"-"`
+	Score  float64 `json:"score"`
+	// Highlights holds fragments of the note's title and content, keyed by
+	// field, as HTML in which the matched terms are wrapped in <mark> tags.
+	Highlights map[string][]string `json:"highlights,omitempty"`
+}
+
+func NewSearchIndex(c SearchIndexConfig) (SearchIndex, error) {
+	switch c.Type {
+	case "bleve":
+		return NewBleveSearchindex(c)
+	case "sqlite":
+		return NewSQLiteSearchIndex(c)
+	case "memory":
+		return NewMemorySearchIndex(), nil
+	default:
+		return nil, fmt.Errorf("Invalid search index type: %q", c.Type)
+	}
+}
+
+// IndexAll indexes every tenant's notes in the repository, and returns how
+// many it indexed. It fills an index that does not persist, such as the
+// memory index, when the repository does.
+func IndexAll(repo Repository, idx SearchIndex) (int, error) {
+	tenantIDs, err := repo.TenantIDs()
+	if err != nil {
+		return 0, fmt.Errorf("error listing tenants: %w", err)
+	}
+
+	var n int
+	for _, tenantID := range tenantIDs {
+		tx := repo.Transaction(tenantID)
+		q := NoteQuery{Limit: reindexPageSize}
+		for {
+			page, err := tx.FindNotes(q)
+			if err != nil {
+				return n, err
+			}
+			for _, note := range page.Notes {
+				if err := idx.IndexNote(tenantID, note); err != nil {
+					return n, err
+				}
+				n++
+			}
+			if page.Next == "" {
+				break
+			}
+			q.Cursor = page.Next
+		}
+	}
+	return n, nil
 }
 
 type SearchIndexConfig struct {
+	Type string
+
 	BleveIndexPath string `mapstructure:"bleve-path"`
+	SQLitePath     string `mapstructure:"sqlite-path"`
+
+	// BleveAutoRebuild rebuilds a Bleve index that was built with a different
+	// mapping at startup, instead of refusing to start.
+	BleveAutoRebuild bool `mapstructure:"bleve-auto-rebuild"`
+
+	// Languages maps tenant IDs to the language, such as "de" or "ja", in
+	// which the Bleve index analyzes their notes. The language of each note
+	// of other tenants is detected. Changing a tenant's language takes effect
+	// once the tenant is reindexed.
+	Languages map[string]string `mapstructure:"languages"`
+}
+
+// indexJob asks for a note's search document to be brought up to date. A job
+// does not say what changed: applying it indexes the note as it is at that
+// moment, or removes it from the index if it is gone or in the trash, so a job
+// can safely be applied more than once.
+type indexJob struct {
+	Seq      uint64 `json:"-"`
+	TenantID string `json:"tenantId"`
+	NoteID   uint64 `json:"noteId"`
+}
+
+// indexQueue is the outbox of index jobs that a repository keeps. Jobs are
+// written in the same transaction as the change that caused them, so every
+// committed change reaches the search index eventually. Jobs are ordered by
+// when their sequence numbers were allocated, which need not be the order in
+// which their transactions committed; the index still ends up right because
+// each job re-reads the note's current state rather than carrying a change.
+type indexQueue interface {
+	Transaction(tenantID string) Transaction
+	// peekIndexJobs returns up to n of the oldest jobs, oldest first.
+	peekIndexJobs(n int) ([]indexJob, error)
+	// ackIndexJob removes a job once it has been applied.
+	ackIndexJob(seq uint64) error
+}
+
+const (
+	indexBatchSize   = 100
+	indexMaxAttempts = 10
+	indexMinBackoff  = 50 * time.Millisecond
+	indexMaxBackoff  = 10 * time.Second
+)
+
+// indexWorker applies the jobs in an indexQueue one at a time, oldest
+// sequence number first. A job that fails is retried with exponential
+// backoff, and dropped after indexMaxAttempts so that it cannot hold up the
+// rest of the queue forever.
+type indexWorker struct {
+	queue indexQueue
+	idx   SearchIndex
+
+	wake      chan struct{}
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func startIndexWorker(queue indexQueue, idx SearchIndex) *indexWorker {
+	w := &indexWorker{
+		queue: queue,
+		idx:   idx,
+		wake:  make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// notify tells the worker that new jobs have been committed.
+func (w *indexWorker) notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close waits for the worker to apply every queued job. A job that fails
+// while the worker is closing is left in the queue for the next start.
+func (w *indexWorker) close() {
+	w.closeOnce.Do(func() { close(w.stop) })
+	<-w.done
+}
+
+func (w *indexWorker) run() {
+	defer close(w.done)
+	for {
+		if !w.drain() {
+			return
+		}
+		select {
+		case <-w.wake:
+		case <-w.stop:
+			// Apply whatever was committed since the last drain.
+			w.drain()
+			return
+		}
+	}
+}
+
+// drain applies jobs until the queue is empty. It returns false if the
+// worker was stopped while waiting to retry.
+func (w *indexWorker) drain() bool {
+	for {
+		jobs, err := w.queue.peekIndexJobs(indexBatchSize)
+		if err != nil {
+			log.Printf("Error reading index queue: %v", err)
+			if !w.wait(indexMaxBackoff) {
+				return false
+			}
+			continue
+		}
+		if len(jobs) == 0 {
+			return true
+		}
+		for _, job := range jobs {
+			if !w.apply(job) {
+				return false
+			}
+		}
+	}
+}
+
+func (w *indexWorker) apply(job indexJob) bool {
+	backoff := indexMinBackoff
+	for attempt := 1; ; attempt++ {
+		err := w.sync(job)
+		if err != nil && attempt >= indexMaxAttempts {
+			log.Printf("Giving up on indexing note %d after %d attempts: %v", job.NoteID, attempt, err)
+			err = nil
+		}
+		if err == nil {
+			if err = w.queue.ackIndexJob(job.Seq); err == nil {
+				return true
+			}
+		}
+
+		log.Printf("Error indexing note %d (attempt %d): %v", job.NoteID, attempt, err)
+		if !w.wait(backoff) {
+			return false
+		}
+		if backoff *= 2; backoff > indexMaxBackoff {
+			backoff = indexMaxBackoff
+		}
+	}
+}
+
+// sync makes the note's search document match the repository.
+func (w *indexWorker) sync(job indexJob) error {
+	note, err := w.queue.Transaction(job.TenantID).FindNoteByID(job.NoteID)
+	if err != nil {
+		return fmt.Errorf("error loading note: %w", err)
+	}
+	if note == nil {
+		// A note that was deleted before it was ever indexed, or whose
+		// removal was already applied, has nothing left to remove.
+		if err := w.idx.RemoveNote(job.TenantID, job.NoteID); !errors.Is(err, errNotIndexed) {
+			return err
+		}
+		return nil
+	}
+	return w.idx.IndexNote(job.TenantID, note)
+}
+
+// wait sleeps for d, returning false if the worker is stopped first.
+func (w *indexWorker) wait(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-w.stop:
+		return false
+	}
 }
@@ -0,0 +1,349 @@
+package note
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The search query language:
+//
+//	tacos                notes that mention tacos
+//	"taco tuesday"       notes that contain the phrase; a backslash escapes
+//	                     a quote or backslash within it
+//	title:meeting        notes with meeting in the title; content: works alike
+//	tag:work             notes with the tag named work, matched exactly
+//	updated:>2024-01-01  notes last updated after that day; created: works
+//	                     alike, with >, >=, <, <= or none, and a day or an
+//	                     RFC 3339 time
+//	-draft, NOT draft    notes that do not mention draft
+//	a b, a AND b         notes that match both
+//	a OR b               notes that match either
+//	(a OR b) c           parentheses group terms
+//
+// AND binds more tightly than OR. Invalid queries return an error matching
+// ErrInvalidQuery that says where the problem is.
+
+// searchExpr is a parsed search query: one of termExpr, timeRangeExpr,
+// notExpr, andExpr or orExpr.
+type searchExpr interface{}
+
+// termExpr matches text in a field, or in any text field if field is empty.
+type termExpr struct {
+	field  string // "title", "content" or "tag"
+	text   string
+	phrase bool
+}
+
+// timeRangeExpr matches notes whose timestamp falls within a range. A zero
+// start or end leaves that side open.
+type timeRangeExpr struct {
+	field                        string // "createdAt" or "updatedAt"
+	start, end                   time.Time
+	startInclusive, endInclusive bool
+}
+
+type notExpr struct {
+	expr searchExpr
+}
+
+type andExpr []searchExpr
+
+type orExpr []searchExpr
+
+// searchFields maps the field names that queries use to those of a Note.
+var searchFields = map[string]string{
+	"title":   "title",
+	"content": "content",
+	"tag":     "tag",
+	"tags":    "tag",
+	"created": "createdAt",
+	"updated": "updatedAt",
+}
+
+// parseSearchQuery parses a query. It returns a nil searchExpr, which matches
+// nothing, for a query without any terms.
+func parseSearchQuery(query string) (searchExpr, error) {
+	tokens, err := lexSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &searchParser{tokens: tokens}
+	if p.peek().kind == tokenEOF {
+		return nil, nil
+	}
+
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, t.errorf("unexpected %s", t)
+	}
+	return expr, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenPhrase
+	tokenLParen
+	tokenRParen
+	tokenMinus
+)
+
+type searchToken struct {
+	kind tokenKind
+	text string
+	// pos is the 1-based position of the token in the query, and end the
+	// position just after it.
+	pos, end int
+}
+
+func (t searchToken) String() string {
+	if t.kind == tokenEOF {
+		return "end of query"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+func (t searchToken) errorf(format string, args ...interface{}) error {
+	return invalidQuery("%s at position %d", fmt.Sprintf(format, args...), t.pos)
+}
+
+// quotePhrase quotes text as a phrase.
+func quotePhrase(text string) string {
+	return `"` + phraseEscaper.Replace(text) + `"`
+}
+
+var phraseEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// lexSearchQuery splits a query into tokens. Words end at white space,
+// parentheses and quotes, so that a phrase can follow a field name directly,
+// as in title:"taco tuesday".
+func lexSearchQuery(query string) ([]searchToken, error) {
+	var tokens []searchToken
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '(':
+			i++
+			tokens = append(tokens, searchToken{kind: tokenLParen, text: "(", pos: start + 1, end: i + 1})
+		case r == ')':
+			i++
+			tokens = append(tokens, searchToken{kind: tokenRParen, text: ")", pos: start + 1, end: i + 1})
+		case r == '-' && i+1 < len(runes) && !unicode.IsSpace(runes[i+1]):
+			i++
+			tokens = append(tokens, searchToken{kind: tokenMinus, text: "-", pos: start + 1, end: i + 1})
+		case r == '"':
+			var text []rune
+			for i++; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				text = append(text, runes[i])
+			}
+			if i == len(runes) {
+				return nil, invalidQuery("unterminated phrase at position %d", start+1)
+			}
+			i++
+			tokens = append(tokens, searchToken{kind: tokenPhrase, text: string(text), pos: start + 1, end: i + 1})
+		default:
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune(`()"`, runes[i]) {
+				i++
+			}
+			text := string(runes[start:i])
+			tokens = append(tokens, searchToken{kind: tokenWord, text: text, pos: start + 1, end: i + 1})
+		}
+	}
+	return append(tokens, searchToken{kind: tokenEOF, pos: len(runes) + 1, end: len(runes) + 1}), nil
+}
+
+type searchParser struct {
+	tokens []searchToken
+	i      int
+}
+
+func (p *searchParser) peek() searchToken {
+	return p.tokens[p.i]
+}
+
+func (p *searchParser) next() searchToken {
+	t := p.tokens[p.i]
+	if t.kind != tokenEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *searchParser) peekKeyword(keyword string) bool {
+	t := p.peek()
+	return t.kind == tokenWord && t.text == keyword
+}
+
+func (p *searchParser) parseOr() (searchExpr, error) {
+	var exprs orExpr
+	for {
+		expr, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if !p.peekKeyword("OR") {
+			break
+		}
+		p.next()
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+func (p *searchParser) parseAnd() (searchExpr, error) {
+	var exprs andExpr
+	for {
+		if t := p.peek(); t.kind == tokenEOF || t.kind == tokenRParen || p.peekKeyword("OR") {
+			if len(exprs) == 0 {
+				return nil, t.errorf("expected a search term before %s", t)
+			}
+			break
+		}
+		if p.peekKeyword("AND") && len(exprs) > 0 {
+			p.next()
+		}
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+func (p *searchParser) parseUnary() (searchExpr, error) {
+	if p.peek().kind == tokenMinus || p.peekKeyword("NOT") {
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *searchParser) parsePrimary() (searchExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenLParen:
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRParen {
+			return nil, t.errorf("unclosed parenthesis")
+		}
+		return expr, nil
+	case tokenPhrase:
+		return termExpr{text: t.text, phrase: true}, nil
+	case tokenWord:
+		if i := strings.IndexRune(t.text, ':'); i > 0 && isFieldName(t.text[:i]) {
+			return p.parseField(t, t.text[:i], t.text[i+1:])
+		}
+		return termExpr{text: t.text}, nil
+	case tokenEOF:
+		return nil, t.errorf("expected a search term")
+	}
+	return nil, t.errorf("unexpected %s", t)
+}
+
+// parseField parses the value of a field, which follows the colon in the same
+// word or is a phrase right after it.
+func (p *searchParser) parseField(t searchToken, name, value string) (searchExpr, error) {
+	field, ok := searchFields[strings.ToLower(name)]
+	if !ok {
+		return nil, t.errorf("unknown field %q", name)
+	}
+
+	phrase := false
+	if value == "" {
+		if next := p.peek(); next.kind == tokenPhrase && next.pos == t.end {
+			value, phrase = p.next().text, true
+		} else {
+			return nil, t.errorf("expected a value after %s:", name)
+		}
+	}
+
+	switch field {
+	case "createdAt", "updatedAt":
+		if phrase {
+			return nil, t.errorf("expected a date after %s:", name)
+		}
+		expr, err := parseTimeRange(field, value)
+		if err != nil {
+			return nil, t.errorf("%v", err)
+		}
+		return expr, nil
+	}
+	return termExpr{field: field, text: value, phrase: phrase}, nil
+}
+
+func isFieldName(s string) bool {
+	for _, r := range s {
+		if !unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTimeRange parses a comparison with a day, which covers the whole day
+// in UTC, or with an RFC 3339 time.
+func parseTimeRange(field, value string) (timeRangeExpr, error) {
+	var op string
+	for _, prefix := range []string{">=", "<=", ">", "<"} {
+		if strings.HasPrefix(value, prefix) {
+			op, value = prefix, value[len(prefix):]
+			break
+		}
+	}
+
+	// [lo, hi) for a day, or [lo, hi] for a single time.
+	var lo, hi time.Time
+	hiInclusive := false
+	if day, err := time.Parse("2006-01-02", value); err == nil {
+		lo, hi = day, day.AddDate(0, 0, 1)
+	} else if t, err := time.Parse(time.RFC3339, value); err == nil {
+		lo, hi, hiInclusive = t, t, true
+	} else {
+		return timeRangeExpr{}, fmt.Errorf("%q is not a date like 2006-01-02 or a time like 2006-01-02T15:04:05Z", value)
+	}
+
+	expr := timeRangeExpr{field: field}
+	switch op {
+	case ">":
+		expr.start, expr.startInclusive = hi, !hiInclusive
+	case ">=":
+		expr.start, expr.startInclusive = lo, true
+	case "<":
+		expr.end, expr.endInclusive = lo, false
+	case "<=":
+		expr.end, expr.endInclusive = hi, hiInclusive
+	default:
+		expr.start, expr.startInclusive = lo, true
+		expr.end, expr.endInclusive = hi, hiInclusive
+	}
+	return expr, nil
+}
@@ -0,0 +1,94 @@
+package note
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	nextDay := day.AddDate(0, 0, 1)
+	instant := time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		query string
+		want  searchExpr
+	}{
+		{"", nil},
+		{"  ", nil},
+		{"tacos", termExpr{text: "tacos"}},
+		{`"taco tuesday"`, termExpr{text: "taco tuesday", phrase: true}},
+		{"title:meeting", termExpr{field: "title", text: "meeting"}},
+		{`Title:"weekly meeting"`, termExpr{field: "title", text: "weekly meeting", phrase: true}},
+		{"content:eggs", termExpr{field: "content", text: "eggs"}},
+		{"tag:work", termExpr{field: "tag", text: "work"}},
+		{`tags:"to do"`, termExpr{field: "tag", text: "to do", phrase: true}},
+		{`tag:"say \"hi\" \\o/"`, termExpr{field: "tag", text: `say "hi" \o/`, phrase: true}},
+		{quotePhrase(`say "hi" \o/`), termExpr{text: `say "hi" \o/`, phrase: true}},
+		{"updated:>2024-01-01", timeRangeExpr{field: "updatedAt", start: nextDay, startInclusive: true}},
+		{"updated:>=2024-01-01", timeRangeExpr{field: "updatedAt", start: day, startInclusive: true}},
+		{"created:<2024-01-01", timeRangeExpr{field: "createdAt", end: day}},
+		{"created:<=2024-01-01", timeRangeExpr{field: "createdAt", end: nextDay}},
+		{"created:2024-01-01", timeRangeExpr{field: "createdAt", start: day, startInclusive: true, end: nextDay}},
+		{"updated:>2024-01-01T12:30:00Z", timeRangeExpr{field: "updatedAt", start: instant}},
+		{"updated:<=2024-01-01T12:30:00Z", timeRangeExpr{field: "updatedAt", end: instant, endInclusive: true}},
+		{"-draft", notExpr{termExpr{text: "draft"}}},
+		{"NOT draft", notExpr{termExpr{text: "draft"}}},
+		{"well-known", termExpr{text: "well-known"}},
+		{"a b", andExpr{termExpr{text: "a"}, termExpr{text: "b"}}},
+		{"a AND b", andExpr{termExpr{text: "a"}, termExpr{text: "b"}}},
+		{"a OR b", orExpr{termExpr{text: "a"}, termExpr{text: "b"}}},
+		{"a b OR c", orExpr{
+			andExpr{termExpr{text: "a"}, termExpr{text: "b"}},
+			termExpr{text: "c"},
+		}},
+		{"a (b OR c)", andExpr{
+			termExpr{text: "a"},
+			orExpr{termExpr{text: "b"}, termExpr{text: "c"}},
+		}},
+		{"tag:work title:meeting updated:>2024-01-01 -draft", andExpr{
+			termExpr{field: "tag", text: "work"},
+			termExpr{field: "title", text: "meeting"},
+			timeRangeExpr{field: "updatedAt", start: nextDay, startInclusive: true},
+			notExpr{termExpr{text: "draft"}},
+		}},
+		{"-(a OR b)", notExpr{orExpr{termExpr{text: "a"}, termExpr{text: "b"}}}},
+		{"or and", andExpr{termExpr{text: "or"}, termExpr{text: "and"}}},
+	}
+	for _, tt := range tests {
+		got, err := parseSearchQuery(tt.query)
+		if assert.NoError(t, err, "query %q", tt.query) {
+			assert.Equal(t, tt.want, got, "query %q", tt.query)
+		}
+	}
+}
+
+func TestParseSearchQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{`"taco tuesday`, "unterminated phrase at position 1"},
+		{`"taco \"`, "unterminated phrase at position 1"},
+		{"(a OR b", "unclosed parenthesis at position 1"},
+		{"a)", `unexpected ")" at position 2`},
+		{"a OR", "expected a search term before end of query at position 5"},
+		{"a AND", "expected a search term at position 6"},
+		{"()", `expected a search term before ")" at position 2`},
+		{"titel:meeting", `unknown field "titel" at position 1`},
+		{"title:", "expected a value after title: at position 1"},
+		{`title: "meeting"`, "expected a value after title: at position 1"},
+		{"updated:>yesterday", `"yesterday" is not a date like 2006-01-02 or a time like 2006-01-02T15:04:05Z at position 1`},
+		{`created:"2024-01-01"`, "expected a date after created: at position 1"},
+	}
+	for _, tt := range tests {
+		_, err := parseSearchQuery(tt.query)
+		if assert.Error(t, err, "query %q", tt.query) {
+			assert.True(t, errors.Is(err, ErrInvalidQuery), "query %q", tt.query)
+			assert.Equal(t, "invalid query: "+tt.err, err.Error(), "query %q", tt.query)
+		}
+	}
+}
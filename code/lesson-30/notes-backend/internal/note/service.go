@@ -1,5 +1,16 @@
 package note
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
 func NewService(repo Repository, idx SearchIndex) *Service {
 	return &Service{
 		Repository: repo,
@@ -12,19 +23,471 @@ type Service struct {
 	idx SearchIndex
 }
 
-func (s *Service) SearchNotes(tenantID, query string) ([]*Note, error) {
-	ids, err := s.idx.Search(tenantID, query)
+// SearchNotes runs a search and loads the notes that it found. The index is
+// updated in the background, so a hit on a note that has just been deleted is
+// left out of the page, though it is still counted in the total.
+func (s *Service) SearchNotes(tenantID string, req SearchRequest) (*SearchResult, error) {
+	res, err := s.idx.Search(tenantID, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.loadHits(tenantID, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// RelatedNotes finds up to limit of the tenant's notes that are most like a
+// note, and loads them as SearchNotes does.
+func (s *Service) RelatedNotes(tenantID string, note *Note, limit int) (*SearchResult, error) {
+	res, err := s.idx.Related(tenantID, note, limit)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.loadHits(tenantID, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// loadHits loads the notes of a page of hits, leaving out any that have been
+// deleted.
+func (s *Service) loadHits(tenantID string, res *SearchResult) error {
+	var err error
+	hits := res.Hits[:0]
+	tx := s.Repository.Transaction(tenantID)
+	for _, hit := range res.Hits {
+		if hit.Note, err = tx.FindNoteByID(hit.NoteID); err != nil {
+			return err
+		}
+		if hit.Note != nil {
+			hits = append(hits, hit)
+		}
+	}
+	res.Hits = hits
+
+	return nil
+}
+
+// Suggest completes a prefix with the tenant's note titles and tag names. As
+// with SearchNotes, titles of notes that have just been deleted are left out.
+func (s *Service) Suggest(tenantID, prefix string, limit int) (*Suggestions, error) {
+	res, err := s.idx.Suggest(tenantID, prefix, limit)
 	if err != nil {
 		return nil, err
 	}
 
-	notes := make([]*Note, len(ids))
+	titles := res.Titles[:0]
 	tx := s.Repository.Transaction(tenantID)
-	for i, id := range ids {
-		if notes[i], err = tx.FindNoteByID(id); err != nil {
+	for _, title := range res.Titles {
+		note, err := tx.FindNoteByID(title.NoteID)
+		if err != nil {
+			return nil, err
+		}
+		if note != nil {
+			titles = append(titles, title)
+		}
+	}
+	res.Titles = titles
+
+	return res, nil
+}
+
+// DiffRevisions compares two revisions of a note. If to is 0, the note's
+// newest revision is used.
+func (s *Service) DiffRevisions(tenantID string, noteID, from, to uint64) (*RevisionDiff, error) {
+	tx := s.Repository.Transaction(tenantID)
+	fromRev, err := tx.FindRevision(noteID, from)
+	if err != nil {
+		return nil, err
+	}
+	if fromRev == nil {
+		return nil, revisionNotFound(from)
+	}
+
+	var toRev *Revision
+	if to == 0 {
+		revisions, err := tx.FindRevisions(noteID)
+		if err != nil {
+			return nil, err
+		}
+		if len(revisions) > 0 {
+			toRev = revisions[len(revisions)-1]
+		}
+	} else if toRev, err = tx.FindRevision(noteID, to); err != nil {
+		return nil, err
+	}
+	if toRev == nil {
+		return nil, revisionNotFound(to)
+	}
+
+	return &RevisionDiff{
+		NoteID:  noteID,
+		From:    fromRev.Rev,
+		To:      toRev.Rev,
+		Title:   DiffLines(fromRev.Title, toRev.Title),
+		Content: DiffLines(fromRev.Content, toRev.Content),
+	}, nil
+}
+
+// RestoreRevision makes an earlier revision the current state of a note. The
+// restored state is recorded as a new revision by the given user, so history
+// is never lost.
+func (s *Service) RestoreRevision(tenantID, userID string, noteID, rev uint64) (*Note, error) {
+	var note *Note
+	err := s.Repository.Update(tenantID, func(tx Transaction) error {
+		revision, err := tx.FindRevision(noteID, rev)
+		if err != nil {
+			return err
+		}
+		if revision == nil {
+			return revisionNotFound(rev)
+		}
+
+		update := &Note{
+			Title:     revision.Title,
+			Content:   revision.Content,
+			UpdatedBy: userID,
+		}
+		if err := tx.UpdateNote(noteID, update); err != nil {
+			return err
+		}
+		note, err = tx.FindNoteByID(noteID)
+		return err
+	})
+
+	return note, err
+}
+
+// TrashConfig controls how long deleted notes are kept before being purged.
+type TrashConfig struct {
+	// Retention is how long a note stays in the trash. 0 keeps notes forever.
+	Retention     time.Duration `mapstructure:"retention"`
+	PurgeInterval time.Duration `mapstructure:"purge-interval"`
+}
+
+// ActiveTenant returns the registered tenant with the given ID, or an error
+// matching ErrTenantInactive if it is suspended or deleted. Tenants whose
+// tokens were issued before the registry existed are registered as active
+// the first time they are seen.
+func (s *Service) ActiveTenant(id string) (*Tenant, error) {
+	tenant, err := s.FindTenant(id)
+	if err != nil {
+		return nil, err
+	}
+	if tenant == nil {
+		tenant = &Tenant{ID: id}
+		err := s.CreateTenant(tenant)
+		if errors.Is(err, ErrAlreadyExists) {
+			// Registered by a concurrent request.
+			return s.ActiveTenant(id)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if tenant.Status != TenantActive {
+		return tenant, fmt.Errorf("tenant %q is %s: %w", id, tenant.Status, ErrTenantInactive)
+	}
+	return tenant, nil
+}
+
+// SetTenantStatus suspends, reinstates or deletes a tenant. It returns an
+// error matching ErrTenantDeleted if the tenant was already deleted, as
+// deletion is final.
+func (s *Service) SetTenantStatus(id string, status TenantStatus) (*Tenant, error) {
+	tenant, err := s.FindTenant(id)
+	if err != nil {
+		return nil, err
+	}
+	if tenant == nil {
+		return nil, tenantNotFound(id)
+	}
+	if tenant.Status == TenantDeleted && status != TenantDeleted {
+		return nil, fmt.Errorf("tenant %q: %w", id, ErrTenantDeleted)
+	}
+	tenant.Status = status
+	if err := s.UpdateTenant(id, tenant); err != nil {
+		return nil, err
+	}
+	return tenant, nil
+}
+
+// RegisterUser adds a user with the given email, password and role to a
+// tenant. It returns an error matching ErrInvalidUser if the email, password
+// or role are not acceptable, and one matching ErrAlreadyExists if the email
+// is taken.
+func (s *Service) RegisterUser(tenantID, email, password string, role Role) (*User, error) {
+	email = normalizeEmail(email)
+	if at := strings.IndexByte(email, '@'); at <= 0 || at == len(email)-1 {
+		return nil, invalidUser("%q is not an email address", email)
+	}
+	if len(password) < minPasswordLength {
+		return nil, invalidUser("password must be at least %d characters", minPasswordLength)
+	}
+	if !role.valid() {
+		return nil, invalidUser("unknown role %q", role)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	id, err := randomID(8)
+	if err != nil {
+		return nil, err
+	}
+	user := &User{
+		ID:           id,
+		TenantID:     tenantID,
+		Email:        email,
+		Role:         role,
+		PasswordHash: hash,
+	}
+	if err := s.CreateUser(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// SetUserRole gives a user another role. It returns an error matching
+// ErrLastOwner if the user is the only owner of their tenant and would stop
+// being one.
+func (s *Service) SetUserRole(id string, role Role) (*User, error) {
+	user, err := s.FindUser(id)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, userNotFound(id)
+	}
+	if role != RoleOwner {
+		if err := s.checkOtherOwner(user); err != nil {
+			return nil, err
+		}
+	}
+	user.Role = role
+	if err := s.UpdateUser(id, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// RemoveUser deletes a user from their tenant. It returns an error matching
+// ErrLastOwner if the user is the only owner of their tenant.
+func (s *Service) RemoveUser(id string) error {
+	user, err := s.FindUser(id)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return userNotFound(id)
+	}
+	if err := s.checkOtherOwner(user); err != nil {
+		return err
+	}
+	return s.DeleteUser(id)
+}
+
+// checkOtherOwner returns an error matching ErrLastOwner if user is an owner
+// and their tenant has no other.
+func (s *Service) checkOtherOwner(user *User) error {
+	if user.Role != RoleOwner {
+		return nil
+	}
+	users, err := s.FindUsers(user.TenantID)
+	if err != nil {
+		return err
+	}
+	for _, other := range users {
+		if other.ID != user.ID && other.Role == RoleOwner {
+			return nil
+		}
+	}
+	return fmt.Errorf("user %q is the only owner: %w", user.ID, ErrLastOwner)
+}
+
+// Authenticate returns the user with the given email and password, or an
+// error matching ErrInvalidCredentials, which does not say whether the email
+// or the password was wrong.
+func (s *Service) Authenticate(email, password string) (*User, error) {
+	user, err := s.FindUserByEmail(normalizeEmail(email))
+	if err != nil {
+		return nil, err
+	}
+	hash := dummyHash
+	if user != nil {
+		hash = user.PasswordHash
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || user == nil {
+		return nil, ErrInvalidCredentials
+	}
+	return user, nil
+}
+
+// StartSession signs a user in for ttl and returns the refresh token that
+// renews the session.
+func (s *Service) StartSession(user *User, ttl time.Duration) (string, *Session, error) {
+	token, err := randomID(32)
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	session := &Session{
+		ID:        hashToken(token),
+		UserID:    user.ID,
+		TenantID:  user.TenantID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if err := s.CreateSession(session); err != nil {
+		return "", nil, err
+	}
+	return token, session, nil
+}
+
+// RefreshSession ends the session of a refresh token and starts a new one
+// for its user, so that each refresh token can only be used once. It returns
+// an error matching ErrInvalidCredentials if the token is unknown, already
+// used or expired, or if its user no longer exists.
+func (s *Service) RefreshSession(token string, ttl time.Duration) (string, *Session, error) {
+	session, err := s.FindSession(hashToken(token))
+	if err != nil {
+		return "", nil, err
+	}
+	if session == nil {
+		return "", nil, ErrInvalidCredentials
+	}
+	// Of two concurrent refreshes with the same token, only the one that
+	// deletes the session goes on to start a new one.
+	err = s.DeleteSession(session.ID)
+	if errors.Is(err, ErrNotFound) {
+		return "", nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if !time.Now().Before(session.ExpiresAt) {
+		return "", nil, ErrInvalidCredentials
+	}
+
+	user, err := s.FindUser(session.UserID)
+	if err != nil {
+		return "", nil, err
+	}
+	if user == nil {
+		return "", nil, ErrInvalidCredentials
+	}
+	return s.StartSession(user, ttl)
+}
+
+// EndSession signs out the session of a refresh token. Ending a session that
+// does not exist is not an error.
+func (s *Service) EndSession(token string) error {
+	err := s.DeleteSession(hashToken(token))
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// IssueAPIKey creates a named API key for a tenant and returns its token,
+// which is not stored and cannot be recovered later. A nil expiresAt makes a
+// key that lasts until it is revoked.
+func (s *Service) IssueAPIKey(tenantID, name string, scopes []string, expiresAt *time.Time) (string, *APIKey, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", nil, invalidAPIKey("a name is required")
+	}
+	if len(scopes) == 0 {
+		return "", nil, invalidAPIKey("at least one scope is required")
+	}
+	now := time.Now()
+	if expiresAt != nil && !now.Before(*expiresAt) {
+		return "", nil, invalidAPIKey("expiry %s is in the past", expiresAt.Format(time.RFC3339))
+	}
+
+	id, err := randomID(8)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomID(32)
+	if err != nil {
+		return "", nil, err
+	}
+	token := apiKeyPrefix + secret
+	key := &APIKey{
+		ID:        id,
+		TenantID:  tenantID,
+		Name:      name,
+		Scopes:    scopes,
+		Hash:      hashToken(token),
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+	}
+	if err := s.CreateAPIKey(key); err != nil {
+		return "", nil, err
+	}
+	return token, key, nil
+}
+
+// AuthenticateAPIKey returns the key of a token and records that it was
+// used, or returns an error matching ErrInvalidCredentials if the token is
+// unknown, revoked or expired.
+func (s *Service) AuthenticateAPIKey(token string) (*APIKey, error) {
+	key, err := s.FindAPIKeyByHash(hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if key == nil || key.expired(now) {
+		return nil, ErrInvalidCredentials
+	}
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyUsePrecision {
+		err := s.TouchAPIKey(key.ID, now)
+		// The key may have been revoked since it was found.
+		if errors.Is(err, ErrNotFound) {
+			return nil, ErrInvalidCredentials
+		}
+		if err != nil {
 			return nil, err
 		}
+		key.LastUsedAt = &now
 	}
+	return key, nil
+}
+
+// RunTrashPurger periodically purges notes that have been in the trash for
+// longer than the configured retention, along with sessions that have
+// expired. It blocks until ctx is cancelled.
+func (s *Service) RunTrashPurger(ctx context.Context, c TrashConfig) {
+	if c.PurgeInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.PurgeInterval)
+	defer ticker.Stop()
+	for {
+		if c.Retention > 0 {
+			n, err := s.Repository.PurgeTrash(time.Now().Add(-c.Retention))
+			if err != nil {
+				log.Printf("error purging trash: %v", err)
+			} else if n > 0 {
+				log.Printf("Purged %d notes from trash", n)
+			}
+		}
+
+		n, err := s.Repository.DeleteExpiredSessions(time.Now())
+		if err != nil {
+			log.Printf("error deleting expired sessions: %v", err)
+		} else if n > 0 {
+			log.Printf("Deleted %d expired sessions", n)
+		}
 
-	return notes, nil
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
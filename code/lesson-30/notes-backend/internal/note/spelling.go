@@ -0,0 +1,105 @@
+package note
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/blevesearch/bleve/search"
+)
+
+// minCorrectionLength is the length of the shortest word that is corrected.
+// Shorter words are too close to too many others.
+const minCorrectionLength = 3
+
+// maxEdits returns the number of edits within which a word is corrected, or 0
+// if it is too short to correct.
+func maxEdits(word string) int {
+	switch n := utf8.RuneCountInString(word); {
+	case n < minCorrectionLength:
+		return 0
+	case n < 6:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// correctQuery replaces the words of a query with their corrections, and
+// returns "" if there are none. Only plain words and the values of title: and
+// content: are corrected, with correct, which is passed a lower-case word and
+// returns "" to leave it as it is. Negated words are left alone, as they
+// cannot be why a query found nothing.
+func correctQuery(query string, correct func(word string) (string, error)) (string, error) {
+	tokens, err := lexSearchQuery(query)
+	if err != nil {
+		return "", nil
+	}
+
+	// Replace words from the end, so that the positions of the words before
+	// them stay the same.
+	runes := []rune(query)
+	corrected := false
+	for j := len(tokens) - 1; j >= 0; j-- {
+		t := tokens[j]
+		if t.kind != tokenWord || t.text == "AND" || t.text == "OR" || t.text == "NOT" {
+			continue
+		}
+		if j > 0 && (tokens[j-1].kind == tokenMinus || tokens[j-1].text == "NOT") {
+			continue
+		}
+
+		word, start := t.text, t.pos-1
+		if k := strings.IndexRune(word, ':'); k >= 0 {
+			field := searchFields[strings.ToLower(word[:k])]
+			if field != "title" && field != "content" {
+				continue
+			}
+			start += utf8.RuneCountInString(word[:k+1])
+			word = word[k+1:]
+		}
+		if words := suggestWords(word); len(words) != 1 || len(words[0]) != len(word) {
+			continue
+		}
+
+		correction, err := correct(strings.ToLower(word))
+		if err != nil {
+			return "", err
+		}
+		if correction == "" {
+			continue
+		}
+		end := start + utf8.RuneCountInString(word)
+		runes = append(runes[:start:start], append([]rune(correction), runes[end:]...)...)
+		corrected = true
+	}
+	if !corrected {
+		return "", nil
+	}
+	return string(runes), nil
+}
+
+// closestWord picks the correction of a word from candidates, which count the
+// notes that contain each of them. It prefers the fewest edits, then the most
+// notes. It returns "" if the word is itself a candidate, as it is then not
+// misspelt, or if no candidate is within maxEdits of it.
+func closestWord(word string, candidates map[string]int) string {
+	if candidates[word] > 0 {
+		return ""
+	}
+	var best string
+	var bestDistance, bestCount int
+	for term, count := range candidates {
+		distance := search.LevenshteinDistance(word, term)
+		if distance > maxEdits(word) {
+			continue
+		}
+		better := best == "" ||
+			distance < bestDistance ||
+			distance == bestDistance && count > bestCount ||
+			distance == bestDistance && count == bestCount && term < best
+		if better {
+			best, bestDistance, bestCount = term, distance, count
+		}
+	}
+	return best
+}
@@ -0,0 +1,1467 @@
+package note
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	// Pure-Go SQLite driver, so static builds do not need CGO.
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations are applied in order and must only ever be appended to.
+var sqliteMigrations = []string{
+	`CREATE TABLE notes (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		tenant_id  TEXT NOT NULL,
+		title      TEXT NOT NULL DEFAULT '',
+		content    TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
+	CREATE INDEX notes_tenant_idx ON notes (tenant_id);
+
+	CREATE TABLE tags (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		tenant_id  TEXT NOT NULL,
+		name       TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX tags_tenant_idx ON tags (tenant_id);
+
+	CREATE TABLE note_tags (
+		note_id INTEGER NOT NULL REFERENCES notes (id) ON DELETE CASCADE,
+		tag_id  INTEGER NOT NULL REFERENCES tags (id) ON DELETE CASCADE,
+		PRIMARY KEY (note_id, tag_id)
+	);
+	CREATE INDEX note_tags_tag_idx ON note_tags (tag_id);`,
+
+	`CREATE TABLE note_revisions (
+		note_id    INTEGER NOT NULL REFERENCES notes (id) ON DELETE CASCADE,
+		rev        INTEGER NOT NULL,
+		title      TEXT NOT NULL,
+		content    TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (note_id, rev)
+	);
+	INSERT INTO note_revisions (note_id, rev, title, content, created_at)
+	SELECT id, 1, title, content, updated_at FROM notes;`,
+
+	`ALTER TABLE notes ADD COLUMN deleted_at DATETIME;
+	CREATE INDEX notes_deleted_idx ON notes (deleted_at) WHERE deleted_at IS NOT NULL;`,
+
+	`ALTER TABLE notes ADD COLUMN version INTEGER NOT NULL DEFAULT 1;`,
+
+	`CREATE INDEX notes_created_idx ON notes (tenant_id, created_at, id) WHERE deleted_at IS NULL;
+	CREATE INDEX notes_updated_idx ON notes (tenant_id, updated_at, id) WHERE deleted_at IS NULL;
+	CREATE INDEX notes_title_idx ON notes (tenant_id, lower(title), id) WHERE deleted_at IS NULL;`,
+
+	// Tag names were not unique before this migration, so any duplicates are
+	// renamed by appending their ID before the unique index is created.
+	`ALTER TABLE tags ADD COLUMN color TEXT NOT NULL DEFAULT '';
+	ALTER TABLE tags ADD COLUMN description TEXT NOT NULL DEFAULT '';
+	UPDATE tags SET name = name || ' (' || id || ')'
+	WHERE id NOT IN (SELECT min(id) FROM tags GROUP BY tenant_id, name);
+	DROP INDEX tags_tenant_idx;
+	CREATE UNIQUE INDEX tags_name_idx ON tags (tenant_id, name);`,
+
+	// The index queue outlives the notes it refers to, so it has no foreign
+	// key.
+	`CREATE TABLE index_queue (
+		seq       INTEGER PRIMARY KEY AUTOINCREMENT,
+		tenant_id TEXT NOT NULL,
+		note_id   INTEGER NOT NULL
+	);`,
+
+	// Tenants are registered when their token is issued, or when a token
+	// issued before the registry existed is first used, so the table does
+	// not hold every tenant that has notes.
+	`CREATE TABLE tenants (
+		id         TEXT PRIMARY KEY,
+		name       TEXT NOT NULL DEFAULT '',
+		status     TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);`,
+
+	// Changes made before users existed were made with tenant tokens, so
+	// they have no author.
+	`CREATE TABLE users (
+		id            TEXT PRIMARY KEY,
+		tenant_id     TEXT NOT NULL,
+		email         TEXT NOT NULL UNIQUE,
+		password_hash BLOB NOT NULL,
+		created_at    DATETIME NOT NULL
+	);
+	CREATE INDEX users_tenant_idx ON users (tenant_id);
+
+	CREATE TABLE sessions (
+		id         TEXT PRIMARY KEY,
+		user_id    TEXT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		tenant_id  TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL
+	);
+
+	ALTER TABLE notes ADD COLUMN updated_by TEXT NOT NULL DEFAULT '';
+	ALTER TABLE note_revisions ADD COLUMN author TEXT NOT NULL DEFAULT '';`,
+
+	// Users created before roles existed could do anything, so they become
+	// owners.
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'owner';`,
+
+	// Scopes are kept as a JSON array, as they are only ever read whole.
+	`CREATE TABLE api_keys (
+		id           TEXT PRIMARY KEY,
+		tenant_id    TEXT NOT NULL,
+		name         TEXT NOT NULL,
+		scopes       TEXT NOT NULL,
+		hash         TEXT NOT NULL UNIQUE,
+		created_at   DATETIME NOT NULL,
+		expires_at   DATETIME,
+		last_used_at DATETIME
+	);
+	CREATE INDEX api_keys_tenant_idx ON api_keys (tenant_id);`,
+}
+
+// openSQLite opens the database at path with the connection settings shared
+// by the repository and the search index, which may live in the same file.
+func openSQLite(path string) (*sql.DB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("error creating directory for SQLite database: %w", err)
+	}
+
+	dsn := "file:" + path +
+		"?_pragma=foreign_keys(1)" +
+		"&_pragma=journal_mode(WAL)" +
+		"&_pragma=busy_timeout(5000)" +
+		"&_time_format=sqlite"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening SQLite database at %q: %w", path, err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error opening SQLite database at %q: %w", path, err)
+	}
+
+	return db, nil
+}
+
+// migrateSQLite applies every migration for component that has not yet been
+// applied. Versions are tracked per component because the repository and the
+// search index may or may not share a database file.
+func migrateSQLite(db *sql.DB, component string, migrations []string) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_versions (
+		component TEXT PRIMARY KEY,
+		version   INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = db.QueryRow(
+		`SELECT version FROM schema_versions WHERE component = ?`, component,
+	).Scan(&version)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error reading schema version: %w", err)
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error applying %s migration %d: %w", component, version+1, err)
+		}
+		_, err = tx.Exec(
+			`INSERT INTO schema_versions (component, version) VALUES (?, ?)
+			ON CONFLICT (component) DO UPDATE SET version = excluded.version`,
+			component, version+1,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func NewSQLiteRepo(c RepositoryConfig, idx SearchIndex) (*sqliteRepo, error) {
+	db, err := openSQLite(c.SQLitePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateSQLite(db, "repository", sqliteMigrations); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error migrating SQLite database: %w", err)
+	}
+
+	r := &sqliteRepo{
+		db:            db,
+		revisionLimit: c.RevisionLimit,
+	}
+	r.indexer = startIndexWorker(r, idx)
+	return r, nil
+}
+
+type sqliteRepo struct {
+	db            *sql.DB
+	revisionLimit int
+	indexer       *indexWorker
+}
+
+func (r *sqliteRepo) Close() error {
+	r.indexer.close()
+	fmt.Println("Closing SQLite database")
+	return r.db.Close()
+}
+
+func (r *sqliteRepo) PurgeTrash(deletedBefore time.Time) (int, error) {
+	// Revisions and tag associations are removed by the foreign key cascade.
+	res, err := r.db.Exec(
+		`DELETE FROM notes WHERE deleted_at IS NOT NULL AND deleted_at < ?`,
+		deletedBefore.UTC(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (r *sqliteRepo) TenantIDs() ([]string, error) {
+	rows, err := r.db.Query(
+		`SELECT tenant_id FROM notes UNION SELECT tenant_id FROM tags ORDER BY tenant_id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (r *sqliteRepo) IndexQueueDepth() (int, error) {
+	var n int
+	err := r.db.QueryRow(`SELECT count(*) FROM index_queue`).Scan(&n)
+	return n, err
+}
+
+// CheckIntegrity looks for associations and revisions that outlived their
+// notes or tags, which foreign keys prevent unless they were turned off, and
+// for notes tagged with another tenant's tags. An association is a single row,
+// so it cannot be one-sided.
+func (r *sqliteRepo) CheckIntegrity(fix bool) ([]*Problem, error) {
+	tx, err := beginImmediate(r.db)
+	if err != nil {
+		return nil, err
+	}
+	problems, err := checkSQLiteIntegrity(tx, fix)
+	if err != nil || !fix {
+		tx.Rollback()
+		return problems, err
+	}
+	return problems, tx.Commit()
+}
+
+func checkSQLiteIntegrity(tx sqlQuerier, fix bool) ([]*Problem, error) {
+	type link struct {
+		noteID, tagID uint64
+	}
+	var links []link
+	var problems []*Problem
+	rows, err := tx.Query(`
+		SELECT nt.note_id, nt.tag_id, coalesce(n.tenant_id, t.tenant_id, ''),
+		       n.id IS NOT NULL,
+		       t.id IS NOT NULL AND (n.id IS NULL OR t.tenant_id = n.tenant_id)
+		FROM note_tags nt
+		LEFT JOIN notes n ON n.id = nt.note_id
+		LEFT JOIN tags t ON t.id = nt.tag_id
+		WHERE n.id IS NULL OR t.id IS NULL OR t.tenant_id != n.tenant_id
+		ORDER BY 3, 1, 2`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var l link
+		var tenantID string
+		var hasNote, hasTag bool
+		if err := rows.Scan(&l.noteID, &l.tagID, &tenantID, &hasNote, &hasTag); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		links = append(links, l)
+		problems = append(problems, &Problem{
+			TenantID:    tenantID,
+			Description: linkProblem(l.noteID, l.tagID, hasNote, hasTag, true, true),
+			Fixed:       fix,
+		})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var orphans []uint64
+	rows, err = tx.Query(`
+		SELECT DISTINCT r.note_id
+		FROM note_revisions r LEFT JOIN notes n ON n.id = r.note_id
+		WHERE n.id IS NULL
+		ORDER BY 1`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var noteID uint64
+		if err := rows.Scan(&noteID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		orphans = append(orphans, noteID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// The tenant of revisions is that of their note, which is gone.
+	for _, noteID := range orphans {
+		p := orphanedRevisionsProblem("", noteID)
+		p.Fixed = fix
+		problems = append(problems, p)
+	}
+
+	if !fix {
+		return problems, nil
+	}
+	for _, l := range links {
+		_, err := tx.Exec(`DELETE FROM note_tags WHERE note_id = ? AND tag_id = ?`, l.noteID, l.tagID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, noteID := range orphans {
+		if _, err := tx.Exec(`DELETE FROM note_revisions WHERE note_id = ?`, noteID); err != nil {
+			return nil, err
+		}
+	}
+	return problems, nil
+}
+
+func (r *sqliteRepo) CreateTenant(tenant *Tenant) error {
+	if err := newTenant(tenant); err != nil {
+		return err
+	}
+	res, err := r.db.Exec(
+		`INSERT INTO tenants (id, name, status, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO NOTHING`,
+		tenant.ID, tenant.Name, tenant.Status, tenant.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return tenantExists(tenant.ID)
+	}
+	return nil
+}
+
+func (r *sqliteRepo) FindTenant(id string) (*Tenant, error) {
+	tenant := new(Tenant)
+	err := r.db.QueryRow(
+		`SELECT id, name, status, created_at FROM tenants WHERE id = ?`, id,
+	).Scan(&tenant.ID, &tenant.Name, &tenant.Status, &tenant.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tenant, nil
+}
+
+func (r *sqliteRepo) FindTenants(q TenantQuery) (*TenantPage, error) {
+	after, err := q.after()
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT id, name, status, created_at FROM tenants WHERE id > ?`
+	args := []interface{}{after}
+	if q.Status != "" {
+		query += ` AND status = ?`
+		args = append(args, q.Status)
+	}
+	query += ` ORDER BY id`
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit+1)
+	}
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tenants := make([]*Tenant, 0)
+	for rows.Next() {
+		tenant := new(Tenant)
+		if err := rows.Scan(&tenant.ID, &tenant.Name, &tenant.Status, &tenant.CreatedAt); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, tenant)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return q.page(tenants), nil
+}
+
+func (r *sqliteRepo) CreateUser(user *User) error {
+	if err := newUser(user); err != nil {
+		return err
+	}
+	res, err := r.db.Exec(
+		`INSERT INTO users (id, tenant_id, email, role, password_hash, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (email) DO NOTHING`,
+		user.ID, user.TenantID, user.Email, user.Role, user.PasswordHash, user.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return emailExists(user.Email)
+	}
+	return nil
+}
+
+func (r *sqliteRepo) FindUser(id string) (*User, error) {
+	return r.findUser(`id = ?`, id)
+}
+
+func (r *sqliteRepo) FindUserByEmail(email string) (*User, error) {
+	return r.findUser(`email = ?`, email)
+}
+
+func (r *sqliteRepo) findUser(condition string, arg interface{}) (*User, error) {
+	user := new(User)
+	err := r.db.QueryRow(
+		`SELECT id, tenant_id, email, role, password_hash, created_at FROM users WHERE `+condition, arg,
+	).Scan(&user.ID, &user.TenantID, &user.Email, &user.Role, &user.PasswordHash, &user.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (r *sqliteRepo) FindUsers(tenantID string) ([]*User, error) {
+	rows, err := r.db.Query(
+		`SELECT id, tenant_id, email, role, password_hash, created_at
+		FROM users WHERE tenant_id = ? ORDER BY id`,
+		tenantID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]*User, 0)
+	for rows.Next() {
+		user := new(User)
+		if err := rows.Scan(&user.ID, &user.TenantID, &user.Email, &user.Role, &user.PasswordHash, &user.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func (r *sqliteRepo) UpdateUser(id string, user *User) error {
+	if !user.Role.valid() {
+		return invalidUser("unknown role %q", user.Role)
+	}
+	res, err := r.db.Exec(`UPDATE users SET role = ? WHERE id = ?`, user.Role, id)
+	if err := affectedOne(res, err, userNotFound(id)); err != nil {
+		return err
+	}
+	stored, err := r.FindUser(id)
+	if err != nil {
+		return err
+	}
+	*user = *stored
+	return nil
+}
+
+// DeleteUser also deletes the user's sessions, which reference it.
+func (r *sqliteRepo) DeleteUser(id string) error {
+	res, err := r.db.Exec(`DELETE FROM users WHERE id = ?`, id)
+	return affectedOne(res, err, userNotFound(id))
+}
+
+func (r *sqliteRepo) CreateSession(session *Session) error {
+	_, err := r.db.Exec(
+		`INSERT INTO sessions (id, user_id, tenant_id, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		session.ID, session.UserID, session.TenantID, session.CreatedAt, session.ExpiresAt,
+	)
+	return err
+}
+
+func (r *sqliteRepo) FindSession(id string) (*Session, error) {
+	session := new(Session)
+	err := r.db.QueryRow(
+		`SELECT id, user_id, tenant_id, created_at, expires_at FROM sessions WHERE id = ?`, id,
+	).Scan(&session.ID, &session.UserID, &session.TenantID, &session.CreatedAt, &session.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (r *sqliteRepo) DeleteSession(id string) error {
+	res, err := r.db.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	return affectedOne(res, err, sessionNotFound())
+}
+
+func (r *sqliteRepo) DeleteExpiredSessions(expiredBy time.Time) (int, error) {
+	// Sessions keep the offset they were created with, so compare instants
+	// rather than text.
+	res, err := r.db.Exec(`DELETE FROM sessions WHERE julianday(expires_at) <= julianday(?)`, expiredBy)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (r *sqliteRepo) CreateAPIKey(key *APIKey) error {
+	scopes, err := json.Marshal(key.Scopes)
+	if err != nil {
+		return err
+	}
+	res, err := r.db.Exec(
+		`INSERT INTO api_keys (id, tenant_id, name, scopes, hash, created_at, expires_at, last_used_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT DO NOTHING`,
+		key.ID, key.TenantID, key.Name, string(scopes), key.Hash, key.CreatedAt, key.ExpiresAt, key.LastUsedAt,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return &AlreadyExistsError{Entity: "API key", Name: key.ID}
+	}
+	return nil
+}
+
+func (r *sqliteRepo) FindAPIKey(id string) (*APIKey, error) {
+	return r.findAPIKey(`id = ?`, id)
+}
+
+func (r *sqliteRepo) FindAPIKeyByHash(hash string) (*APIKey, error) {
+	return r.findAPIKey(`hash = ?`, hash)
+}
+
+const sqliteAPIKeyColumns = `id, tenant_id, name, scopes, hash, created_at, expires_at, last_used_at`
+
+func (r *sqliteRepo) findAPIKey(condition string, arg interface{}) (*APIKey, error) {
+	key, err := scanAPIKey(r.db.QueryRow(`SELECT `+sqliteAPIKeyColumns+` FROM api_keys WHERE `+condition, arg))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return key, err
+}
+
+func (r *sqliteRepo) FindAPIKeys(tenantID string) ([]*APIKey, error) {
+	rows, err := r.db.Query(
+		`SELECT `+sqliteAPIKeyColumns+` FROM api_keys WHERE tenant_id = ? ORDER BY id`,
+		tenantID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]*APIKey, 0)
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	key := new(APIKey)
+	var scopes string
+	err := row.Scan(
+		&key.ID, &key.TenantID, &key.Name, &scopes, &key.Hash,
+		&key.CreatedAt, &key.ExpiresAt, &key.LastUsedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(scopes), &key.Scopes); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (r *sqliteRepo) TouchAPIKey(id string, usedAt time.Time) error {
+	res, err := r.db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, usedAt, id)
+	return affectedOne(res, err, apiKeyNotFound(id))
+}
+
+func (r *sqliteRepo) DeleteAPIKey(id string) error {
+	res, err := r.db.Exec(`DELETE FROM api_keys WHERE id = ?`, id)
+	return affectedOne(res, err, apiKeyNotFound(id))
+}
+
+func (r *sqliteRepo) UpdateTenant(id string, tenant *Tenant) error {
+	if !tenant.Status.valid() {
+		return fmt.Errorf("invalid tenant status %q", tenant.Status)
+	}
+	res, err := r.db.Exec(
+		`UPDATE tenants SET name = ?, status = ? WHERE id = ?`,
+		tenant.Name, tenant.Status, id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return tenantNotFound(id)
+	}
+
+	stored, err := r.FindTenant(id)
+	if err != nil {
+		return err
+	}
+	*tenant = *stored
+	return nil
+}
+
+func (r *sqliteRepo) peekIndexJobs(n int) ([]indexJob, error) {
+	rows, err := r.db.Query(
+		`SELECT seq, tenant_id, note_id FROM index_queue ORDER BY seq LIMIT ?`, n,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []indexJob
+	for rows.Next() {
+		var job indexJob
+		if err := rows.Scan(&job.Seq, &job.TenantID, &job.NoteID); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func (r *sqliteRepo) ackIndexJob(seq uint64) error {
+	_, err := r.db.Exec(`DELETE FROM index_queue WHERE seq = ?`, seq)
+	return err
+}
+
+func (r *sqliteRepo) Transaction(tenantID string) Transaction {
+	return &sqliteTransaction{
+		sqliteRepo: r,
+		tenantID:   tenantID,
+		q:          r.db,
+	}
+}
+
+func (r *sqliteRepo) Update(tenantID string, fn func(tx Transaction) error) error {
+	sqlTx, err := beginImmediate(r.db)
+	if err != nil {
+		return err
+	}
+
+	tx := &sqliteTransaction{
+		sqliteRepo: r,
+		tenantID:   tenantID,
+		q:          sqlTx,
+		inTx:       true,
+	}
+	if err := fn(tx); err != nil {
+		sqlTx.Rollback()
+		return err
+	}
+	if err := sqlTx.Commit(); err != nil {
+		return err
+	}
+
+	r.indexer.notify()
+	return nil
+}
+
+// sqlQuerier is satisfied by *sql.DB, *sql.Tx and *immediateTx.
+type sqlQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// immediateTx is a transaction that takes the write lock when it begins, so
+// that it waits for other writers rather than failing with SQLITE_BUSY when
+// it first writes after reading. The driver ignores its _txlock setting
+// whenever _time_format is set, so the transaction is begun by hand on a
+// dedicated connection.
+type immediateTx struct {
+	conn *sql.Conn
+}
+
+func beginImmediate(db *sql.DB) (*immediateTx, error) {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(context.Background(), `BEGIN IMMEDIATE`); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &immediateTx{conn: conn}, nil
+}
+
+func (t *immediateTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.conn.ExecContext(context.Background(), query, args...)
+}
+
+func (t *immediateTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return t.conn.QueryContext(context.Background(), query, args...)
+}
+
+func (t *immediateTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return t.conn.QueryRowContext(context.Background(), query, args...)
+}
+
+func (t *immediateTx) Commit() error {
+	if _, err := t.Exec(`COMMIT`); err != nil {
+		t.Rollback()
+		return err
+	}
+	return t.conn.Close()
+}
+
+func (t *immediateTx) Rollback() error {
+	_, err := t.Exec(`ROLLBACK`)
+	t.conn.Close()
+	return err
+}
+
+// sqliteTransaction runs each operation on its own unless it was created by
+// Update, in which case all operations share a single SQL transaction.
+type sqliteTransaction struct {
+	*sqliteRepo
+	tenantID string
+
+	q    sqlQuerier
+	inTx bool
+}
+
+// atomic runs fn so that all of its statements share one SQL transaction,
+// starting a new transaction unless tx is already part of one.
+func (tx *sqliteTransaction) atomic(fn func(tx *sqliteTransaction) error) error {
+	if tx.inTx {
+		return fn(tx)
+	}
+	return tx.sqliteRepo.Update(tx.tenantID, func(t Transaction) error {
+		return fn(t.(*sqliteTransaction))
+	})
+}
+
+// reindex queues notes to have their search documents brought up to date.
+// It must be called within atomic so that the queue entries are committed
+// along with the change.
+func (tx *sqliteTransaction) reindex(noteIDs ...uint64) error {
+	for _, noteID := range noteIDs {
+		_, err := tx.q.Exec(
+			`INSERT INTO index_queue (tenant_id, note_id) VALUES (?, ?)`,
+			tx.tenantID, noteID,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *sqliteTransaction) FindNoteByID(id uint64) (*Note, error) {
+	note := new(Note)
+	err := tx.q.QueryRow(
+		`SELECT id, version, title, content, created_at, updated_at, updated_by
+		FROM notes WHERE id = ? AND tenant_id = ? AND deleted_at IS NULL`,
+		id, tx.tenantID,
+	).Scan(&note.ID, &note.Version, &note.Title, &note.Content, &note.CreatedAt, &note.UpdatedAt, &note.UpdatedBy)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	rows, err := tx.q.Query(
+		`SELECT t.id, t.name, t.color, t.description, t.created_at
+		FROM note_tags nt JOIN tags t ON t.id = nt.tag_id
+		WHERE nt.note_id = ?
+		ORDER BY t.id`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		tag := new(Tag)
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.Color, &tag.Description, &tag.CreatedAt); err != nil {
+			return nil, err
+		}
+		note.Tags = append(note.Tags, tag)
+	}
+
+	return note, rows.Err()
+}
+
+func (tx *sqliteTransaction) FindAllNotes() ([]*Note, error) {
+	return tx.findNotes(false)
+}
+
+func (tx *sqliteTransaction) FindTrashedNotes() ([]*Note, error) {
+	return tx.findNotes(true)
+}
+
+// findNotes loads either the live or the trashed notes, along with their tags.
+func (tx *sqliteTransaction) findNotes(trashed bool) ([]*Note, error) {
+	condition := "deleted_at IS NULL"
+	if trashed {
+		condition = "deleted_at IS NOT NULL"
+	}
+	notes, err := tx.queryNotes(
+		`SELECT id, version, title, content, created_at, updated_at, updated_by, deleted_at
+		FROM notes WHERE tenant_id = ? AND `+condition+`
+		ORDER BY id`,
+		tx.tenantID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return notes, tx.withTags(notes)
+}
+
+// sqliteSortColumns are the expressions that notes are ordered by, matching
+// the indexes created by the migrations.
+var sqliteSortColumns = map[NoteSort]string{
+	SortByCreatedAt: "created_at",
+	SortByUpdatedAt: "updated_at",
+	SortByTitle:     "lower(title)",
+}
+
+func (tx *sqliteTransaction) FindNotes(q NoteQuery) (*NotePage, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	after, err := q.after()
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT id, version, title, content, created_at, updated_at, updated_by, deleted_at
+	FROM notes WHERE tenant_id = ? AND deleted_at IS NULL`
+	args := []interface{}{tx.tenantID}
+	if q.TagID > 0 {
+		query += ` AND id IN (SELECT note_id FROM note_tags WHERE tag_id = ?)`
+		args = append(args, q.TagID)
+	}
+	if !q.UpdatedSince.IsZero() {
+		query += ` AND updated_at >= ?`
+		args = append(args, q.UpdatedSince.UTC())
+	}
+	if !q.CreatedBefore.IsZero() {
+		query += ` AND created_at < ?`
+		args = append(args, q.CreatedBefore.UTC())
+	}
+
+	column, op, order := sqliteSortColumns[q.Sort], ">", "ASC"
+	if q.Descending {
+		op, order = "<", "DESC"
+	}
+	if after != nil {
+		query += fmt.Sprintf(` AND (%s, id) %s (?, ?)`, column, op)
+		switch q.Sort {
+		case SortByCreatedAt:
+			args = append(args, after.CreatedAt)
+		case SortByUpdatedAt:
+			args = append(args, after.UpdatedAt)
+		case SortByTitle:
+			args = append(args, titleSortKey(after.Title))
+		}
+		args = append(args, after.ID)
+	}
+	query += fmt.Sprintf(` ORDER BY %s %s, id %s`, column, order, order)
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit+1)
+	}
+
+	notes, err := tx.queryNotes(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	page := q.page(notes)
+	return page, tx.withTags(page.Notes)
+}
+
+func (tx *sqliteTransaction) queryNotes(query string, args ...interface{}) ([]*Note, error) {
+	rows, err := tx.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notes := make([]*Note, 0)
+	for rows.Next() {
+		note := new(Note)
+		if err := rows.Scan(&note.ID, &note.Version, &note.Title, &note.Content, &note.CreatedAt, &note.UpdatedAt, &note.UpdatedBy, &note.DeletedAt); err != nil {
+			return nil, err
+		}
+		notes = append(notes, note)
+	}
+	return notes, rows.Err()
+}
+
+// withTags loads the tags of the given notes.
+func (tx *sqliteTransaction) withTags(notes []*Note) error {
+	if len(notes) == 0 {
+		return nil
+	}
+
+	byID := make(map[uint64]*Note, len(notes))
+	args := make([]interface{}, len(notes))
+	for i, note := range notes {
+		byID[note.ID] = note
+		args[i] = note.ID
+	}
+	placeholders := strings.Repeat(", ?", len(notes))[2:]
+
+	rows, err := tx.q.Query(
+		`SELECT nt.note_id, t.id, t.name, t.color, t.description, t.created_at
+		FROM note_tags nt JOIN tags t ON t.id = nt.tag_id
+		WHERE nt.note_id IN (`+placeholders+`)
+		ORDER BY nt.note_id, t.id`,
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var noteID uint64
+		tag := new(Tag)
+		if err := rows.Scan(&noteID, &tag.ID, &tag.Name, &tag.Color, &tag.Description, &tag.CreatedAt); err != nil {
+			return err
+		}
+		byID[noteID].Tags = append(byID[noteID].Tags, tag)
+	}
+
+	return rows.Err()
+}
+
+func (tx *sqliteTransaction) FindTagByID(id uint64) (*Tag, error) {
+	tag := new(Tag)
+	err := tx.q.QueryRow(
+		`SELECT id, name, color, description, created_at FROM tags WHERE id = ? AND tenant_id = ?`,
+		id, tx.tenantID,
+	).Scan(&tag.ID, &tag.Name, &tag.Color, &tag.Description, &tag.CreatedAt)
+	switch err {
+	case nil:
+		return tag, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (tx *sqliteTransaction) FindAllTags() ([]*Tag, error) {
+	rows, err := tx.q.Query(
+		`SELECT id, name, color, description, created_at FROM tags WHERE tenant_id = ? ORDER BY id`,
+		tx.tenantID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make([]*Tag, 0)
+	for rows.Next() {
+		tag := new(Tag)
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.Color, &tag.Description, &tag.CreatedAt); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+func (tx *sqliteTransaction) FindTags(q TagQuery) (*TagPage, error) {
+	after, err := q.after()
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT id, name, color, description, created_at FROM tags WHERE tenant_id = ? AND id > ? ORDER BY id`
+	args := []interface{}{tx.tenantID, after}
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit+1)
+	}
+	rows, err := tx.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make([]*Tag, 0)
+	for rows.Next() {
+		tag := new(Tag)
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.Color, &tag.Description, &tag.CreatedAt); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return q.page(tags), nil
+}
+
+func (tx *sqliteTransaction) FindRevisions(noteID uint64) ([]*Revision, error) {
+	rows, err := tx.q.Query(
+		`SELECT r.note_id, r.rev, r.title, r.content, r.created_at, r.author
+		FROM note_revisions r JOIN notes n ON n.id = r.note_id
+		WHERE r.note_id = ? AND n.tenant_id = ?
+		ORDER BY r.rev`,
+		noteID, tx.tenantID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := make([]*Revision, 0)
+	for rows.Next() {
+		rev := new(Revision)
+		if err := rows.Scan(&rev.NoteID, &rev.Rev, &rev.Title, &rev.Content, &rev.CreatedAt, &rev.Author); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+
+	return revisions, rows.Err()
+}
+
+func (tx *sqliteTransaction) FindRevision(noteID, rev uint64) (*Revision, error) {
+	revision := new(Revision)
+	err := tx.q.QueryRow(
+		`SELECT r.note_id, r.rev, r.title, r.content, r.created_at, r.author
+		FROM note_revisions r JOIN notes n ON n.id = r.note_id
+		WHERE r.note_id = ? AND r.rev = ? AND n.tenant_id = ?`,
+		noteID, rev, tx.tenantID,
+	).Scan(&revision.NoteID, &revision.Rev, &revision.Title, &revision.Content, &revision.CreatedAt, &revision.Author)
+	switch err {
+	case nil:
+		return revision, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (tx *sqliteTransaction) CreateNote(note *Note) error {
+	return tx.atomic(func(tx *sqliteTransaction) error {
+		now := time.Now().UTC()
+		res, err := tx.q.Exec(
+			`INSERT INTO notes (tenant_id, title, content, created_at, updated_at, updated_by)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			tx.tenantID, note.Title, note.Content, now, now, note.UpdatedBy,
+		)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		note.ID = uint64(id)
+		note.Version = 1
+		note.CreatedAt = now
+		note.UpdatedAt = now
+		note.DeletedAt = nil
+		if err := tx.addRevision(note); err != nil {
+			return err
+		}
+		return tx.reindex(note.ID)
+	})
+}
+
+func (tx *sqliteTransaction) UpdateNote(id uint64, note *Note) error {
+	return tx.atomic(func(tx *sqliteTransaction) error {
+		now := time.Now().UTC()
+		res, err := tx.q.Exec(
+			`UPDATE notes SET title = ?, content = ?, updated_at = ?, updated_by = ?, version = version + 1
+			WHERE id = ? AND tenant_id = ? AND deleted_at IS NULL`,
+			note.Title, note.Content, now, note.UpdatedBy, id, tx.tenantID,
+		)
+		if err := affectedOne(res, err, noteNotFound(id)); err != nil {
+			return err
+		}
+
+		err = tx.q.QueryRow(
+			`SELECT version, created_at FROM notes WHERE id = ?`, id,
+		).Scan(&note.Version, &note.CreatedAt)
+		if err != nil {
+			return err
+		}
+		note.ID = id
+		note.UpdatedAt = now
+		if err := tx.addRevision(note); err != nil {
+			return err
+		}
+		return tx.reindex(id)
+	})
+}
+
+func (tx *sqliteTransaction) CheckNoteVersion(id, version uint64) error {
+	note := &Note{ID: id}
+	err := tx.q.QueryRow(
+		`SELECT version FROM notes WHERE id = ? AND tenant_id = ? AND deleted_at IS NULL`,
+		id, tx.tenantID,
+	).Scan(&note.Version)
+	switch err {
+	case nil:
+		return checkVersion(note, version)
+	case sql.ErrNoRows:
+		return noteNotFound(id)
+	default:
+		return err
+	}
+}
+
+func (tx *sqliteTransaction) DeleteNote(id uint64) error {
+	return tx.atomic(func(tx *sqliteTransaction) error {
+		res, err := tx.q.Exec(
+			`UPDATE notes SET deleted_at = ?
+			WHERE id = ? AND tenant_id = ? AND deleted_at IS NULL`,
+			time.Now().UTC(), id, tx.tenantID,
+		)
+		if err := affectedOne(res, err, noteNotFound(id)); err != nil {
+			return err
+		}
+		return tx.reindex(id)
+	})
+}
+
+func (tx *sqliteTransaction) RestoreNote(id uint64) error {
+	return tx.atomic(func(tx *sqliteTransaction) error {
+		res, err := tx.q.Exec(
+			`UPDATE notes SET deleted_at = NULL
+			WHERE id = ? AND tenant_id = ? AND deleted_at IS NOT NULL`,
+			id, tx.tenantID,
+		)
+		if err := affectedOne(res, err, noteNotFound(id)); err != nil {
+			return err
+		}
+		return tx.reindex(id)
+	})
+}
+
+func (tx *sqliteTransaction) PurgeNote(id uint64) error {
+	// Revisions and tag associations are removed by the foreign key cascade.
+	res, err := tx.q.Exec(
+		`DELETE FROM notes WHERE id = ? AND tenant_id = ? AND deleted_at IS NOT NULL`,
+		id, tx.tenantID,
+	)
+	return affectedOne(res, err, noteNotFound(id))
+}
+
+func (tx *sqliteTransaction) CreateTag(tag *Tag) error {
+	return tx.atomic(func(tx *sqliteTransaction) error {
+		if err := tx.checkTagName(0, tag.Name); err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		res, err := tx.q.Exec(
+			`INSERT INTO tags (tenant_id, name, color, description, created_at) VALUES (?, ?, ?, ?, ?)`,
+			tx.tenantID, tag.Name, tag.Color, tag.Description, now,
+		)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		tag.ID = uint64(id)
+		tag.CreatedAt = now
+		return nil
+	})
+}
+
+func (tx *sqliteTransaction) UpdateTag(id uint64, tag *Tag) error {
+	return tx.atomic(func(tx *sqliteTransaction) error {
+		if err := tx.checkTagName(id, tag.Name); err != nil {
+			return err
+		}
+
+		tag.ID = id
+		err := tx.q.QueryRow(
+			`UPDATE tags SET name = ?, color = ?, description = ?
+			WHERE id = ? AND tenant_id = ?
+			RETURNING created_at`,
+			tag.Name, tag.Color, tag.Description, id, tx.tenantID,
+		).Scan(&tag.CreatedAt)
+		switch err {
+		case nil:
+		case sql.ErrNoRows:
+			return tagNotFound(id)
+		default:
+			return err
+		}
+
+		noteIDs, err := tx.taggedNoteIDs(id)
+		if err != nil {
+			return err
+		}
+		return tx.reindex(noteIDs...)
+	})
+}
+
+func (tx *sqliteTransaction) DeleteTag(id uint64) error {
+	return tx.atomic(func(tx *sqliteTransaction) error {
+		noteIDs, err := tx.taggedNoteIDs(id)
+		if err != nil {
+			return err
+		}
+
+		// Associations with notes are removed by the foreign key cascade.
+		res, err := tx.q.Exec(
+			`DELETE FROM tags WHERE id = ? AND tenant_id = ?`,
+			id, tx.tenantID,
+		)
+		if err := affectedOne(res, err, tagNotFound(id)); err != nil {
+			return err
+		}
+		return tx.reindex(noteIDs...)
+	})
+}
+
+func (tx *sqliteTransaction) MergeTag(id, intoID uint64) error {
+	return tx.atomic(func(tx *sqliteTransaction) error {
+		for _, tagID := range []uint64{id, intoID} {
+			var exists bool
+			err := tx.q.QueryRow(
+				`SELECT EXISTS (SELECT 1 FROM tags WHERE id = ? AND tenant_id = ?)`,
+				tagID, tx.tenantID,
+			).Scan(&exists)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return tagNotFound(tagID)
+			}
+		}
+		if id == intoID {
+			return fmt.Errorf("cannot merge tag %d into itself", id)
+		}
+
+		noteIDs, err := tx.taggedNoteIDs(id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.q.Exec(
+			`INSERT OR IGNORE INTO note_tags (note_id, tag_id)
+			SELECT note_id, ? FROM note_tags WHERE tag_id = ?`,
+			intoID, id,
+		)
+		if err != nil {
+			return err
+		}
+		// The old associations are removed by the foreign key cascade.
+		if _, err := tx.q.Exec(`DELETE FROM tags WHERE id = ?`, id); err != nil {
+			return err
+		}
+		return tx.reindex(noteIDs...)
+	})
+}
+
+func (tx *sqliteTransaction) TagNote(noteID, tagID uint64) error {
+	return tx.atomic(func(tx *sqliteTransaction) error {
+		var exists bool
+		err := tx.q.QueryRow(
+			`SELECT EXISTS (SELECT 1 FROM notes WHERE id = ? AND tenant_id = ? AND deleted_at IS NULL)`,
+			noteID, tx.tenantID,
+		).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return noteNotFound(noteID)
+		}
+		err = tx.q.QueryRow(
+			`SELECT EXISTS (SELECT 1 FROM tags WHERE id = ? AND tenant_id = ?)`,
+			tagID, tx.tenantID,
+		).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return tagNotFound(tagID)
+		}
+
+		_, err = tx.q.Exec(
+			`INSERT OR IGNORE INTO note_tags (note_id, tag_id) VALUES (?, ?)`,
+			noteID, tagID,
+		)
+		if err != nil {
+			return err
+		}
+		return tx.reindex(noteID)
+	})
+}
+
+func (tx *sqliteTransaction) UntagNote(noteID, tagID uint64) error {
+	return tx.atomic(func(tx *sqliteTransaction) error {
+		_, err := tx.q.Exec(
+			`DELETE FROM note_tags
+			WHERE note_id = ? AND tag_id = ?
+			AND note_id IN (SELECT id FROM notes WHERE tenant_id = ?)`,
+			noteID, tagID, tx.tenantID,
+		)
+		if err != nil {
+			return err
+		}
+		return tx.reindex(noteID)
+	})
+}
+
+// checkTagName returns an error if a tag other than id already has name.
+func (tx *sqliteTransaction) checkTagName(id uint64, name string) error {
+	var exists bool
+	err := tx.q.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM tags WHERE tenant_id = ? AND name = ? AND id != ?)`,
+		tx.tenantID, name, id,
+	).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return tagExists(name)
+	}
+	return nil
+}
+
+// taggedNoteIDs returns the IDs of the notes with a tag, including those in
+// the trash.
+func (tx *sqliteTransaction) taggedNoteIDs(tagID uint64) ([]uint64, error) {
+	rows, err := tx.q.Query(`SELECT note_id FROM note_tags WHERE tag_id = ?`, tagID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var noteIDs []uint64
+	for rows.Next() {
+		var noteID uint64
+		if err := rows.Scan(&noteID); err != nil {
+			return nil, err
+		}
+		noteIDs = append(noteIDs, noteID)
+	}
+	return noteIDs, rows.Err()
+}
+
+// addRevision records the current state of note as its next revision and
+// discards any revisions beyond the retention limit.
+func (tx *sqliteTransaction) addRevision(note *Note) error {
+	_, err := tx.q.Exec(
+		`INSERT INTO note_revisions (note_id, rev, title, content, created_at, author)
+		SELECT ?, COALESCE(MAX(rev), 0) + 1, ?, ?, ?, ?
+		FROM note_revisions WHERE note_id = ?`,
+		note.ID, note.Title, note.Content, note.UpdatedAt, note.UpdatedBy, note.ID,
+	)
+	if err != nil || tx.revisionLimit <= 0 {
+		return err
+	}
+
+	_, err = tx.q.Exec(
+		`DELETE FROM note_revisions
+		WHERE note_id = ?
+		AND rev <= (SELECT MAX(rev) FROM note_revisions WHERE note_id = ?) - ?`,
+		note.ID, note.ID, tx.revisionLimit,
+	)
+	return err
+}
+
+// affectedOne checks the outcome of a statement that targets a single row,
+// returning notFound if no row was affected.
+func affectedOne(res sql.Result, err error, notFound error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFound
+	}
+	return nil
+}
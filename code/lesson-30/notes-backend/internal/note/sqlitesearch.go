@@ -0,0 +1,344 @@
+package note
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var sqliteSearchMigrations = []string{
+	`CREATE VIRTUAL TABLE note_search USING fts5 (
+		tenant_id UNINDEXED,
+		title,
+		content,
+		tags,
+		tokenize = 'porter unicode61'
+	);`,
+}
+
+// NewSQLiteSearchIndex creates a SearchIndex backed by an FTS5 table. When it
+// shares a file with the SQLite repository, one file holds all of the data.
+// It does not compute facets, correct queries or suggest tag names.
+func NewSQLiteSearchIndex(c SearchIndexConfig) (*SQLiteSearchIndex, error) {
+	db, err := openSQLite(c.SQLitePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrateSQLite(db, "search", sqliteSearchMigrations); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error migrating search index: %w", err)
+	}
+
+	return &SQLiteSearchIndex{
+		db: db,
+	}, nil
+}
+
+type SQLiteSearchIndex struct {
+	db *sql.DB
+}
+
+func (i *SQLiteSearchIndex) IndexNote(tenantID string, note *Note) error {
+	tagNames := make([]string, 0, len(note.Tags))
+	for _, tag := range note.Tags {
+		if tag != nil {
+			tagNames = append(tagNames, tag.Name)
+		}
+	}
+
+	tx, err := i.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM note_search WHERE rowid = ?`, note.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO note_search (rowid, tenant_id, title, content, tags)
+		VALUES (?, ?, ?, ?, ?)`,
+		note.ID, tenantID, note.Title, note.Content, strings.Join(tagNames, " "),
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (i *SQLiteSearchIndex) RemoveNote(tenantID string, id uint64) error {
+	res, err := i.db.Exec(
+		`DELETE FROM note_search WHERE rowid = ? AND tenant_id = ?`,
+		id, tenantID,
+	)
+	if err != nil {
+		return fmt.Errorf("error removing document: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return errNotIndexed
+	}
+
+	return nil
+}
+
+func (i *SQLiteSearchIndex) Search(tenantID string, r SearchRequest) (*SearchResult, error) {
+	res := &SearchResult{Hits: make([]*SearchHit, 0)}
+	expr, err := parseSearchQuery(r.Query)
+	if err != nil {
+		return nil, err
+	}
+	match, err := ftsMatchExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	if match == "" {
+		return res, nil
+	}
+
+	err = i.db.QueryRow(
+		`SELECT count(*) FROM note_search WHERE note_search MATCH ? AND tenant_id = ?`,
+		match, tenantID,
+	).Scan(&res.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	// Matches are marked with control characters, which cannot be confused
+	// with the note's text, until the text has been escaped.
+	rows, err := i.db.Query(
+		`SELECT rowid, -rank,
+			highlight(note_search, 1, char(2), char(3)),
+			snippet(note_search, 2, char(2), char(3), '…', 32)
+		FROM note_search
+		WHERE note_search MATCH ? AND tenant_id = ?
+		ORDER BY rank
+		LIMIT ? OFFSET ?`,
+		match, tenantID, r.size(), r.From,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var title, content string
+		hit := &SearchHit{}
+		if err := rows.Scan(&hit.NoteID, &hit.Score, &title, &content); err != nil {
+			return nil, err
+		}
+		for field, frag := range map[string]string{"title": title, "content": content} {
+			if !strings.ContainsRune(frag, '\x02') {
+				continue
+			}
+			if hit.Highlights == nil {
+				hit.Highlights = make(map[string][]string)
+			}
+			hit.Highlights[field] = []string{ftsHighlightReplacer.Replace(html.EscapeString(frag))}
+		}
+		res.Hits = append(res.Hits, hit)
+	}
+
+	return res, rows.Err()
+}
+
+var ftsHighlightReplacer = strings.NewReplacer("\x02", "<mark>", "\x03", "</mark>")
+
+func (i *SQLiteSearchIndex) Suggest(tenantID, prefix string, limit int) (*Suggestions, error) {
+	s := &Suggestions{
+		Titles: make([]*TitleSuggestion, 0),
+		Tags:   make([]*TagSuggestion, 0),
+	}
+	words := suggestWords(prefix)
+	if len(words) == 0 || limit <= 0 {
+		return s, nil
+	}
+	for j, word := range words {
+		words[j] = ftsQuote(word) + "*"
+	}
+
+	rows, err := i.db.Query(
+		`SELECT rowid, title, -rank
+		FROM note_search
+		WHERE note_search MATCH ? AND tenant_id = ?
+		ORDER BY rank
+		LIMIT ?`,
+		"title : "+ftsGroup(words, " AND "), tenantID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		title := &TitleSuggestion{}
+		if err := rows.Scan(&title.NoteID, &title.Title, &title.Score); err != nil {
+			return nil, err
+		}
+		s.Titles = append(s.Titles, title)
+	}
+
+	return s, rows.Err()
+}
+
+// Related finds the notes that share any of the note's tags or longest words,
+// which FTS5 ranks by how rare they are.
+func (i *SQLiteSearchIndex) Related(tenantID string, note *Note, limit int) (*SearchResult, error) {
+	res := &SearchResult{Hits: make([]*SearchHit, 0)}
+
+	seen := make(map[string]bool)
+	var words []string
+	for _, word := range suggestWords(note.Title + " " + note.Content) {
+		if !seen[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+	sort.SliceStable(words, func(a, b int) bool {
+		return len(words[a]) > len(words[b])
+	})
+	if len(words) > maxRelatedTerms {
+		words = words[:maxRelatedTerms]
+	}
+	var matches []string
+	for _, word := range words {
+		matches = append(matches, ftsQuote(word))
+	}
+	for _, tag := range note.Tags {
+		if tag != nil {
+			matches = append(matches, "tags : "+ftsQuote(tag.Name))
+		}
+	}
+	if len(matches) == 0 || limit <= 0 {
+		return res, nil
+	}
+	match := strings.Join(matches, " OR ")
+
+	err := i.db.QueryRow(
+		`SELECT count(*) FROM note_search
+		WHERE note_search MATCH ? AND tenant_id = ? AND rowid != ?`,
+		match, tenantID, note.ID,
+	).Scan(&res.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := i.db.Query(
+		`SELECT rowid, -rank
+		FROM note_search
+		WHERE note_search MATCH ? AND tenant_id = ? AND rowid != ?
+		ORDER BY rank
+		LIMIT ?`,
+		match, tenantID, note.ID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		hit := &SearchHit{}
+		if err := rows.Scan(&hit.NoteID, &hit.Score); err != nil {
+			return nil, err
+		}
+		res.Hits = append(res.Hits, hit)
+	}
+
+	return res, rows.Err()
+}
+
+func (i *SQLiteSearchIndex) Close() error {
+	return i.db.Close()
+}
+
+// ftsMatchExpr compiles a parsed search query into an FTS5 expression that
+// mirrors the Bleve query, with two differences: tags are matched as words
+// rather than exactly, and dates cannot be searched, as the index does not
+// hold them. Each word is quoted so that user input can never be interpreted
+// as FTS5 query syntax. An empty expression matches nothing.
+func ftsMatchExpr(expr searchExpr) (string, error) {
+	switch e := expr.(type) {
+	case nil:
+		return "", nil
+	case termExpr:
+		column := map[string]string{"title": "title", "content": "content", "tag": "tags"}[e.field]
+		var match string
+		if e.phrase || e.field == "tag" {
+			match = ftsQuote(e.text)
+		} else {
+			words := strings.FieldsFunc(e.text, func(r rune) bool {
+				return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+			})
+			for i, word := range words {
+				words[i] = ftsQuote(word)
+			}
+			match = ftsGroup(words, " AND ")
+		}
+		if match == "" || column == "" {
+			return match, nil
+		}
+		return column + " : " + match, nil
+	case timeRangeExpr:
+		return "", invalidQuery("the sqlite search index cannot search by date")
+	case notExpr:
+		return ftsMatchExpr(andExpr{e})
+	case andExpr:
+		var include, exclude []string
+		for _, expr := range e {
+			not, negated := expr.(notExpr)
+			if negated {
+				expr = not.expr
+			}
+			match, err := ftsMatchExpr(expr)
+			if err != nil {
+				return "", err
+			}
+			switch {
+			case negated && match != "":
+				exclude = append(exclude, match)
+			case !negated && match == "":
+				return "", nil
+			case !negated:
+				include = append(include, match)
+			}
+		}
+		if len(include) == 0 {
+			return "", invalidQuery("the sqlite search index needs a term that is not negated")
+		}
+		match := ftsGroup(include, " AND ")
+		for _, not := range exclude {
+			match = "(" + match + ") NOT (" + not + ")"
+		}
+		return match, nil
+	case orExpr:
+		var matches []string
+		for _, expr := range e {
+			match, err := ftsMatchExpr(expr)
+			if err != nil {
+				return "", err
+			}
+			if match != "" {
+				matches = append(matches, match)
+			}
+		}
+		return ftsGroup(matches, " OR "), nil
+	}
+	panic(fmt.Sprintf("unexpected search expression %T", expr))
+}
+
+func ftsQuote(text string) string {
+	return `"` + strings.ReplaceAll(text, `"`, `""`) + `"`
+}
+
+// ftsGroup joins expressions with an operator, in parentheses if there is
+// more than one.
+func ftsGroup(exprs []string, op string) string {
+	if len(exprs) < 2 {
+		return strings.Join(exprs, op)
+	}
+	return "(" + strings.Join(exprs, op) + ")"
+}
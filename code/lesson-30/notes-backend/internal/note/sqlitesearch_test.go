@@ -0,0 +1,103 @@
+package note
+
+import (
+	"errors"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteSearchResults(t *testing.T) {
+	idx, err := NewSQLiteSearchIndex(SearchIndexConfig{
+		SQLitePath: path.Join(t.TempDir(), "search.db"),
+	})
+	require.NoError(t, err)
+	defer idx.Close()
+
+	testSearchResults(t, idx)
+}
+
+func TestSQLiteSearchQueryLanguage(t *testing.T) {
+	idx, err := NewSQLiteSearchIndex(SearchIndexConfig{
+		SQLitePath: path.Join(t.TempDir(), "search.db"),
+	})
+	require.NoError(t, err)
+	defer idx.Close()
+
+	for _, n := range queryLanguageNotes() {
+		require.NoError(t, idx.IndexNote("tenant1", n))
+	}
+
+	tests := []struct {
+		query string
+		want  []uint64
+	}{
+		{"tag:work title:meeting -draft", []uint64{1}},
+		{"meeting", []uint64{1, 2, 3}},
+		{"weekly meeting", []uint64{1}},
+		{"title:meeting", []uint64{1, 2}},
+		{"title:weekly-meeting", []uint64{1}},
+		{"content:agenda", []uint64{1, 2}},
+		{`"weekly meeting"`, []uint64{1}},
+		{`"meeting weekly"`, []uint64{}},
+		// Tags are matched as words.
+		{"tag:work", []uint64{1, 2, 4}},
+		{`tag:"work stuff"`, []uint64{4}},
+		{"meeting -draft", []uint64{1, 3}},
+		{"meeting NOT title:meeting", []uint64{3}},
+		{"eggs OR tacos", []uint64{3, 4}},
+		{"(eggs OR tacos) -tacos", []uint64{3}},
+		{"title:(weekly", nil},
+	}
+	for _, tt := range tests {
+		res, err := idx.Search("tenant1", SearchRequest{Query: tt.query, Size: 10})
+		if tt.want == nil {
+			assert.True(t, errors.Is(err, ErrInvalidQuery), "query %q: got %v", tt.query, err)
+			continue
+		}
+		if assert.NoError(t, err, "query %q", tt.query) {
+			assert.ElementsMatch(t, tt.want, res.IDs(), "query %q", tt.query)
+		}
+	}
+
+	for _, query := range []string{"updated:>2024-01-01", "-draft"} {
+		_, err := idx.Search("tenant1", SearchRequest{Query: query})
+		assert.True(t, errors.Is(err, ErrInvalidQuery), "should reject %q, got %v", query, err)
+	}
+}
+
+func TestSQLiteSuggest(t *testing.T) {
+	idx, err := NewSQLiteSearchIndex(SearchIndexConfig{
+		SQLitePath: path.Join(t.TempDir(), "search.db"),
+	})
+	require.NoError(t, err)
+	defer idx.Close()
+
+	require.NoError(t, idx.IndexNote("tenant1", &Note{ID: 1, Title: "Weekly meeting"}))
+	require.NoError(t, idx.IndexNote("tenant1", &Note{ID: 2, Title: "Tacos", Content: "Meet at noon"}))
+	require.NoError(t, idx.IndexNote("tenant2", &Note{ID: 3, Title: "Meeting with tenant2"}))
+
+	s, err := idx.Suggest("tenant1", "wee Me", 10)
+	require.NoError(t, err)
+	if assert.Len(t, s.Titles, 1) {
+		assert.Equal(t, uint64(1), s.Titles[0].NoteID)
+		assert.Equal(t, "Weekly meeting", s.Titles[0].Title)
+	}
+	assert.Empty(t, s.Tags, "should not suggest tags")
+
+	s, err = idx.Suggest("tenant1", `"`, 10)
+	require.NoError(t, err)
+	assert.Empty(t, s.Titles)
+}
+
+func TestSQLiteRelated(t *testing.T) {
+	idx, err := NewSQLiteSearchIndex(SearchIndexConfig{
+		SQLitePath: path.Join(t.TempDir(), "search.db"),
+	})
+	require.NoError(t, err)
+	defer idx.Close()
+
+	testRelated(t, idx)
+}
@@ -0,0 +1,134 @@
+package note
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// TenantStatus says whether a tenant may use its token.
+type TenantStatus string
+
+const (
+	TenantActive    TenantStatus = "active"
+	TenantSuspended TenantStatus = "suspended"
+	// TenantDeleted is final: a deleted tenant cannot be reinstated.
+	TenantDeleted TenantStatus = "deleted"
+)
+
+func (s TenantStatus) valid() bool {
+	return s == TenantActive || s == TenantSuspended || s == TenantDeleted
+}
+
+// Tenant is the registry's record of a tenant, whose notes and tags are kept
+// apart from every other tenant's.
+type Tenant struct {
+	ID        string       `json:"id"`
+	Name      string       `json:"name"`
+	Status    TenantStatus `json:"status"`
+	CreatedAt time.Time    `json:"createdAt"`
+}
+
+func (t *Tenant) MustMarshal() []byte {
+	bs, err := json.Marshal(t)
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+func (t *Tenant) Unmarshal(bs []byte) error {
+	if t == nil {
+		return nil
+	}
+	return json.Unmarshal(bs, t)
+}
+
+// ErrTenantInactive is matched by the errors returned when a tenant that is
+// suspended or deleted tries to use its token.
+var ErrTenantInactive = errors.New("tenant is not active")
+
+// ErrTenantDeleted is matched by the errors returned when the status of a
+// deleted tenant would be changed.
+var ErrTenantDeleted = errors.New("tenant is deleted")
+
+func tenantNotFound(id string) error {
+	return fmt.Errorf("tenant %q %w", id, ErrNotFound)
+}
+
+func tenantExists(id string) error {
+	return &AlreadyExistsError{Entity: "tenant", Name: id}
+}
+
+// newTenant fills in the creation time and status of a tenant that is about
+// to be registered.
+func newTenant(t *Tenant) error {
+	if t.ID == "" {
+		return errors.New("tenant ID must not be empty")
+	}
+	if t.CreatedAt.IsZero() {
+		t.CreatedAt = time.Now()
+	}
+	if t.Status == "" {
+		t.Status = TenantActive
+	}
+	if !t.Status.valid() {
+		return fmt.Errorf("invalid tenant status %q", t.Status)
+	}
+	return nil
+}
+
+// TenantQuery selects a page of tenants in ID order, optionally only those
+// with the given status. A Limit of 0 returns every remaining tenant.
+type TenantQuery struct {
+	Status TenantStatus
+	Limit  int
+	Cursor string
+}
+
+// TenantPage is a page of tenants. Next is empty on the last page.
+type TenantPage struct {
+	Tenants []*Tenant
+	Next    string
+}
+
+// after validates the query and returns the ID of the last tenant of the
+// previous page, or "".
+func (q *TenantQuery) after() (string, error) {
+	if q.Limit < 0 {
+		return "", invalidQuery("limit must not be negative")
+	}
+	if q.Status != "" && !q.Status.valid() {
+		return "", invalidQuery("unknown status %q", q.Status)
+	}
+	if q.Cursor == "" {
+		return "", nil
+	}
+
+	var id string
+	bs, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err == nil {
+		err = json.Unmarshal(bs, &id)
+	}
+	if err != nil {
+		return "", invalidQuery("malformed cursor")
+	}
+	return id, nil
+}
+
+func (q *TenantQuery) matches(t *Tenant) bool {
+	return q.Status == "" || t.Status == q.Status
+}
+
+// page cuts tenants, which may hold one more than the limit, down to a page.
+func (q *TenantQuery) page(tenants []*Tenant) *TenantPage {
+	page := &TenantPage{Tenants: tenants}
+	if q.Limit > 0 && len(tenants) > q.Limit {
+		page.Tenants = tenants[:q.Limit]
+		bs, _ := json.Marshal(page.Tenants[q.Limit-1].ID)
+		page.Next = base64.RawURLEncoding.EncodeToString(bs)
+	}
+	return page
+}
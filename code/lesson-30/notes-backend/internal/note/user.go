@@ -0,0 +1,178 @@
+package note
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Role says what a user may do within their tenant.
+type Role string
+
+const (
+	// RoleOwner manages the tenant's users, besides what editors do.
+	RoleOwner Role = "owner"
+	// RoleEditor changes notes and tags.
+	RoleEditor Role = "editor"
+	// RoleViewer only reads notes and tags.
+	RoleViewer Role = "viewer"
+)
+
+func (r Role) valid() bool {
+	return r == RoleOwner || r == RoleEditor || r == RoleViewer
+}
+
+// User is an account that signs in to a tenant with an email and password.
+// A tenant may have any number of users, but an email belongs to one user.
+type User struct {
+	ID       string `json:"id"`
+	TenantID string `json:"tenantId"`
+	Email    string `json:"email"`
+	Role     Role   `json:"role"`
+	// PasswordHash is the bcrypt hash of the user's password. It is stored
+	// but never sent to clients.
+	PasswordHash []byte    `json:"-"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// storedUser is the stored form of a user, which includes the password hash.
+type storedUser struct {
+	*userFields
+	PasswordHash []byte `json:"passwordHash"`
+}
+
+type userFields User
+
+func (u *User) MustMarshal() []byte {
+	bs, err := json.Marshal(storedUser{(*userFields)(u), u.PasswordHash})
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+func (u *User) Unmarshal(bs []byte) error {
+	if u == nil {
+		return nil
+	}
+	stored := storedUser{userFields: (*userFields)(u)}
+	if err := json.Unmarshal(bs, &stored); err != nil {
+		return err
+	}
+	u.PasswordHash = stored.PasswordHash
+	// Users stored before roles existed could do anything.
+	if u.Role == "" {
+		u.Role = RoleOwner
+	}
+	return nil
+}
+
+// Session is a user's sign-in, which lasts until it expires or is ended. Its
+// ID is the hash of the refresh token that renews it, so that a stolen
+// database does not hold tokens that can be used.
+type Session struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"userId"`
+	TenantID  string    `json:"tenantId"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func (s *Session) MustMarshal() []byte {
+	bs, err := json.Marshal(s)
+	if err != nil {
+		panic(err)
+	}
+	return bs
+}
+
+func (s *Session) Unmarshal(bs []byte) error {
+	if s == nil {
+		return nil
+	}
+	return json.Unmarshal(bs, s)
+}
+
+// ErrInvalidUser is matched by the errors returned when a user is created
+// with a malformed email, a password that is too short or an unknown role.
+var ErrInvalidUser = errors.New("invalid user")
+
+// ErrLastOwner is matched by the errors returned when the only owner of a
+// tenant would be removed or given another role.
+var ErrLastOwner = errors.New("tenant must keep an owner")
+
+// ErrInvalidCredentials is matched by the errors returned when an email and
+// password or a refresh token do not sign in a user.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// minPasswordLength is the length in bytes of the shortest password accepted.
+const minPasswordLength = 8
+
+func invalidUser(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidUser, fmt.Sprintf(format, args...))
+}
+
+func userNotFound(id string) error {
+	return fmt.Errorf("user %q %w", id, ErrNotFound)
+}
+
+func emailExists(email string) error {
+	return &AlreadyExistsError{Entity: "user with email", Name: email}
+}
+
+func sessionNotFound() error {
+	return fmt.Errorf("session %w", ErrNotFound)
+}
+
+// normalizeEmail makes emails that differ only in case or surrounding space
+// the same.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// newUser checks a user that is about to be stored and fills in its creation
+// time and role, which is viewer unless it is given.
+func newUser(u *User) error {
+	if u.ID == "" || u.TenantID == "" {
+		return errors.New("user ID and tenant ID must not be empty")
+	}
+	if len(u.PasswordHash) == 0 {
+		return errors.New("user must have a password")
+	}
+	if u.Role == "" {
+		u.Role = RoleViewer
+	}
+	if !u.Role.valid() {
+		return invalidUser("unknown role %q", u.Role)
+	}
+	u.Email = normalizeEmail(u.Email)
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = time.Now()
+	}
+	return nil
+}
+
+// dummyHash is compared against when a user signs in with an unknown email,
+// so that the response takes as long as it would for a wrong password. It is
+// a bcrypt hash of a password that no one uses, at the default cost.
+var dummyHash = []byte("$2a$10$Kap1NQ7ZRrt5ksSEGG27/e/eD0Fewe039l5uOCIGTij5ffz1QHRi.")
+
+// hashToken returns what is stored in place of a secret token, such as a
+// refresh token or an API key.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomID(n int) (string, error) {
+	bs := make([]byte, n)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bs), nil
+}
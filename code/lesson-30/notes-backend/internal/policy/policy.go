@@ -0,0 +1,117 @@
+// Package policy decides what the members of a tenant may do, so that the
+// rules live in one place rather than in each handler. The transport asks a
+// Policy before it serves a request, and a different Policy can be plugged in
+// without touching the handlers.
+package policy
+
+import (
+	"errors"
+	"fmt"
+
+	"learn-cljs.com/notes/internal/note"
+)
+
+// Action is something a request does to a tenant's data.
+type Action string
+
+const (
+	ReadNotes     Action = "notes:read"
+	WriteNotes    Action = "notes:write"
+	ReadTags      Action = "tags:read"
+	WriteTags     Action = "tags:write"
+	ReadMembers   Action = "members:read"
+	ManageMembers Action = "members:manage"
+	ManageKeys    Action = "keys:manage"
+)
+
+// Principal is who a request is made by.
+type Principal struct {
+	TenantID string
+	// UserID is empty for requests made with a tenant token, which act as
+	// an owner of the tenant.
+	UserID string
+	Role   note.Role
+	// Scopes, if not nil, further limits the actions of the principal to
+	// those it lists, whatever its role allows. It is set for requests made
+	// with an API key.
+	Scopes []Action
+}
+
+// inScope reports whether p's scopes allow action.
+func (p *Principal) inScope(action Action) bool {
+	if p.Scopes == nil {
+		return true
+	}
+	for _, scoped := range p.Scopes {
+		if scoped == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy authorizes the actions of principals.
+type Policy interface {
+	// Authorize returns an error matching ErrDenied if p may not perform
+	// action.
+	Authorize(p *Principal, action Action) error
+}
+
+// ErrDenied is matched by the errors returned when a principal may not
+// perform an action.
+var ErrDenied = errors.New("permission denied")
+
+// Roles is a Policy that grants each role a fixed set of actions.
+type Roles map[note.Role][]Action
+
+func (r Roles) Authorize(p *Principal, action Action) error {
+	if !p.inScope(action) {
+		return fmt.Errorf("%w: %s is out of scope", ErrDenied, action)
+	}
+	for _, granted := range r[p.Role] {
+		if granted == action {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: role %q may not %s", ErrDenied, p.Role, action)
+}
+
+// Default lets viewers read, editors also change notes and tags, and owners
+// also manage the tenant's members and API keys.
+var Default = Roles{
+	note.RoleOwner: {
+		ReadNotes, WriteNotes, ReadTags, WriteTags, ReadMembers, ManageMembers, ManageKeys,
+	},
+	note.RoleEditor: {
+		ReadNotes, WriteNotes, ReadTags, WriteTags, ReadMembers,
+	},
+	note.RoleViewer: {
+		ReadNotes, ReadTags, ReadMembers,
+	},
+}
+
+// Scopes maps each scope an API key may be issued with to the actions it
+// allows. Tags are read along with notes, so reading notes also allows
+// reading tags.
+var Scopes = map[string][]Action{
+	string(ReadNotes):  {ReadNotes, ReadTags},
+	string(WriteNotes): {WriteNotes},
+	string(WriteTags):  {WriteTags},
+}
+
+// ErrUnknownScope is matched by the errors returned for scopes missing from
+// Scopes.
+var ErrUnknownScope = errors.New("unknown scope")
+
+// ScopedActions returns the actions allowed by scopes, which are never nil.
+func ScopedActions(scopes []string) ([]Action, error) {
+	actions := []Action{}
+	for _, scope := range scopes {
+		allowed, ok := Scopes[scope]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownScope, scope)
+		}
+		actions = append(actions, allowed...)
+	}
+	return actions, nil
+}
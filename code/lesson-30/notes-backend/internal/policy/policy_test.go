@@ -0,0 +1,53 @@
+package policy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"learn-cljs.com/notes/internal/note"
+)
+
+func TestDefault(t *testing.T) {
+	tests := []struct {
+		role    note.Role
+		allowed []Action
+		denied  []Action
+	}{
+		{note.RoleOwner, []Action{ReadNotes, WriteNotes, WriteTags, ManageMembers, ManageKeys}, nil},
+		{note.RoleEditor, []Action{ReadNotes, WriteNotes, ReadTags, WriteTags, ReadMembers}, []Action{ManageMembers, ManageKeys}},
+		{note.RoleViewer, []Action{ReadNotes, ReadTags, ReadMembers}, []Action{WriteNotes, WriteTags, ManageMembers}},
+		{"", nil, []Action{ReadNotes}},
+	}
+	for _, tt := range tests {
+		p := &Principal{TenantID: "tenant", UserID: "user", Role: tt.role}
+		for _, action := range tt.allowed {
+			assert.NoError(t, Default.Authorize(p, action), "%s should be allowed to %s", tt.role, action)
+		}
+		for _, action := range tt.denied {
+			err := Default.Authorize(p, action)
+			assert.True(t, errors.Is(err, ErrDenied), "%s should not be allowed to %s", tt.role, action)
+		}
+	}
+}
+
+func TestScopes(t *testing.T) {
+	actions, err := ScopedActions([]string{"notes:read", "tags:write"})
+	assert.NoError(t, err)
+	p := &Principal{TenantID: "tenant", Role: note.RoleOwner, Scopes: actions}
+	for _, action := range []Action{ReadNotes, ReadTags, WriteTags} {
+		assert.NoError(t, Default.Authorize(p, action), "scopes should allow %s", action)
+	}
+	for _, action := range []Action{WriteNotes, ReadMembers, ManageKeys} {
+		err := Default.Authorize(p, action)
+		assert.True(t, errors.Is(err, ErrDenied), "scopes should not allow %s", action)
+	}
+
+	actions, err = ScopedActions(nil)
+	assert.NoError(t, err)
+	p.Scopes = actions
+	assert.True(t, errors.Is(Default.Authorize(p, ReadNotes), ErrDenied), "no scopes should allow nothing")
+
+	_, err = ScopedActions([]string{"members:manage"})
+	assert.True(t, errors.Is(err, ErrUnknownScope))
+}
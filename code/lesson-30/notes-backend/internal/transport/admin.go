@@ -0,0 +1,112 @@
+package transport
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"learn-cljs.com/notes/internal/note"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+// adminCtx only lets through requests that carry the admin token.
+func (s *HTTPServer) adminCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader := r.Header.Get("Authorization")
+		token := []byte(strings.TrimPrefix(authHeader, "Bearer "))
+		if !strings.HasPrefix(authHeader, "Bearer ") ||
+			subtle.ConstantTimeCompare(token, s.config.AdminToken) != 1 {
+			render.Render(w, r, errForbidden(errors.New("admin token required")))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// registeredTenantCtx adds the tenant named by the tenantID route param to
+// the context. Unlike tenantCtx, it takes the tenant's ID rather than its
+// token, and admits tenants of any status.
+func (s *HTTPServer) registeredTenantCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := s.notes.FindTenant(chi.URLParam(r, "tenantID"))
+		if err != nil {
+			render.Render(w, r, errServerError(
+				fmt.Errorf("error loading tenant: %w", err),
+			))
+			return
+		}
+		if tenant == nil {
+			render.Render(w, r, errNotFound)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "tenant", tenant)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// handleListTenants lists a page of registered tenants, optionally only
+// those with the status given by the status query param.
+func (s *HTTPServer) handleListTenants(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseLimit(r.URL.Query())
+	if err != nil {
+		render.Render(w, r, errInvalidRequest(err))
+		return
+	}
+
+	page, err := s.notes.FindTenants(note.TenantQuery{
+		Status: note.TenantStatus(r.URL.Query().Get("status")),
+		Limit:  limit,
+		Cursor: r.URL.Query().Get("cursor"),
+	})
+	if err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+	setNextLink(w, r, page.Next)
+	if err := json.NewEncoder(w).Encode(page.Tenants); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+}
+
+func (s *HTTPServer) getTenant(w http.ResponseWriter, r *http.Request) {
+	tenant := r.Context().Value("tenant").(*note.Tenant)
+	if err := json.NewEncoder(w).Encode(tenant); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+}
+
+func (s *HTTPServer) suspendTenant(w http.ResponseWriter, r *http.Request) {
+	s.setTenantStatus(w, r, note.TenantSuspended)
+}
+
+func (s *HTTPServer) reinstateTenant(w http.ResponseWriter, r *http.Request) {
+	s.setTenantStatus(w, r, note.TenantActive)
+}
+
+// deleteTenant marks a tenant as deleted, which stops it from using its
+// token for good. Its notes and tags are kept.
+func (s *HTTPServer) deleteTenant(w http.ResponseWriter, r *http.Request) {
+	s.setTenantStatus(w, r, note.TenantDeleted)
+}
+
+func (s *HTTPServer) setTenantStatus(w http.ResponseWriter, r *http.Request, status note.TenantStatus) {
+	tenant := r.Context().Value("tenant").(*note.Tenant)
+	tenant, err := s.notes.SetTenantStatus(tenant.ID, status)
+	if err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+	if err := json.NewEncoder(w).Encode(tenant); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+}
@@ -0,0 +1,122 @@
+package transport
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"learn-cljs.com/notes/internal/note"
+)
+
+func TestAdminToken(t *testing.T) {
+	s := newTestServer(t)
+	ownerToken, owner := createAccount(t, s, "owner@example.com")
+	tenantPath := "/admin/tenants/" + owner.TenantID
+
+	for _, path := range []string{"/admin/tenants", tenantPath, "/admin/search/queue"} {
+		assertError(t, do(t, s, http.MethodGet, path, "", nil), http.StatusForbidden, path+" without a token")
+		assertError(t, do(t, s, http.MethodGet, path, "not the admin token", nil), http.StatusForbidden, path+" with a wrong token")
+		assertError(t, do(t, s, http.MethodGet, path, ownerToken, nil), http.StatusForbidden, path+" with an owner's token")
+		assertSuccess(t, do(t, s, http.MethodGet, path, testAdminToken, nil), path+" with the admin token")
+	}
+	for _, path := range []string{"/suspend", "/reinstate"} {
+		assertError(t, do(t, s, http.MethodPost, tenantPath+path, ownerToken, nil), http.StatusForbidden, path+" with an owner's token")
+	}
+	assertError(t, do(t, s, http.MethodDelete, tenantPath, ownerToken, nil), http.StatusForbidden, "delete with an owner's token")
+	assertSuccess(t, do(t, s, http.MethodGet, "/notes", ownerToken, nil), "tenant should stay active")
+}
+
+func TestAdminDisabled(t *testing.T) {
+	idx := note.NewMemorySearchIndex()
+	repo := note.NewInMemoryRepo(note.RepositoryConfig{}, idx)
+	t.Cleanup(func() { repo.Close() })
+	s := NewHTTPServer(Config{
+		Context:       context.Background(),
+		NoteService:   note.NewService(repo, idx),
+		SigningSecret: []byte("signing secret"),
+		Auth:          AuthConfig{AccessTokenTTL: time.Hour, RefreshTokenTTL: time.Hour},
+	})
+
+	// An empty bearer token would match an empty admin token.
+	req := httptest.NewRequest(http.MethodGet, "/admin/tenants", http.NoBody)
+	req.Header.Set("Authorization", "Bearer ")
+	rec := httptest.NewRecorder()
+	s.Handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "should not serve admin routes without an admin token: %s", rec.Body)
+}
+
+func TestAdminTenants(t *testing.T) {
+	s := newTestServer(t)
+	ownerToken, owner := createAccount(t, s, "owner@example.com")
+	_, other := createAccount(t, s, "other@example.com")
+	tenantPath := "/admin/tenants/" + owner.TenantID
+
+	listTenants := func(query string) []*note.Tenant {
+		rec := do(t, s, http.MethodGet, "/admin/tenants"+query, testAdminToken, nil)
+		require.Equal(t, http.StatusOK, rec.Code, "list tenants: %s", rec.Body)
+		var tenants []*note.Tenant
+		decode(t, rec, &tenants)
+		return tenants
+	}
+	tenantIDs := func(tenants []*note.Tenant) []string {
+		ids := make([]string, len(tenants))
+		for i, tenant := range tenants {
+			ids[i] = tenant.ID
+		}
+		return ids
+	}
+	setStatus := func(method, path string, want note.TenantStatus) {
+		rec := do(t, s, method, path, testAdminToken, nil)
+		require.Equal(t, http.StatusOK, rec.Code, "%s %s: %s", method, path, rec.Body)
+		var tenant note.Tenant
+		decode(t, rec, &tenant)
+		assert.Equal(t, want, tenant.Status)
+	}
+
+	assert.ElementsMatch(t, []string{owner.TenantID, other.TenantID}, tenantIDs(listTenants("")))
+	assert.Len(t, listTenants("?limit=1"), 1)
+	assertError(t, do(t, s, http.MethodGet, "/admin/tenants?status=bogus", testAdminToken, nil), http.StatusBadRequest, "unknown status")
+	assertError(t, do(t, s, http.MethodGet, "/admin/tenants/unknown", testAdminToken, nil), http.StatusNotFound, "unknown tenant")
+
+	rec := do(t, s, http.MethodGet, tenantPath, testAdminToken, nil)
+	require.Equal(t, http.StatusOK, rec.Code, "get tenant: %s", rec.Body)
+	var tenant note.Tenant
+	decode(t, rec, &tenant)
+	assert.Equal(t, owner.TenantID, tenant.ID)
+	assert.Equal(t, note.TenantActive, tenant.Status)
+
+	setStatus(http.MethodPost, tenantPath+"/suspend", note.TenantSuspended)
+	assert.Equal(t, []string{owner.TenantID}, tenantIDs(listTenants("?status=suspended")))
+	assert.Equal(t, []string{other.TenantID}, tenantIDs(listTenants("?status=active")))
+	assertError(t, do(t, s, http.MethodGet, "/notes", ownerToken, nil), http.StatusForbidden, "suspended tenant")
+
+	setStatus(http.MethodPost, tenantPath+"/reinstate", note.TenantActive)
+	assertSuccess(t, do(t, s, http.MethodGet, "/notes", ownerToken, nil), "reinstated tenant")
+
+	setStatus(http.MethodDelete, tenantPath, note.TenantDeleted)
+	assert.Equal(t, []string{owner.TenantID}, tenantIDs(listTenants("?status=deleted")))
+	assertError(t, do(t, s, http.MethodGet, "/notes", ownerToken, nil), http.StatusForbidden, "deleted tenant")
+	assertError(t, do(t, s, http.MethodPost, tenantPath+"/reinstate", testAdminToken, nil), http.StatusConflict, "reinstate deleted tenant")
+	assertError(t, do(t, s, http.MethodPost, tenantPath+"/suspend", testAdminToken, nil), http.StatusConflict, "suspend deleted tenant")
+}
+
+func TestAdminIndexQueue(t *testing.T) {
+	s := newTestServer(t)
+	ownerToken, _ := createAccount(t, s, "owner@example.com")
+
+	rec := do(t, s, http.MethodGet, "/admin/search/queue", testAdminToken, nil)
+	require.Equal(t, http.StatusOK, rec.Code, "index queue: %s", rec.Body)
+	var res map[string]int
+	decode(t, rec, &res)
+	assert.Contains(t, res, "depth")
+
+	assertError(t, do(t, s, http.MethodGet, "/admin/search/queue", ownerToken, nil), http.StatusForbidden, "owner reads the index queue")
+	rec = do(t, s, http.MethodGet, "/search/queue", ownerToken, nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "should only serve the index queue to admins: %s", rec.Body)
+	rec = do(t, s, http.MethodGet, "/search/queue", testAdminToken, nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "should only serve the index queue under /admin: %s", rec.Body)
+}
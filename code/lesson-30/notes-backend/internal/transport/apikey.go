@@ -0,0 +1,116 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"learn-cljs.com/notes/internal/note"
+	"learn-cljs.com/notes/internal/policy"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+// apiKeyPrincipal returns the principal of a request made with an API key,
+// which acts as an owner of its tenant within the key's scopes.
+func apiKeyPrincipal(key *note.APIKey) (*policy.Principal, error) {
+	scopes, err := policy.ScopedActions(key.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	return &policy.Principal{TenantID: key.TenantID, Role: note.RoleOwner, Scopes: scopes}, nil
+}
+
+// handleListAPIKeys lists the API keys of the tenant that made the request,
+// without their tokens.
+func (s *HTTPServer) handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value("tenantID").(string)
+	keys, err := s.notes.FindAPIKeys(tenantID)
+	if err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+	if err := json.NewEncoder(w).Encode(keys); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+}
+
+// handleCreateAPIKey issues an API key with the name, scopes and optional
+// expiry in the body. The response is the only one that holds the key's
+// token.
+func (s *HTTPServer) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expiresAt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		render.Render(w, r, errInvalidRequest(err))
+		return
+	}
+	if _, err := policy.ScopedActions(req.Scopes); err != nil {
+		render.Render(w, r, errInvalidRequest(err))
+		return
+	}
+
+	tenantID := r.Context().Value("tenantID").(string)
+	token, key, err := s.notes.IssueAPIKey(tenantID, req.Name, req.Scopes, req.ExpiresAt)
+	if err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(struct {
+		*note.APIKey
+		Token string `json:"token"`
+	}{key, token})
+	if err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+}
+
+// apiKeyCtx adds the API key named by the keyID route param to the context,
+// if it belongs to the tenant that made the request.
+func (s *HTTPServer) apiKeyCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, err := s.notes.FindAPIKey(chi.URLParam(r, "keyID"))
+		if err != nil {
+			render.Render(w, r, errServerError(
+				fmt.Errorf("error loading API key: %w", err),
+			))
+			return
+		}
+		tenantID := r.Context().Value("tenantID").(string)
+		if key == nil || key.TenantID != tenantID {
+			render.Render(w, r, errNotFound)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "apiKey", key)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (s *HTTPServer) getAPIKey(w http.ResponseWriter, r *http.Request) {
+	key := r.Context().Value("apiKey").(*note.APIKey)
+	if err := json.NewEncoder(w).Encode(key); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+}
+
+// revokeAPIKey deletes an API key, which stops working at once.
+func (s *HTTPServer) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	key := r.Context().Value("apiKey").(*note.APIKey)
+	if err := s.notes.DeleteAPIKey(key.ID); err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
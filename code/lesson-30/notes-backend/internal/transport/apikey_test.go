@@ -0,0 +1,109 @@
+package transport
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"learn-cljs.com/notes/internal/note"
+)
+
+type issuedKey struct {
+	note.APIKey
+	Token string `json:"token"`
+}
+
+func issueKey(t *testing.T, s *HTTPServer, ownerToken, name string, scopes ...string) *issuedKey {
+	rec := do(t, s, http.MethodPost, "/api-keys", ownerToken, map[string]interface{}{
+		"name": name, "scopes": scopes,
+	})
+	require.Equal(t, http.StatusCreated, rec.Code, "issue key: %s", rec.Body)
+	key := new(issuedKey)
+	decode(t, rec, key)
+	return key
+}
+
+func findKey(t *testing.T, s *HTTPServer, ownerToken, id string) *note.APIKey {
+	rec := do(t, s, http.MethodGet, "/api-keys/"+id, ownerToken, nil)
+	require.Equal(t, http.StatusOK, rec.Code, "find key: %s", rec.Body)
+	key := new(note.APIKey)
+	decode(t, rec, key)
+	return key
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	s := newTestServer(t)
+	ownerToken, _ := createAccount(t, s, "owner@example.com")
+	editorToken, _ := addMember(t, s, ownerToken, "editor@example.com", note.RoleEditor)
+	reader := issueKey(t, s, ownerToken, "reader", "notes:read")
+	writer := issueKey(t, s, ownerToken, "writer", "notes:write", "tags:write")
+	assert.True(t, note.IsAPIKey(reader.Token))
+
+	assertError(t, do(t, s, http.MethodPost, "/api-keys", ownerToken, map[string]interface{}{
+		"name": "admin", "scopes": []string{"members:manage"},
+	}), http.StatusBadRequest, "unknown scope")
+	assertError(t, do(t, s, http.MethodPost, "/api-keys", ownerToken, map[string]interface{}{
+		"name": "late", "scopes": []string{"notes:read"}, "expiresAt": time.Now().Add(-time.Hour),
+	}), http.StatusBadRequest, "expiry in the past")
+	assertError(t, do(t, s, http.MethodPost, "/api-keys", editorToken, map[string]interface{}{
+		"name": "mine", "scopes": []string{"notes:read"},
+	}), http.StatusForbidden, "editor issues a key")
+
+	assertSuccess(t, do(t, s, http.MethodGet, "/notes", reader.Token, nil), "reader lists notes")
+	assertSuccess(t, do(t, s, http.MethodGet, "/tags", reader.Token, nil), "reader lists tags")
+	assertError(t, do(t, s, http.MethodPost, "/notes", reader.Token, map[string]string{"title": "Mine"}),
+		http.StatusForbidden, "reader creates a note")
+	assertError(t, do(t, s, http.MethodGet, "/api-keys", reader.Token, nil), http.StatusForbidden, "reader lists keys")
+	assertError(t, do(t, s, http.MethodPost, "/api-keys", reader.Token, map[string]interface{}{
+		"name": "more", "scopes": []string{"notes:write"},
+	}), http.StatusForbidden, "reader issues a key")
+	assertError(t, do(t, s, http.MethodGet, "/users", reader.Token, nil), http.StatusForbidden, "reader lists members")
+
+	assertSuccess(t, do(t, s, http.MethodPost, "/notes", writer.Token, map[string]string{"title": "Mine"}), "writer creates a note")
+	assertSuccess(t, do(t, s, http.MethodPost, "/tags", writer.Token, map[string]string{"name": "mine"}), "writer creates a tag")
+	assertError(t, do(t, s, http.MethodGet, "/notes", writer.Token, nil), http.StatusForbidden, "writer lists notes")
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	s := newTestServer(t)
+	ownerToken, owner := createAccount(t, s, "owner@example.com")
+	otherToken, _ := createAccount(t, s, "other@example.com")
+	key := issueKey(t, s, ownerToken, "sync", "notes:read")
+
+	rec := do(t, s, http.MethodGet, "/api-keys", ownerToken, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), key.Token, "should not list tokens")
+	var keys []*note.APIKey
+	decode(t, rec, &keys)
+	require.Len(t, keys, 1)
+	assert.Equal(t, "sync", keys[0].Name)
+	assert.Nil(t, keys[0].LastUsedAt)
+
+	assertSuccess(t, do(t, s, http.MethodGet, "/notes", key.Token, nil), "use key")
+	found := findKey(t, s, ownerToken, key.ID)
+	require.NotNil(t, found.LastUsedAt, "should record when the key was used")
+	assert.WithinDuration(t, time.Now(), *found.LastUsedAt, time.Minute)
+
+	assertError(t, do(t, s, http.MethodGet, "/api-keys/"+key.ID, otherToken, nil), http.StatusNotFound, "other tenant finds key")
+	assertError(t, do(t, s, http.MethodDelete, "/api-keys/"+key.ID, otherToken, nil), http.StatusNotFound, "other tenant revokes key")
+	assertSuccess(t, do(t, s, http.MethodGet, "/notes", key.Token, nil), "key survives other tenant")
+
+	assertSuccess(t, do(t, s, http.MethodDelete, "/api-keys/"+key.ID, ownerToken, nil), "revoke key")
+	assertError(t, do(t, s, http.MethodGet, "/notes", key.Token, nil), http.StatusUnauthorized, "revoked key")
+	assertError(t, do(t, s, http.MethodGet, "/api-keys/"+key.ID, ownerToken, nil), http.StatusNotFound, "find revoked key")
+
+	// Keys cannot be issued already expired, so expire one by storing it
+	// again.
+	token, expired, err := s.notes.IssueAPIKey(owner.TenantID, "old", []string{"notes:read"}, nil)
+	require.NoError(t, err)
+	assertSuccess(t, do(t, s, http.MethodGet, "/notes", token, nil), "use key before it expires")
+	require.NoError(t, s.notes.DeleteAPIKey(expired.ID))
+	past := time.Now().Add(-time.Minute)
+	expired.ExpiresAt = &past
+	require.NoError(t, s.notes.CreateAPIKey(expired))
+	assertError(t, do(t, s, http.MethodGet, "/notes", token, nil), http.StatusUnauthorized, "expired key")
+
+	assertError(t, do(t, s, http.MethodGet, "/notes", "key_unknown", nil), http.StatusUnauthorized, "unknown key")
+}
@@ -0,0 +1,418 @@
+package transport
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"learn-cljs.com/notes/internal/note"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+// AuthConfig controls how long users stay signed in.
+type AuthConfig struct {
+	// AccessTokenTTL is how long an access token is accepted. Access tokens
+	// are not stored, so they cannot be revoked before they expire.
+	AccessTokenTTL time.Duration `mapstructure:"access-token-ttl"`
+	// RefreshTokenTTL is how long a session lasts without being refreshed.
+	RefreshTokenTTL time.Duration `mapstructure:"refresh-token-ttl"`
+}
+
+// accessClaims are what an access token says about its bearer.
+type accessClaims struct {
+	TenantID  string `json:"tid"`
+	UserID    string `json:"uid"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// errAccessTokenExpired is returned for access tokens that were valid, so
+// that clients know to refresh them.
+var errAccessTokenExpired = errors.New("access token expired")
+
+// signAccessToken returns an access token for a user, which is the ID of the
+// key that signed it, the encoded claims and their MAC, separated by dots.
+// Without a keyring, it is signed with the signing secret and the key ID is
+// empty.
+func (s *HTTPServer) signAccessToken(user *note.User, expiresAt time.Time) (string, error) {
+	bs, err := json.Marshal(accessClaims{
+		TenantID:  user.TenantID,
+		UserID:    user.ID,
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	keyID, secret := "", s.config.SigningSecret
+	if key := s.currentKey(); key != nil {
+		keyID, secret = key.ID, key.Secret
+	}
+	claims := base64.RawURLEncoding.EncodeToString(bs)
+	return keyID + "." + claims + "." + hex.EncodeToString(accessMAC(secret, claims)), nil
+}
+
+// isAccessToken tells access tokens apart from tenant tokens, which have at
+// most one dot.
+func isAccessToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// decodeAccessToken verifies an access token with the key that it names, or
+// with the signing secret if it names none, and returns its claims.
+func (s *HTTPServer) decodeAccessToken(token string) (*accessClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed access token")
+	}
+	keyID, claims := parts[0], parts[1]
+
+	secret := s.config.SigningSecret
+	if keyID != "" {
+		secret = nil
+		if s.config.Keyring != nil {
+			if key := s.config.Keyring.Find(keyID); key != nil {
+				secret = key.Secret
+			}
+		}
+	}
+	mac, err := hex.DecodeString(parts[2])
+	if len(secret) == 0 || err != nil || !hmac.Equal(accessMAC(secret, claims), mac) {
+		return nil, errors.New("invalid access token")
+	}
+
+	bs, err := base64.RawURLEncoding.DecodeString(claims)
+	if err != nil {
+		return nil, errors.New("malformed access token")
+	}
+	c := new(accessClaims)
+	if err := json.Unmarshal(bs, c); err != nil {
+		return nil, errors.New("malformed access token")
+	}
+	if !time.Now().Before(time.Unix(c.ExpiresAt, 0)) {
+		return nil, errAccessTokenExpired
+	}
+	return c, nil
+}
+
+// accessMAC signs the claims of an access token with a key derived from
+// secret, so that a MAC made for one kind of token is never valid for the
+// other. Tenant tokens keep using the secret itself, which leaves the tokens
+// already issued valid. Their MACs cover exactly 8 bytes, so they can never
+// give away the derived key.
+func accessMAC(secret []byte, claims string) []byte {
+	mac := hmac.New(sha256.New, accessKey(secret))
+	mac.Write([]byte(claims))
+	return mac.Sum(nil)
+}
+
+// accessKeyLabel names the purpose of the key that signs access tokens.
+const accessKeyLabel = "notes access token v1"
+
+func accessKey(secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(accessKeyLabel))
+	return mac.Sum(nil)
+}
+
+// currentUser returns the user who made the request, or nil if it was made
+// with a tenant token.
+func currentUser(r *http.Request) *note.User {
+	user, _ := r.Context().Value("user").(*note.User)
+	return user
+}
+
+// currentUserID returns the ID of the user who made the request, or "" if it
+// was made with a tenant token.
+func currentUserID(r *http.Request) string {
+	if user := currentUser(r); user != nil {
+		return user.ID
+	}
+	return ""
+}
+
+type credentials struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// sessionResponse is sent whenever a user signs in or refreshes their
+// session.
+type sessionResponse struct {
+	AccessToken  string     `json:"accessToken"`
+	RefreshToken string     `json:"refreshToken"`
+	TokenType    string     `json:"tokenType"`
+	ExpiresIn    int64      `json:"expiresIn"`
+	User         *note.User `json:"user"`
+}
+
+// handleCreateAccount registers a new tenant, with the display name in the
+// optional name field, whose first user and owner has the given email and
+// password, and signs the user in.
+func (s *HTTPServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		credentials
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		render.Render(w, r, errInvalidRequest(err))
+		return
+	}
+
+	// The user is registered first, so that a taken email or short password
+	// does not leave a tenant without users behind. If the tenant cannot be
+	// registered after all, the user is removed again, as otherwise the
+	// tenant would be registered as active the first time the user signed
+	// in.
+	tid, err := newTenantID()
+	if err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+	user, err := s.notes.RegisterUser(hex.EncodeToString(tid), req.Email, req.Password, note.RoleOwner)
+	if err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+	if err := s.notes.CreateTenant(&note.Tenant{ID: user.TenantID, Name: req.Name}); err != nil {
+		if err := s.notes.DeleteUser(user.ID); err != nil {
+			log.Printf("error removing user %q of unregistered tenant: %v", user.ID, err)
+		}
+		render.Render(w, r, errRepository(err))
+		return
+	}
+
+	s.startSession(w, r, http.StatusCreated, user)
+}
+
+// handleLogin signs in the user with the email and password in the body.
+func (s *HTTPServer) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var req credentials
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		render.Render(w, r, errInvalidRequest(err))
+		return
+	}
+
+	user, err := s.notes.Authenticate(req.Email, req.Password)
+	if err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+	if _, err := s.notes.ActiveTenant(user.TenantID); err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+	s.startSession(w, r, http.StatusOK, user)
+}
+
+func (s *HTTPServer) startSession(w http.ResponseWriter, r *http.Request, status int, user *note.User) {
+	refreshToken, _, err := s.notes.StartSession(user, s.config.Auth.RefreshTokenTTL)
+	if err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+	s.renderSession(w, r, status, user, refreshToken)
+}
+
+// handleRefresh exchanges the refresh token in the body for a new access
+// token and refresh token. Each refresh token can only be used once.
+func (s *HTTPServer) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		render.Render(w, r, errInvalidRequest(err))
+		return
+	}
+
+	refreshToken, session, err := s.notes.RefreshSession(req.RefreshToken, s.config.Auth.RefreshTokenTTL)
+	if err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+	if _, err := s.notes.ActiveTenant(session.TenantID); err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+	user, err := s.notes.FindUser(session.UserID)
+	if err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+	if user == nil {
+		render.Render(w, r, errRepository(note.ErrInvalidCredentials))
+		return
+	}
+	s.renderSession(w, r, http.StatusOK, user, refreshToken)
+}
+
+func (s *HTTPServer) renderSession(w http.ResponseWriter, r *http.Request, status int, user *note.User, refreshToken string) {
+	accessTTL := s.config.Auth.AccessTokenTTL
+	accessToken, err := s.signAccessToken(user, time.Now().Add(accessTTL))
+	if err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(sessionResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(accessTTL / time.Second),
+		User:         user,
+	}); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+}
+
+// handleLogout ends the session of the refresh token in the body. Access
+// tokens issued for the session stay valid until they expire.
+func (s *HTTPServer) handleLogout(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		render.Render(w, r, errInvalidRequest(err))
+		return
+	}
+	if err := s.notes.EndSession(req.RefreshToken); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListUsers lists the users of the tenant that made the request.
+func (s *HTTPServer) handleListUsers(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value("tenantID").(string)
+	users, err := s.notes.FindUsers(tenantID)
+	if err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+	if err := json.NewEncoder(w).Encode(users); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+}
+
+// handleCreateUser adds a user with the email, password and role in the body
+// to the tenant that made the request. The role defaults to viewer. Tenant
+// tokens may add users too, which lets tenants created before accounts
+// existed sign in with an email.
+func (s *HTTPServer) handleCreateUser(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		credentials
+		Role note.Role `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		render.Render(w, r, errInvalidRequest(err))
+		return
+	}
+	if req.Role == "" {
+		req.Role = note.RoleViewer
+	}
+
+	tenantID := r.Context().Value("tenantID").(string)
+	user, err := s.notes.RegisterUser(tenantID, req.Email, req.Password, req.Role)
+	if err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(user); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+}
+
+// getCurrentUser returns the user who made the request, which is not found
+// for requests made with a tenant token.
+func (s *HTTPServer) getCurrentUser(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(r)
+	if user == nil {
+		render.Render(w, r, errNotFound)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(user); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+}
+
+// memberCtx adds the user named by the userID route param to the context, if
+// they belong to the tenant that made the request.
+func (s *HTTPServer) memberCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.notes.FindUser(chi.URLParam(r, "userID"))
+		if err != nil {
+			render.Render(w, r, errServerError(
+				fmt.Errorf("error loading user: %w", err),
+			))
+			return
+		}
+		tenantID := r.Context().Value("tenantID").(string)
+		if user == nil || user.TenantID != tenantID {
+			render.Render(w, r, errNotFound)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "member", user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (s *HTTPServer) getMember(w http.ResponseWriter, r *http.Request) {
+	member := r.Context().Value("member").(*note.User)
+	if err := json.NewEncoder(w).Encode(member); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+}
+
+// updateMember gives a member the role in the body. The tenant's only owner
+// cannot be given another role.
+func (s *HTTPServer) updateMember(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Role note.Role `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		render.Render(w, r, errInvalidRequest(err))
+		return
+	}
+
+	member := r.Context().Value("member").(*note.User)
+	member, err := s.notes.SetUserRole(member.ID, req.Role)
+	if err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+	if err := json.NewEncoder(w).Encode(member); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+}
+
+// deleteMember removes a member from the tenant. The tenant's only owner
+// cannot be removed.
+func (s *HTTPServer) deleteMember(w http.ResponseWriter, r *http.Request) {
+	member := r.Context().Value("member").(*note.User)
+	if err := s.notes.RemoveUser(member.ID); err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,138 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"learn-cljs.com/notes/internal/note"
+)
+
+// unregisteredTenants is a repository that cannot register tenants.
+type unregisteredTenants struct {
+	note.Repository
+}
+
+func (unregisteredTenants) CreateTenant(*note.Tenant) error {
+	return errors.New("tenant registry unavailable")
+}
+
+func startSession(t *testing.T, rec *httptest.ResponseRecorder, status int) sessionResponse {
+	require.Equal(t, status, rec.Code, "start session: %s", rec.Body)
+	var res sessionResponse
+	decode(t, rec, &res)
+	assert.NotEmpty(t, res.AccessToken)
+	assert.NotEmpty(t, res.RefreshToken)
+	assert.Equal(t, "Bearer", res.TokenType)
+	assert.Equal(t, int64(time.Hour/time.Second), res.ExpiresIn)
+	return res
+}
+
+func TestCreateAccount(t *testing.T) {
+	s := newTestServer(t)
+	res := startSession(t, do(t, s, http.MethodPost, "/accounts", "", map[string]string{
+		"email": "owner@example.com", "password": "password1", "name": "Acme",
+	}), http.StatusCreated)
+	require.NotNil(t, res.User)
+	assert.Equal(t, "owner@example.com", res.User.Email)
+	assert.Equal(t, note.RoleOwner, res.User.Role)
+	assertSuccess(t, do(t, s, http.MethodGet, "/notes", res.AccessToken, nil), "use new account")
+
+	rec := do(t, s, http.MethodGet, "/admin/tenants/"+res.User.TenantID, testAdminToken, nil)
+	require.Equal(t, http.StatusOK, rec.Code, "get tenant: %s", rec.Body)
+	var tenant note.Tenant
+	decode(t, rec, &tenant)
+	assert.Equal(t, "Acme", tenant.Name)
+	assert.Equal(t, note.TenantActive, tenant.Status)
+
+	assertError(t, do(t, s, http.MethodPost, "/accounts", "", credentials{Email: "owner@example.com", Password: "password2"}),
+		http.StatusConflict, "email taken")
+	assertError(t, do(t, s, http.MethodPost, "/accounts", "", credentials{Email: "short@example.com", Password: "short"}),
+		http.StatusBadRequest, "short password")
+	assertError(t, do(t, s, http.MethodPost, "/accounts", "", credentials{Email: "not an email", Password: "password1"}),
+		http.StatusBadRequest, "invalid email")
+	assertError(t, do(t, s, http.MethodPost, "/login", "", credentials{Email: "short@example.com", Password: "short"}),
+		http.StatusUnauthorized, "should not keep a rejected account")
+}
+
+func TestCreateAccountUndone(t *testing.T) {
+	idx := note.NewMemorySearchIndex()
+	repo := note.NewInMemoryRepo(note.RepositoryConfig{}, idx)
+	t.Cleanup(func() { repo.Close() })
+	s := NewHTTPServer(Config{
+		Context:       context.Background(),
+		NoteService:   note.NewService(unregisteredTenants{repo}, idx),
+		SigningSecret: []byte("signing secret"),
+		Auth:          AuthConfig{AccessTokenTTL: time.Hour, RefreshTokenTTL: time.Hour},
+	})
+
+	assertError(t, do(t, s, http.MethodPost, "/accounts", "", credentials{Email: "owner@example.com", Password: "password1"}),
+		http.StatusInternalServerError, "tenant not registered")
+	assertError(t, do(t, s, http.MethodPost, "/login", "", credentials{Email: "owner@example.com", Password: "password1"}),
+		http.StatusUnauthorized, "should remove the user of an unregistered tenant")
+	user, err := repo.FindUserByEmail("owner@example.com")
+	require.NoError(t, err)
+	assert.Nil(t, user, "should free the email for another attempt")
+}
+
+func TestLogin(t *testing.T) {
+	s := newTestServer(t)
+	_, owner := createAccount(t, s, "owner@example.com")
+
+	res := startSession(t, do(t, s, http.MethodPost, "/login", "", credentials{Email: "owner@example.com", Password: "password1"}),
+		http.StatusOK)
+	require.NotNil(t, res.User)
+	assert.Equal(t, owner.ID, res.User.ID)
+	assertSuccess(t, do(t, s, http.MethodGet, "/notes", res.AccessToken, nil), "use access token")
+
+	assertError(t, do(t, s, http.MethodPost, "/login", "", credentials{Email: "owner@example.com", Password: "password2"}),
+		http.StatusUnauthorized, "wrong password")
+	assertError(t, do(t, s, http.MethodPost, "/login", "", credentials{Email: "nobody@example.com", Password: "password1"}),
+		http.StatusUnauthorized, "unknown email")
+
+	assertSuccess(t, do(t, s, http.MethodPost, "/admin/tenants/"+owner.TenantID+"/suspend", testAdminToken, nil), "suspend")
+	assertError(t, do(t, s, http.MethodPost, "/login", "", credentials{Email: "owner@example.com", Password: "password1"}),
+		http.StatusForbidden, "suspended tenant")
+}
+
+func TestRefresh(t *testing.T) {
+	s := newTestServer(t)
+	first := startSession(t, do(t, s, http.MethodPost, "/accounts", "", credentials{Email: "owner@example.com", Password: "password1"}),
+		http.StatusCreated)
+	refresh := func(token string) *httptest.ResponseRecorder {
+		return do(t, s, http.MethodPost, "/refresh", "", map[string]string{"refreshToken": token})
+	}
+
+	second := startSession(t, refresh(first.RefreshToken), http.StatusOK)
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken, "should issue a new refresh token")
+	assert.Equal(t, first.User.ID, second.User.ID)
+	assertSuccess(t, do(t, s, http.MethodGet, "/notes", second.AccessToken, nil), "use refreshed access token")
+
+	assertError(t, refresh(first.RefreshToken), http.StatusUnauthorized, "reuse refresh token")
+	assertError(t, refresh("unknown"), http.StatusUnauthorized, "unknown refresh token")
+	startSession(t, refresh(second.RefreshToken), http.StatusOK)
+}
+
+func TestLogout(t *testing.T) {
+	s := newTestServer(t)
+	res := startSession(t, do(t, s, http.MethodPost, "/accounts", "", credentials{Email: "owner@example.com", Password: "password1"}),
+		http.StatusCreated)
+	other := startSession(t, do(t, s, http.MethodPost, "/login", "", credentials{Email: "owner@example.com", Password: "password1"}),
+		http.StatusOK)
+
+	rec := do(t, s, http.MethodPost, "/logout", "", map[string]string{"refreshToken": res.RefreshToken})
+	assert.Equal(t, http.StatusNoContent, rec.Code, "logout: %s", rec.Body)
+	assertError(t, do(t, s, http.MethodPost, "/refresh", "", map[string]string{"refreshToken": res.RefreshToken}),
+		http.StatusUnauthorized, "refresh after logout")
+	assertSuccess(t, do(t, s, http.MethodGet, "/notes", res.AccessToken, nil), "access token outlives its session")
+	startSession(t, do(t, s, http.MethodPost, "/refresh", "", map[string]string{"refreshToken": other.RefreshToken}),
+		http.StatusOK)
+
+	rec = do(t, s, http.MethodPost, "/logout", "", map[string]string{"refreshToken": res.RefreshToken})
+	assert.Equal(t, http.StatusNoContent, rec.Code, "should end a session only once without error: %s", rec.Body)
+}
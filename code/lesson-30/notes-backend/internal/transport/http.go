@@ -9,14 +9,19 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"learn-cljs.com/notes/internal/keyring"
 	"learn-cljs.com/notes/internal/note"
+	"learn-cljs.com/notes/internal/policy"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -36,7 +41,17 @@ type Config struct {
 	Addr          string
 	StaticFileDir string
 	NoteService   *note.Service
+	// SigningSecret signs tenant tokens while Keyring is empty, and verifies
+	// the tokens that name no key, which were signed before keys had IDs.
 	SigningSecret []byte
+	Keyring       *keyring.Keyring
+	// AdminToken is the bearer token of the admin endpoints, which are not
+	// served if it is empty.
+	AdminToken []byte
+	Auth       AuthConfig
+	// Policy decides what each member of a tenant may do. It defaults to
+	// policy.Default.
+	Policy policy.Policy
 }
 
 func NewHTTPServer(c Config) *HTTPServer {
@@ -71,17 +86,21 @@ func (s *HTTPServer) newRouter(staticFileDir string) chi.Router {
 				return true
 			},
 			AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-			AllowedHeaders:   []string{"Authorization", "Accept", "Content-Type"},
-			ExposedHeaders:   []string{"Location"},
+			AllowedHeaders:   []string{"Authorization", "Accept", "Content-Type", "If-Match"},
+			ExposedHeaders:   []string{"Location", "ETag", "Link", "X-Total-Count"},
 			AllowCredentials: true,
 			MaxAge:           300,
 		}),
 	)
 
 	r.Post("/tenant", s.handleGenerateTenant)
-	r.Post("/accounts", s.handleGenerateTenant)
+	r.Post("/accounts", s.handleCreateAccount)
+	r.Post("/login", s.handleLogin)
+	r.Post("/refresh", s.handleRefresh)
+	r.Post("/logout", s.handleLogout)
 	r.Route("/notes", func(r chi.Router) {
 		r.Use(s.tenantCtx) // Add tenantID based on header
+		r.Use(s.authorizeByMethod(policy.ReadNotes, policy.WriteNotes))
 		r.Post("/", s.handleCreateNote)
 		r.Get("/", s.handleListNotes)
 
@@ -90,19 +109,97 @@ func (s *HTTPServer) newRouter(staticFileDir string) chi.Router {
 			r.Get("/", s.getNote)
 			r.Put("/", s.updateNote)
 			r.Delete("/", s.deleteNote)
+			r.Get("/related", s.relatedNotes)
 
 			r.Route("/tags/{tagID}", func(r chi.Router) {
 				r.Use(s.tagCtx)
 				r.Put("/", s.tagNote)
 				r.Delete("/", s.untagNote)
 			})
+
+			r.Route("/revisions", func(r chi.Router) {
+				r.Get("/", s.listRevisions)
+
+				r.Route("/{rev}", func(r chi.Router) {
+					r.Use(s.revisionCtx)
+					r.Get("/", s.getRevision)
+					r.Get("/diff", s.diffRevision)
+					r.Post("/restore", s.restoreRevision)
+				})
+			})
+		})
+	})
+
+	if len(s.config.AdminToken) > 0 {
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(s.adminCtx)
+			r.Get("/search/queue", s.handleIndexQueue)
+
+			r.Route("/tenants", func(r chi.Router) {
+				r.Get("/", s.handleListTenants)
+
+				r.Route("/{tenantID}", func(r chi.Router) {
+					r.Use(s.registeredTenantCtx)
+					r.Get("/", s.getTenant)
+					r.Delete("/", s.deleteTenant)
+					r.Post("/suspend", s.suspendTenant)
+					r.Post("/reinstate", s.reinstateTenant)
+				})
+			})
+		})
+	}
+
+	r.Route("/users", func(r chi.Router) {
+		r.Use(s.tenantCtx)
+		r.Use(s.authorizeByMethod(policy.ReadMembers, policy.ManageMembers))
+		r.Get("/", s.handleListUsers)
+		r.Post("/", s.handleCreateUser)
+		r.Get("/me", s.getCurrentUser)
+
+		r.Route("/{userID}", func(r chi.Router) {
+			r.Use(s.memberCtx)
+			r.Get("/", s.getMember)
+			r.Put("/", s.updateMember)
+			r.Delete("/", s.deleteMember)
 		})
 	})
+	r.Route("/api-keys", func(r chi.Router) {
+		r.Use(s.tenantCtx)
+		r.Use(s.authorize(policy.ManageKeys))
+		r.Get("/", s.handleListAPIKeys)
+		r.Post("/", s.handleCreateAPIKey)
 
+		r.Route("/{keyID}", func(r chi.Router) {
+			r.Use(s.apiKeyCtx)
+			r.Get("/", s.getAPIKey)
+			r.Delete("/", s.revokeAPIKey)
+		})
+	})
+	r.Route("/suggest", func(r chi.Router) {
+		r.Use(s.tenantCtx)
+		r.Use(s.authorize(policy.ReadNotes))
+		r.Get("/", s.handleSuggest)
+	})
+	r.Route("/trash", func(r chi.Router) {
+		r.Use(s.tenantCtx)
+		r.Use(s.authorizeByMethod(policy.ReadNotes, policy.WriteNotes))
+		r.Get("/", s.handleListTrash)
+		r.Post("/{noteID}/restore", s.restoreNote)
+		r.Delete("/{noteID}", s.purgeNote)
+	})
 	r.Route("/tags", func(r chi.Router) {
 		r.Use(s.tenantCtx)
+		r.Use(s.authorizeByMethod(policy.ReadTags, policy.WriteTags))
 		r.Post("/", s.handleCreateTag)
 		r.Get("/", s.handleListTags)
+
+		r.Route("/{tagID}", func(r chi.Router) {
+			r.Use(s.tagCtx)
+			r.Put("/", s.updateTag)
+			r.Delete("/", s.deleteTag)
+			r.Get("/notes", s.listTagNotes)
+			r.Post("/merge", s.mergeTag)
+		})
 	})
 
 	// Since all files are relative to the root path, we do not need to worry about
@@ -113,33 +210,103 @@ func (s *HTTPServer) newRouter(staticFileDir string) chi.Router {
 	return r
 }
 
+// handleGenerateTenant registers a new tenant, with the display name in the
+// optional JSON body, and returns its token.
 func (s *HTTPServer) handleGenerateTenant(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		render.Render(w, r, errInvalidRequest(err))
+		return
+	}
+
+	tid, err := newTenantID()
+	if err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+	tenant := &note.Tenant{ID: hex.EncodeToString(tid), Name: req.Name}
+	if err := s.notes.CreateTenant(tenant); err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+	w.Write([]byte(s.signTenantID(tid)))
+	w.WriteHeader(http.StatusOK)
+}
+
+func newTenantID() ([]byte, error) {
 	tid := make([]byte, 8)
 	_, err := rand.Read(tid)
+	return tid, err
+}
+
+// signTenantID returns a token for a tenant ID, signed with the current key
+// of the keyring and prefixed with its ID and a dot. Without a keyring,
+// tokens are signed with the signing secret and name no key.
+func (s *HTTPServer) signTenantID(tid []byte) string {
+	if key := s.currentKey(); key != nil {
+		return key.ID + "." + hex.EncodeToString(append(tid, tenantMAC(key.Secret, tid)...))
+	}
+	return hex.EncodeToString(append(tid, tenantMAC(s.config.SigningSecret, tid)...))
+}
+
+func (s *HTTPServer) currentKey() *keyring.Key {
+	if s.config.Keyring == nil {
+		return nil
+	}
+	return s.config.Keyring.Current()
+}
+
+// tenantMAC signs a tenant ID with the secret itself. See accessMAC for how
+// access tokens are kept apart from tenant tokens.
+func tenantMAC(secret, tid []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(tid)
+	return mac.Sum(nil)
+}
+
+// handleIndexQueue reports how many committed changes are still waiting to be
+// applied to the search index. The count covers every tenant, so it would let
+// anyone watch how busy the server's tenants are, and is only served to the
+// admin.
+func (s *HTTPServer) handleIndexQueue(w http.ResponseWriter, r *http.Request) {
+	depth, err := s.notes.IndexQueueDepth()
 	if err != nil {
 		render.Render(w, r, errServerError(err))
 		return
 	}
-	mac := hmac.New(sha256.New, s.config.SigningSecret)
-	mac.Write(tid)
-	tidMAC := mac.Sum(nil)
-	tid = append(tid, tidMAC...)
-	authenticTID := hex.EncodeToString(tid)
-	w.Write([]byte(authenticTID))
-	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(map[string]int{"depth": depth}); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
 }
 
+// decodeTenantID verifies a token with the key that it names, which may be
+// retired, or with the signing secret if it names none.
 func (s *HTTPServer) decodeTenantID(encoded string) (string, bool) {
+	secret := s.config.SigningSecret
+	if i := strings.IndexByte(encoded, '.'); i >= 0 {
+		var key *keyring.Key
+		if s.config.Keyring != nil {
+			key = s.config.Keyring.Find(encoded[:i])
+		}
+		if key == nil {
+			return "", false
+		}
+		secret, encoded = key.Secret, encoded[i+1:]
+	}
+	if len(secret) == 0 {
+		return "", false
+	}
+
 	data, err := hex.DecodeString(encoded)
-	if err != nil {
+	if err != nil || len(data) != 8+sha256.Size {
 		return "", false
 	}
 	tid := data[0:8]
 	expectedMAC := data[8:]
-	mac := hmac.New(sha256.New, s.config.SigningSecret)
-	mac.Write(tid)
-	tidMAC := mac.Sum(nil)
-	if !hmac.Equal(tidMAC, expectedMAC) {
+	if !hmac.Equal(tenantMAC(secret, tid), expectedMAC) {
 		return "", false
 	}
 
@@ -153,38 +320,228 @@ func (s *HTTPServer) handleCreateNote(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	tenantID := r.Context().Value("tenantID").(string)
-	if err := s.notes.Transaction(tenantID).CreateNote(n); err != nil {
-		render.Render(w, r, errInvalidRequest(err))
+	n.UpdatedBy = currentUserID(r)
+	// Any tags supplied with the note are linked by ID in the same unit of work
+	// so that a note is never left partially tagged.
+	tags := n.Tags
+	n.Tags = nil
+	for _, tag := range tags {
+		if tag == nil {
+			render.Render(w, r, errInvalidRequest(errors.New("tags must not be null")))
+			return
+		}
+	}
+	err := s.notes.Update(tenantID, func(tx note.Transaction) error {
+		if err := tx.CreateNote(n); err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			if err := tx.TagNote(n.ID, tag.ID); err != nil {
+				return err
+			}
+		}
+		var err error
+		n, err = tx.FindNoteByID(n.ID)
+		return err
+	})
+	if err != nil {
+		render.Render(w, r, errRepository(err))
 		return
 	}
 
 	w.Header().Add("Location", fmt.Sprintf("/notes/%d", n.ID))
+	w.Header().Set("ETag", noteETag(n))
 	if err := json.NewEncoder(w).Encode(n); err != nil {
 		render.Render(w, r, errServerError(err))
 		return
 	}
 }
 
+// handleListNotes lists a page of notes, or searches them if a "q" query
+// parameter is given. The URL of the next page is sent in a Link header.
 func (s *HTTPServer) handleListNotes(w http.ResponseWriter, r *http.Request) {
-	var notes []*note.Note
-	var err error
-	tenantID := r.Context().Value("tenantID").(string)
 	if q, ok := r.URL.Query()["q"]; ok && len(q) == 1 {
-		notes, err = s.notes.SearchNotes(tenantID, q[0])
-	} else {
-		fmt.Println("Listing all")
-		notes, err = s.notes.Transaction(tenantID).FindAllNotes()
+		s.searchNotes(w, r, q[0])
+		return
 	}
+
+	tenantID := r.Context().Value("tenantID").(string)
+	query, err := parseNoteQuery(r.URL.Query())
 	if err != nil {
+		render.Render(w, r, errInvalidRequest(err))
+		return
+	}
+	page, err := s.notes.Transaction(tenantID).FindNotes(query)
+	if err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+	setNextLink(w, r, page.Next)
+
+	if err := json.NewEncoder(w).Encode(page.Notes); err != nil {
 		render.Render(w, r, errServerError(err))
 		return
 	}
-	if err := json.NewEncoder(w).Encode(notes); err != nil {
+}
+
+// searchNotes sends a page of search hits, best match first, along with the
+// total number of hits, facets that count them by tag and date, and a corrected
+// query if there are none. Each hit is a note along with its score and
+// highlights. The total is also sent in an X-Total-Count header, and pages are
+// selected with "from" and "size".
+func (s *HTTPServer) searchNotes(w http.ResponseWriter, r *http.Request, query string) {
+	tenantID := r.Context().Value("tenantID").(string)
+	req, err := parseSearchRequest(query, r.URL.Query())
+	if err != nil {
+		render.Render(w, r, errInvalidRequest(err))
+		return
+	}
+	res, err := s.notes.SearchNotes(tenantID, req)
+	if err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+
+	w.Header().Set("X-Total-Count", strconv.FormatUint(res.Total, 10))
+	if next := req.From + req.Size; uint64(next) < res.Total {
+		setPageLink(w, r, "from", strconv.Itoa(next))
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
 		render.Render(w, r, errServerError(err))
 		return
 	}
 }
 
+func parseSearchRequest(query string, params url.Values) (note.SearchRequest, error) {
+	req := note.SearchRequest{Query: query, Size: note.DefaultSearchSize}
+	if from := params.Get("from"); from != "" {
+		var err error
+		if req.From, err = strconv.Atoi(from); err != nil {
+			return req, fmt.Errorf("error parsing from: %w", err)
+		}
+		if req.From < 0 {
+			return req, errors.New("from must not be negative")
+		}
+	}
+	if size := params.Get("size"); size != "" {
+		var err error
+		if req.Size, err = strconv.Atoi(size); err != nil {
+			return req, fmt.Errorf("error parsing size: %w", err)
+		}
+		if req.Size < 1 || req.Size > maxPageSize {
+			return req, fmt.Errorf("size must be between 1 and %d", maxPageSize)
+		}
+	}
+	return req, nil
+}
+
+// defaultSuggestLimit is the number of titles and of tags suggested when no
+// limit is given.
+const defaultSuggestLimit = 10
+
+// handleSuggest completes the "prefix" parameter with up to "limit" note
+// titles and tag names each, for a search box to offer as the user types.
+func (s *HTTPServer) handleSuggest(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value("tenantID").(string)
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		render.Render(w, r, errInvalidRequest(errors.New("prefix is required")))
+		return
+	}
+	limit, err := parseLimit(r.URL.Query())
+	if err != nil {
+		render.Render(w, r, errInvalidRequest(err))
+		return
+	}
+	if limit == 0 {
+		limit = defaultSuggestLimit
+	}
+
+	suggestions, err := s.notes.Suggest(tenantID, prefix, limit)
+	if err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+	if err := json.NewEncoder(w).Encode(suggestions); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+}
+
+// maxPageSize is the largest limit that a listing accepts.
+const maxPageSize = 1000
+
+func parseNoteQuery(params url.Values) (note.NoteQuery, error) {
+	var q note.NoteQuery
+	var err error
+	if q.Limit, err = parseLimit(params); err != nil {
+		return q, err
+	}
+	q.Cursor = params.Get("cursor")
+	q.Sort = note.NoteSort(params.Get("sort"))
+
+	switch order := params.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		q.Descending = true
+	default:
+		return q, fmt.Errorf("order must be asc or desc, not %q", order)
+	}
+
+	if tag := params.Get("tag"); tag != "" {
+		if q.TagID, err = strconv.ParseUint(tag, 10, 64); err != nil {
+			return q, fmt.Errorf("error parsing tag: %w", err)
+		}
+	}
+	if since := params.Get("updatedSince"); since != "" {
+		if q.UpdatedSince, err = time.Parse(time.RFC3339, since); err != nil {
+			return q, fmt.Errorf("error parsing updatedSince: %w", err)
+		}
+	}
+	if before := params.Get("createdBefore"); before != "" {
+		if q.CreatedBefore, err = time.Parse(time.RFC3339, before); err != nil {
+			return q, fmt.Errorf("error parsing createdBefore: %w", err)
+		}
+	}
+
+	return q, nil
+}
+
+// parseLimit parses the page size of a listing. Listings are unlimited when
+// no limit is given.
+func parseLimit(params url.Values) (int, error) {
+	param := params.Get("limit")
+	if param == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(param)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing limit: %w", err)
+	}
+	if limit < 1 || limit > maxPageSize {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+	}
+	return limit, nil
+}
+
+// setNextLink advertises the next page of a listing, if there is one.
+func setNextLink(w http.ResponseWriter, r *http.Request, next string) {
+	if next == "" {
+		return
+	}
+	setPageLink(w, r, "cursor", next)
+}
+
+// setPageLink advertises the request's URL with param set to value as the
+// next page.
+func setPageLink(w http.ResponseWriter, r *http.Request, param, value string) {
+	u := *r.URL
+	params := u.Query()
+	params.Set(param, value)
+	u.RawQuery = params.Encode()
+	w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, u.RequestURI()))
+}
+
 func (s *HTTPServer) handleCreateTag(w http.ResponseWriter, r *http.Request) {
 	t := &note.Tag{}
 	if err := json.NewDecoder(r.Body).Decode(t); err != nil {
@@ -193,7 +550,7 @@ func (s *HTTPServer) handleCreateTag(w http.ResponseWriter, r *http.Request) {
 	}
 	tenantID := r.Context().Value("tenantID").(string)
 	if err := s.notes.Transaction(tenantID).CreateTag(t); err != nil {
-		render.Render(w, r, errInvalidRequest(err))
+		render.Render(w, r, errRepository(err))
 		return
 	}
 
@@ -205,18 +562,124 @@ func (s *HTTPServer) handleCreateTag(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *HTTPServer) handleListTags(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseLimit(r.URL.Query())
+	if err != nil {
+		render.Render(w, r, errInvalidRequest(err))
+		return
+	}
+
+	tenantID := r.Context().Value("tenantID").(string)
+	page, err := s.notes.Transaction(tenantID).FindTags(note.TagQuery{
+		Limit:  limit,
+		Cursor: r.URL.Query().Get("cursor"),
+	})
+	if err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+	setNextLink(w, r, page.Next)
+	if err := json.NewEncoder(w).Encode(page.Tags); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+}
+
+func (s *HTTPServer) updateTag(w http.ResponseWriter, r *http.Request) {
+	t := &note.Tag{}
+	if err := json.NewDecoder(r.Body).Decode(t); err != nil {
+		render.Render(w, r, errInvalidRequest(err))
+		return
+	}
+	if strings.TrimSpace(t.Name) == "" {
+		render.Render(w, r, errInvalidRequest(errors.New("tag name must not be empty")))
+		return
+	}
+
+	tenantID := r.Context().Value("tenantID").(string)
+	tagID := r.Context().Value("tagID").(uint64)
+	if err := s.notes.Transaction(tenantID).UpdateTag(tagID, t); err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+	if err := json.NewEncoder(w).Encode(t); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+}
+
+func (s *HTTPServer) deleteTag(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value("tenantID").(string)
+	tagID := r.Context().Value("tagID").(uint64)
+	if err := s.notes.Transaction(tenantID).DeleteTag(tagID); err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listTagNotes lists the notes with a tag. It accepts the same paging, sort
+// and filter parameters as the note listing.
+func (s *HTTPServer) listTagNotes(w http.ResponseWriter, r *http.Request) {
+	query, err := parseNoteQuery(r.URL.Query())
+	if err != nil {
+		render.Render(w, r, errInvalidRequest(err))
+		return
+	}
+	query.TagID = r.Context().Value("tagID").(uint64)
+
 	tenantID := r.Context().Value("tenantID").(string)
-	tags, err := s.notes.Transaction(tenantID).FindAllTags()
+	page, err := s.notes.Transaction(tenantID).FindNotes(query)
 	if err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+	setNextLink(w, r, page.Next)
+	if err := json.NewEncoder(w).Encode(page.Notes); err != nil {
 		render.Render(w, r, errServerError(err))
 		return
 	}
-	if err := json.NewEncoder(w).Encode(tags); err != nil {
+}
+
+// mergeTag folds the tag in the URL into the tag given by "into" in the
+// request body, and responds with the tag that remains.
+func (s *HTTPServer) mergeTag(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Into uint64 `json:"into"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		render.Render(w, r, errInvalidRequest(err))
+		return
+	}
+	tagID := r.Context().Value("tagID").(uint64)
+	if body.Into == 0 || body.Into == tagID {
+		render.Render(w, r, errInvalidRequest(errors.New("into must be the ID of another tag")))
+		return
+	}
+
+	tenantID := r.Context().Value("tenantID").(string)
+	var into *note.Tag
+	err := s.notes.Update(tenantID, func(tx note.Transaction) error {
+		if err := tx.MergeTag(tagID, body.Into); err != nil {
+			return err
+		}
+		var err error
+		into, err = tx.FindTagByID(body.Into)
+		return err
+	})
+	if err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+	if err := json.NewEncoder(w).Encode(into); err != nil {
 		render.Render(w, r, errServerError(err))
 		return
 	}
 }
 
+// tenantCtx adds the ID of the tenant that made the request to the context,
+// along with the user if the request was made with an access token rather
+// than a tenant token or an API key.
 func (s *HTTPServer) tenantCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
@@ -226,16 +689,65 @@ func (s *HTTPServer) tenantCtx(next http.Handler) http.Handler {
 			))
 			return
 		}
-		encodedTenantID := authHeader[7:]
-		tenantID, ok := s.decodeTenantID(encodedTenantID)
+		token := authHeader[7:]
+
+		var user *note.User
+		var key *note.APIKey
+		tenantID, ok := "", false
+		if note.IsAPIKey(token) {
+			var err error
+			if key, err = s.notes.AuthenticateAPIKey(token); err != nil {
+				render.Render(w, r, errRepository(err))
+				return
+			}
+			tenantID, ok = key.TenantID, true
+		} else if isAccessToken(token) {
+			claims, err := s.decodeAccessToken(token)
+			if err != nil {
+				render.Render(w, r, errUnauthorized(err))
+				return
+			}
+			if user, err = s.notes.FindUser(claims.UserID); err != nil {
+				render.Render(w, r, errServerError(
+					fmt.Errorf("error loading user: %w", err),
+				))
+				return
+			}
+			if user == nil || user.TenantID != claims.TenantID {
+				render.Render(w, r, errUnauthorized(errors.New("user no longer exists")))
+				return
+			}
+			tenantID, ok = user.TenantID, true
+		} else {
+			tenantID, ok = s.decodeTenantID(token)
+		}
 		if !ok {
 			render.Render(w, r, errInvalidRequest(
 				errors.New("invalid tenant supplied"),
 			))
 			return
 		}
+		if _, err := s.notes.ActiveTenant(tenantID); err != nil {
+			render.Render(w, r, errRepository(err))
+			return
+		}
+
+		// Tenant tokens predate users, and act as an owner of the tenant.
+		principal := &policy.Principal{TenantID: tenantID, Role: note.RoleOwner}
+		if user != nil {
+			principal.UserID, principal.Role = user.ID, user.Role
+		}
+		if key != nil {
+			var err error
+			if principal, err = apiKeyPrincipal(key); err != nil {
+				render.Render(w, r, errUnauthorized(err))
+				return
+			}
+		}
 
 		ctx := context.WithValue(r.Context(), "tenantID", tenantID)
+		ctx = context.WithValue(ctx, "user", user)
+		ctx = context.WithValue(ctx, "principal", principal)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -279,12 +791,43 @@ func (s *HTTPServer) noteCtx(next http.Handler) http.Handler {
 
 func (s *HTTPServer) getNote(w http.ResponseWriter, r *http.Request) {
 	note := r.Context().Value("note").(*note.Note)
+	w.Header().Set("ETag", noteETag(note))
 	if err := json.NewEncoder(w).Encode(note); err != nil {
 		render.Render(w, r, errServerError(err))
 		return
 	}
 }
 
+// defaultRelatedLimit is the number of related notes sent when no limit is
+// given.
+const defaultRelatedLimit = 10
+
+// relatedNotes sends the tenant's notes that are most like a note, by shared
+// tags and significant words, most similar first. Each is a note along with
+// its score, as in a search.
+func (s *HTTPServer) relatedNotes(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value("tenantID").(string)
+	n := r.Context().Value("note").(*note.Note)
+	limit, err := parseLimit(r.URL.Query())
+	if err != nil {
+		render.Render(w, r, errInvalidRequest(err))
+		return
+	}
+	if limit == 0 {
+		limit = defaultRelatedLimit
+	}
+
+	res, err := s.notes.RelatedNotes(tenantID, n, limit)
+	if err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+	if err := json.NewEncoder(w).Encode(res.Hits); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+}
+
 func (s *HTTPServer) updateNote(w http.ResponseWriter, r *http.Request) {
 	id := r.Context().Value("note").(*note.Note).ID
 	n := &note.Note{}
@@ -293,15 +836,95 @@ func (s *HTTPServer) updateNote(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	etag, version, conditional, err := ifMatchETag(r)
+	if err != nil {
+		render.Render(w, r, errInvalidRequest(err))
+		return
+	}
+
 	tenantID := r.Context().Value("tenantID").(string)
-	if err := s.notes.Transaction(tenantID).UpdateNote(id, n); err != nil {
-		render.Render(w, r, errServerError(err))
+	n.UpdatedBy = currentUserID(r)
+	err = s.notes.Update(tenantID, func(tx note.Transaction) error {
+		if conditional {
+			if err := checkNoteETag(tx, id, etag, version); err != nil {
+				return err
+			}
+		}
+		if err := tx.UpdateNote(id, n); err != nil {
+			return err
+		}
+		var err error
+		n, err = tx.FindNoteByID(id)
+		return err
+	})
+	if err != nil {
+		render.Render(w, r, errRepository(err))
 		return
 	}
 
+	w.Header().Set("ETag", noteETag(n))
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// noteETag returns a strong entity tag for the current state of a note.
+// Tagging a note, or changing one of its tags, leaves its version as it was,
+// so the entity tag also covers the note's tags.
+func noteETag(n *note.Note) string {
+	tags := append([]*note.Tag(nil), n.Tags...)
+	sort.Slice(tags, func(i, j int) bool { return tags[i].ID < tags[j].ID })
+
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	for _, tag := range tags {
+		// Encoding a tag cannot fail.
+		enc.Encode(tag)
+	}
+	return strconv.Quote(fmt.Sprintf("%d-%x", n.Version, h.Sum(nil)[:8]))
+}
+
+// ifMatchETag returns the entity tag required by the If-Match header, along
+// with the note version it names. conditional is false when the header is
+// absent or "*", since any existing note matches.
+func ifMatchETag(r *http.Request) (etag string, version uint64, conditional bool, err error) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		return "", 0, false, nil
+	}
+
+	unquoted, err := strconv.Unquote(ifMatch)
+	if err == nil {
+		i := strings.IndexByte(unquoted, '-')
+		if i < 0 {
+			err = errors.New("missing tags")
+		} else {
+			version, err = strconv.ParseUint(unquoted[:i], 10, 64)
+		}
+	}
+	if err != nil {
+		return "", 0, false, fmt.Errorf("If-Match must be a single entity tag returned by the server: %s", ifMatch)
+	}
+	return ifMatch, version, true, nil
+}
+
+// checkNoteETag returns an error matching note.ErrConflict unless the note
+// with id has the entity tag etag, which names version.
+func checkNoteETag(tx note.Transaction, id uint64, etag string, version uint64) error {
+	if err := tx.CheckNoteVersion(id, version); err != nil {
+		return err
+	}
+	n, err := tx.FindNoteByID(id)
+	if err != nil {
+		return err
+	}
+	if n == nil {
+		return &note.NotFoundError{Entity: "note", ID: id}
+	}
+	if noteETag(n) != etag {
+		return fmt.Errorf("note %d's tags have changed: %w", id, note.ErrConflict)
+	}
+	return nil
+}
+
 func (s *HTTPServer) tagCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
@@ -345,7 +968,7 @@ func (s *HTTPServer) tagNote(w http.ResponseWriter, r *http.Request) {
 	tagID := r.Context().Value("tagID").(uint64)
 
 	if err := s.notes.Transaction(tenantID).TagNote(noteID, tagID); err != nil {
-		render.Render(w, r, errServerError(err))
+		render.Render(w, r, errRepository(err))
 		return
 	}
 
@@ -368,14 +991,181 @@ func (s *HTTPServer) untagNote(w http.ResponseWriter, r *http.Request) {
 func (s *HTTPServer) deleteNote(w http.ResponseWriter, r *http.Request) {
 	tenantID := r.Context().Value("tenantID").(string)
 	id := r.Context().Value("note").(*note.Note).ID
-	if err := s.notes.Transaction(tenantID).DeleteNote(id); err != nil {
+	etag, version, conditional, err := ifMatchETag(r)
+	if err != nil {
+		render.Render(w, r, errInvalidRequest(err))
+		return
+	}
+
+	err = s.notes.Update(tenantID, func(tx note.Transaction) error {
+		if conditional {
+			if err := checkNoteETag(tx, id, etag, version); err != nil {
+				return err
+			}
+		}
+		return tx.DeleteNote(id)
+	})
+	if err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *HTTPServer) handleListTrash(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value("tenantID").(string)
+	notes, err := s.notes.Transaction(tenantID).FindTrashedNotes()
+	if err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+	if err := json.NewEncoder(w).Encode(notes); err != nil {
 		render.Render(w, r, errServerError(err))
 		return
 	}
+}
+
+func (s *HTTPServer) restoreNote(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "noteID"), 10, 64)
+	if err != nil {
+		render.Render(w, r, errInvalidRequest(
+			fmt.Errorf("error parsing noteID: %w", err),
+		))
+		return
+	}
+
+	tenantID := r.Context().Value("tenantID").(string)
+	var n *note.Note
+	err = s.notes.Update(tenantID, func(tx note.Transaction) error {
+		if err := tx.RestoreNote(id); err != nil {
+			return err
+		}
+		n, err = tx.FindNoteByID(id)
+		return err
+	})
+	if err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+	if err := json.NewEncoder(w).Encode(n); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+}
+
+func (s *HTTPServer) purgeNote(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "noteID"), 10, 64)
+	if err != nil {
+		render.Render(w, r, errInvalidRequest(
+			fmt.Errorf("error parsing noteID: %w", err),
+		))
+		return
+	}
+
+	tenantID := r.Context().Value("tenantID").(string)
+	if err := s.notes.Transaction(tenantID).PurgeNote(id); err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (s *HTTPServer) listRevisions(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value("tenantID").(string)
+	noteID := r.Context().Value("note").(*note.Note).ID
+	revisions, err := s.notes.Transaction(tenantID).FindRevisions(noteID)
+	if err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+	if err := json.NewEncoder(w).Encode(revisions); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+}
+
+func (s *HTTPServer) revisionCtx(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rev, err := strconv.ParseUint(chi.URLParam(r, "rev"), 10, 64)
+		if err != nil {
+			render.Render(w, r, errInvalidRequest(
+				fmt.Errorf("error parsing rev: %w", err),
+			))
+			return
+		}
+
+		tenantID := r.Context().Value("tenantID").(string)
+		noteID := r.Context().Value("note").(*note.Note).ID
+		revision, err := s.notes.Transaction(tenantID).FindRevision(noteID, rev)
+		if err != nil {
+			render.Render(w, r, errServerError(
+				fmt.Errorf("error loading revision: %w", err),
+			))
+			return
+		}
+
+		if revision == nil {
+			render.Render(w, r, errNotFound)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "revision", revision)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (s *HTTPServer) getRevision(w http.ResponseWriter, r *http.Request) {
+	revision := r.Context().Value("revision").(*note.Revision)
+	if err := json.NewEncoder(w).Encode(revision); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+}
+
+// diffRevision compares the revision in the URL with the revision given by
+// the "to" query parameter, or with the newest revision if it is omitted.
+func (s *HTTPServer) diffRevision(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value("tenantID").(string)
+	revision := r.Context().Value("revision").(*note.Revision)
+
+	var to uint64
+	if param := r.URL.Query().Get("to"); param != "" {
+		var err error
+		if to, err = strconv.ParseUint(param, 10, 64); err != nil {
+			render.Render(w, r, errInvalidRequest(
+				fmt.Errorf("error parsing to: %w", err),
+			))
+			return
+		}
+	}
+
+	diff, err := s.notes.DiffRevisions(tenantID, revision.NoteID, revision.Rev, to)
+	if err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+	if err := json.NewEncoder(w).Encode(diff); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+}
+
+func (s *HTTPServer) restoreRevision(w http.ResponseWriter, r *http.Request) {
+	tenantID := r.Context().Value("tenantID").(string)
+	revision := r.Context().Value("revision").(*note.Revision)
+	n, err := s.notes.RestoreRevision(tenantID, currentUserID(r), revision.NoteID, revision.Rev)
+	if err != nil {
+		render.Render(w, r, errRepository(err))
+		return
+	}
+	if err := json.NewEncoder(w).Encode(n); err != nil {
+		render.Render(w, r, errServerError(err))
+		return
+	}
+}
+
 func (s *HTTPServer) Serve() error {
 	log.Printf("Server listening on %s", s.config.Addr)
 	return s.ListenAndServe()
@@ -416,3 +1206,76 @@ func errServerError(err error) render.Renderer {
 }
 
 var errNotFound = &ErrResponse{HTTPStatusCode: 404, StatusText: "Resource not found."}
+
+func errPreconditionFailed(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 412,
+		StatusText:     "Precondition failed.",
+		ErrorText:      err.Error(),
+	}
+}
+
+func errConflict(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 409,
+		StatusText:     "Resource already exists.",
+		ErrorText:      err.Error(),
+	}
+}
+
+func errUnauthorized(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 401,
+		StatusText:     "Unauthorized.",
+		ErrorText:      err.Error(),
+	}
+}
+
+func errForbidden(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 403,
+		StatusText:     "Forbidden.",
+		ErrorText:      err.Error(),
+	}
+}
+
+func errStateConflict(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 409,
+		StatusText:     "Conflict with the current state of the resource.",
+		ErrorText:      err.Error(),
+	}
+}
+
+// errRepository maps errors returned by the note repository and search index
+// to a response.
+func errRepository(err error) render.Renderer {
+	if errors.Is(err, note.ErrNotFound) {
+		return errNotFound
+	}
+	if errors.Is(err, note.ErrConflict) {
+		return errPreconditionFailed(err)
+	}
+	if errors.Is(err, note.ErrAlreadyExists) {
+		return errConflict(err)
+	}
+	if errors.Is(err, note.ErrInvalidQuery) || errors.Is(err, note.ErrInvalidUser) ||
+		errors.Is(err, note.ErrInvalidAPIKey) {
+		return errInvalidRequest(err)
+	}
+	if errors.Is(err, note.ErrInvalidCredentials) {
+		return errUnauthorized(err)
+	}
+	if errors.Is(err, note.ErrTenantInactive) {
+		return errForbidden(err)
+	}
+	if errors.Is(err, note.ErrTenantDeleted) || errors.Is(err, note.ErrLastOwner) {
+		return errStateConflict(err)
+	}
+	return errServerError(err)
+}
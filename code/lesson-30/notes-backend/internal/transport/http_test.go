@@ -0,0 +1,223 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"learn-cljs.com/notes/internal/note"
+)
+
+const testAdminToken = "admin token"
+
+func newTestServer(t *testing.T) *HTTPServer {
+	idx := note.NewMemorySearchIndex()
+	repo := note.NewInMemoryRepo(note.RepositoryConfig{}, idx)
+	t.Cleanup(func() { repo.Close() })
+
+	return NewHTTPServer(Config{
+		Context:       context.Background(),
+		NoteService:   note.NewService(repo, idx),
+		SigningSecret: []byte("signing secret"),
+		AdminToken:    []byte(testAdminToken),
+		Auth:          AuthConfig{AccessTokenTTL: time.Hour, RefreshTokenTTL: time.Hour},
+	})
+}
+
+// do serves a request with body encoded as JSON, authorized by token if it is
+// not empty.
+func do(t *testing.T, s *HTTPServer, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	var r io.Reader = http.NoBody
+	if body != nil {
+		bs, err := json.Marshal(body)
+		require.NoError(t, err)
+		r = bytes.NewReader(bs)
+	}
+	req := httptest.NewRequest(method, path, r)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(v), "response: %s", rec.Body)
+}
+
+func assertSuccess(t *testing.T, rec *httptest.ResponseRecorder, msg string) {
+	assert.True(t, rec.Code >= 200 && rec.Code < 300, "%s: got %d %s", msg, rec.Code, rec.Body)
+}
+
+// assertError checks that a request failed with status and an ErrResponse.
+func assertError(t *testing.T, rec *httptest.ResponseRecorder, status int, msg string) {
+	if !assert.Equal(t, status, rec.Code, "%s: %s", msg, rec.Body) {
+		return
+	}
+	var res ErrResponse
+	decode(t, rec, &res)
+	assert.NotEmpty(t, res.StatusText, msg)
+}
+
+// createAccount registers a tenant whose owner has email, and returns the
+// owner's access token.
+func createAccount(t *testing.T, s *HTTPServer, email string) (string, *note.User) {
+	rec := do(t, s, http.MethodPost, "/accounts", "", credentials{Email: email, Password: "password1"})
+	require.Equal(t, http.StatusCreated, rec.Code, "create account: %s", rec.Body)
+	var res sessionResponse
+	decode(t, rec, &res)
+	return res.AccessToken, res.User
+}
+
+// addMember adds a user with role to the tenant of ownerToken, and returns
+// the new user's access token.
+func addMember(t *testing.T, s *HTTPServer, ownerToken, email string, role note.Role) (string, *note.User) {
+	rec := do(t, s, http.MethodPost, "/users", ownerToken, map[string]string{
+		"email": email, "password": "password1", "role": string(role),
+	})
+	require.Equal(t, http.StatusCreated, rec.Code, "add member: %s", rec.Body)
+
+	rec = do(t, s, http.MethodPost, "/login", "", credentials{Email: email, Password: "password1"})
+	require.Equal(t, http.StatusOK, rec.Code, "login: %s", rec.Body)
+	var res sessionResponse
+	decode(t, rec, &res)
+	return res.AccessToken, res.User
+}
+
+func TestTenantCtx(t *testing.T) {
+	s := newTestServer(t)
+	ownerToken, owner := createAccount(t, s, "owner@example.com")
+	viewerToken, viewer := addMember(t, s, ownerToken, "viewer@example.com", note.RoleViewer)
+
+	assertError(t, do(t, s, http.MethodGet, "/notes", "", nil), http.StatusBadRequest, "no token")
+	assertError(t, do(t, s, http.MethodGet, "/notes", "nonsense", nil), http.StatusBadRequest, "malformed token")
+	assertSuccess(t, do(t, s, http.MethodGet, "/notes", ownerToken, nil), "owner")
+	assertSuccess(t, do(t, s, http.MethodGet, "/notes", viewerToken, nil), "viewer")
+
+	tampered := ownerToken[:len(ownerToken)-1] + "0"
+	if strings.HasSuffix(ownerToken, "0") {
+		tampered = ownerToken[:len(ownerToken)-1] + "1"
+	}
+	assertError(t, do(t, s, http.MethodGet, "/notes", tampered, nil), http.StatusUnauthorized, "tampered token")
+
+	expired, err := s.signAccessToken(owner, time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	assertError(t, do(t, s, http.MethodGet, "/notes", expired, nil), http.StatusUnauthorized, "expired token")
+
+	tid, err := hex.DecodeString(owner.TenantID)
+	require.NoError(t, err)
+	tenantToken := s.signTenantID(tid)
+	assertSuccess(t, do(t, s, http.MethodPost, "/users", tenantToken, map[string]string{
+		"email": "editor@example.com", "password": "password1", "role": "editor",
+	}), "tenant token should act as an owner")
+
+	assertSuccess(t, do(t, s, http.MethodDelete, "/users/"+viewer.ID, ownerToken, nil), "remove viewer")
+	assertError(t, do(t, s, http.MethodGet, "/notes", viewerToken, nil), http.StatusUnauthorized, "deleted user")
+
+	path := "/admin/tenants/" + owner.TenantID
+	assertSuccess(t, do(t, s, http.MethodPost, path+"/suspend", testAdminToken, nil), "suspend")
+	assertError(t, do(t, s, http.MethodGet, "/notes", ownerToken, nil), http.StatusForbidden, "suspended tenant")
+	assertError(t, do(t, s, http.MethodGet, "/notes", tenantToken, nil), http.StatusForbidden, "suspended tenant token")
+	assertSuccess(t, do(t, s, http.MethodPost, path+"/reinstate", testAdminToken, nil), "reinstate")
+	assertSuccess(t, do(t, s, http.MethodGet, "/notes", ownerToken, nil), "reinstated tenant")
+}
+
+func TestTokenKindsDoNotMix(t *testing.T) {
+	secret := []byte("signing secret")
+	tid := []byte("8 bytes!")
+	assert.NotEqual(t, tenantMAC(secret, tid), accessMAC(secret, string(tid)),
+		"should not sign access tokens and tenant tokens alike")
+}
+
+func TestCreateNote(t *testing.T) {
+	s := newTestServer(t)
+	token, _ := createAccount(t, s, "owner@example.com")
+	rec := do(t, s, http.MethodPost, "/tags", token, map[string]string{"name": "home"})
+	require.Equal(t, http.StatusOK, rec.Code, "create tag: %s", rec.Body)
+	var tag note.Tag
+	decode(t, rec, &tag)
+
+	rec = do(t, s, http.MethodPost, "/notes", token, map[string]interface{}{
+		"title": "Shopping", "tags": []interface{}{map[string]uint64{"id": tag.ID}},
+	})
+	require.Equal(t, http.StatusOK, rec.Code, "create note: %s", rec.Body)
+	var n note.Note
+	decode(t, rec, &n)
+	assert.Equal(t, []string{"home"}, tagNames(n.Tags))
+
+	assertError(t, do(t, s, http.MethodPost, "/notes", token, map[string]interface{}{
+		"title": "Null tag", "tags": []interface{}{nil},
+	}), http.StatusBadRequest, "null tag")
+	assertError(t, do(t, s, http.MethodPost, "/notes", token, map[string]interface{}{
+		"title": "Missing tag", "tags": []interface{}{map[string]uint64{"id": tag.ID + 100}},
+	}), http.StatusNotFound, "missing tag")
+
+	rec = do(t, s, http.MethodGet, "/notes", token, nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var notes []*note.Note
+	decode(t, rec, &notes)
+	assert.Len(t, notes, 1, "should not keep a note whose tags could not be linked")
+}
+
+func TestNoteETag(t *testing.T) {
+	s := newTestServer(t)
+	token, _ := createAccount(t, s, "owner@example.com")
+	rec := do(t, s, http.MethodPost, "/notes", token, map[string]string{"title": "Shopping"})
+	require.Equal(t, http.StatusOK, rec.Code, "create note: %s", rec.Body)
+	var n note.Note
+	decode(t, rec, &n)
+	rec = do(t, s, http.MethodPost, "/tags", token, map[string]string{"name": "home"})
+	require.Equal(t, http.StatusOK, rec.Code, "create tag: %s", rec.Body)
+	var tag note.Tag
+	decode(t, rec, &tag)
+	notePath := fmt.Sprintf("/notes/%d", n.ID)
+	tagPath := fmt.Sprintf("/tags/%d", tag.ID)
+
+	etag := func() string {
+		rec := do(t, s, http.MethodGet, notePath, token, nil)
+		require.Equal(t, http.StatusOK, rec.Code, "get note: %s", rec.Body)
+		return rec.Header().Get("ETag")
+	}
+	update := func(ifMatch, title string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, notePath, strings.NewReader(fmt.Sprintf(`{"title":%q}`, title)))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("If-Match", ifMatch)
+		rec := httptest.NewRecorder()
+		s.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	untagged := etag()
+	assertSuccess(t, do(t, s, http.MethodPut, notePath+"/tags/"+strconv.FormatUint(tag.ID, 10), token, nil), "tag note")
+	tagged := etag()
+	assert.NotEqual(t, untagged, tagged, "should change the entity tag when a note is tagged")
+	assertSuccess(t, do(t, s, http.MethodPut, tagPath, token, map[string]string{"name": "house"}), "rename tag")
+	renamed := etag()
+	assert.NotEqual(t, tagged, renamed, "should change the entity tag when a note's tag changes")
+
+	assertError(t, update(untagged, "Groceries"), http.StatusPreconditionFailed, "update before tagging")
+	assertError(t, update(`"1"`, "Groceries"), http.StatusBadRequest, "entity tag without tags")
+	rec = update(renamed, "Groceries")
+	require.Equal(t, http.StatusNoContent, rec.Code, "update: %s", rec.Body)
+	assert.Equal(t, etag(), rec.Header().Get("ETag"), "should send the updated entity tag")
+}
+
+func tagNames(tags []*note.Tag) []string {
+	names := make([]string, len(tags))
+	for i, tag := range tags {
+		names[i] = tag.Name
+	}
+	return names
+}
@@ -0,0 +1,46 @@
+package transport
+
+import (
+	"net/http"
+
+	"learn-cljs.com/notes/internal/policy"
+
+	"github.com/go-chi/render"
+)
+
+// currentPrincipal returns who made the request, which tenantCtx adds to the
+// context.
+func currentPrincipal(r *http.Request) *policy.Principal {
+	return r.Context().Value("principal").(*policy.Principal)
+}
+
+// authorize only lets through requests whose principal the policy allows to
+// perform action. It must be used after tenantCtx.
+func (s *HTTPServer) authorize(action policy.Action) func(http.Handler) http.Handler {
+	return s.authorizeByMethod(action, action)
+}
+
+// authorizeByMethod is like authorize, but asks for read to serve GET and
+// HEAD requests and for write to serve any other method.
+func (s *HTTPServer) authorizeByMethod(read, write policy.Action) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			action := write
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				action = read
+			}
+			if err := s.policy().Authorize(currentPrincipal(r), action); err != nil {
+				render.Render(w, r, errForbidden(err))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (s *HTTPServer) policy() policy.Policy {
+	if s.config.Policy == nil {
+		return policy.Default
+	}
+	return s.config.Policy
+}
@@ -0,0 +1,65 @@
+package transport
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"learn-cljs.com/notes/internal/note"
+)
+
+func TestRoles(t *testing.T) {
+	s := newTestServer(t)
+	ownerToken, owner := createAccount(t, s, "owner@example.com")
+	editorToken, _ := addMember(t, s, ownerToken, "editor@example.com", note.RoleEditor)
+	viewerToken, viewer := addMember(t, s, ownerToken, "viewer@example.com", note.RoleViewer)
+
+	rec := do(t, s, http.MethodPost, "/notes", ownerToken, map[string]string{"title": "Shopping"})
+	require.Equal(t, http.StatusOK, rec.Code, "create note: %s", rec.Body)
+	var n note.Note
+	decode(t, rec, &n)
+	rec = do(t, s, http.MethodPost, "/tags", ownerToken, map[string]string{"name": "home"})
+	require.Equal(t, http.StatusOK, rec.Code, "create tag: %s", rec.Body)
+	var tag note.Tag
+	decode(t, rec, &tag)
+	notePath := fmt.Sprintf("/notes/%d", n.ID)
+	tagPath := fmt.Sprintf("/tags/%d", tag.ID)
+
+	assertForbidden := func(rec *httptest.ResponseRecorder, msg string) {
+		assertError(t, rec, http.StatusForbidden, msg)
+	}
+
+	assertSuccess(t, do(t, s, http.MethodGet, notePath, viewerToken, nil), "viewer reads a note")
+	assertSuccess(t, do(t, s, http.MethodGet, "/tags", viewerToken, nil), "viewer reads tags")
+	assertSuccess(t, do(t, s, http.MethodGet, "/users", viewerToken, nil), "viewer reads members")
+	assertForbidden(do(t, s, http.MethodPost, "/notes", viewerToken, map[string]string{"title": "Mine"}), "viewer creates a note")
+	assertForbidden(do(t, s, http.MethodPut, notePath, viewerToken, map[string]string{"title": "Mine"}), "viewer updates a note")
+	assertForbidden(do(t, s, http.MethodDelete, notePath, viewerToken, nil), "viewer deletes a note")
+	assertForbidden(do(t, s, http.MethodPut, tagPath, viewerToken, map[string]string{"name": "mine"}), "viewer updates a tag")
+	assertForbidden(do(t, s, http.MethodDelete, tagPath, viewerToken, nil), "viewer deletes a tag")
+
+	assertSuccess(t, do(t, s, http.MethodPut, notePath, editorToken, map[string]string{"title": "Groceries"}), "editor updates a note")
+	assertSuccess(t, do(t, s, http.MethodPut, tagPath, editorToken, map[string]string{"name": "house"}), "editor updates a tag")
+	assertForbidden(do(t, s, http.MethodPost, "/users", editorToken, map[string]string{
+		"email": "new@example.com", "password": "password1",
+	}), "editor adds a member")
+	assertForbidden(do(t, s, http.MethodPut, "/users/"+viewer.ID, editorToken, map[string]string{"role": "editor"}), "editor changes a role")
+	assertForbidden(do(t, s, http.MethodDelete, "/users/"+viewer.ID, editorToken, nil), "editor removes a member")
+
+	rec = do(t, s, http.MethodPost, "/users", ownerToken, map[string]string{
+		"email": "new@example.com", "password": "password1",
+	})
+	assert.Equal(t, http.StatusCreated, rec.Code, "owner adds a member: %s", rec.Body)
+	var added note.User
+	decode(t, rec, &added)
+	assert.Equal(t, note.RoleViewer, added.Role, "should add viewers by default")
+	assertSuccess(t, do(t, s, http.MethodPut, "/users/"+viewer.ID, ownerToken, map[string]string{"role": "editor"}), "owner changes a role")
+	assertSuccess(t, do(t, s, http.MethodPut, notePath, viewerToken, map[string]string{"title": "Promoted"}), "promoted viewer updates a note")
+	assertError(t, do(t, s, http.MethodPut, "/users/"+owner.ID, ownerToken, map[string]string{"role": "viewer"}),
+		http.StatusConflict, "only owner steps down")
+	assertSuccess(t, do(t, s, http.MethodDelete, tagPath, ownerToken, nil), "owner deletes a tag")
+	assertSuccess(t, do(t, s, http.MethodDelete, notePath, ownerToken, nil), "owner deletes a note")
+}